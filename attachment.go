@@ -0,0 +1,204 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This file implements encrypted attachments.
+//
+// An attachment, e.g., a large media file, is not sent through the Double
+// Ratchet. Instead, it is encrypted under a fresh random key in the chunked
+// stream format and might be uploaded anywhere. A small Attachment pointer,
+// holding the key and a SHA-256 digest of the ciphertext, is sent through the
+// Session. The receiver downloads the ciphertext, verifies, and decrypts it.
+
+package xochimilco
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// attachmentMagic starts each marshalled Attachment.
+const attachmentMagic = "\x00XOA"
+
+// Attachment points to an encrypted attachment.
+//
+// It MUST only be sent through a Session, e.g., by SendAttachment, as it holds
+// the attachment's key.
+type Attachment struct {
+	// Location of the ciphertext, e.g., an URL. It is not used by Xochimilco
+	// and might be left empty.
+	Location string
+
+	// ContentType is the plaintext's MIME type, e.g., "image/png".
+	ContentType string
+
+	// Size is the plaintext's length.
+	Size uint64
+
+	// Key is the random AES-256 key of the attachment's stream.
+	Key []byte
+
+	// Digest is the SHA-256 digest of the ciphertext.
+	Digest []byte
+}
+
+// MarshalBinary encodes an Attachment:
+//
+//	magic "\x00XOA" (4 byte) | key (32 byte) | digest (32 byte) | size (8 byte) |
+//	content type length (2 byte) | content type | location length (2 byte) | location
+//
+// All integers are encoded in network byte order.
+func (att Attachment) MarshalBinary() (data []byte, err error) {
+	if len(att.Key) != streamKeySize {
+		err = fmt.Errorf("attachment key MUST be %d bytes", streamKeySize)
+		return
+	} else if len(att.Digest) != sha256.Size {
+		err = fmt.Errorf("attachment digest MUST be %d bytes", sha256.Size)
+		return
+	} else if len(att.ContentType) > 0xffff || len(att.Location) > 0xffff {
+		err = fmt.Errorf("attachment content type or location exceeds length")
+		return
+	}
+
+	b := new(bytes.Buffer)
+	_, _ = b.WriteString(attachmentMagic)
+	_, _ = b.Write(att.Key)
+	_, _ = b.Write(att.Digest)
+	_ = binary.Write(b, binary.BigEndian, att.Size)
+	_ = binary.Write(b, binary.BigEndian, uint16(len(att.ContentType)))
+	_, _ = b.WriteString(att.ContentType)
+	_ = binary.Write(b, binary.BigEndian, uint16(len(att.Location)))
+	_, _ = b.WriteString(att.Location)
+
+	data = b.Bytes()
+	return
+}
+
+// UnmarshalBinary decodes an Attachment, e.g., a plaintext from Receive. An
+// error is returned for any other data.
+func (att *Attachment) UnmarshalBinary(data []byte) (err error) {
+	const fixedSize = len(attachmentMagic) + streamKeySize + sha256.Size + 8
+
+	if len(data) < fixedSize+2 || !bytes.HasPrefix(data, []byte(attachmentMagic)) {
+		return fmt.Errorf("data is not an attachment")
+	}
+	data = data[len(attachmentMagic):]
+
+	att.Key = make([]byte, streamKeySize)
+	copy(att.Key, data[:streamKeySize])
+	data = data[streamKeySize:]
+
+	att.Digest = make([]byte, sha256.Size)
+	copy(att.Digest, data[:sha256.Size])
+	data = data[sha256.Size:]
+
+	att.Size = binary.BigEndian.Uint64(data[:8])
+	data = data[8:]
+
+	var fields [2]string
+	for i := range fields {
+		if len(data) < 2 {
+			return fmt.Errorf("attachment is truncated")
+		}
+		l := int(binary.BigEndian.Uint16(data[:2]))
+		data = data[2:]
+
+		if len(data) < l {
+			return fmt.Errorf("attachment is truncated")
+		}
+		fields[i] = string(data[:l])
+		data = data[l:]
+	}
+	att.ContentType, att.Location = fields[0], fields[1]
+
+	if len(data) > 0 {
+		return fmt.Errorf("attachment has %d trailing bytes", len(data))
+	}
+	return
+}
+
+// EncryptAttachment encrypts an attachment from src to dst.
+//
+// The returned Attachment holds the fresh key, the ciphertext's digest, and
+// the plaintext's size. Its Location might be set after uploading the
+// ciphertext. Afterwards, it might be sent by SendAttachment.
+func EncryptAttachment(dst io.Writer, src io.Reader, contentType string) (att *Attachment, err error) {
+	key := make([]byte, streamKeySize)
+	if _, err = rand.Read(key); err != nil {
+		return
+	}
+
+	digest := sha256.New()
+	sw, err := newStreamWriter(io.MultiWriter(dst, digest), key)
+	if err != nil {
+		return
+	}
+
+	size, err := io.Copy(sw, src)
+	if err != nil {
+		return
+	}
+	if err = sw.Close(); err != nil {
+		return
+	}
+
+	att = &Attachment{
+		ContentType: contentType,
+		Size:        uint64(size),
+		Key:         key,
+		Digest:      digest.Sum(nil),
+	}
+	return
+}
+
+// DecryptAttachment verifies and decrypts an attachment's ciphertext from src
+// to dst.
+//
+// As the attachment is decrypted while being read, plaintext might be written
+// to dst before an error is detected, e.g., a digest mismatch at the end. In
+// case of an error, all written data MUST be discarded.
+func DecryptAttachment(dst io.Writer, src io.Reader, att *Attachment) (err error) {
+	digest := sha256.New()
+	teeSrc := io.TeeReader(src, digest)
+
+	sr, err := newStreamReader(teeSrc, att.Key)
+	if err != nil {
+		return
+	}
+
+	size, err := io.Copy(dst, sr)
+	if err != nil {
+		return
+	}
+
+	// The ciphertext MUST end with the stream's last chunk.
+	if n, _ := teeSrc.Read(make([]byte, 1)); n > 0 {
+		return fmt.Errorf("attachment has trailing data")
+	}
+
+	if subtle.ConstantTimeCompare(digest.Sum(nil), att.Digest) != 1 {
+		return fmt.Errorf("attachment digest differs")
+	} else if uint64(size) != att.Size {
+		return fmt.Errorf("attachment size differs, %d instead of %d", size, att.Size)
+	}
+
+	return
+}
+
+// SendAttachment sends an Attachment pointer to the other party.
+//
+// This is a shortcut for Send with the marshalled Attachment. The other party
+// might detect it by unmarshalling Receive's plaintext.
+func (sess *Session) SendAttachment(att *Attachment) (dataMsg string, err error) {
+	data, err := att.MarshalBinary()
+	if err != nil {
+		return
+	}
+
+	return sess.Send(data)
+}
@@ -0,0 +1,128 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package xochimilco
+
+import (
+	"bytes"
+	"crypto/rand"
+	"reflect"
+	"testing"
+)
+
+func TestAttachment(t *testing.T) {
+	for _, size := range []int{0, 23, StreamChunkSize, 2*StreamChunkSize + 42} {
+		payload := make([]byte, size)
+		if _, err := rand.Read(payload); err != nil {
+			t.Fatal(err)
+		}
+
+		var ciphertext bytes.Buffer
+		att, err := EncryptAttachment(&ciphertext, bytes.NewReader(payload), "application/octet-stream")
+		if err != nil {
+			t.Fatal(err)
+		} else if att.Size != uint64(size) {
+			t.Fatalf("attachment size differs, %d %d", att.Size, size)
+		}
+		att.Location = "https://example.org/attachments/23"
+
+		alice, bob := testSessionPair(t)
+		testSessionEstablish(t, alice, bob)
+
+		dataMsg, err := alice.SendAttachment(att)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, plaintext, err := bob.Receive(dataMsg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var recvAtt Attachment
+		if err := recvAtt.UnmarshalBinary(plaintext); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(&recvAtt, att) {
+			t.Fatalf("attachments differ, %v %v", recvAtt, att)
+		}
+
+		var recvPayload bytes.Buffer
+		if err := DecryptAttachment(&recvPayload, bytes.NewReader(ciphertext.Bytes()), &recvAtt); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(recvPayload.Bytes(), payload) {
+			t.Fatal("payload differs")
+		}
+	}
+}
+
+func TestAttachmentInvalid(t *testing.T) {
+	payload := bytes.Repeat([]byte{0x42}, StreamChunkSize+5)
+
+	var ciphertextBuff bytes.Buffer
+	att, err := EncryptAttachment(&ciphertextBuff, bytes.NewReader(payload), "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext := ciphertextBuff.Bytes()
+
+	otherKey := *att
+	otherKey.Key = make([]byte, streamKeySize)
+
+	otherDigest := *att
+	otherDigest.Digest = make([]byte, len(att.Digest))
+
+	otherSize := *att
+	otherSize.Size++
+
+	testcases := []struct {
+		name       string
+		ciphertext []byte
+		att        *Attachment
+	}{
+		{"key", ciphertext, &otherKey},
+		{"digest", ciphertext, &otherDigest},
+		{"size", ciphertext, &otherSize},
+		{"truncated", ciphertext[:len(ciphertext)-1], att},
+		{"trailing", append(append([]byte{}, ciphertext...), 0x00), att},
+	}
+
+	for _, testcase := range testcases {
+		if err := DecryptAttachment(new(bytes.Buffer), bytes.NewReader(testcase.ciphertext), testcase.att); err == nil {
+			t.Errorf("%s did not error", testcase.name)
+		}
+	}
+}
+
+func TestAttachmentUnmarshalInvalid(t *testing.T) {
+	att := Attachment{
+		ContentType: "image/png",
+		Location:    "somewhere",
+		Size:        1337,
+		Key:         make([]byte, streamKeySize),
+		Digest:      make([]byte, 32),
+	}
+
+	data, err := att.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inputs := [][]byte{
+		nil,
+		[]byte("hello bob"),
+		data[:len(data)-1],
+		append(append([]byte{}, data...), 0x00),
+		append([]byte{0x23}, data[1:]...),
+	}
+
+	for _, input := range inputs {
+		if err := new(Attachment).UnmarshalBinary(input); err == nil {
+			t.Errorf("%x did not error", input)
+		}
+	}
+
+	if _, err := (Attachment{Key: []byte{1}}).MarshalBinary(); err == nil {
+		t.Error("invalid key did not error")
+	}
+}
@@ -0,0 +1,157 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This file implements closing a Session, including a reason.
+//
+// Within an established Session, a close message is encrypted and authenticated
+// by the Double Ratchet, carrying a reason code and an optional text. Thus, a
+// MITM cannot tear down an established Session. Only before the other party
+// has proven its session key, an unauthenticated close message is accepted to
+// allow rejecting an offer resp. acknowledgement.
+
+package xochimilco
+
+import (
+	"fmt"
+)
+
+// CloseReason describes why a Session was closed.
+type CloseReason byte
+
+const (
+	// CloseUnauthenticated is reported for an unauthenticated close message.
+	// Those are only accepted before the other party has proven its session
+	// key, e.g., if it rejects the offered identity key. Its origin cannot be
+	// verified.
+	CloseUnauthenticated CloseReason = iota
+
+	// CloseUser is a regular close, initiated by the user.
+	CloseUser
+
+	// CloseKeyRejected signals that the other party's identity key was rejected.
+	CloseKeyRejected
+
+	// CloseDesync signals an unrecoverable state, e.g., after too many lost
+	// messages.
+	CloseDesync
+
+	// CloseRekey signals that this Session is closed to establish a new one.
+	CloseRekey
+)
+
+func (reason CloseReason) String() string {
+	switch reason {
+	case CloseUnauthenticated:
+		return "unauthenticated"
+	case CloseUser:
+		return "user closed"
+	case CloseKeyRejected:
+		return "key rejected"
+	case CloseDesync:
+		return "desynchronized"
+	case CloseRekey:
+		return "rekey"
+	default:
+		return fmt.Sprintf("unknown reason %d", byte(reason))
+	}
+}
+
+// reset the internal state. Thus, the same Session might be reused.
+func (sess *Session) reset() {
+	sess.spkPub, sess.spkPriv = nil, nil
+	sess.kemPriv = nil
+	sess.pake = nil
+	sess.noiseHs, sess.noiseFinish = nil, nil
+	sess.earlyData = false
+	sess.offerData = nil
+	sess.confirmMacSend, sess.confirmMacRecv = nil, nil
+	sess.protocol = ProtocolLegacy
+	sess.peerIdKey, sess.peerUnverified = nil, false
+	sess.transcript, sess.sas = nil, nil
+	sess.sasNonce, sess.sasCommit = nil, nil
+	sess.peerConfirmed = false
+	sess.doubleRatchet = nil
+	sess.Reassembler.reset()
+}
+
+// Close this Session and tell the other party to do the same.
+//
+// This is a shortcut for CloseWithReason with CloseUser and no text.
+func (sess *Session) Close() (closeMsg string, err error) {
+	return sess.CloseWithReason(CloseUser, "")
+}
+
+// CloseWithReason closes this Session and tells the other party to do the
+// same, including a reason and an optional text.
+//
+// Within an active Session, the close message is encrypted. Otherwise, e.g.,
+// when rejecting an offer, an unauthenticated close message without a reason
+// is created.
+//
+// This resets the internal state. Thus, the same Session might be reused.
+func (sess *Session) CloseWithReason(reason CloseReason, text string) (closeMsg string, err error) {
+	if reason == CloseUnauthenticated {
+		err = fmt.Errorf("close reason %v cannot be sent", reason)
+		return
+	}
+
+	// An unauthenticated close message is always encoded in the legacy format,
+	// as the other party might not know the negotiated version yet.
+	// The same applies if Alice has not sent her final Noise handshake message.
+	version, payload := ProtocolLegacy, closeMessage{0xff}
+	if sess.doubleRatchet != nil && sess.noiseFinish == nil {
+		var ciphertext []byte
+		ciphertext, err = sess.doubleRatchet.EncryptWithAssociatedData(
+			append([]byte{byte(reason)}, text...), typeAssociatedData(sessClose))
+		if err != nil {
+			return
+		}
+
+		version, payload = sess.protocol, closeMessage(ciphertext)
+	}
+
+	sess.reset()
+
+	closeMsg, err = marshalEncodedMessage(sess.Encoding, version, sessClose, payload)
+	return
+}
+
+// PeerCloseReason returns the reason and text of the last close message
+// received from the other party.
+func (sess *Session) PeerCloseReason() (reason CloseReason, text string) {
+	return sess.peerCloseReason, sess.peerCloseText
+}
+
+// receiveClose deals with incoming sessClose messages.
+func (sess *Session) receiveClose(msg closeMessage) (isClosed bool, err error) {
+	reason, text := CloseUnauthenticated, ""
+
+	switch {
+	case !msg.isAuthenticated() && sess.peerConfirmed:
+		err = fmt.Errorf("received an unauthenticated sessClose within an established session")
+		return
+
+	case msg.isAuthenticated() && sess.doubleRatchet == nil:
+		err = fmt.Errorf("received an authenticated sessClose without an active session")
+		return
+
+	case msg.isAuthenticated():
+		var plaintext []byte
+		plaintext, err = sess.doubleRatchet.DecryptWithAssociatedData(msg, typeAssociatedData(sessClose))
+		if err != nil {
+			return
+		} else if len(plaintext) == 0 {
+			err = fmt.Errorf("sessClose misses its reason")
+			return
+		}
+
+		reason, text = CloseReason(plaintext[0]), string(plaintext[1:])
+	}
+
+	sess.reset()
+	sess.peerCloseReason, sess.peerCloseText = reason, text
+
+	isClosed = true
+	return
+}
@@ -0,0 +1,215 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package xochimilco
+
+import (
+	"crypto/ed25519"
+	"testing"
+)
+
+func TestSessionCloseReason(t *testing.T) {
+	testcases := []struct {
+		reason CloseReason
+		text   string
+	}{
+		{CloseUser, ""},
+		{CloseUser, "bye"},
+		{CloseKeyRejected, "your key changed"},
+		{CloseDesync, ""},
+		{CloseRekey, "see you in a new session"},
+	}
+
+	for _, testcase := range testcases {
+		alice, bob := testSessionPair(t)
+		testSessionEstablish(t, alice, bob)
+		testSessionExchange(t, alice, bob, "hello bob")
+
+		closeMsg, err := bob.CloseWithReason(testcase.reason, testcase.text)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		isEstablished, isClosed, plaintext, err := alice.Receive(closeMsg)
+		if err != nil {
+			t.Fatal(err)
+		} else if isEstablished || !isClosed || len(plaintext) > 0 {
+			t.Fatal("invalid message")
+		}
+
+		if reason, text := alice.PeerCloseReason(); reason != testcase.reason || text != testcase.text {
+			t.Fatalf("close reason differs, %v %q", reason, text)
+		}
+
+		// Alice's Session was reset.
+		if _, err := alice.Send([]byte("hello?")); err == nil {
+			t.Fatal("Send after close did not error")
+		}
+	}
+}
+
+func TestSessionCloseForged(t *testing.T) {
+	alice, bob := testSessionPair(t)
+	testSessionEstablish(t, alice, bob)
+	testSessionExchange(t, alice, bob, "hello bob")
+
+	// A MITM tries to tear down this established Session.
+	forgedMsg, err := marshalMessage(sessClose, closeMessage{0xff})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, receiver := range []*Session{alice, bob} {
+		if _, isClosed, _, err := receiver.Receive(forgedMsg); err == nil || isClosed {
+			t.Fatal("forged close was accepted")
+		}
+	}
+
+	testSessionExchange(t, alice, bob, "still there?")
+	testSessionExchange(t, bob, alice, "yes")
+
+	// Also an altered ciphertext MUST be rejected.
+	closeMsg, err := alice.CloseWithReason(CloseUser, "bye")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, closeIf, err := unmarshalMessage(closeMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closePayload := *closeIf.(*closeMessage)
+	closePayload[len(closePayload)-1] ^= 0xff
+
+	forgedMsg, err = marshalMessage(sessClose, closePayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, isClosed, _, err := bob.Receive(forgedMsg); err == nil || isClosed {
+		t.Fatal("altered close was accepted")
+	}
+}
+
+func TestSessionCloseRelabelled(t *testing.T) {
+	alice, bob := testSessionPair(t)
+	testSessionEstablish(t, alice, bob)
+	testSessionExchange(t, alice, bob, "hello bob")
+
+	// A MITM relabels a data message as a close message.
+	dataMsg, err := alice.Send([]byte("x definitely not a close"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, dataIf, err := unmarshalMessage(dataMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forgedMsg, err := marshalMessage(sessClose, closeMessage(*dataIf.(*dataMessage)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, isClosed, _, err := bob.Receive(forgedMsg); err == nil || isClosed {
+		t.Fatal("relabelled data message was accepted as a close")
+	}
+
+	// The other way round, a close message cannot be relabelled as data.
+	closeMsg, err := bob.CloseWithReason(CloseUser, "bye")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, closeIf, err := unmarshalMessage(closeMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forgedMsg, err = marshalMessage(sessData, dataMessage(*closeIf.(*closeMessage)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, plaintext, err := alice.Receive(forgedMsg); err == nil {
+		t.Fatalf("relabelled close message was accepted as data, %q", plaintext)
+	}
+}
+
+func TestSessionCloseRejectOffer(t *testing.T) {
+	alice, bob := testSessionPair(t)
+	bob.VerifyPeer = func(_ ed25519.PublicKey) bool { return false }
+
+	offerMsg, err := alice.Offer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := bob.Acknowledge(offerMsg); err == nil {
+		t.Fatal("should fail")
+	}
+
+	// Bob tells Alice that he rejects her offer.
+	closeMsg, err := bob.CloseWithReason(CloseKeyRejected, "who are you?")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, isClosed, _, err := alice.Receive(closeMsg)
+	if err != nil {
+		t.Fatal(err)
+	} else if !isClosed {
+		t.Fatal("invalid message")
+	}
+
+	// Without an established Session, the reason cannot be transmitted.
+	if reason, text := alice.PeerCloseReason(); reason != CloseUnauthenticated || text != "" {
+		t.Fatalf("close reason differs, %v %q", reason, text)
+	}
+}
+
+func TestSessionCloseRejectAck(t *testing.T) {
+	alice, bob := testSessionPair(t)
+	alice.VerifyPeer = func(_ ed25519.PublicKey) bool { return false }
+
+	offerMsg, err := alice.Offer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ackMsg, err := bob.Acknowledge(offerMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, err := alice.Receive(ackMsg); err == nil {
+		t.Fatal("should fail")
+	}
+
+	// Alice rejects Bob, who has not yet received anything from Alice. Thus,
+	// he accepts the unauthenticated close.
+	closeMsg, err := alice.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, isClosed, _, err := bob.Receive(closeMsg); err != nil {
+		t.Fatal(err)
+	} else if !isClosed {
+		t.Fatal("invalid message")
+	}
+}
+
+func TestSessionCloseInvalidReason(t *testing.T) {
+	alice, bob := testSessionPair(t)
+	testSessionEstablish(t, alice, bob)
+
+	if _, err := alice.CloseWithReason(CloseUnauthenticated, ""); err == nil {
+		t.Fatal("should fail")
+	}
+
+	// The Session is still usable.
+	testSessionExchange(t, alice, bob, "hello bob")
+}
@@ -0,0 +1,125 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This file implements the optional key confirmation within the handshake.
+//
+// After acknowledging, Bob has no proof that Alice derived the same session key
+// until her first message arrives. With key confirmation, Alice's first message
+// contains an HMAC over the handshake's transcript, keyed by a key derived from
+// the session key. Thus, Bob can verify that Alice took part in this very
+// handshake. In the other direction, Bob's acknowledgement already contains a
+// ciphertext, proving his knowledge of the session key.
+//
+// Furthermore, the key confirmation reveals Alice's committed nonce for the
+// ShortAuthString.
+
+package xochimilco
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// confirmInfo is the HKDF info to derive the key confirmation key.
+const confirmInfo = "Xochimilco key confirmation"
+
+// confirmMac calculates the key confirmation HMAC over the handshake.
+//
+// The transcript consists of the offer's and the acknowledgement's payload,
+// each prefixed by its message type and length. The HMAC-SHA-256 is keyed by a
+// key derived from the session key by a SHA-256 HKDF.
+func confirmMac(sessKey, offerData []byte, ackType messageType, ackData []byte) (mac []byte, err error) {
+	confirmKey := make([]byte, 32)
+	kdf := hkdf.New(sha256.New, sessKey, bytes.Repeat([]byte{0x00}, sha256.Size), []byte(confirmInfo))
+	if _, err = io.ReadFull(kdf, confirmKey); err != nil {
+		return
+	}
+
+	h := hmac.New(sha256.New, confirmKey)
+	for _, part := range []struct {
+		t    messageType
+		data []byte
+	}{{sessOffer, offerData}, {ackType, ackData}} {
+		var prefix [5]byte
+		prefix[0] = byte(part.t)
+		binary.BigEndian.PutUint32(prefix[1:], uint32(len(part.data)))
+
+		_, _ = h.Write(prefix[:])
+		_, _ = h.Write(part.data)
+	}
+
+	mac = h.Sum(nil)
+	return
+}
+
+// Confirm the session key to the passive party (Bob).
+//
+// If Alice has requested key confirmation by KeyConfirmation, she MUST send a
+// confirmation after receiving the acknowledgement. This method creates such a
+// dedicated message. Alternatively, her next Send call includes it.
+//
+// The same applies to the final message of a Noise HandshakeNoiseXX, which
+// Bob requires to establish his Session.
+func (sess *Session) Confirm() (confirmMsg string, err error) {
+	if sess.noiseFinish != nil {
+		return sess.finishNoise(nil)
+	} else if sess.confirmMacSend == nil {
+		err = fmt.Errorf("no pending key confirmation")
+		return
+	}
+
+	confirm := confirmMessage{mac: sess.confirmMacSend, nonce: sess.sasNonce}
+	confirmMsg, err = marshalEncodedMessage(sess.Encoding, sess.protocol, sessConfirm, confirm)
+	if err != nil {
+		return
+	}
+
+	sess.confirmMacSend, sess.sasNonce = nil, nil
+	return
+}
+
+// PeerConfirmed reports whether the other party has proven to know the same
+// session key.
+//
+// For the active party (Alice), this is the case after the acknowledgement was
+// received. The passive party (Bob) needs either Alice's key confirmation or
+// her first successfully decrypted message.
+func (sess *Session) PeerConfirmed() bool {
+	return sess.peerConfirmed
+}
+
+// receiveConfirm deals with incoming sessConfirm messages.
+func (sess *Session) receiveConfirm(confirm *confirmMessage) (plaintext []byte, err error) {
+	if sess.confirmMacRecv == nil {
+		err = fmt.Errorf("received an unexpected sessConfirm")
+		return
+	}
+
+	if !hmac.Equal(confirm.mac, sess.confirmMacRecv) {
+		err = fmt.Errorf("key confirmation differs")
+		return
+	}
+
+	if sess.sasCommit != nil {
+		if err = confirm.splitNonce(); err != nil {
+			return
+		} else if err = sess.revealSasNonce(confirm.nonce); err != nil {
+			return
+		}
+	}
+
+	sess.confirmMacRecv = nil
+	sess.peerConfirmed = true
+
+	if len(confirm.cipher) > 0 {
+		plaintext, err = sess.doubleRatchet.Decrypt(confirm.cipher)
+	}
+	return
+}
@@ -0,0 +1,153 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package xochimilco
+
+import (
+	"testing"
+
+	"github.com/oxzi/xochimilco/x3dh"
+)
+
+func TestSessionKeyConfirmation(t *testing.T) {
+	for _, isPq := range []bool{false, true} {
+		alice, bob := testSessionPair(t)
+		alice.KeyConfirmation = true
+		if isPq {
+			alice.X3dhConfig = x3dh.Config{Version: x3dh.Version1}
+			bob.X3dhConfig = x3dh.Config{Version: x3dh.Version1}
+			alice.PostQuantum = true
+		}
+
+		testSessionEstablish(t, alice, bob)
+
+		if !alice.PeerConfirmed() {
+			t.Fatal("Alice has no confirmation after the acknowledgement")
+		} else if bob.PeerConfirmed() {
+			t.Fatal("Bob has a confirmation before Alice's message")
+		}
+
+		confirmMsg, err := alice.Confirm()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		isEstablished, isClosed, plaintext, err := bob.Receive(confirmMsg)
+		if err != nil {
+			t.Fatal(err)
+		} else if isEstablished || isClosed || len(plaintext) > 0 {
+			t.Fatal("invalid message")
+		} else if !bob.PeerConfirmed() {
+			t.Fatal("Bob has no confirmation")
+		}
+
+		// A second confirmation is neither available nor accepted.
+		if _, err := alice.Confirm(); err == nil {
+			t.Fatal("second confirmation did not error")
+		}
+		if _, _, _, err := bob.Receive(confirmMsg); err == nil {
+			t.Fatal("replayed confirmation did not error")
+		}
+
+		testSessionExchange(t, alice, bob, "hello bob")
+		testSessionExchange(t, bob, alice, "hej alice")
+	}
+}
+
+func TestSessionKeyConfirmationSend(t *testing.T) {
+	alice, bob := testSessionPair(t)
+	alice.KeyConfirmation = true
+	bob.KeyConfirmation = true
+
+	testSessionEstablish(t, alice, bob)
+
+	// Bob is allowed to send messages before Alice's confirmation.
+	testSessionExchange(t, bob, alice, "hej alice")
+
+	// Alice's first message includes her confirmation.
+	testSessionExchange(t, alice, bob, "hello bob")
+	if !bob.PeerConfirmed() {
+		t.Fatal("Bob has no confirmation")
+	}
+
+	testSessionExchange(t, alice, bob, "how are you?")
+	testSessionExchange(t, bob, alice, "fine")
+}
+
+func TestSessionKeyConfirmationMissing(t *testing.T) {
+	alice, bob := testSessionPair(t)
+	alice.KeyConfirmation = true
+
+	testSessionEstablish(t, alice, bob)
+
+	// Alice's confirmation gets lost.
+	if _, err := alice.Confirm(); err != nil {
+		t.Fatal(err)
+	}
+
+	dataMsg, err := alice.Send([]byte("hello bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, err := bob.Receive(dataMsg); err == nil {
+		t.Fatal("should fail")
+	} else if bob.PeerConfirmed() {
+		t.Fatal("Bob has a confirmation")
+	}
+}
+
+func TestSessionKeyConfirmationForged(t *testing.T) {
+	alice, bob := testSessionPair(t)
+	alice.KeyConfirmation = true
+
+	testSessionEstablish(t, alice, bob)
+
+	forgedMsg, err := marshalMessage(sessConfirm, confirmMessage{mac: make([]byte, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, err := bob.Receive(forgedMsg); err == nil {
+		t.Fatal("should fail")
+	} else if bob.PeerConfirmed() {
+		t.Fatal("Bob has a confirmation")
+	}
+}
+
+func TestSessionKeyConfirmationRequired(t *testing.T) {
+	alice, bob := testSessionPair(t)
+	bob.KeyConfirmation = true
+
+	offerMsg, err := alice.Offer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Bob requires a key confirmation, which Alice does not offer.
+	if _, err := bob.Acknowledge(offerMsg); err == nil {
+		t.Fatal("should fail")
+	}
+}
+
+func TestSessionImplicitConfirmation(t *testing.T) {
+	alice, bob := testSessionPair(t)
+
+	testSessionEstablish(t, alice, bob)
+
+	if _, err := alice.Confirm(); err == nil {
+		t.Fatal("unrequested confirmation did not error")
+	}
+
+	if !alice.PeerConfirmed() {
+		t.Fatal("Alice has no confirmation after the acknowledgement")
+	} else if bob.PeerConfirmed() {
+		t.Fatal("Bob has a confirmation before Alice's message")
+	}
+
+	testSessionExchange(t, alice, bob, "hello bob")
+	if !bob.PeerConfirmed() {
+		t.Fatal("Bob has no confirmation after Alice's message")
+	}
+}
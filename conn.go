@@ -0,0 +1,368 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This file implements a net.Conn wrapper, similar to crypto/tls.
+//
+// A Conn performs the Session's handshake over an underlying stream and
+// afterwards exchanges data as encrypted messages. Text messages are separated
+// by newlines, while EncodingBinary frames are self-delimiting.
+
+package xochimilco
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// connMaxWrite is the maximum plaintext length of a single message.
+	connMaxWrite = 64 * 1024
+
+	// connMaxMessage is the maximum length of a received message.
+	connMaxMessage = 256 * 1024
+
+	// connCloseTimeout limits sending the close message within Close.
+	connCloseTimeout = 5 * time.Second
+)
+
+// Conn is an encrypted connection over an underlying net.Conn.
+//
+// It is created by Client or Server for the active resp. passive party. The
+// handshake runs on the first Read or Write call, or explicitly by Handshake.
+type Conn struct {
+	conn     net.Conn
+	sess     *Session
+	isClient bool
+
+	reader *bufio.Reader
+
+	// handshakeMutex guards the handshake's state.
+	handshakeMutex sync.Mutex
+	handshakeDone  bool
+	handshakeErr   error
+
+	// sessMutex guards the Session, used by both Read and Write.
+	sessMutex sync.Mutex
+
+	readMutex sync.Mutex
+	readBuff  []byte
+	readErr   error
+
+	writeMutex sync.Mutex
+}
+
+// Client returns a new Conn for the active party (Alice), using the configured
+// Session. The Session MUST NOT be used otherwise.
+func Client(conn net.Conn, sess *Session) *Conn {
+	return &Conn{
+		conn:     conn,
+		sess:     sess,
+		isClient: true,
+		reader:   bufio.NewReader(conn),
+	}
+}
+
+// Server returns a new Conn for the passive party (Bob), using the configured
+// Session. The Session MUST NOT be used otherwise.
+func Server(conn net.Conn, sess *Session) *Conn {
+	return &Conn{
+		conn:     conn,
+		sess:     sess,
+		isClient: false,
+		reader:   bufio.NewReader(conn),
+	}
+}
+
+// readMessage reads the next message from the underlying connection.
+func (c *Conn) readMessage() (msg string, err error) {
+	first, err := c.reader.Peek(1)
+	if err != nil {
+		return
+	}
+
+	if first[0] == binaryMagic[0] {
+		return ReadBinaryMessage(c.reader, connMaxMessage)
+	}
+
+	var line []byte
+	for {
+		var part []byte
+		part, err = c.reader.ReadSlice('\n')
+		line = append(line, part...)
+
+		if len(line) > connMaxMessage {
+			err = fmt.Errorf("message exceeds the limit of %d bytes", connMaxMessage)
+			return
+		} else if err == bufio.ErrBufferFull {
+			continue
+		} else if err != nil {
+			return
+		}
+		break
+	}
+
+	msg = string(bytes.TrimRight(line, "\r\n"))
+	return
+}
+
+// writeMessage writes a message to the underlying connection.
+func (c *Conn) writeMessage(msg string) (err error) {
+	if !bytes.HasPrefix([]byte(msg), []byte(binaryMagic)) {
+		msg += "\n"
+	}
+
+	_, err = io.WriteString(c.conn, msg)
+	return
+}
+
+// Handshake runs the Session's handshake, if not done yet.
+//
+// The client sends its offer and waits for the acknowledgement. The server
+// waits for the offer and sends its acknowledgement. If key confirmation was
+// requested, it is included in the client's first Write.
+func (c *Conn) Handshake() error {
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+
+	if c.handshakeDone {
+		return c.handshakeErr
+	}
+
+	c.handshakeErr = c.handshake()
+	c.handshakeDone = true
+	return c.handshakeErr
+}
+
+// handshake implements Handshake.
+func (c *Conn) handshake() (err error) {
+	if c.sess.Encoding == EncodingArmor {
+		return fmt.Errorf("armored messages cannot be sent over a Conn")
+	}
+
+	c.sessMutex.Lock()
+	defer c.sessMutex.Unlock()
+
+	if c.isClient {
+		var offerMsg, ackMsg string
+		if offerMsg, err = c.sess.Offer(); err != nil {
+			return
+		}
+		if err = c.writeMessage(offerMsg); err != nil {
+			return
+		}
+
+		if ackMsg, err = c.readMessage(); err != nil {
+			return
+		}
+
+		var isEstablished, isClosed bool
+		if isEstablished, isClosed, _, err = c.sess.Receive(ackMsg); err != nil {
+			return
+		} else if isClosed {
+			return fmt.Errorf("server closed the session, %v", c.sess.peerCloseReason)
+		} else if !isEstablished {
+			return fmt.Errorf("server did not acknowledge the session")
+		}
+		return
+	}
+
+	var offerMsg, ackMsg string
+	if offerMsg, err = c.readMessage(); err != nil {
+		return
+	}
+
+	if ackMsg, err = c.sess.Acknowledge(offerMsg); err != nil {
+		if closeMsg, closeErr := c.sess.CloseWithReason(CloseKeyRejected, ""); closeErr == nil {
+			_ = c.writeMessage(closeMsg)
+		}
+		return
+	}
+
+	err = c.writeMessage(ackMsg)
+	return
+}
+
+// Read decrypted data from the connection. After the other party has closed
+// the Session, io.EOF is returned.
+func (c *Conn) Read(p []byte) (n int, err error) {
+	if err = c.Handshake(); err != nil {
+		return
+	}
+
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+
+	for len(c.readBuff) == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+
+		var msg string
+		if msg, err = c.readMessage(); err != nil {
+			c.readErr = err
+			continue
+		}
+
+		c.sessMutex.Lock()
+		_, isClosed, plaintext, recvErr := c.sess.Receive(msg)
+		c.sessMutex.Unlock()
+
+		switch {
+		case recvErr != nil:
+			c.readErr = recvErr
+		case isClosed:
+			c.readErr = io.EOF
+		default:
+			c.readBuff = plaintext
+		}
+	}
+
+	n = copy(p, c.readBuff)
+	c.readBuff = c.readBuff[n:]
+	return
+}
+
+// Write data encrypted to the connection. Longer data is split into multiple
+// messages.
+func (c *Conn) Write(p []byte) (n int, err error) {
+	if err = c.Handshake(); err != nil {
+		return
+	}
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	for len(p) > 0 {
+		l := len(p)
+		if l > connMaxWrite {
+			l = connMaxWrite
+		}
+
+		c.sessMutex.Lock()
+		dataMsg, sendErr := c.sess.Send(p[:l])
+		c.sessMutex.Unlock()
+		if sendErr != nil {
+			return n, sendErr
+		}
+
+		if err = c.writeMessage(dataMsg); err != nil {
+			return
+		}
+
+		p = p[l:]
+		n += l
+	}
+
+	return
+}
+
+// Close the Session, tell the other party, and close the underlying
+// connection.
+func (c *Conn) Close() error {
+	c.handshakeMutex.Lock()
+	isEstablished := c.handshakeDone && c.handshakeErr == nil
+	c.handshakeMutex.Unlock()
+
+	if isEstablished {
+		c.writeMutex.Lock()
+		c.sessMutex.Lock()
+		// After the other party has closed, our Session was already reset.
+		// Like crypto/tls, the close message must not block forever.
+		if c.sess.doubleRatchet != nil {
+			if closeMsg, err := c.sess.Close(); err == nil {
+				_ = c.conn.SetWriteDeadline(time.Now().Add(connCloseTimeout))
+				_ = c.writeMessage(closeMsg)
+			}
+		}
+		c.sessMutex.Unlock()
+		c.writeMutex.Unlock()
+	}
+
+	return c.conn.Close()
+}
+
+// LocalAddr returns the underlying connection's local address.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the underlying connection's remote address.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetDeadline sets the underlying connection's deadlines.
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the underlying connection's read deadline.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the underlying connection's write deadline.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// Dial connects to an address and runs the handshake as the active party;
+// Client and net.Dial.
+func Dial(network, address string, sess *Session) (conn *Conn, err error) {
+	rawConn, err := net.Dial(network, address)
+	if err != nil {
+		return
+	}
+
+	conn = Client(rawConn, sess)
+	if err = conn.Handshake(); err != nil {
+		_ = rawConn.Close()
+		conn = nil
+	}
+	return
+}
+
+// Listener accepts connections as the passive party; Server.
+type Listener struct {
+	net.Listener
+
+	// NewSession creates a configured Session for each accepted connection.
+	NewSession func() *Session
+}
+
+// NewListener wraps an existing net.Listener.
+func NewListener(inner net.Listener, newSession func() *Session) *Listener {
+	return &Listener{
+		Listener:   inner,
+		NewSession: newSession,
+	}
+}
+
+// Listen announces on an address; net.Listen. Each accepted connection gets
+// its own Session, created by newSession.
+func Listen(network, address string, newSession func() *Session) (l *Listener, err error) {
+	inner, err := net.Listen(network, address)
+	if err != nil {
+		return
+	}
+
+	l = NewListener(inner, newSession)
+	return
+}
+
+// Accept the next connection, returning a *Conn. Its handshake runs on the
+// first Read or Write call, or explicitly by Handshake.
+func (l *Listener) Accept() (net.Conn, error) {
+	rawConn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return Server(rawConn, l.NewSession()), nil
+}
@@ -0,0 +1,168 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package xochimilco
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+)
+
+// testConnPipe creates a Client and a Server over a net.Pipe and runs both
+// handshakes concurrently.
+func testConnPipe(t *testing.T, alice, bob *Session) (client, server *Conn, clientErr, serverErr error) {
+	clientRaw, serverRaw := net.Pipe()
+	client, server = Client(clientRaw, alice), Server(serverRaw, bob)
+
+	serverErrCh := make(chan error)
+	go func() { serverErrCh <- server.Handshake() }()
+
+	clientErr = client.Handshake()
+	if clientErr != nil {
+		_ = clientRaw.Close()
+	}
+	serverErr = <-serverErrCh
+	return
+}
+
+// testConnTransfer writes data to one Conn and reads it from the other.
+func testConnTransfer(t *testing.T, writer, reader *Conn, size int) {
+	payload := make([]byte, size)
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatal(err)
+	}
+
+	errCh := make(chan error)
+	go func() {
+		_, err := writer.Write(payload)
+		errCh <- err
+	}()
+
+	recv := make([]byte, size)
+	if _, err := io.ReadFull(reader, recv); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(recv, payload) {
+		t.Fatal("payload differs")
+	}
+}
+
+func TestConnPipe(t *testing.T) {
+	testcases := []struct {
+		name      string
+		configure func(alice, bob *Session)
+	}{
+		{"default", func(_, _ *Session) {}},
+		{"confirmation", func(alice, bob *Session) {
+			alice.KeyConfirmation, bob.KeyConfirmation = true, true
+		}},
+		{"binary", func(alice, bob *Session) {
+			alice.Encoding, bob.Encoding = EncodingBinary, EncodingBinary
+			alice.Protocol, bob.Protocol = Protocol1, Protocol1
+		}},
+		{"url", func(alice, bob *Session) {
+			alice.Encoding, bob.Encoding = EncodingBase64URL, EncodingBinary
+		}},
+	}
+
+	for _, testcase := range testcases {
+		alice, bob := testSessionPair(t)
+		testcase.configure(alice, bob)
+
+		client, server, clientErr, serverErr := testConnPipe(t, alice, bob)
+		if clientErr != nil || serverErr != nil {
+			t.Fatalf("%s: %v %v", testcase.name, clientErr, serverErr)
+		}
+
+		for _, size := range []int{1, 1337, 3*connMaxWrite + 23} {
+			testConnTransfer(t, client, server, size)
+			testConnTransfer(t, server, client, size)
+		}
+
+		// Closing the client results in an io.EOF for the server.
+		errCh := make(chan error)
+		go func() {
+			_, err := server.Read(make([]byte, 1))
+			errCh <- err
+		}()
+
+		if err := client.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errCh; err != io.EOF {
+			t.Fatalf("%s: server read %v instead of io.EOF", testcase.name, err)
+		}
+
+		if err := server.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConnRejected(t *testing.T) {
+	alice, bob := testSessionPair(t)
+	bob.VerifyPeer = func(_ ed25519.PublicKey) bool { return false }
+
+	_, _, clientErr, serverErr := testConnPipe(t, alice, bob)
+	if clientErr == nil || serverErr == nil {
+		t.Fatalf("rejected handshake did not error, %v %v", clientErr, serverErr)
+	}
+}
+
+func TestConnTCP(t *testing.T) {
+	alice, bob := testSessionPair(t)
+
+	l, err := Listen("tcp", "127.0.0.1:0", func() *Session { return bob })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// The server echoes everything back.
+	serverErrCh := make(chan error)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			serverErrCh <- err
+			return
+		}
+		defer conn.Close()
+
+		_, err = io.Copy(conn, conn)
+		serverErrCh <- err
+	}()
+
+	client, err := Dial("tcp", l.Addr().String(), alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, msg := range []string{"hello bob", "how are you?", "bye"} {
+		if _, err := client.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+
+		recv := make([]byte, len(msg))
+		if _, err := io.ReadFull(client, recv); err != nil {
+			t.Fatal(err)
+		} else if string(recv) != msg {
+			t.Fatalf("echo differs, %q %q", recv, msg)
+		}
+	}
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-serverErrCh; err != nil {
+		t.Fatal(err)
+	}
+}
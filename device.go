@@ -0,0 +1,622 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This file implements multi-device support.
+//
+// A user owns a long time identity key, which signs a DeviceList of the user's
+// devices' identity keys. Each device has its own identity key and establishes
+// a pairwise Session with each other device, i.e., the other users' devices as
+// well as its user's other devices. A DeviceManager keeps those Sessions in
+// sync with the signed DeviceLists and fans out each message.
+//
+// Between two devices, only the one with the bytewise smaller identity key
+// sends the Offer. Thus, both devices might add each other simultaneously
+// without racing offers.
+
+package xochimilco
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// deviceListMagic starts each marshalled DeviceList.
+	deviceListMagic = "\x00XOD"
+
+	// deviceListContext prefixes the signed data of a DeviceList.
+	deviceListContext = "Xochimilco device list"
+
+	// deviceEnvelopeMagic starts each message sent by a DeviceManager.
+	deviceEnvelopeMagic = "\x00XOM"
+
+	// maxDeviceQueue is the maximum amount of messages queued for a device
+	// without an established Session.
+	maxDeviceQueue = 64
+)
+
+// DeviceList is a user's signed list of device identity keys.
+type DeviceList struct {
+	// UserKey is the user's public identity key, signing this list.
+	UserKey ed25519.PublicKey
+
+	// Version of this list. A newer list MUST have a greater version.
+	Version uint64
+
+	// Devices are the devices' public identity keys.
+	Devices []ed25519.PublicKey
+
+	// Signature by the UserKey; NewDeviceList.
+	Signature []byte
+}
+
+// NewDeviceList creates a DeviceList, signed by the user's identity key.
+func NewDeviceList(userKey ed25519.PrivateKey, version uint64, devices []ed25519.PublicKey) (list *DeviceList, err error) {
+	list = &DeviceList{
+		UserKey: userKey.Public().(ed25519.PublicKey),
+		Version: version,
+	}
+	for _, device := range devices {
+		list.Devices = append(list.Devices, append(ed25519.PublicKey{}, device...))
+	}
+
+	signed, err := list.signedData()
+	if err != nil {
+		return
+	}
+
+	list.Signature = ed25519.Sign(userKey, signed)
+	return
+}
+
+// signedData of a DeviceList:
+//
+//	"Xochimilco device list" | user key (32 byte) | version (8 byte) |
+//	device count (2 byte) | { device key (32 byte) }
+func (list *DeviceList) signedData() (data []byte, err error) {
+	if len(list.UserKey) != ed25519.PublicKeySize {
+		err = fmt.Errorf("user key MUST be of %d bytes", ed25519.PublicKeySize)
+		return
+	} else if len(list.Devices) >= 1<<16 {
+		err = fmt.Errorf("device list exceeds maximum device count")
+		return
+	}
+
+	b := new(bytes.Buffer)
+	_, _ = b.WriteString(deviceListContext)
+	_, _ = b.Write(list.UserKey)
+	_ = binary.Write(b, binary.BigEndian, list.Version)
+	_ = binary.Write(b, binary.BigEndian, uint16(len(list.Devices)))
+
+	for i, device := range list.Devices {
+		if len(device) != ed25519.PublicKeySize {
+			err = fmt.Errorf("device key MUST be of %d bytes", ed25519.PublicKeySize)
+			return
+		}
+		for _, other := range list.Devices[:i] {
+			if device.Equal(other) {
+				err = fmt.Errorf("device key is listed twice")
+				return
+			}
+		}
+		_, _ = b.Write(device)
+	}
+
+	data = b.Bytes()
+	return
+}
+
+// Verify the DeviceList's signature by its UserKey.
+//
+// Only the signature is checked. The UserKey itself needs to be verified
+// separately, e.g., by a TrustStore; DeviceManager.VerifyUser.
+func (list *DeviceList) Verify() (err error) {
+	signed, err := list.signedData()
+	if err != nil {
+		return
+	}
+
+	if !ed25519.Verify(list.UserKey, signed, list.Signature) {
+		err = fmt.Errorf("device list signature is invalid")
+	}
+	return
+}
+
+// Contains reports whether a device's identity key is listed.
+func (list *DeviceList) Contains(device ed25519.PublicKey) bool {
+	for _, d := range list.Devices {
+		if d.Equal(device) {
+			return true
+		}
+	}
+	return false
+}
+
+// MarshalBinary encodes a DeviceList:
+//
+//	magic "\x00XOD" (4 byte) | user key (32 byte) | version (8 byte) |
+//	device count (2 byte) | { device key (32 byte) } | signature (64 byte)
+//
+// All integers are encoded in network byte order.
+func (list DeviceList) MarshalBinary() (data []byte, err error) {
+	signed, err := list.signedData()
+	if err != nil {
+		return
+	} else if len(list.Signature) != ed25519.SignatureSize {
+		err = fmt.Errorf("signature MUST be of %d bytes", ed25519.SignatureSize)
+		return
+	}
+
+	data = append([]byte(deviceListMagic), signed[len(deviceListContext):]...)
+	data = append(data, list.Signature...)
+	return
+}
+
+// UnmarshalBinary decodes a DeviceList. Its signature is not verified; Verify.
+func (list *DeviceList) UnmarshalBinary(data []byte) (err error) {
+	const fixedSize = len(deviceListMagic) + ed25519.PublicKeySize + 8 + 2
+
+	if len(data) < fixedSize+ed25519.SignatureSize || !bytes.HasPrefix(data, []byte(deviceListMagic)) {
+		return fmt.Errorf("data is not a device list")
+	}
+	data = data[len(deviceListMagic):]
+
+	userKey := append(ed25519.PublicKey{}, data[:ed25519.PublicKeySize]...)
+	data = data[ed25519.PublicKeySize:]
+
+	version := binary.BigEndian.Uint64(data[:8])
+	count := int(binary.BigEndian.Uint16(data[8:10]))
+	data = data[10:]
+
+	if len(data) != count*ed25519.PublicKeySize+ed25519.SignatureSize {
+		return fmt.Errorf("device list has an invalid length")
+	}
+
+	devices := make([]ed25519.PublicKey, count)
+	for i := range devices {
+		devices[i] = append(ed25519.PublicKey{}, data[:ed25519.PublicKeySize]...)
+		data = data[ed25519.PublicKeySize:]
+	}
+
+	list.UserKey, list.Version, list.Devices = userKey, version, devices
+	list.Signature = append([]byte{}, data...)
+	return
+}
+
+// DeviceMessage is an outgoing message for one device.
+type DeviceMessage struct {
+	// User is the receiving device's user identity key.
+	User ed25519.PublicKey
+
+	// Device is the receiving device's identity key.
+	Device ed25519.PublicKey
+
+	// Msg is the encoded message to be sent to the device.
+	Msg string
+}
+
+// DeviceEnvelope is a received message, sent by another DeviceManager's Send.
+type DeviceEnvelope struct {
+	// Sender is the sending device's user identity key.
+	Sender ed25519.PublicKey
+
+	// Device is the sending device's identity key.
+	Device ed25519.PublicKey
+
+	// Recipient is the user identity key, the message was sent to. It differs
+	// from the own user only for a copy from one of the own other devices.
+	Recipient ed25519.PublicKey
+
+	// Plaintext of the message.
+	Plaintext []byte
+}
+
+// deviceState is a DeviceManager's state of another device.
+type deviceState struct {
+	user   ed25519.PublicKey
+	device ed25519.PublicKey
+
+	// sess is nil while awaiting the other device's offer.
+	sess        *Session
+	established bool
+
+	// pending is the Session of a new offer for an established Session, e.g.,
+	// after the other device's restart. It replaces sess after its first
+	// authenticated message, as a replayed offer must not break sess.
+	pending *Session
+
+	// queue of envelopes, sent once the Session is established.
+	queue [][]byte
+}
+
+// DeviceManager maintains one Session for each other device of the known
+// users, including the own user's other devices.
+//
+// Users are added and updated by their signed DeviceList; UpdateDeviceList.
+// Sessions are created for new devices and closed for removed devices. All
+// messages are passed to Receive. The resulting DeviceMessages, e.g., offers,
+// acknowledgements, or queued data, MUST be sent to their devices.
+//
+// A DeviceManager is not safe for concurrent use.
+type DeviceManager struct {
+	// IdentityKey is this device's private Ed25519 identity key.
+	IdentityKey ed25519.PrivateKey
+
+	// UserKey is the own user's public identity key, signing the own
+	// DeviceList.
+	UserKey ed25519.PublicKey
+
+	// VerifyUser is a callback to verify another user's identity key before
+	// accepting their DeviceList, e.g., TrustStore.VerifyPeer.
+	VerifyUser func(user ed25519.PublicKey) (valid bool)
+
+	// Configure is an optional callback for each new Session, e.g., to set its
+	// X3dhConfig. Afterwards, its IdentityKey and VerifyPeer are overwritten
+	// and its Verifier and PeerEstablished are cleared, as each Session is
+	// pinned to its device's key. KeyConfirmation is always enabled.
+	Configure func(sess *Session)
+
+	lists   map[string]*DeviceList
+	devices map[string]*deviceState
+}
+
+// ownDevice returns this device's public identity key.
+func (dm *DeviceManager) ownDevice() ed25519.PublicKey {
+	return dm.IdentityKey.Public().(ed25519.PublicKey)
+}
+
+// newSession creates a new Session for another device.
+func (dm *DeviceManager) newSession(device ed25519.PublicKey) (sess *Session) {
+	sess = new(Session)
+	if dm.Configure != nil {
+		dm.Configure(sess)
+	}
+
+	// A Verifier would be used instead of VerifyPeer, skipping the pin.
+	sess.IdentityKey = dm.IdentityKey
+	sess.Verifier, sess.PeerEstablished = nil, nil
+	sess.VerifyPeer = func(peer ed25519.PublicKey) bool {
+		return peer.Equal(device)
+	}
+
+	// The confirmation lets the other device replace an established Session.
+	sess.KeyConfirmation = true
+	return
+}
+
+// isOfferer reports whether this device offers the Session to another device.
+func (dm *DeviceManager) isOfferer(device ed25519.PublicKey) bool {
+	return bytes.Compare(dm.ownDevice(), device) < 0
+}
+
+// DeviceList returns the currently known DeviceList of a user.
+func (dm *DeviceManager) DeviceList(user ed25519.PublicKey) *DeviceList {
+	return dm.lists[string(user)]
+}
+
+// UpdateDeviceList adds or updates a user's DeviceList, after verifying its
+// signature and, for other users, VerifyUser. A list MUST NOT be older than
+// the current one and a list of the same version MUST be identical.
+//
+// For each new device, a Session is created. If this device is the offering
+// one, an offer is returned. Sessions of removed devices are closed and their
+// close messages are returned. Passing the current list again recreates
+// Sessions which were closed by the other device.
+func (dm *DeviceManager) UpdateDeviceList(list *DeviceList) (msgs []DeviceMessage, err error) {
+	if err = list.Verify(); err != nil {
+		return
+	}
+
+	isOwnUser := list.UserKey.Equal(dm.UserKey)
+	if !isOwnUser && (dm.VerifyUser == nil || !dm.VerifyUser(list.UserKey)) {
+		err = fmt.Errorf("user key was rejected")
+		return
+	}
+
+	oldList := dm.lists[string(list.UserKey)]
+	if oldList != nil && list.Version < oldList.Version {
+		err = fmt.Errorf("device list version %d is older than %d", list.Version, oldList.Version)
+		return
+	} else if oldList != nil && list.Version == oldList.Version {
+		// Another list with the same version might be a rollback.
+		var data, oldData []byte
+		if data, err = list.MarshalBinary(); err != nil {
+			return
+		} else if oldData, err = oldList.MarshalBinary(); err != nil {
+			return
+		} else if !bytes.Equal(data, oldData) {
+			err = fmt.Errorf("device list version %d differs from the current one", list.Version)
+			return
+		}
+	}
+
+	for _, device := range list.Devices {
+		if st, ok := dm.devices[string(device)]; ok && !st.user.Equal(list.UserKey) {
+			err = fmt.Errorf("device key belongs to another user")
+			return
+		} else if !isOwnUser && device.Equal(dm.ownDevice()) {
+			err = fmt.Errorf("own device key belongs to another user")
+			return
+		}
+	}
+
+	if dm.lists == nil {
+		dm.lists = make(map[string]*DeviceList)
+		dm.devices = make(map[string]*deviceState)
+	}
+	dm.lists[string(list.UserKey)] = list
+
+	// Retire removed devices.
+	if oldList != nil {
+		for _, device := range oldList.Devices {
+			st, ok := dm.devices[string(device)]
+			if !ok || list.Contains(device) {
+				continue
+			}
+			delete(dm.devices, string(device))
+
+			if st.sess == nil {
+				continue
+			}
+
+			var closeMsg string
+			if closeMsg, err = st.sess.Close(); err != nil {
+				return
+			}
+			msgs = append(msgs, DeviceMessage{User: st.user, Device: st.device, Msg: closeMsg})
+		}
+	}
+
+	// Create Sessions for new or closed devices.
+	for _, device := range list.Devices {
+		if device.Equal(dm.ownDevice()) {
+			continue
+		}
+
+		st, ok := dm.devices[string(device)]
+		if !ok {
+			st = &deviceState{
+				user:   list.UserKey,
+				device: append(ed25519.PublicKey{}, device...),
+			}
+			dm.devices[string(device)] = st
+		}
+
+		if st.sess != nil || !dm.isOfferer(device) {
+			continue
+		}
+
+		st.sess = dm.newSession(st.device)
+		var offerMsg string
+		if offerMsg, err = st.sess.Offer(); err != nil {
+			return
+		}
+		msgs = append(msgs, DeviceMessage{User: st.user, Device: st.device, Msg: offerMsg})
+	}
+
+	return
+}
+
+// marshalDeviceEnvelope creates the plaintext of a Session message, carrying
+// the recipient user's identity key next to the plaintext.
+func marshalDeviceEnvelope(recipient ed25519.PublicKey, plaintext []byte) []byte {
+	data := append([]byte(deviceEnvelopeMagic), recipient...)
+	return append(data, plaintext...)
+}
+
+// sendDevice sends an envelope to a device or queues it until its Session is
+// established.
+func (dm *DeviceManager) sendDevice(st *deviceState, envelope []byte) (msgs []DeviceMessage, err error) {
+	if !st.established {
+		if len(st.queue) >= maxDeviceQueue {
+			err = fmt.Errorf("queue of device %x is full", []byte(st.device))
+			return
+		}
+		st.queue = append(st.queue, envelope)
+		return
+	}
+
+	dataMsg, err := st.sess.Send(envelope)
+	if err != nil {
+		return
+	}
+
+	msgs = append(msgs, DeviceMessage{User: st.user, Device: st.device, Msg: dataMsg})
+	return
+}
+
+// Send a message to all devices of a user and to the own other devices.
+//
+// Messages for devices without an established Session are queued and returned
+// by Receive once the Session is established.
+func (dm *DeviceManager) Send(user ed25519.PublicKey, plaintext []byte) (msgs []DeviceMessage, err error) {
+	list := dm.lists[string(user)]
+	if list == nil {
+		err = fmt.Errorf("user's device list is unknown")
+		return
+	}
+
+	lists := []*DeviceList{list}
+	if ownList := dm.lists[string(dm.UserKey)]; ownList != nil && ownList != list {
+		lists = append(lists, ownList)
+	}
+
+	envelope := marshalDeviceEnvelope(user, plaintext)
+	for _, l := range lists {
+		for _, device := range l.Devices {
+			st, ok := dm.devices[string(device)]
+			if !ok {
+				continue
+			}
+
+			var deviceMsgs []DeviceMessage
+			if deviceMsgs, err = dm.sendDevice(st, envelope); err != nil {
+				return
+			}
+			msgs = append(msgs, deviceMsgs...)
+		}
+	}
+
+	return
+}
+
+// establish marks a device's Session as established and sends its queue.
+func (dm *DeviceManager) establish(st *deviceState) (msgs []DeviceMessage, err error) {
+	st.established = true
+
+	if st.sess.confirmMacSend != nil || st.sess.noiseFinish != nil {
+		var confirmMsg string
+		if confirmMsg, err = st.sess.Confirm(); err != nil {
+			return
+		}
+		msgs = append(msgs, DeviceMessage{User: st.user, Device: st.device, Msg: confirmMsg})
+	}
+
+	queue := st.queue
+	st.queue = nil
+	for _, envelope := range queue {
+		var deviceMsgs []DeviceMessage
+		if deviceMsgs, err = dm.sendDevice(st, envelope); err != nil {
+			return
+		}
+		msgs = append(msgs, deviceMsgs...)
+	}
+	return
+}
+
+// receivePending tries to receive an authenticated message on a device's
+// pending Session. On success, the pending Session replaces the established
+// one. Otherwise, the pending Session is dropped, as its state might be
+// altered by the failed attempt, and the message is left to the established
+// Session.
+func (dm *DeviceManager) receivePending(st *deviceState, msgType messageType, msg string) (isPromoted, isEstablished bool, plaintext []byte) {
+	if st.pending == nil {
+		return
+	}
+
+	switch msgType {
+	case sessConfirm, sessNoiseFinish, sessData:
+	default:
+		return
+	}
+
+	sess := st.pending
+	st.pending = nil
+
+	isEstablished, _, plaintext, err := sess.Receive(msg)
+	if err != nil {
+		return
+	}
+
+	st.sess, isPromoted = sess, true
+	return
+}
+
+// Receive a message from another device.
+//
+// The returned DeviceMessages, e.g., an acknowledgement or queued messages,
+// MUST be sent. If the message carried a plaintext, it is returned within a
+// DeviceEnvelope. Messages from devices not listed in a current DeviceList
+// are rejected.
+func (dm *DeviceManager) Receive(device ed25519.PublicKey, msg string) (env *DeviceEnvelope, msgs []DeviceMessage, err error) {
+	st, ok := dm.devices[string(device)]
+	if !ok {
+		err = fmt.Errorf("device is unknown")
+		return
+	}
+
+	_, msgType, _, err := unmarshalVersionedMessage(msg)
+	if err != nil {
+		return
+	}
+
+	var isEstablished, isClosed bool
+	var plaintext []byte
+
+	switch msgType {
+	case sessOffer, sessNoiseOffer:
+		if dm.isOfferer(device) {
+			err = fmt.Errorf("received an offer from a device expecting this device's offer")
+			return
+		}
+
+		sess := dm.newSession(st.device)
+		var ackMsg string
+		if ackMsg, err = sess.AcknowledgeContext(context.Background(), msg, nil); err != nil {
+			return
+		}
+
+		msgs = append(msgs, DeviceMessage{User: st.user, Device: st.device, Msg: ackMsg})
+
+		// A new offer for an established Session might be a replay. Thus, it
+		// stays pending until the other device has proven its Session.
+		if st.established {
+			st.pending = sess
+			return
+		}
+
+		st.sess, st.established, st.pending = sess, false, nil
+		isEstablished = sess.doubleRatchet != nil
+
+	default:
+		if st.sess == nil {
+			err = fmt.Errorf("device has no session")
+			return
+		}
+
+		var isPromoted bool
+		if isPromoted, isEstablished, plaintext = dm.receivePending(st, msgType, msg); isPromoted {
+			break
+		}
+
+		if isEstablished, isClosed, plaintext, err = st.sess.Receive(msg); err != nil {
+			return
+		}
+	}
+
+	if isClosed {
+		st.sess, st.established, st.pending = nil, false, nil
+		return
+	}
+
+	if isEstablished {
+		var queuedMsgs []DeviceMessage
+		if queuedMsgs, err = dm.establish(st); err != nil {
+			return
+		}
+		msgs = append(msgs, queuedMsgs...)
+	}
+
+	if len(plaintext) == 0 {
+		return
+	}
+
+	if !st.sess.PeerIdentityKey().Equal(st.device) {
+		err = fmt.Errorf("session's peer is not the sending device")
+		return
+	}
+
+	const fixedSize = len(deviceEnvelopeMagic) + ed25519.PublicKeySize
+	if len(plaintext) < fixedSize || !bytes.HasPrefix(plaintext, []byte(deviceEnvelopeMagic)) {
+		err = fmt.Errorf("plaintext is not a device envelope")
+		return
+	}
+
+	recipient := ed25519.PublicKey(plaintext[len(deviceEnvelopeMagic):fixedSize])
+	if !st.user.Equal(dm.UserKey) && !recipient.Equal(dm.UserKey) {
+		err = fmt.Errorf("device envelope was sent to another user")
+		return
+	}
+
+	env = &DeviceEnvelope{
+		Sender:    st.user,
+		Device:    st.device,
+		Recipient: append(ed25519.PublicKey{}, recipient...),
+		Plaintext: plaintext[fixedSize:],
+	}
+	return
+}
@@ -0,0 +1,474 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package xochimilco
+
+import (
+	"context"
+	"crypto/ed25519"
+	"reflect"
+	"testing"
+)
+
+// testDeviceNet connects DeviceManagers by their device keys.
+type testDeviceNet struct {
+	managers  map[string]*DeviceManager
+	envelopes map[string][]*DeviceEnvelope
+}
+
+// testDeviceUser creates a user key and n devices for this user.
+func testDeviceUser(t *testing.T, net *testDeviceNet, n int) (userPriv ed25519.PrivateKey, devices []*DeviceManager) {
+	userPub, userPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < n; i++ {
+		devices = append(devices, testDeviceAdd(t, net, userPub))
+	}
+	return
+}
+
+// testDeviceAdd creates a new device for a user.
+func testDeviceAdd(t *testing.T, net *testDeviceNet, userPub ed25519.PublicKey) (dm *DeviceManager) {
+	_, devicePriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dm = &DeviceManager{
+		IdentityKey: devicePriv,
+		UserKey:     userPub,
+		VerifyUser:  func(_ ed25519.PublicKey) bool { return true },
+	}
+	net.managers[string(dm.ownDevice())] = dm
+	return
+}
+
+// testDeviceOutgoing is a message from a DeviceManager.
+type testDeviceOutgoing struct {
+	from *DeviceManager
+	msg  DeviceMessage
+}
+
+// testDeviceList signs a DeviceList for a user's devices.
+func testDeviceList(t *testing.T, userPriv ed25519.PrivateKey, version uint64, devices []*DeviceManager) (list *DeviceList) {
+	var keys []ed25519.PublicKey
+	for _, dm := range devices {
+		keys = append(keys, dm.ownDevice())
+	}
+
+	list, err := NewDeviceList(userPriv, version, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// update passes DeviceLists to all DeviceManagers and returns the resulting
+// messages without delivering them.
+func (net *testDeviceNet) update(t *testing.T, lists ...*DeviceList) (outs []testDeviceOutgoing) {
+	for _, dm := range net.managers {
+		for _, list := range lists {
+			msgs, err := dm.UpdateDeviceList(list)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, msg := range msgs {
+				outs = append(outs, testDeviceOutgoing{dm, msg})
+			}
+		}
+	}
+	return
+}
+
+// send messages from a DeviceManager, resulting in outgoing messages.
+func (net *testDeviceNet) send(from *DeviceManager, msgs []DeviceMessage) (outs []testDeviceOutgoing) {
+	for _, msg := range msgs {
+		outs = append(outs, testDeviceOutgoing{from, msg})
+	}
+	return
+}
+
+// deliver outgoing messages, including all resulting messages.
+func (net *testDeviceNet) deliver(t *testing.T, queue []testDeviceOutgoing) {
+	for len(queue) > 0 {
+		out := queue[0]
+		queue = queue[1:]
+
+		dm, ok := net.managers[string(out.msg.Device)]
+		if !ok {
+			continue
+		}
+
+		env, replies, err := dm.Receive(out.from.ownDevice(), out.msg.Msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env != nil {
+			net.envelopes[string(out.msg.Device)] = append(net.envelopes[string(out.msg.Device)], env)
+		}
+		queue = append(queue, net.send(dm, replies)...)
+	}
+}
+
+// received checks and resets the envelopes received by a device.
+func (net *testDeviceNet) received(t *testing.T, dm *DeviceManager, plaintexts ...string) (envs []*DeviceEnvelope) {
+	envs = net.envelopes[string(dm.ownDevice())]
+	delete(net.envelopes, string(dm.ownDevice()))
+
+	if len(envs) != len(plaintexts) {
+		t.Fatalf("device received %d instead of %d messages", len(envs), len(plaintexts))
+	}
+	for i, env := range envs {
+		if string(env.Plaintext) != plaintexts[i] {
+			t.Fatalf("plaintext differs, %q %q", env.Plaintext, plaintexts[i])
+		}
+	}
+	return
+}
+
+func TestDeviceManager(t *testing.T) {
+	net := &testDeviceNet{
+		managers:  make(map[string]*DeviceManager),
+		envelopes: make(map[string][]*DeviceEnvelope),
+	}
+
+	alicePriv, aliceDevices := testDeviceUser(t, net, 2)
+	bobPriv, bobDevices := testDeviceUser(t, net, 1)
+	alicePub, bobPub := alicePriv.Public().(ed25519.PublicKey), bobPriv.Public().(ed25519.PublicKey)
+	alicePhone, aliceLaptop, bobPhone := aliceDevices[0], aliceDevices[1], bobDevices[0]
+
+	// Messages sent before the Sessions are established are queued.
+	outs := net.update(t, testDeviceList(t, alicePriv, 1, aliceDevices), testDeviceList(t, bobPriv, 1, bobDevices))
+	if msgs, err := alicePhone.Send(bobPub, []byte("hello bob")); err != nil {
+		t.Fatal(err)
+	} else if len(msgs) > 0 {
+		t.Fatalf("Send without Sessions resulted in %d messages", len(msgs))
+	}
+	net.deliver(t, outs)
+
+	envs := net.received(t, bobPhone, "hello bob")
+	if !envs[0].Sender.Equal(alicePub) || !envs[0].Device.Equal(alicePhone.ownDevice()) || !envs[0].Recipient.Equal(bobPub) {
+		t.Fatal("Bob's envelope has unexpected keys")
+	}
+	envs = net.received(t, aliceLaptop, "hello bob")
+	if !envs[0].Sender.Equal(alicePub) || !envs[0].Recipient.Equal(bobPub) {
+		t.Fatal("Alice's laptop's envelope has unexpected keys")
+	}
+	net.received(t, alicePhone)
+
+	msgs, err := bobPhone.Send(alicePub, []byte("hej alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	net.deliver(t, net.send(bobPhone, msgs))
+	net.received(t, alicePhone, "hej alice")
+	net.received(t, aliceLaptop, "hej alice")
+
+	// Bob adds a laptop, which receives all following messages.
+	bobLaptop := testDeviceAdd(t, net, bobPub)
+	bobDevices = append(bobDevices, bobLaptop)
+	net.deliver(t, net.update(t, testDeviceList(t, alicePriv, 1, aliceDevices), testDeviceList(t, bobPriv, 2, bobDevices)))
+
+	msgs, err = aliceLaptop.Send(bobPub, []byte("hello bob's laptop"))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(msgs) != 3 {
+		t.Fatalf("Send resulted in %d instead of 3 messages", len(msgs))
+	}
+	net.deliver(t, net.send(aliceLaptop, msgs))
+	for _, dm := range []*DeviceManager{alicePhone, bobPhone, bobLaptop} {
+		net.received(t, dm, "hello bob's laptop")
+	}
+
+	// Bob removes his phone, whose Sessions are closed.
+	net.deliver(t, net.update(t, testDeviceList(t, bobPriv, 3, bobDevices[1:])))
+
+	msgs, err = alicePhone.Send(bobPub, []byte("bye phone"))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(msgs) != 2 {
+		t.Fatalf("Send resulted in %d instead of 2 messages", len(msgs))
+	}
+	net.deliver(t, net.send(alicePhone, msgs))
+	net.received(t, bobLaptop, "bye phone")
+	net.received(t, aliceLaptop, "bye phone")
+	net.received(t, bobPhone)
+
+	if _, _, err := alicePhone.Receive(bobPhone.ownDevice(), "!XO!3AQID!OX!"); err == nil {
+		t.Fatal("message from a removed device was accepted")
+	}
+
+	// An older device list is rejected.
+	if _, err := alicePhone.UpdateDeviceList(testDeviceList(t, bobPriv, 2, bobDevices)); err == nil {
+		t.Fatal("older device list was accepted")
+	}
+
+	// Another device list of the current version is rejected, while the
+	// current one might be passed again.
+	if _, err := alicePhone.UpdateDeviceList(testDeviceList(t, bobPriv, 3, bobDevices)); err == nil {
+		t.Fatal("another device list of the same version was accepted")
+	} else if _, err := alicePhone.UpdateDeviceList(alicePhone.DeviceList(bobPub)); err != nil {
+		t.Fatal(err)
+	} else if alicePhone.DeviceList(bobPub).Contains(bobPhone.ownDevice()) {
+		t.Fatal("removed device was added again")
+	}
+}
+
+func TestDeviceManagerInvalid(t *testing.T) {
+	net := &testDeviceNet{
+		managers:  make(map[string]*DeviceManager),
+		envelopes: make(map[string][]*DeviceEnvelope),
+	}
+
+	alicePriv, aliceDevices := testDeviceUser(t, net, 1)
+	bobPriv, bobDevices := testDeviceUser(t, net, 1)
+	alicePhone := aliceDevices[0]
+
+	// A rejected user.
+	alicePhone.VerifyUser = func(_ ed25519.PublicKey) bool { return false }
+	list, err := NewDeviceList(bobPriv, 1, []ed25519.PublicKey{bobDevices[0].ownDevice()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alicePhone.UpdateDeviceList(list); err == nil {
+		t.Fatal("rejected user's device list was accepted")
+	}
+	alicePhone.VerifyUser = func(_ ed25519.PublicKey) bool { return true }
+
+	// A forged device list.
+	list.Version++
+	if _, err := alicePhone.UpdateDeviceList(list); err == nil {
+		t.Fatal("forged device list was accepted")
+	}
+
+	// Another user claims Alice's device.
+	list, err = NewDeviceList(bobPriv, 2, []ed25519.PublicKey{alicePhone.ownDevice()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alicePhone.UpdateDeviceList(list); err == nil {
+		t.Fatal("device list claiming the own device was accepted")
+	}
+
+	if _, err := NewDeviceList(alicePriv, 1, []ed25519.PublicKey{alicePhone.ownDevice(), alicePhone.ownDevice()}); err == nil {
+		t.Fatal("device list with a duplicate device was created")
+	}
+
+	if _, err := alicePhone.Send(bobPriv.Public().(ed25519.PublicKey), []byte("hello")); err == nil {
+		t.Fatal("Send to an unknown user did not error")
+	}
+	if _, _, err := alicePhone.Receive(bobDevices[0].ownDevice(), "!XO!3AQID!OX!"); err == nil {
+		t.Fatal("message from an unknown device was accepted")
+	}
+}
+
+func TestDeviceManagerVerifier(t *testing.T) {
+	net := &testDeviceNet{
+		managers:  make(map[string]*DeviceManager),
+		envelopes: make(map[string][]*DeviceEnvelope),
+	}
+
+	alicePriv, aliceDevices := testDeviceUser(t, net, 1)
+	bobPriv, bobDevices := testDeviceUser(t, net, 1)
+
+	// The receiver of the offer accepts each key by its configured Verifier.
+	offerer, receiver := aliceDevices[0], bobDevices[0]
+	if !offerer.isOfferer(receiver.ownDevice()) {
+		offerer, receiver = receiver, offerer
+	}
+	receiver.Configure = func(sess *Session) {
+		sess.Verifier = VerifierFunc(func(_ context.Context, _ PeerInfo) (Decision, error) {
+			return DecisionAccept, nil
+		})
+	}
+
+	for _, list := range []*DeviceList{testDeviceList(t, alicePriv, 1, aliceDevices), testDeviceList(t, bobPriv, 1, bobDevices)} {
+		if _, err := receiver.UpdateDeviceList(list); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Mallory offers a Session in the name of the offering device.
+	_, malloryPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mallory := &Session{
+		IdentityKey:     malloryPriv,
+		VerifyPeer:      func(_ ed25519.PublicKey) bool { return true },
+		KeyConfirmation: true,
+	}
+	offerMsg, err := mallory.Offer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := receiver.Receive(offerer.ownDevice(), offerMsg); err == nil {
+		t.Fatal("offer by another key than the device's one was accepted")
+	}
+}
+
+func TestDeviceManagerReplayedOffer(t *testing.T) {
+	net := &testDeviceNet{
+		managers:  make(map[string]*DeviceManager),
+		envelopes: make(map[string][]*DeviceEnvelope),
+	}
+
+	alicePriv, aliceDevices := testDeviceUser(t, net, 1)
+	bobPriv, bobDevices := testDeviceUser(t, net, 1)
+	alicePub, bobPub := alicePriv.Public().(ed25519.PublicKey), bobPriv.Public().(ed25519.PublicKey)
+	alicePhone, bobPhone := aliceDevices[0], bobDevices[0]
+
+	outs := net.update(t, testDeviceList(t, alicePriv, 1, aliceDevices), testDeviceList(t, bobPriv, 1, bobDevices))
+	if len(outs) != 1 {
+		t.Fatalf("update resulted in %d instead of one offer", len(outs))
+	}
+	offer := outs[0]
+	net.deliver(t, outs)
+
+	msgs, err := alicePhone.Send(bobPub, []byte("hello bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	net.deliver(t, net.send(alicePhone, msgs))
+	net.received(t, bobPhone, "hello bob")
+
+	// The replayed offer is acknowledged, but it cannot be confirmed and does
+	// not replace the established Session.
+	receiver := net.managers[string(offer.msg.Device)]
+	if _, _, err := receiver.Receive(offer.from.ownDevice(), offer.msg.Msg); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs, err = bobPhone.Send(alicePub, []byte("hej alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	net.deliver(t, net.send(bobPhone, msgs))
+	net.received(t, alicePhone, "hej alice")
+
+	msgs, err = alicePhone.Send(bobPub, []byte("still there?"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	net.deliver(t, net.send(alicePhone, msgs))
+	net.received(t, bobPhone, "still there?")
+}
+
+func TestDeviceManagerRestartedOfferer(t *testing.T) {
+	net := &testDeviceNet{
+		managers:  make(map[string]*DeviceManager),
+		envelopes: make(map[string][]*DeviceEnvelope),
+	}
+
+	alicePriv, aliceDevices := testDeviceUser(t, net, 1)
+	bobPriv, bobDevices := testDeviceUser(t, net, 1)
+	lists := []*DeviceList{testDeviceList(t, alicePriv, 1, aliceDevices), testDeviceList(t, bobPriv, 1, bobDevices)}
+
+	offerer, receiver := aliceDevices[0], bobDevices[0]
+	if !offerer.isOfferer(receiver.ownDevice()) {
+		offerer, receiver = receiver, offerer
+	}
+
+	net.deliver(t, net.update(t, lists...))
+
+	msgs, err := offerer.Send(receiver.UserKey, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	net.deliver(t, net.send(offerer, msgs))
+	net.received(t, receiver, "hello")
+
+	// The offering device loses its state and offers a new Session.
+	restarted := &DeviceManager{
+		IdentityKey: offerer.IdentityKey,
+		UserKey:     offerer.UserKey,
+		VerifyUser:  offerer.VerifyUser,
+	}
+	net.managers[string(restarted.ownDevice())] = restarted
+
+	var outs []testDeviceOutgoing
+	for _, list := range lists {
+		msgs, err := restarted.UpdateDeviceList(list)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outs = append(outs, net.send(restarted, msgs)...)
+	}
+	if len(outs) != 1 {
+		t.Fatalf("restart resulted in %d instead of one offer", len(outs))
+	}
+	net.deliver(t, outs)
+
+	msgs, err = receiver.Send(restarted.UserKey, []byte("welcome back"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	net.deliver(t, net.send(receiver, msgs))
+	net.received(t, restarted, "welcome back")
+
+	msgs, err = restarted.Send(receiver.UserKey, []byte("thanks"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	net.deliver(t, net.send(restarted, msgs))
+	net.received(t, receiver, "thanks")
+}
+
+func TestDeviceListMarshal(t *testing.T) {
+	userPub, userPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var devices []ed25519.PublicKey
+	for i := 0; i < 3; i++ {
+		devicePub, _, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		devices = append(devices, devicePub)
+	}
+
+	list, err := NewDeviceList(userPriv, 23, devices)
+	if err != nil {
+		t.Fatal(err)
+	} else if !list.UserKey.Equal(userPub) || !list.Contains(devices[1]) || list.Contains(userPub) {
+		t.Fatal("device list has unexpected keys")
+	}
+
+	data, err := list.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var list2 DeviceList
+	if err := list2.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(list, &list2) {
+		t.Fatalf("device lists differ, %v %v", list, list2)
+	} else if err := list2.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := len(deviceListMagic); i < len(data); i++ {
+		forged := append([]byte{}, data...)
+		forged[i] ^= 0x01
+
+		var list3 DeviceList
+		if err := list3.UnmarshalBinary(forged); err != nil {
+			continue
+		} else if err := list3.Verify(); err == nil {
+			t.Fatalf("device list with a flipped bit at %d was verified", i)
+		}
+	}
+
+	for _, invalid := range [][]byte{nil, data[:len(data)-1], append(append([]byte{}, data...), 0x00)} {
+		if err := list2.UnmarshalBinary(invalid); err == nil {
+			t.Fatalf("invalid device list %x was unmarshalled", invalid)
+		}
+	}
+}
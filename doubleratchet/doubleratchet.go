@@ -74,6 +74,10 @@ type DoubleRatchet struct {
 //
 // The active peer MUST send the first message.
 func CreateActive(sessKey, associatedData, peerDhPub []byte) (dr *DoubleRatchet, err error) {
+	if err = checkPublicKey(peerDhPub); err != nil {
+		return
+	}
+
 	dhr, err := dhRatchetActive(sessKey, peerDhPub)
 	if err != nil {
 		return
@@ -122,6 +126,13 @@ func (dr *DoubleRatchet) dhStep() (err error) {
 //
 // The resulting ciphertext will include the necessary header.
 func (dr *DoubleRatchet) Encrypt(plaintext []byte) (ciphertext []byte, err error) {
+	return dr.EncryptWithAssociatedData(plaintext, nil)
+}
+
+// EncryptWithAssociatedData works like Encrypt, but additionally authenticates
+// associated data next to the Double Ratchet's own, e.g., an application's
+// message type. The same data MUST be passed to DecryptWithAssociatedData.
+func (dr *DoubleRatchet) EncryptWithAssociatedData(plaintext, associatedData []byte) (ciphertext []byte, err error) {
 	if dr.chainKeySend == nil {
 		err = dr.dhStep()
 		if err != nil {
@@ -147,7 +158,7 @@ func (dr *DoubleRatchet) Encrypt(plaintext []byte) (ciphertext []byte, err error
 		return
 	}
 
-	ciphertext, err = encrypt(msgKey, plaintext, dr.associatedData)
+	ciphertext, err = encrypt(msgKey, plaintext, dr.fullAssociatedData(associatedData))
 	if err != nil {
 		return
 	}
@@ -188,6 +199,12 @@ func (dr *DoubleRatchet) skipMsgKeys(until int) (err error) {
 // The encryption is an AEAD encryption. Thus, a changed message should be
 // detected and result in an error.
 func (dr *DoubleRatchet) Decrypt(ciphertext []byte) (plaintext []byte, err error) {
+	return dr.DecryptWithAssociatedData(ciphertext, nil)
+}
+
+// DecryptWithAssociatedData works like Decrypt for a ciphertext created by
+// EncryptWithAssociatedData with the same associated data.
+func (dr *DoubleRatchet) DecryptWithAssociatedData(ciphertext, associatedData []byte) (plaintext []byte, err error) {
 	if len(ciphertext) <= headerLen {
 		return nil, fmt.Errorf("ciphertext is too short")
 	}
@@ -198,6 +215,13 @@ func (dr *DoubleRatchet) Decrypt(ciphertext []byte) (plaintext []byte, err error
 	}
 
 	if subtle.ConstantTimeCompare(h.dhPub, dr.peerDhPub) != 1 {
+		// The announced public key is validated before altering any state.
+		// Otherwise, a forged header might break this Double Ratchet.
+		err = checkPublicKey(h.dhPub)
+		if err != nil {
+			return
+		}
+
 		err = dr.skipMsgKeys(h.prevNo)
 		if err != nil {
 			return
@@ -234,6 +258,15 @@ func (dr *DoubleRatchet) Decrypt(ciphertext []byte) (plaintext []byte, err error
 		dr.recvNo++
 	}
 
-	plaintext, err = decrypt(msgKey, ciphertext[headerLen:], dr.associatedData)
+	plaintext, err = decrypt(msgKey, ciphertext[headerLen:], dr.fullAssociatedData(associatedData))
 	return
 }
+
+// fullAssociatedData appends additional associated data to the Double
+// Ratchet's own associated data.
+func (dr *DoubleRatchet) fullAssociatedData(associatedData []byte) []byte {
+	if len(associatedData) == 0 {
+		return dr.associatedData
+	}
+	return append(append([]byte{}, dr.associatedData...), associatedData...)
+}
@@ -7,6 +7,7 @@ package doubleratchet
 import (
 	"bytes"
 	"crypto/rand"
+	"errors"
 	norand "math/rand"
 	"testing"
 )
@@ -167,3 +168,83 @@ func TestDoubleRatchetOutOfOrder(t *testing.T) {
 		}
 	}
 }
+
+func TestDoubleRatchetLowOrderPeer(t *testing.T) {
+	sessKey := make([]byte, 32)
+	if _, err := rand.Read(sessKey); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, lowOrderPoint := range lowOrderPoints {
+		_, err := CreateActive(sessKey, []byte("AD"), lowOrderPoint)
+		if !errors.Is(err, ErrLowOrderPoint) {
+			t.Errorf("%x resulted in err %v", lowOrderPoint, err)
+		}
+	}
+}
+
+func TestDoubleRatchetLowOrderHeader(t *testing.T) {
+	alice, bob := testDoubleRatchetSetup(t)
+
+	msg, err := alice.Encrypt([]byte("hello bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.Decrypt(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	// A forged message announces a low order point as the next DH public key.
+	for _, lowOrderPoint := range lowOrderPoints {
+		forged, err := header{dhPub: lowOrderPoint}.marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		forged = append(forged, make([]byte, 64)...)
+
+		if _, err := bob.Decrypt(forged); !errors.Is(err, ErrLowOrderPoint) {
+			t.Errorf("%x resulted in err %v", lowOrderPoint, err)
+		}
+	}
+
+	// Bob's state MUST NOT be altered by the forged messages.
+	msg, err = alice.Encrypt([]byte("still there?"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := bob.Decrypt(msg); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(plaintext, []byte("still there?")) {
+		t.Fatalf("plaintext differs, %s", plaintext)
+	}
+}
+
+func TestDoubleRatchetAssociatedData(t *testing.T) {
+	alice, bob := testDoubleRatchetSetup(t)
+
+	ciphertext, err := alice.EncryptWithAssociatedData([]byte("hello"), []byte{0x04})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.Decrypt(ciphertext); err == nil {
+		t.Fatal("ciphertext was decrypted without its associated data")
+	}
+
+	ciphertext, err = alice.Encrypt([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.DecryptWithAssociatedData(ciphertext, []byte{0x04}); err == nil {
+		t.Fatal("ciphertext was decrypted with other associated data")
+	}
+
+	ciphertext, err = alice.EncryptWithAssociatedData([]byte("hello"), []byte{0x04})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := bob.DecryptWithAssociatedData(ciphertext, []byte{0x04}); err != nil {
+		t.Fatal(err)
+	} else if string(plaintext) != "hello" {
+		t.Fatalf("plaintext differs, %q", plaintext)
+	}
+}
@@ -16,6 +16,8 @@ import (
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"io"
 
@@ -37,18 +39,84 @@ func dhKeyPair() (pubKey, privKey []byte, err error) {
 	return
 }
 
+// ErrLowOrderPoint is returned if a peer's X25519 public key is a point of a
+// low order. Such a key would result in an all-zero shared secret without any
+// contribution from our private key.
+var ErrLowOrderPoint = errors.New("X25519 public key is a low order point")
+
+// lowOrderPoints are all X25519 public keys of a low order, including their
+// non-canonical encodings. The most significant bit is ignored by X25519 and
+// must be masked before comparison. This list was taken from libsodium.
+var lowOrderPoints = [][]byte{
+	// 0 (order 4)
+	{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+	// 1 (order 1)
+	{0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+	// 325606250916557431795983626356110631294008115727848805560023387167927233504 (order 8)
+	{0xe0, 0xeb, 0x7a, 0x7c, 0x3b, 0x41, 0xb8, 0xae, 0x16, 0x56, 0xe3, 0xfa, 0xf1, 0x9f, 0xc4, 0x6a, 0xda, 0x09, 0x8d, 0xeb, 0x9c, 0x32, 0xb1, 0xfd, 0x86, 0x62, 0x05, 0x16, 0x5f, 0x49, 0xb8, 0x00},
+	// 39382357235489614581723060781553021112529911719440698176882885853963445705823 (order 8)
+	{0x5f, 0x9c, 0x95, 0xbc, 0xa3, 0x50, 0x8c, 0x24, 0xb1, 0xd0, 0xb1, 0x55, 0x9c, 0x83, 0xef, 0x5b, 0x04, 0x44, 0x5c, 0xc4, 0x58, 0x1c, 0x8e, 0x86, 0xd8, 0x22, 0x4e, 0xdd, 0xd0, 0x9f, 0x11, 0x57},
+	// p - 1 (order 2)
+	{0xec, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f},
+	// p (= 0)
+	{0xed, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f},
+	// p + 1 (= 1)
+	{0xee, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f},
+}
+
+// checkPublicKey validates a peer's X25519 public key.
+//
+// Next to the key's length, it is checked that the key is not a low order
+// point. In the latter case, ErrLowOrderPoint is returned.
+func checkPublicKey(pubKey []byte) error {
+	if len(pubKey) != curve25519.PointSize {
+		return fmt.Errorf("public key MUST be of %d bytes", curve25519.PointSize)
+	}
+
+	masked := make([]byte, curve25519.PointSize)
+	copy(masked, pubKey)
+	masked[curve25519.PointSize-1] &= 0x7f
+
+	isLowOrder := 0
+	for _, lowOrderPoint := range lowOrderPoints {
+		isLowOrder |= subtle.ConstantTimeCompare(masked, lowOrderPoint)
+	}
+	if isLowOrder == 1 {
+		return ErrLowOrderPoint
+	}
+
+	return nil
+}
+
 // dh calculates an Elliptic Curve Diffie-Hellman shared secret between a
 // private key and another peer's public key based on Curve25519, RFC 7748.
 //
+// The peer's public key is validated by checkPublicKey. Furthermore, an
+// all-zero shared secret is rejected as demanded by RFC 7748, section 6.1.
+// Both cases result in an ErrLowOrderPoint.
+//
 // The Double Ratchet Algorithm specification names this function DH.
 func dh(privKey, pubKey []byte) (sharedSec []byte, err error) {
 	if len(privKey) != curve25519.ScalarSize {
 		return nil, fmt.Errorf("private key MUST be of %d bytes", curve25519.ScalarSize)
-	} else if len(pubKey) != curve25519.PointSize {
-		return nil, fmt.Errorf("public key MUST be of %d bytes", curve25519.PointSize)
+	}
+	if err = checkPublicKey(pubKey); err != nil {
+		return
 	}
 
-	return curve25519.X25519(privKey, pubKey)
+	// curve25519.X25519 would also check for an all-zero output, but does not
+	// allow distinguishing this error. Thus, the check is performed here.
+	var dst, scalar, point [32]byte
+	copy(scalar[:], privKey)
+	copy(point[:], pubKey)
+	curve25519.ScalarMult(&dst, &scalar, &point)
+
+	if subtle.ConstantTimeCompare(dst[:], make([]byte, len(dst))) == 1 {
+		return nil, ErrLowOrderPoint
+	}
+
+	sharedSec = dst[:]
+	return
 }
 
 // chainKdf returns a pair (32-byte chain key, 32-byte message key) as the
@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/sha256"
+	"errors"
 	"testing"
 )
 
@@ -37,6 +38,26 @@ func TestDh(t *testing.T) {
 	}
 }
 
+func TestDhLowOrder(t *testing.T) {
+	_, priv, err := dhKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, lowOrderPoint := range lowOrderPoints {
+		// Check both the original point and the one with the ignored most
+		// significant bit set.
+		highBitPoint := append([]byte{}, lowOrderPoint...)
+		highBitPoint[len(highBitPoint)-1] |= 0x80
+
+		for _, pub := range [][]byte{lowOrderPoint, highBitPoint} {
+			if _, err := dh(priv, pub); !errors.Is(err, ErrLowOrderPoint) {
+				t.Errorf("%x resulted in err %v", pub, err)
+			}
+		}
+	}
+}
+
 func TestChainKdfInput(t *testing.T) {
 	testcases := []struct {
 		input   []byte
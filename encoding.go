@@ -0,0 +1,254 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This file implements alternative encodings for messages.
+//
+// Next to the default Base64 text between Prefix and Suffix, messages might be
+// encoded with the URL-safe Base64 alphabet, as raw binary frames, or as an
+// armored multi-line text. The encoding is detected when parsing a message.
+
+package xochimilco
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Encoding of a message's text representation.
+type Encoding byte
+
+const (
+	// EncodingBase64 is the default encoding, being standard Base64 between
+	// Prefix and Suffix.
+	EncodingBase64 Encoding = iota
+
+	// EncodingBase64URL is like EncodingBase64, but uses the URL-safe Base64
+	// alphabet without padding, e.g., for links or QR codes.
+	EncodingBase64URL
+
+	// EncodingBinary is a raw binary frame without the Base64 overhead for
+	// binary transports. It consists of a header and the payload:
+	//
+	//	"\x00XO" | version (1 byte) | type (1 byte) | length (4 byte) | payload
+	//
+	// The length is encoded in network byte order. It allows reading frames
+	// from a stream; ReadBinaryMessage.
+	EncodingBinary
+
+	// EncodingArmor is a multi-line text for, e.g., emails. The Base64 encoded
+	// payload is wrapped into lines and followed by a CRC-24 checksum, similar
+	// to OpenPGP's ASCII Armor:
+	//
+	//	-----BEGIN XOCHIMILCO MESSAGE-----
+	//	Version: 1
+	//	Type: 3
+	//
+	//	AQIDBA...
+	//	=AbCd
+	//	-----END XOCHIMILCO MESSAGE-----
+	EncodingArmor
+)
+
+const (
+	// binaryMagic starts each EncodingBinary frame.
+	binaryMagic = "\x00XO"
+
+	// binaryHeaderSize is the length of an EncodingBinary frame's header.
+	binaryHeaderSize = len(binaryMagic) + 1 + 1 + 4
+
+	// armorBegin and armorEnd enclose an EncodingArmor message.
+	armorBegin = "-----BEGIN XOCHIMILCO MESSAGE-----"
+	armorEnd   = "-----END XOCHIMILCO MESSAGE-----"
+
+	// armorLineLength is the length of an EncodingArmor message's Base64 lines.
+	armorLineLength = 64
+)
+
+// encodeBinary creates an EncodingBinary frame.
+func encodeBinary(v ProtocolVersion, t messageType, data []byte) (out string, err error) {
+	if uint64(len(data)) > 0xffffffff {
+		err = fmt.Errorf("payload exceeds the binary frame's length")
+		return
+	}
+
+	frame := make([]byte, binaryHeaderSize+len(data))
+	copy(frame, binaryMagic)
+	frame[len(binaryMagic)] = byte(v)
+	frame[len(binaryMagic)+1] = byte(t)
+	binary.BigEndian.PutUint32(frame[len(binaryMagic)+2:], uint32(len(data)))
+	copy(frame[binaryHeaderSize:], data)
+
+	out = string(frame)
+	return
+}
+
+// decodeBinary parses an EncodingBinary frame.
+func decodeBinary(in string) (v ProtocolVersion, t messageType, data []byte, err error) {
+	if len(in) < binaryHeaderSize || !strings.HasPrefix(in, binaryMagic) {
+		err = fmt.Errorf("binary frame misses its header")
+		return
+	}
+
+	v = ProtocolVersion(in[len(binaryMagic)])
+	t = messageType(in[len(binaryMagic)+1])
+
+	length := binary.BigEndian.Uint32([]byte(in[len(binaryMagic)+2 : binaryHeaderSize]))
+	if uint64(length) != uint64(len(in)-binaryHeaderSize) {
+		err = fmt.Errorf("binary frame's length differs, %d instead of %d", length, len(in)-binaryHeaderSize)
+		return
+	}
+
+	data = []byte(in[binaryHeaderSize:])
+	return
+}
+
+// ReadBinaryMessage reads the next EncodingBinary frame from a stream.
+//
+// To prevent memory exhaustion, the payload's length is limited by maxSize.
+// The returned message might be passed to, e.g., Receive.
+func ReadBinaryMessage(r io.Reader, maxSize int) (msg string, err error) {
+	header := make([]byte, binaryHeaderSize)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+
+	if string(header[:len(binaryMagic)]) != binaryMagic {
+		err = fmt.Errorf("binary frame misses its magic bytes")
+		return
+	}
+
+	length := binary.BigEndian.Uint32(header[len(binaryMagic)+2:])
+	if uint64(length) > uint64(maxSize) {
+		err = fmt.Errorf("binary frame's length %d exceeds the limit of %d", length, maxSize)
+		return
+	}
+
+	frame := make([]byte, binaryHeaderSize+int(length))
+	copy(frame, header)
+	if _, err = io.ReadFull(r, frame[binaryHeaderSize:]); err != nil {
+		return
+	}
+
+	msg = string(frame)
+	return
+}
+
+// crc24 calculates the CRC-24 checksum as specified in RFC 4880, section 6.1.
+func crc24(data []byte) uint32 {
+	const (
+		crc24Init = 0xb704ce
+		crc24Poly = 0x1864cfb
+	)
+
+	crc := uint32(crc24Init)
+	for _, b := range data {
+		crc ^= uint32(b) << 16
+		for i := 0; i < 8; i++ {
+			crc <<= 1
+			if crc&0x1000000 != 0 {
+				crc ^= crc24Poly
+			}
+		}
+	}
+	return crc & 0xffffff
+}
+
+// armorChecksum creates the Base64 encoded CRC-24 checksum line's value.
+func armorChecksum(data []byte) string {
+	crc := crc24(data)
+	return base64.StdEncoding.EncodeToString([]byte{byte(crc >> 16), byte(crc >> 8), byte(crc)})
+}
+
+// encodeArmor creates an EncodingArmor message.
+func encodeArmor(v ProtocolVersion, t messageType, data []byte) (out string, err error) {
+	b := new(strings.Builder)
+
+	_, _ = fmt.Fprintln(b, armorBegin)
+	_, _ = fmt.Fprintf(b, "Version: %d\n", v)
+	_, _ = fmt.Fprintf(b, "Type: %d\n", t)
+	_, _ = fmt.Fprintln(b)
+
+	payload := base64.StdEncoding.EncodeToString(data)
+	for len(payload) > armorLineLength {
+		_, _ = fmt.Fprintln(b, payload[:armorLineLength])
+		payload = payload[armorLineLength:]
+	}
+	if len(payload) > 0 {
+		_, _ = fmt.Fprintln(b, payload)
+	}
+
+	_, _ = fmt.Fprintf(b, "=%s\n", armorChecksum(data))
+	_, _ = fmt.Fprint(b, armorEnd)
+
+	out = b.String()
+	return
+}
+
+// decodeArmor parses an EncodingArmor message.
+func decodeArmor(in string) (v ProtocolVersion, t messageType, data []byte, err error) {
+	lines := strings.Split(strings.TrimSpace(in), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSpace(lines[i])
+	}
+
+	if len(lines) < 3 || lines[0] != armorBegin || lines[len(lines)-1] != armorEnd {
+		err = fmt.Errorf("armored message misses its begin and/or end line")
+		return
+	}
+	lines = lines[1 : len(lines)-1]
+
+	// Headers until the first empty line; unknown headers are ignored.
+	var hasVersion, hasType bool
+	for len(lines) > 0 && lines[0] != "" {
+		key, value, ok := strings.Cut(lines[0], ": ")
+		if !ok {
+			err = fmt.Errorf("invalid armor header line %q", lines[0])
+			return
+		}
+		lines = lines[1:]
+
+		var num uint64
+		switch key {
+		case "Version":
+			num, err = strconv.ParseUint(value, 10, 8)
+			v, hasVersion = ProtocolVersion(num), true
+		case "Type":
+			num, err = strconv.ParseUint(value, 10, 8)
+			t, hasType = messageType(num), true
+		}
+		if err != nil {
+			err = fmt.Errorf("invalid armor header %s: %v", key, err)
+			return
+		}
+	}
+	if !hasVersion || !hasType {
+		err = fmt.Errorf("armored message misses its Version and/or Type header")
+		return
+	} else if len(lines) < 2 {
+		err = fmt.Errorf("armored message misses its payload")
+		return
+	}
+
+	checksum := lines[len(lines)-1]
+	if !strings.HasPrefix(checksum, "=") {
+		err = fmt.Errorf("armored message misses its checksum")
+		return
+	}
+
+	data, err = base64.StdEncoding.DecodeString(strings.Join(lines[1:len(lines)-1], ""))
+	if err != nil {
+		return
+	}
+
+	if checksum[1:] != armorChecksum(data) {
+		err = fmt.Errorf("armored message's checksum differs")
+		return
+	}
+
+	return
+}
@@ -0,0 +1,216 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package xochimilco
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEncodingRoundtrip(t *testing.T) {
+	payloads := []dataMessage{
+		{},
+		{0xfb, 0xff},
+		dataMessage(bytes.Repeat([]byte{0xfb, 0xef, 0xbe}, 100)),
+	}
+
+	for _, enc := range []Encoding{EncodingBase64, EncodingBase64URL, EncodingBinary, EncodingArmor} {
+		for v := ProtocolLegacy; v <= protocolLatest; v++ {
+			for _, payload := range payloads {
+				out, err := marshalEncodedMessage(enc, v, sessData, payload)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				outEnc, outV, outT, outM, err := unmarshalEncodedMessage(out)
+				if err != nil {
+					t.Fatalf("%d: %v", enc, err)
+				} else if outV != v || outT != sessData {
+					t.Fatalf("%d: framing differs, %d %d", enc, outV, outT)
+				} else if !bytes.Equal(*outM.(*dataMessage), payload) {
+					t.Fatalf("%d: payload differs", enc)
+				}
+
+				// Short URL-safe messages might be indistinguishable.
+				if outEnc != enc && !(enc == EncodingBase64URL && !strings.ContainsAny(out, "-_")) {
+					t.Fatalf("detected encoding %d instead of %d", outEnc, enc)
+				}
+			}
+		}
+	}
+}
+
+func TestEncodingBase64URL(t *testing.T) {
+	out, err := marshalEncodedMessage(EncodingBase64URL, Protocol1, sessData, dataMessage{0xfb, 0xff})
+	if err != nil {
+		t.Fatal(err)
+	} else if out != Prefix+"v1.3.-_8"+Suffix {
+		t.Fatalf("unexpected encoding, %s", out)
+	}
+
+	// Padded URL-safe Base64 is also accepted.
+	if _, _, _, m, err := unmarshalEncodedMessage(Prefix + "v1.3.-_8=" + Suffix); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(m, &dataMessage{0xfb, 0xff}) {
+		t.Fatalf("payload differs, %v", m)
+	}
+}
+
+func TestEncodingArmor(t *testing.T) {
+	out, err := marshalEncodedMessage(EncodingArmor, Protocol1, sessData, dataMessage(bytes.Repeat([]byte{0x42}, 100)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(out, "\n")
+	for _, line := range lines {
+		if len(line) > armorLineLength {
+			t.Fatalf("line exceeds length, %q", line)
+		}
+	}
+
+	// Surrounding whitespace, CRLF line endings, and additional headers are
+	// accepted.
+	modified := "\r\n  " + strings.ReplaceAll(
+		strings.Replace(out, "Type: 3\n", "Type: 3\nComment: hello\n", 1), "\n", "\r\n") + "\r\n"
+	if _, _, _, _, err := unmarshalEncodedMessage(modified); err != nil {
+		t.Fatal(err)
+	}
+
+	invalids := []string{
+		strings.Replace(out, "QkJC", "QkJD", 1),
+		strings.Replace(out, "Version: 1\n", "", 1),
+		strings.Replace(out, "Type: 3\n", "Type: 256\n", 1),
+		strings.Replace(out, "Type: 3\n", "Type 3\n", 1),
+		strings.Replace(out, "\n=", "\n", 1),
+		strings.Replace(out, armorEnd, "", 1),
+		armorBegin + "\n" + armorEnd,
+	}
+	for _, invalid := range invalids {
+		if _, _, _, _, err := unmarshalEncodedMessage(invalid); err == nil {
+			t.Errorf("%q did not error", invalid)
+		}
+	}
+}
+
+func TestCrc24(t *testing.T) {
+	testcases := []struct {
+		in  string
+		crc uint32
+	}{
+		{"", 0xb704ce},
+		{"123456789", 0x21cf02},
+	}
+
+	for _, testcase := range testcases {
+		if crc := crc24([]byte(testcase.in)); crc != testcase.crc {
+			t.Errorf("%q: CRC-24 differs, %06x %06x", testcase.in, crc, testcase.crc)
+		}
+	}
+}
+
+func TestEncodingBinary(t *testing.T) {
+	var stream bytes.Buffer
+	var msgs []string
+	for i := 0; i < 8; i++ {
+		msg, err := marshalEncodedMessage(EncodingBinary, Protocol1, sessData, dataMessage(bytes.Repeat([]byte{byte(i)}, i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msgs = append(msgs, msg)
+		stream.WriteString(msg)
+	}
+
+	for _, msg := range msgs {
+		if read, err := ReadBinaryMessage(&stream, 16); err != nil {
+			t.Fatal(err)
+		} else if read != msg {
+			t.Fatalf("read message differs")
+		}
+	}
+
+	if _, err := ReadBinaryMessage(&stream, 16); err == nil {
+		t.Fatal("reading an empty stream did not error")
+	}
+
+	// Exceeding frames are rejected.
+	msg, err := marshalEncodedMessage(EncodingBinary, Protocol1, sessData, dataMessage(make([]byte, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadBinaryMessage(strings.NewReader(msg), 16); err == nil {
+		t.Fatal("exceeding frame did not error")
+	}
+
+	invalids := []string{
+		binaryMagic,
+		msg[:len(msg)-1],
+		msg + "\x00",
+		binaryMagic + "\x02\x03\x00\x00\x00\x00",
+		binaryMagic + "\x01\xff\x00\x00\x00\x00",
+	}
+	for _, invalid := range invalids {
+		if _, _, _, _, err := unmarshalEncodedMessage(invalid); err == nil {
+			t.Errorf("%q did not error", invalid)
+		}
+	}
+}
+
+func TestSessionEncoding(t *testing.T) {
+	for _, enc := range []Encoding{EncodingBase64URL, EncodingBinary, EncodingArmor} {
+		alice, bob := testSessionPair(t)
+		alice.Encoding = enc
+		alice.Protocol, bob.Protocol = Protocol1, Protocol1
+
+		offerMsg, err := alice.Offer()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if offerEnc, _, _, _, err := unmarshalEncodedMessage(offerMsg); err != nil {
+			t.Fatal(err)
+		} else if offerEnc != enc {
+			t.Fatalf("offer uses encoding %d instead of %d", offerEnc, enc)
+		}
+
+		ackMsg, err := bob.Acknowledge(offerMsg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if isEstablished, _, _, err := alice.Receive(ackMsg); err != nil {
+			t.Fatal(err)
+		} else if !isEstablished {
+			t.Fatal("Session was not established")
+		}
+
+		testSessionExchange(t, alice, bob, "hello bob")
+		testSessionExchange(t, bob, alice, "hej alice")
+
+		// Fragments keep the original message's encoding.
+		alice.MaxFragmentSize = 128
+		fragments, err := alice.SendFragments(bytes.Repeat([]byte("hello bob "), 32))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, frag := range fragments {
+			if len(frag) > alice.MaxFragmentSize {
+				t.Fatalf("fragment exceeds size, %d", len(frag))
+			} else if fragEnc, _, _, _, err := unmarshalEncodedMessage(frag); err != nil {
+				t.Fatal(err)
+			} else if fragEnc != enc && enc != EncodingBase64URL {
+				t.Fatalf("fragment uses encoding %d instead of %d", fragEnc, enc)
+			}
+
+			if _, _, _, err := bob.Receive(frag); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,282 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This file implements the fragmentation of encoded messages.
+//
+// Some transports, e.g., IRC or SMS, limit a message's length. Thus, an encoded
+// message might be split into multiple sessFragment messages, each one being
+// a complete encoded message on its own. The receiver collects those fragments
+// until the original message can be reassembled.
+
+package xochimilco
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+const (
+	// DefaultMaxPending is the default limit of incomplete messages.
+	DefaultMaxPending = 16
+
+	// DefaultMaxSize is the default limit of a reassembled message's length.
+	DefaultMaxSize = 1 << 20
+
+	// DefaultTimeout is the default duration to wait for missing fragments.
+	DefaultTimeout = 5 * time.Minute
+)
+
+// fragment an encoded message into sessFragment messages.
+//
+// Each fragment will be at most size bytes long and is encoded in the same
+// Encoding and version as the original message. A message not exceeding this
+// size is returned unaltered.
+func fragment(msg string, size int) (fragments []string, err error) {
+	if len(msg) <= size {
+		fragments = []string{msg}
+		return
+	}
+
+	enc, version, msgType, _, err := unmarshalEncodedMessage(msg)
+	if err != nil {
+		return
+	} else if msgType == sessFragment {
+		err = fmt.Errorf("cannot fragment another fragment")
+		return
+	}
+
+	// Search the largest data size resulting in fragments within the limit.
+	// As the fragment's header has a fixed length, its values do not matter.
+	var dataSize int
+	for low, high := 1, size; low <= high; {
+		mid := (low + high) / 2
+
+		var fragMsg string
+		fragMsg, err = marshalEncodedMessage(enc, version, sessFragment, fragmentMessage{data: make([]byte, mid)})
+		if err != nil {
+			return
+		}
+
+		if len(fragMsg) <= size {
+			dataSize, low = mid, mid+1
+		} else {
+			high = mid - 1
+		}
+	}
+	if dataSize <= 0 {
+		err = fmt.Errorf("fragment size %d is too small", size)
+		return
+	}
+
+	count := (len(msg) + dataSize - 1) / dataSize
+	if count > 0xffff {
+		err = fmt.Errorf("message requires %d fragments, exceeding the limit", count)
+		return
+	}
+
+	var idBuff [8]byte
+	if _, err = rand.Read(idBuff[:]); err != nil {
+		return
+	}
+	id := binary.BigEndian.Uint64(idBuff[:])
+
+	fragments = make([]string, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * dataSize
+		if end > len(msg) {
+			end = len(msg)
+		}
+
+		fragments[i], err = marshalEncodedMessage(enc, version, sessFragment, fragmentMessage{
+			id:    id,
+			index: uint16(i),
+			count: uint16(count),
+			data:  []byte(msg[i*dataSize : end]),
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Reassembler collects fragments until their original message is complete.
+//
+// Each Session has its own Reassembler for all messages passed to Receive. A
+// fragmented offer needs to be reassembled by another Reassembler before being
+// passed to Acknowledge.
+//
+// To prevent memory exhaustion, both the amount and the length of incomplete
+// messages are limited. Incomplete messages are discarded after a timeout. The
+// zero value uses the default limits.
+type Reassembler struct {
+	// MaxPending limits the amount of incomplete messages. If exceeded, the
+	// oldest incomplete message is discarded. Defaults to DefaultMaxPending.
+	MaxPending int
+
+	// MaxSize limits a reassembled message's length. Defaults to
+	// DefaultMaxSize.
+	MaxSize int
+
+	// Timeout after which an incomplete message is discarded. Defaults to
+	// DefaultTimeout.
+	Timeout time.Duration
+
+	// now returns the current time. Defaults to time.Now.
+	now func() time.Time
+
+	// pending holds all incomplete messages by their identifier.
+	pending map[uint64]*pendingMessage
+}
+
+// pendingMessage is an incomplete message within the Reassembler.
+type pendingMessage struct {
+	created   time.Time
+	fragments [][]byte
+	received  int
+	size      int
+}
+
+// Add an encoded message to this Reassembler.
+//
+// If the message is not a fragment, it is returned unaltered. Otherwise, msg
+// holds the original message once the last fragment was added; complete. Until
+// then, msg is empty.
+func (r *Reassembler) Add(fragment string) (msg string, complete bool, err error) {
+	_, msgType, msgIf, err := unmarshalVersionedMessage(fragment)
+	if err != nil {
+		return
+	} else if msgType != sessFragment {
+		msg, complete = fragment, true
+		return
+	}
+
+	return r.add(msgIf.(*fragmentMessage))
+}
+
+// add a parsed fragment to this Reassembler; Add.
+func (r *Reassembler) add(frag *fragmentMessage) (msg string, complete bool, err error) {
+	maxPending, maxSize, timeout := r.MaxPending, r.MaxSize, r.Timeout
+	if maxPending <= 0 {
+		maxPending = DefaultMaxPending
+	}
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	now := time.Now()
+	if r.now != nil {
+		now = r.now()
+	}
+
+	if r.pending == nil {
+		r.pending = make(map[uint64]*pendingMessage)
+	}
+
+	var oldestId uint64
+	var oldest *pendingMessage
+	for id, p := range r.pending {
+		if now.Sub(p.created) > timeout {
+			delete(r.pending, id)
+		} else if oldest == nil || p.created.Before(oldest.created) {
+			oldestId, oldest = id, p
+		}
+	}
+
+	p, ok := r.pending[frag.id]
+	if !ok {
+		if int(frag.count) > maxSize {
+			err = fmt.Errorf("fragment count %d exceeds the size limit", frag.count)
+			return
+		}
+
+		if len(r.pending) >= maxPending && oldest != nil {
+			delete(r.pending, oldestId)
+		}
+
+		p = &pendingMessage{
+			created:   now,
+			fragments: make([][]byte, frag.count),
+		}
+		r.pending[frag.id] = p
+	}
+
+	if int(frag.count) != len(p.fragments) {
+		delete(r.pending, frag.id)
+		err = fmt.Errorf("fragment count differs, %d instead of %d", frag.count, len(p.fragments))
+		return
+	} else if p.fragments[frag.index] != nil {
+		err = fmt.Errorf("received fragment %d twice", frag.index)
+		return
+	}
+
+	p.size += len(frag.data)
+	if p.size > maxSize {
+		delete(r.pending, frag.id)
+		err = fmt.Errorf("fragmented message exceeds the size limit of %d", maxSize)
+		return
+	}
+
+	p.fragments[frag.index] = frag.data
+	p.received++
+	if p.received < len(p.fragments) {
+		return
+	}
+
+	delete(r.pending, frag.id)
+
+	data := make([]byte, 0, p.size)
+	for _, fragData := range p.fragments {
+		data = append(data, fragData...)
+	}
+	msg = string(data)
+
+	if _, msgType, _, parseErr := unmarshalVersionedMessage(msg); parseErr != nil {
+		msg, err = "", fmt.Errorf("reassembled message is invalid: %v", parseErr)
+		return
+	} else if msgType == sessFragment {
+		msg, err = "", fmt.Errorf("reassembled message is another fragment")
+		return
+	}
+
+	complete = true
+	return
+}
+
+// reset discards all incomplete messages.
+func (r *Reassembler) reset() {
+	r.pending = nil
+}
+
+// Fragment an encoded message, e.g., from Offer, Acknowledge, or Send, for a
+// size-limited transport.
+//
+// Each fragment will be at most MaxFragmentSize bytes long. A message not
+// exceeding this limit or any message if MaxFragmentSize is not set is returned
+// as the only element.
+func (sess *Session) Fragment(msg string) (fragments []string, err error) {
+	if sess.MaxFragmentSize <= 0 {
+		fragments = []string{msg}
+		return
+	}
+
+	return fragment(msg, sess.MaxFragmentSize)
+}
+
+// SendFragments works like Send, but splits the message into fragments; see
+// Fragment.
+func (sess *Session) SendFragments(plaintext []byte) (fragments []string, err error) {
+	dataMsg, err := sess.Send(plaintext)
+	if err != nil {
+		return
+	}
+
+	return sess.Fragment(dataMsg)
+}
@@ -0,0 +1,307 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package xochimilco
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oxzi/xochimilco/x3dh"
+)
+
+func TestFragment(t *testing.T) {
+	for _, v := range []ProtocolVersion{ProtocolLegacy, Protocol1} {
+		for _, size := range []int{48, 64, 100, 512} {
+			msg, err := marshalVersionedMessage(v, sessData, dataMessage(bytes.Repeat([]byte{0x23}, 1000)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fragments, err := fragment(msg, size)
+			if err != nil {
+				t.Fatal(err)
+			} else if len(fragments) < 2 {
+				t.Fatalf("message was not fragmented, %d", len(fragments))
+			}
+
+			var r Reassembler
+			for i, frag := range fragments {
+				if len(frag) > size {
+					t.Fatalf("fragment exceeds size, %d > %d", len(frag), size)
+				} else if !strings.HasPrefix(frag, Prefix) || !strings.HasSuffix(frag, Suffix) {
+					t.Fatalf("fragment misses framing, %s", frag)
+				}
+
+				fragVersion, _, _, err := unmarshalVersionedMessage(frag)
+				if err != nil {
+					t.Fatal(err)
+				} else if fragVersion != v {
+					t.Fatalf("fragment version differs, %d %d", fragVersion, v)
+				}
+
+				out, complete, err := r.Add(frag)
+				if err != nil {
+					t.Fatal(err)
+				} else if complete != (i == len(fragments)-1) {
+					t.Fatalf("fragment %d of %d is complete: %t", i, len(fragments), complete)
+				} else if complete && out != msg {
+					t.Fatalf("reassembled message differs")
+				}
+			}
+
+			if len(r.pending) != 0 {
+				t.Fatalf("Reassembler has %d pending messages", len(r.pending))
+			}
+		}
+	}
+}
+
+func TestFragmentSmall(t *testing.T) {
+	msg, err := marshalMessage(sessData, dataMessage{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Short messages are not fragmented.
+	if fragments, err := fragment(msg, len(msg)); err != nil {
+		t.Fatal(err)
+	} else if len(fragments) != 1 || fragments[0] != msg {
+		t.Fatalf("message was altered, %v", fragments)
+	}
+
+	// Too small fragment sizes are not supported.
+	if _, err := fragment(msg, len(msg)-1); err == nil {
+		t.Fatal("should fail")
+	}
+
+	// A non-fragment passes a Reassembler.
+	var r Reassembler
+	if out, complete, err := r.Add(msg); err != nil {
+		t.Fatal(err)
+	} else if !complete || out != msg {
+		t.Fatal("message was altered")
+	}
+}
+
+func testFragments(t *testing.T, size int) []string {
+	msg, err := marshalMessage(sessData, dataMessage(bytes.Repeat([]byte{0x42}, 256)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fragments, err := fragment(msg, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fragments
+}
+
+func TestReassemblerReorder(t *testing.T) {
+	fragments := testFragments(t, 64)
+
+	var r Reassembler
+	for i := len(fragments) - 1; i >= 0; i-- {
+		_, complete, err := r.Add(fragments[i])
+		if err != nil {
+			t.Fatal(err)
+		} else if complete != (i == 0) {
+			t.Fatalf("fragment %d is complete: %t", i, complete)
+		}
+	}
+}
+
+func TestReassemblerDuplicate(t *testing.T) {
+	fragments := testFragments(t, 64)
+
+	var r Reassembler
+	if _, _, err := r.Add(fragments[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.Add(fragments[0]); err == nil {
+		t.Fatal("duplicate fragment did not error")
+	}
+}
+
+func TestReassemblerMaxSize(t *testing.T) {
+	fragments := testFragments(t, 64)
+
+	r := Reassembler{MaxSize: 128}
+	var err error
+	for _, frag := range fragments {
+		if _, _, err = r.Add(frag); err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		t.Fatal("exceeding message did not error")
+	} else if len(r.pending) != 0 {
+		t.Fatal("exceeding message is still pending")
+	}
+}
+
+func TestReassemblerMaxPending(t *testing.T) {
+	now := time.Now()
+	r := Reassembler{MaxPending: 4, now: func() time.Time { return now }}
+
+	var firstFragments []string
+	for i := 0; i < 8; i++ {
+		fragments := testFragments(t, 64)
+		if i == 0 {
+			firstFragments = fragments
+		}
+
+		if _, _, err := r.Add(fragments[0]); err != nil {
+			t.Fatal(err)
+		} else if len(r.pending) > 4 {
+			t.Fatalf("Reassembler has %d pending messages", len(r.pending))
+		}
+
+		now = now.Add(time.Second)
+	}
+
+	// The first and oldest message was discarded.
+	for _, frag := range firstFragments[1:] {
+		if _, complete, err := r.Add(frag); err != nil {
+			t.Fatal(err)
+		} else if complete {
+			t.Fatal("discarded message was completed")
+		}
+	}
+}
+
+func TestReassemblerTimeout(t *testing.T) {
+	fragments := testFragments(t, 64)
+
+	now := time.Now()
+	r := Reassembler{Timeout: time.Minute, now: func() time.Time { return now }}
+
+	for _, frag := range fragments[:len(fragments)-1] {
+		if _, _, err := r.Add(frag); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now = now.Add(2 * time.Minute)
+
+	if _, complete, err := r.Add(fragments[len(fragments)-1]); err != nil {
+		t.Fatal(err)
+	} else if complete {
+		t.Fatal("timed out message was completed")
+	}
+}
+
+func TestReassemblerInvalid(t *testing.T) {
+	var r Reassembler
+
+	// A fragment within a fragment is not allowed.
+	inner := testFragments(t, 64)[0]
+	fragments, err := fragment(inner, len(inner)-1)
+	if err == nil {
+		t.Fatal("fragmenting a fragment did not error")
+	}
+
+	// Neither is garbage within fragments.
+	fragments = make([]string, 2)
+	for i := range fragments {
+		fragments[i], err = marshalMessage(sessFragment, fragmentMessage{
+			id: 23, index: uint16(i), count: 2, data: []byte("garbage"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, err := r.Add(fragments[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, complete, err := r.Add(fragments[1]); err == nil || complete {
+		t.Fatal("garbage was reassembled")
+	}
+
+	// Fragments of the same message must agree on their count.
+	for i, count := range []uint16{2, 3} {
+		frag, err := marshalMessage(sessFragment, fragmentMessage{
+			id: 42, index: uint16(i), count: count, data: []byte("foo"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err := r.Add(frag); (err != nil) != (i == 1) {
+			t.Fatalf("fragment %d: %v", i, err)
+		}
+	}
+}
+
+func TestSessionFragments(t *testing.T) {
+	alice, bob := testSessionPair(t)
+	alice.X3dhConfig = x3dh.Config{Version: x3dh.Version1}
+	bob.X3dhConfig = x3dh.Config{Version: x3dh.Version1}
+	alice.PostQuantum = true
+	alice.Protocol, bob.Protocol = Protocol1, Protocol1
+	alice.MaxFragmentSize, bob.MaxFragmentSize = 200, 200
+
+	// The PQXDH offer is far too long and is reassembled manually.
+	offerMsg, err := alice.Offer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offerFragments, err := alice.Fragment(offerMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var r Reassembler
+	for _, frag := range offerFragments {
+		offerMsg, _, err = r.Add(frag)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ackMsg, err := bob.Acknowledge(offerMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ackFragments, err := bob.Fragment(ackMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, frag := range ackFragments {
+		isEstablished, _, _, err := alice.Receive(frag)
+		if err != nil {
+			t.Fatal(err)
+		} else if isEstablished != (i == len(ackFragments)-1) {
+			t.Fatalf("fragment %d is established: %t", i, isEstablished)
+		}
+	}
+
+	plaintext := bytes.Repeat([]byte("hello bob "), 100)
+	dataFragments, err := alice.SendFragments(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(dataFragments) < 2 {
+		t.Fatalf("message was not fragmented, %d", len(dataFragments))
+	}
+
+	for i, frag := range dataFragments {
+		_, _, recv, err := bob.Receive(frag)
+		if err != nil {
+			t.Fatal(err)
+		} else if i < len(dataFragments)-1 && len(recv) > 0 {
+			t.Fatalf("fragment %d returned a plaintext", i)
+		} else if i == len(dataFragments)-1 && !bytes.Equal(recv, plaintext) {
+			t.Fatal("plaintext differs")
+		}
+	}
+
+	testSessionExchange(t, bob, alice, "hej alice")
+}
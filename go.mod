@@ -1,5 +1,10 @@
 module github.com/oxzi/xochimilco
 
-go 1.15
+go 1.24
 
-require golang.org/x/crypto v0.0.0-20210220033148-5ea612d1eb83
+require (
+	filippo.io/edwards25519 v1.1.0
+	golang.org/x/crypto v0.0.0-20210220033148-5ea612d1eb83
+)
+
+require golang.org/x/sys v0.0.0-20191026070338-33540a1f6037 // indirect
@@ -0,0 +1,382 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This file implements the membership management of a group, based on the
+// Sender Keys of senderkey.go.
+//
+// A Group holds this party's own SenderKey and each other member's
+// PeerSenderKey. Whenever a member is removed, the own SenderKey is rotated and
+// all other members' PeerSenderKeys are dropped, as the removed member knows
+// them. As each remaining member does the same, new keys are distributed over
+// the pairwise Sessions. Until then, a member's messages cannot be decrypted.
+
+package xochimilco
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/oxzi/xochimilco/senderkey"
+)
+
+// groupMagic starts each marshalled Group.
+const groupMagic = "\x00XOG"
+
+// groupMember is another member's state within a Group.
+type groupMember struct {
+	identityKey ed25519.PublicKey
+
+	// peerKey is the member's current PeerSenderKey, nil until received.
+	peerKey *PeerSenderKey
+
+	// pending is set until the own SenderKey was sent to this member.
+	pending bool
+}
+
+// Group of members, identified by their identity keys, exchanging group
+// messages encrypted by Sender Keys.
+//
+// The own SenderKey is sent to each member through the pairwise Session by
+// Distribute; PendingDistributions lists the members still waiting for it. The
+// other members' SenderKeyDistributions are passed to ReceiveDistribution.
+//
+// All members MUST agree on the membership, e.g., by an application level
+// protocol. A Group is not safe for concurrent use.
+type Group struct {
+	groupID     []byte
+	identityKey ed25519.PublicKey
+	senderKey   *SenderKey
+
+	members map[string]*groupMember
+}
+
+// NewGroup creates a new Group without other members. The identity key is the
+// own public identity key, as used within the pairwise Sessions.
+func NewGroup(groupID []byte, identityKey ed25519.PublicKey) (g *Group, err error) {
+	if len(identityKey) != ed25519.PublicKeySize {
+		err = fmt.Errorf("identity key MUST be of %d bytes", ed25519.PublicKeySize)
+		return
+	}
+
+	senderKey, err := NewSenderKey(groupID)
+	if err != nil {
+		return
+	}
+
+	g = &Group{
+		groupID:     senderKey.GroupID(),
+		identityKey: append(ed25519.PublicKey{}, identityKey...),
+		senderKey:   senderKey,
+		members:     make(map[string]*groupMember),
+	}
+	return
+}
+
+// GroupID identifies this Group.
+func (g *Group) GroupID() []byte {
+	return g.groupID
+}
+
+// Members returns the identity keys of all other members, sorted bytewise.
+func (g *Group) Members() (members []ed25519.PublicKey) {
+	for _, m := range g.members {
+		members = append(members, m.identityKey)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return bytes.Compare(members[i], members[j]) < 0
+	})
+	return
+}
+
+// IsMember reports whether an identity key belongs to another member.
+func (g *Group) IsMember(identityKey ed25519.PublicKey) bool {
+	_, ok := g.members[string(identityKey)]
+	return ok
+}
+
+// AddMember adds another member. The own SenderKey needs to be distributed to
+// the new member afterwards.
+func (g *Group) AddMember(identityKey ed25519.PublicKey) (err error) {
+	if len(identityKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("identity key MUST be of %d bytes", ed25519.PublicKeySize)
+	} else if identityKey.Equal(g.identityKey) {
+		return fmt.Errorf("cannot add oneself as a member")
+	} else if g.IsMember(identityKey) {
+		return fmt.Errorf("identity key is already a member")
+	}
+
+	g.members[string(identityKey)] = &groupMember{
+		identityKey: append(ed25519.PublicKey{}, identityKey...),
+		pending:     true,
+	}
+	return
+}
+
+// RemoveMember removes another member and rotates all Sender Keys.
+//
+// The own SenderKey is replaced and needs to be distributed to all remaining
+// members. Each remaining member's PeerSenderKey is dropped, as the removed
+// member knows it as well. Thus, their messages are rejected until their new
+// SenderKeyDistribution was received.
+func (g *Group) RemoveMember(identityKey ed25519.PublicKey) (err error) {
+	if !g.IsMember(identityKey) {
+		return fmt.Errorf("identity key is not a member")
+	}
+
+	delete(g.members, string(identityKey))
+	return g.Rotate()
+}
+
+// Rotate replaces the own SenderKey and drops all other members'
+// PeerSenderKeys, as done when removing a member.
+func (g *Group) Rotate() (err error) {
+	senderKey, err := NewSenderKey(g.groupID)
+	if err != nil {
+		return
+	}
+
+	g.senderKey = senderKey
+	for _, m := range g.members {
+		m.peerKey = nil
+		m.pending = true
+	}
+	return
+}
+
+// PendingDistributions returns the identity keys of all members, who have not
+// received the current own SenderKey yet; Distribute.
+func (g *Group) PendingDistributions() (members []ed25519.PublicKey) {
+	for _, m := range g.Members() {
+		if g.members[string(m)].pending {
+			members = append(members, m)
+		}
+	}
+	return
+}
+
+// Distribute the own SenderKey to a member through the pairwise Session. The
+// Session's peer MUST be a member.
+func (g *Group) Distribute(sess *Session) (dataMsg string, err error) {
+	m, ok := g.members[string(sess.PeerIdentityKey())]
+	if !ok {
+		err = fmt.Errorf("session's peer is not a member")
+		return
+	}
+
+	if dataMsg, err = sess.SendSenderKey(g.senderKey.Distribution()); err != nil {
+		return
+	}
+
+	m.pending = false
+	return
+}
+
+// ReceiveDistribution processes a member's SenderKeyDistribution, received
+// through the pairwise Session. A distribution from a non-member or for
+// another group is rejected.
+//
+// A previous PeerSenderKey of this member is replaced.
+func (g *Group) ReceiveDistribution(sess *Session, dist *SenderKeyDistribution) (err error) {
+	peer := sess.PeerIdentityKey()
+	m, ok := g.members[string(peer)]
+	if !ok {
+		return fmt.Errorf("session's peer is not a member")
+	} else if !bytes.Equal(dist.GroupID, g.groupID) {
+		return fmt.Errorf("sender key distribution belongs to another group")
+	}
+
+	peerKey, err := NewPeerSenderKey(peer, dist)
+	if err != nil {
+		return
+	}
+
+	// A KeyID identifies the sender of a group message. Thus, a member MUST NOT
+	// claim another member's KeyID.
+	for _, other := range g.members {
+		if other != m && other.peerKey != nil && other.peerKey.KeyID() == peerKey.KeyID() {
+			return fmt.Errorf("sender key distribution has another member's key ID")
+		}
+	}
+
+	m.peerKey = peerKey
+	return
+}
+
+// Encrypt a plaintext as a group message, to be sent to all members.
+func (g *Group) Encrypt(plaintext []byte) (groupMsg string, err error) {
+	return g.senderKey.Encrypt(plaintext)
+}
+
+// Decrypt a group message from another member, returning the sender's
+// identity key next to the plaintext.
+//
+// Messages from removed members or by a replaced SenderKey are rejected.
+func (g *Group) Decrypt(groupMsg string) (sender ed25519.PublicKey, plaintext []byte, err error) {
+	groupID, keyID, err := GroupMessageInfo(groupMsg)
+	if err != nil {
+		return
+	} else if !bytes.Equal(groupID, g.groupID) {
+		err = fmt.Errorf("group message belongs to another group")
+		return
+	}
+
+	// KeyIDs are unique within ReceiveDistribution. However, each member with
+	// this KeyID is tried, as a failed decryption does not alter the state.
+	err = fmt.Errorf("group message's sender key is unknown")
+	for _, m := range g.members {
+		if m.peerKey == nil || m.peerKey.KeyID() != keyID {
+			continue
+		}
+
+		if plaintext, err = m.peerKey.Decrypt(groupMsg); err != nil {
+			continue
+		}
+		sender = m.identityKey
+		return
+	}
+	return
+}
+
+// MarshalBinary encodes a Group's state, including all secret keys:
+//
+//	magic "\x00XOG" (4 byte) | group ID length (2 byte) | group ID |
+//	identity key (32 byte) | own sender key length (2 byte) | own sender key |
+//	member count (2 byte) |
+//	{ identity key (32 byte) | pending (1 byte) | peer key length (2 byte) | peer key }
+//
+// All integers are encoded in network byte order. Thus, the state MUST be
+// stored securely.
+func (g *Group) MarshalBinary() (data []byte, err error) {
+	senderData, err := g.senderKey.sender.MarshalBinary()
+	if err != nil {
+		return
+	}
+
+	b := new(bytes.Buffer)
+	_, _ = b.WriteString(groupMagic)
+	_ = binary.Write(b, binary.BigEndian, uint16(len(g.groupID)))
+	_, _ = b.Write(g.groupID)
+	_, _ = b.Write(g.identityKey)
+	_ = binary.Write(b, binary.BigEndian, uint16(len(senderData)))
+	_, _ = b.Write(senderData)
+
+	members := g.Members()
+	if len(members) >= 1<<16 {
+		err = fmt.Errorf("group exceeds maximum member count")
+		return
+	}
+	_ = binary.Write(b, binary.BigEndian, uint16(len(members)))
+
+	for _, identityKey := range members {
+		m := g.members[string(identityKey)]
+
+		var peerData []byte
+		if m.peerKey != nil {
+			if peerData, err = m.peerKey.receiver.MarshalBinary(); err != nil {
+				return
+			} else if len(peerData) >= 1<<16 {
+				err = fmt.Errorf("member's peer key exceeds maximum length")
+				return
+			}
+		}
+
+		var pending byte
+		if m.pending {
+			pending = 1
+		}
+
+		_, _ = b.Write(m.identityKey)
+		_ = b.WriteByte(pending)
+		_ = binary.Write(b, binary.BigEndian, uint16(len(peerData)))
+		_, _ = b.Write(peerData)
+	}
+
+	data = b.Bytes()
+	return
+}
+
+// UnmarshalBinary decodes a Group's state.
+func (g *Group) UnmarshalBinary(data []byte) (err error) {
+	if len(data) < len(groupMagic)+2 || !bytes.HasPrefix(data, []byte(groupMagic)) {
+		return fmt.Errorf("data is not a group")
+	}
+	data = data[len(groupMagic):]
+
+	l := int(binary.BigEndian.Uint16(data[:2]))
+	data = data[2:]
+	if l == 0 || len(data) < l+ed25519.PublicKeySize+2 {
+		return fmt.Errorf("group is truncated")
+	}
+
+	groupID := append([]byte{}, data[:l]...)
+	data = data[l:]
+
+	identityKey := append(ed25519.PublicKey{}, data[:ed25519.PublicKeySize]...)
+	data = data[ed25519.PublicKeySize:]
+
+	l = int(binary.BigEndian.Uint16(data[:2]))
+	data = data[2:]
+	if len(data) < l+2 {
+		return fmt.Errorf("group is truncated")
+	}
+
+	sender := new(senderkey.Sender)
+	if err = sender.UnmarshalBinary(data[:l]); err != nil {
+		return
+	}
+	data = data[l:]
+
+	count := int(binary.BigEndian.Uint16(data[:2]))
+	data = data[2:]
+
+	members := make(map[string]*groupMember, count)
+	for i := 0; i < count; i++ {
+		if len(data) < ed25519.PublicKeySize+1+2 {
+			return fmt.Errorf("group member is truncated")
+		}
+
+		m := &groupMember{
+			identityKey: append(ed25519.PublicKey{}, data[:ed25519.PublicKeySize]...),
+			pending:     data[ed25519.PublicKeySize] != 0,
+		}
+		data = data[ed25519.PublicKeySize+1:]
+
+		l := int(binary.BigEndian.Uint16(data[:2]))
+		data = data[2:]
+		if len(data) < l {
+			return fmt.Errorf("group member is truncated")
+		}
+
+		if l > 0 {
+			receiver := new(senderkey.Receiver)
+			if err = receiver.UnmarshalBinary(data[:l]); err != nil {
+				return
+			}
+			m.peerKey = &PeerSenderKey{
+				groupID:  groupID,
+				member:   m.identityKey,
+				receiver: receiver,
+			}
+		}
+		data = data[l:]
+
+		if _, ok := members[string(m.identityKey)]; ok {
+			return fmt.Errorf("group member is listed twice")
+		}
+		members[string(m.identityKey)] = m
+	}
+
+	if len(data) > 0 {
+		return fmt.Errorf("group has %d trailing bytes", len(data))
+	}
+
+	g.groupID = groupID
+	g.identityKey = identityKey
+	g.senderKey = &SenderKey{groupID: groupID, sender: sender}
+	g.members = members
+	return
+}
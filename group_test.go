@@ -0,0 +1,260 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package xochimilco
+
+import (
+	"crypto/ed25519"
+	"testing"
+)
+
+// testGroupParty is a group member with a Session to each other member.
+type testGroupParty struct {
+	key      ed25519.PrivateKey
+	group    *Group
+	sessions map[string]*Session
+}
+
+// testGroupSetup creates a Group for n parties, with established Sessions and
+// distributed Sender Keys between all of them.
+func testGroupSetup(t *testing.T, n int) (parties []*testGroupParty) {
+	parties = make([]*testGroupParty, n)
+	for i := range parties {
+		pub, priv, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		group, err := NewGroup([]byte("xochimilco group"), pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parties[i] = &testGroupParty{key: priv, group: group, sessions: make(map[string]*Session)}
+	}
+
+	for i, p := range parties {
+		for _, q := range parties[i+1:] {
+			pPub, qPub := p.key.Public().(ed25519.PublicKey), q.key.Public().(ed25519.PublicKey)
+			pSess := &Session{IdentityKey: p.key, VerifyPeer: func(peer ed25519.PublicKey) bool { return peer.Equal(qPub) }}
+			qSess := &Session{IdentityKey: q.key, VerifyPeer: func(peer ed25519.PublicKey) bool { return peer.Equal(pPub) }}
+			testSessionEstablish(t, pSess, qSess)
+
+			p.sessions[string(qPub)], q.sessions[string(pPub)] = pSess, qSess
+
+			if err := p.group.AddMember(qPub); err != nil {
+				t.Fatal(err)
+			}
+			if err := q.group.AddMember(pPub); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, p := range parties {
+		testGroupDistribute(t, p, parties)
+	}
+	return
+}
+
+// testGroupDistribute sends a party's pending SenderKey distributions.
+func testGroupDistribute(t *testing.T, p *testGroupParty, parties []*testGroupParty) {
+	for _, member := range p.group.PendingDistributions() {
+		dataMsg, err := p.group.Distribute(p.sessions[string(member)])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, q := range parties {
+			if !q.key.Public().(ed25519.PublicKey).Equal(member) {
+				continue
+			}
+
+			sess := q.sessions[string(p.key.Public().(ed25519.PublicKey))]
+			_, _, plaintext, err := sess.Receive(dataMsg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var dist SenderKeyDistribution
+			if err := dist.UnmarshalBinary(plaintext); err != nil {
+				t.Fatal(err)
+			}
+			if err := q.group.ReceiveDistribution(sess, &dist); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if pending := p.group.PendingDistributions(); len(pending) > 0 {
+		t.Fatalf("%d distributions are still pending", len(pending))
+	}
+}
+
+// testGroupExchange encrypts a group message from one party and checks if it
+// can be decrypted by the others.
+func testGroupExchange(t *testing.T, sender *testGroupParty, receivers []*testGroupParty, canDecrypt bool) {
+	groupMsg, err := sender.group.Encrypt([]byte("hello group"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range receivers {
+		from, plaintext, err := r.group.Decrypt(groupMsg)
+		if !canDecrypt {
+			if err == nil {
+				t.Fatal("group message was decrypted")
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		} else if !from.Equal(sender.key.Public()) {
+			t.Fatal("group message's sender differs")
+		} else if string(plaintext) != "hello group" {
+			t.Fatalf("plaintext differs, %q", plaintext)
+		}
+	}
+}
+
+func TestGroup(t *testing.T) {
+	parties := testGroupSetup(t, 3)
+	alice, bob, carol := parties[0], parties[1], parties[2]
+
+	if members := alice.group.Members(); len(members) != 2 {
+		t.Fatalf("Alice's group has %d members", len(members))
+	}
+
+	testGroupExchange(t, alice, []*testGroupParty{bob, carol}, true)
+	testGroupExchange(t, bob, []*testGroupParty{alice, carol}, true)
+	testGroupExchange(t, carol, []*testGroupParty{alice, bob}, true)
+
+	// Alice and Bob remove Carol.
+	carolPub := carol.key.Public().(ed25519.PublicKey)
+	for _, p := range []*testGroupParty{alice, bob} {
+		if err := p.group.RemoveMember(carolPub); err != nil {
+			t.Fatal(err)
+		} else if p.group.IsMember(carolPub) {
+			t.Fatal("Carol is still a member")
+		} else if len(p.group.PendingDistributions()) != 1 {
+			t.Fatal("new sender key is not pending")
+		}
+	}
+
+	// Until the new sender keys are distributed, the old ones are rejected.
+	testGroupExchange(t, bob, []*testGroupParty{alice}, false)
+
+	testGroupDistribute(t, alice, parties)
+	testGroupDistribute(t, bob, parties)
+
+	testGroupExchange(t, alice, []*testGroupParty{bob}, true)
+	testGroupExchange(t, bob, []*testGroupParty{alice}, true)
+
+	// Carol can neither read nor write anymore.
+	testGroupExchange(t, alice, []*testGroupParty{carol}, false)
+	testGroupExchange(t, carol, []*testGroupParty{alice, bob}, false)
+
+	dist := carol.group.senderKey.Distribution()
+	if err := alice.group.ReceiveDistribution(alice.sessions[string(carolPub)], dist); err == nil {
+		t.Fatal("removed member's distribution was accepted")
+	}
+	if _, err := alice.group.Distribute(alice.sessions[string(carolPub)]); err == nil {
+		t.Fatal("sender key was distributed to a removed member")
+	}
+}
+
+func TestGroupDuplicateKeyID(t *testing.T) {
+	parties := testGroupSetup(t, 3)
+	alice, bob, carol := parties[0], parties[1], parties[2]
+	bobPub, carolPub := bob.key.Public().(ed25519.PublicKey), carol.key.Public().(ed25519.PublicKey)
+
+	// Carol claims Bob's KeyID for her own sender key.
+	dist := carol.group.senderKey.Distribution()
+	dist.Key.KeyID = alice.group.members[string(bobPub)].peerKey.KeyID()
+	if err := alice.group.ReceiveDistribution(alice.sessions[string(carolPub)], dist); err == nil {
+		t.Fatal("distribution with another member's key ID was accepted")
+	}
+
+	// Both Bob's and Carol's messages are still attributed correctly.
+	testGroupExchange(t, bob, []*testGroupParty{alice}, true)
+	testGroupExchange(t, carol, []*testGroupParty{alice}, true)
+}
+
+func TestGroupInvalid(t *testing.T) {
+	parties := testGroupSetup(t, 2)
+	alice, bob := parties[0], parties[1]
+	alicePub, bobPub := alice.key.Public().(ed25519.PublicKey), bob.key.Public().(ed25519.PublicKey)
+
+	if err := alice.group.AddMember(alicePub); err == nil {
+		t.Fatal("Alice added herself")
+	} else if err := alice.group.AddMember(bobPub); err == nil {
+		t.Fatal("Bob was added twice")
+	} else if err := alice.group.AddMember(nil); err == nil {
+		t.Fatal("invalid identity key was added")
+	} else if err := alice.group.RemoveMember(alicePub); err == nil {
+		t.Fatal("Alice removed herself")
+	}
+
+	// A distribution for another group.
+	sk, err := NewSenderKey([]byte("other group"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.group.ReceiveDistribution(alice.sessions[string(bobPub)], sk.Distribution()); err == nil {
+		t.Fatal("other group's distribution was accepted")
+	}
+
+	// Another group's message.
+	groupMsg, err := sk.Encrypt([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := alice.group.Decrypt(groupMsg); err == nil {
+		t.Fatal("other group's message was decrypted")
+	}
+
+	if _, err := NewGroup(nil, alicePub); err == nil {
+		t.Fatal("group without ID was created")
+	} else if _, err := NewGroup([]byte("group"), nil); err == nil {
+		t.Fatal("group without identity key was created")
+	}
+}
+
+func TestGroupMarshal(t *testing.T) {
+	parties := testGroupSetup(t, 3)
+	alice, bob, carol := parties[0], parties[1], parties[2]
+
+	testGroupExchange(t, alice, []*testGroupParty{bob, carol}, true)
+	if err := bob.group.AddMember(make(ed25519.PublicKey, ed25519.PublicKeySize)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range parties {
+		data, err := p.group.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var g Group
+		if err := g.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		p.group = &g
+
+		for _, invalid := range [][]byte{nil, data[:len(data)-1], append(append([]byte{}, data...), 0x00)} {
+			if err := g.UnmarshalBinary(invalid); err == nil {
+				t.Fatalf("invalid group %x was unmarshalled", invalid)
+			}
+		}
+	}
+
+	if len(bob.group.Members()) != 3 || len(bob.group.PendingDistributions()) != 1 {
+		t.Fatal("Bob's restored group differs")
+	}
+
+	testGroupExchange(t, alice, []*testGroupParty{bob, carol}, true)
+	testGroupExchange(t, bob, []*testGroupParty{alice, carol}, true)
+	testGroupExchange(t, carol, []*testGroupParty{alice, bob}, true)
+}
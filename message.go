@@ -8,7 +8,10 @@ import (
 	"crypto/subtle"
 	"encoding"
 	"encoding/base64"
+	"encoding/binary"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -32,9 +35,51 @@ const (
 	// sessClose cancels a Xochimilco session. This is possible in each state
 	// and might occur due to a regular closing as well as rejecting an identity
 	// key.
-	// A MITM can also send this. However, a MITM can also drop messages.
+	// Within an established session, its payload is an encrypted reason. Only
+	// before, an unauthenticated variant exists. A MITM can also send the
+	// latter. However, a MITM can also drop messages.
 	sessClose
 
+	// sessAckExt is a variant of sessAck, additionally carrying extensions. It
+	// is only sent in response to a sessOffer with extensions.
+	sessAckExt
+
+	// sessConfirm is Alice's key confirmation for Bob, optionally followed by
+	// her first encrypted message. It is only sent if requested in the offer.
+	sessConfirm
+
+	// sessFragment is one part of another encoded message, which was split up
+	// for size-limited transports.
+	sessFragment
+
+	// sessStream announces an encrypted stream, sent next to this Session. It
+	// holds a Double Ratchet ciphertext of the stream's key.
+	sessStream
+
+	// sessPakeOffer is Alice's initial message for a password-authenticated
+	// handshake, as an alternative to sessOffer; PakeOffer.
+	sessPakeOffer
+
+	// sessPakeAck is Bob's answer to a sessPakeOffer, including his key
+	// confirmation and a first nonsense ciphertext, like sessAck.
+	sessPakeAck
+
+	// sessNoiseOffer is Alice's initial message for a Noise handshake, as an
+	// alternative to sessOffer; Session.Handshake.
+	sessNoiseOffer
+
+	// sessNoiseAck is Bob's answer to a sessNoiseOffer. For PatternIK, it also
+	// contains a first nonsense ciphertext, like sessAck.
+	sessNoiseAck
+
+	// sessNoiseFinish is Alice's final message of a Noise PatternXX handshake,
+	// followed by her first encrypted message.
+	sessNoiseFinish
+
+	// sessGroup is a group message, encrypted once by a Sender Key for all
+	// members. It is not bound to a Session; PeerSenderKey.Decrypt.
+	sessGroup
+
 	// Prefix indicates the beginning of an encoded message.
 	Prefix string = "!XO!"
 
@@ -42,19 +87,135 @@ const (
 	Suffix string = "!OX!"
 )
 
-// marshalMessage creates the entire encoded message from a struct.
+// typeAssociatedData binds a Double Ratchet ciphertext to its messageType by
+// additional associated data. Thus, a ciphertext cannot be relabelled as
+// another message type. For compatibility, sessData, including initial
+// ciphertexts within the handshake, has no additional associated data.
+func typeAssociatedData(t messageType) []byte {
+	if t == sessData {
+		return nil
+	}
+	return []byte{byte(t)}
+}
+
+// ProtocolVersion identifies the wire format resp. the protocol variant.
+//
+// The version is part of each message's framing. A Session negotiates the
+// version within the handshake; Session.Protocol.
+type ProtocolVersion byte
+
+const (
+	// ProtocolLegacy is the initial wire format. The message type is encoded as
+	// a single ASCII digit between the prefix and the Base64 encoded payload:
+	//
+	//	!XO!<type><base64>!OX!
+	ProtocolLegacy ProtocolVersion = iota
+
+	// Protocol1 is the versioned wire format. The version and the message type
+	// are encoded as decimal numbers, separated by dots:
+	//
+	//	!XO!v<version>.<type>.<base64>!OX!
+	Protocol1
+
+	// protocolLatest is the latest supported ProtocolVersion.
+	protocolLatest = Protocol1
+)
+
+// offeredProtocols lists all ProtocolVersions after ProtocolLegacy up to the
+// latest one, as announced within an offer's extProtocols.
+func offeredProtocols(latest ProtocolVersion) (versions []byte) {
+	for v := Protocol1; v <= latest; v++ {
+		versions = append(versions, byte(v))
+	}
+	return
+}
+
+// protocolAssociatedData binds the offered and the negotiated ProtocolVersion
+// into the Double Ratchet's associated data. Thus, a MITM stripping versions
+// from the offer results in different associated data for both parties.
+//
+// Offers without any announced version are not altered for compatibility.
+func protocolAssociatedData(associatedData, offered []byte, negotiated ProtocolVersion) []byte {
+	if len(offered) == 0 {
+		return associatedData
+	}
+
+	ad := append([]byte{}, associatedData...)
+	ad = append(ad, byte(len(offered)))
+	ad = append(ad, offered...)
+	return append(ad, byte(negotiated))
+}
+
+// earlyDataAssociatedData binds Alice's support for early data into the Double
+// Ratchet's associated data; extEarlyData. Thus, a MITM stripping or adding
+// this extension results in different associated data for both parties, and
+// both parties agree on the early data indication within the initial payload.
+func earlyDataAssociatedData(associatedData []byte, earlyData bool) []byte {
+	if !earlyData {
+		return associatedData
+	}
+
+	ad := append([]byte{}, associatedData...)
+	return append(ad, byte(extEarlyData))
+}
+
+// marshalMessage creates the entire encoded message from a struct, using the
+// ProtocolLegacy wire format.
 func marshalMessage(t messageType, m encoding.BinaryMarshaler) (out string, err error) {
-	b := new(strings.Builder)
+	return marshalVersionedMessage(ProtocolLegacy, t, m)
+}
 
-	_, _ = fmt.Fprint(b, Prefix)
-	_, _ = fmt.Fprint(b, int(t))
+// marshalVersionedMessage creates the entire encoded message from a struct for
+// a specific ProtocolVersion.
+func marshalVersionedMessage(v ProtocolVersion, t messageType, m encoding.BinaryMarshaler) (out string, err error) {
+	return marshalEncodedMessage(EncodingBase64, v, t, m)
+}
+
+// marshalEncodedMessage creates the entire encoded message from a struct for a
+// specific ProtocolVersion and Encoding.
+func marshalEncodedMessage(enc Encoding, v ProtocolVersion, t messageType, m encoding.BinaryMarshaler) (out string, err error) {
+	if v > protocolLatest {
+		err = fmt.Errorf("unsupported protocol version %d", v)
+		return
+	}
 
 	data, err := m.MarshalBinary()
 	if err != nil {
 		return
 	}
 
-	b64 := base64.NewEncoder(base64.StdEncoding, b)
+	switch enc {
+	case EncodingBase64:
+		out, err = encodeText(base64.StdEncoding, v, t, data)
+	case EncodingBase64URL:
+		out, err = encodeText(base64.RawURLEncoding, v, t, data)
+	case EncodingBinary:
+		out, err = encodeBinary(v, t, data)
+	case EncodingArmor:
+		out, err = encodeArmor(v, t, data)
+	default:
+		err = fmt.Errorf("unsupported encoding %d", enc)
+	}
+	return
+}
+
+// encodeText creates a text message, framed by Prefix and Suffix.
+func encodeText(b64Enc *base64.Encoding, v ProtocolVersion, t messageType, data []byte) (out string, err error) {
+	b := new(strings.Builder)
+
+	_, _ = fmt.Fprint(b, Prefix)
+
+	switch {
+	case v == ProtocolLegacy && t <= 9:
+		_, _ = fmt.Fprint(b, int(t))
+	case v == ProtocolLegacy:
+		err = fmt.Errorf("message type %d cannot be encoded in the legacy format", t)
+		return
+	default:
+		_, _ = fmt.Fprintf(b, "v%d.%d.", v, t)
+	}
+
+	b64 := base64.NewEncoder(b64Enc, b)
 	if _, err = b64.Write(data); err != nil {
 		return
 	}
@@ -70,12 +231,113 @@ func marshalMessage(t messageType, m encoding.BinaryMarshaler) (out string, err
 
 // unmarshalMessage recreates the struct for an encoded message.
 func unmarshalMessage(in string) (t messageType, m interface{}, err error) {
-	if !strings.HasPrefix(in, Prefix) || !strings.HasSuffix(in, Suffix) {
+	_, t, m, err = unmarshalVersionedMessage(in)
+	return
+}
+
+// parseFraming splits an encoded message's content, without its pre- and
+// suffix, into the ProtocolVersion, the messageType, and the Base64 payload.
+func parseFraming(in string) (v ProtocolVersion, t messageType, payload string, err error) {
+	if len(in) == 0 {
+		err = fmt.Errorf("message string misses its type")
+		return
+	}
+
+	// ProtocolLegacy: a single ASCII digit
+	if in[0] != 'v' {
+		if in[0] < '0' || in[0] > '9' {
+			err = fmt.Errorf("invalid legacy message type %q", in[0])
+			return
+		}
+
+		v, t, payload = ProtocolLegacy, messageType(in[0]-'0'), in[1:]
+		return
+	}
+
+	// Protocol1 and later: v<version>.<type>.<payload>
+	fields := strings.SplitN(in[1:], ".", 3)
+	if len(fields) != 3 {
+		err = fmt.Errorf("message string misses version or type field")
+		return
+	}
+
+	version, err := strconv.ParseUint(fields[0], 10, 8)
+	if err != nil {
+		err = fmt.Errorf("invalid protocol version: %v", err)
+		return
+	}
+	v = ProtocolVersion(version)
+	if v == ProtocolLegacy {
+		err = fmt.Errorf("legacy protocol version cannot be explicitly stated")
+		return
+	}
+
+	msgType, err := strconv.ParseUint(fields[1], 10, 8)
+	if err != nil {
+		err = fmt.Errorf("invalid message type: %v", err)
+		return
+	}
+
+	t, payload = messageType(msgType), fields[2]
+	return
+}
+
+// decodeText parses a text message, framed by Prefix and Suffix. Both the
+// standard and the URL-safe Base64 alphabet are supported, the latter also
+// without padding.
+func decodeText(in string) (enc Encoding, v ProtocolVersion, t messageType, data []byte, err error) {
+	if !strings.HasPrefix(in, Prefix) || !strings.HasSuffix(in, Suffix) || len(in) < len(Prefix)+len(Suffix) {
 		err = fmt.Errorf("message string misses pre- and/or suffix")
 		return
 	}
 
-	switch t = messageType(in[len(Prefix)] - '0'); t {
+	v, t, payload, err := parseFraming(in[len(Prefix) : len(in)-len(Suffix)])
+	if err != nil {
+		return
+	}
+
+	enc = EncodingBase64
+	if strings.ContainsAny(payload, "-_") || len(payload)%4 != 0 {
+		enc = EncodingBase64URL
+		payload = strings.TrimRight(payload, "=")
+		data, err = base64.RawURLEncoding.DecodeString(payload)
+	} else {
+		data, err = base64.StdEncoding.DecodeString(payload)
+	}
+	return
+}
+
+// unmarshalVersionedMessage recreates the struct for an encoded message, also
+// returning its ProtocolVersion.
+func unmarshalVersionedMessage(in string) (v ProtocolVersion, t messageType, m interface{}, err error) {
+	_, v, t, m, err = unmarshalEncodedMessage(in)
+	return
+}
+
+// unmarshalEncodedMessage recreates the struct for an encoded message, also
+// returning its detected Encoding and its ProtocolVersion.
+func unmarshalEncodedMessage(in string) (enc Encoding, v ProtocolVersion, t messageType, m interface{}, err error) {
+	var data []byte
+	switch {
+	case strings.HasPrefix(in, binaryMagic):
+		enc = EncodingBinary
+		v, t, data, err = decodeBinary(in)
+	case strings.HasPrefix(strings.TrimSpace(in), armorBegin):
+		enc = EncodingArmor
+		v, t, data, err = decodeArmor(in)
+	default:
+		enc, v, t, data, err = decodeText(in)
+	}
+	if err != nil {
+		return
+	}
+
+	if v > protocolLatest {
+		err = fmt.Errorf("unsupported protocol version %d", v)
+		return
+	}
+
+	switch t {
 	case sessOffer:
 		m = new(offerMessage)
 	case sessAck:
@@ -84,43 +346,158 @@ func unmarshalMessage(in string) (t messageType, m interface{}, err error) {
 		m = new(dataMessage)
 	case sessClose:
 		m = new(closeMessage)
+	case sessAckExt:
+		m = new(ackExtMessage)
+	case sessConfirm:
+		m = new(confirmMessage)
+	case sessFragment:
+		m = new(fragmentMessage)
+	case sessStream:
+		m = new(streamMessage)
+	case sessPakeOffer:
+		m = new(pakeOfferMessage)
+	case sessPakeAck:
+		m = new(pakeAckMessage)
+	case sessNoiseOffer:
+		m = new(noiseOfferMessage)
+	case sessNoiseAck, sessNoiseFinish:
+		m = new(noiseMessage)
+	case sessGroup:
+		m = new(groupMessage)
 	default:
 		err = fmt.Errorf("unsupported message type %d", t)
 		return
 	}
 
-	data, err := base64.StdEncoding.DecodeString(in[len(Prefix)+1 : len(in)-len(Suffix)])
-	if err != nil {
-		return
+	err = m.(encoding.BinaryUnmarshaler).UnmarshalBinary(data)
+
+	return
+}
+
+// extensionType identifies an optional field within a sessOffer or sessAckExt.
+type extensionType byte
+
+const (
+	_ extensionType = iota
+
+	// extKemPub is Alice's ML-KEM-768 encapsulation key (PQSPK), requesting a
+	// PQXDH key agreement.
+	extKemPub
+
+	// extKemSig is the signature of extKemPub by Alice's identity key.
+	extKemSig
+
+	// extKemCipher is Bob's ML-KEM-768 ciphertext, answering a PQXDH request.
+	extKemCipher
+
+	// extKeyConfirm is Alice's request to confirm the session key. Its value
+	// is empty.
+	extKeyConfirm
+
+	// extEarlyData is Alice's support for application data within the
+	// acknowledgement. Its value is empty. It MUST NOT be part of a sessAckExt,
+	// as Bob indicates such data within the encrypted initial payload.
+	extEarlyData
+
+	// extProtocols lists Alice's supported ProtocolVersions, one byte each.
+	extProtocols
+
+	// extSasCommit is Alice's SHA-256 commitment to her nonce for the
+	// ShortAuthString, revealed within her key confirmation. Thus, it requires
+	// extKeyConfirm.
+	extSasCommit
+)
+
+const (
+	// earlyDataAbsent prefixes Bob's random initial payload if Alice supports
+	// early data; extEarlyData.
+	earlyDataAbsent byte = iota
+
+	// earlyDataPresent prefixes Bob's early data within the initial payload.
+	earlyDataPresent
+)
+
+// extensions are optional fields of a sessOffer or sessAckExt message.
+//
+// They are encoded as a sequence of their type (1 byte), their length (2 bytes,
+// big endian), and their value. Unknown extensions are ignored by a Session
+// for forward compatibility.
+type extensions map[extensionType][]byte
+
+func (ext extensions) MarshalBinary() (data []byte, err error) {
+	types := make([]extensionType, 0, len(ext))
+	for t := range ext {
+		types = append(types, t)
 	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
 
-	err = m.(encoding.BinaryUnmarshaler).UnmarshalBinary(data)
+	for _, t := range types {
+		if len(ext[t]) >= 1<<16 {
+			return nil, fmt.Errorf("extension %d exceeds maximum length", t)
+		}
+
+		data = append(data, byte(t))
+		data = binary.BigEndian.AppendUint16(data, uint16(len(ext[t])))
+		data = append(data, ext[t]...)
+	}
+
+	return
+}
+
+func (ext *extensions) UnmarshalBinary(data []byte) (err error) {
+	*ext = make(extensions)
+
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return fmt.Errorf("extension header is truncated")
+		}
+
+		t := extensionType(data[0])
+		l := int(binary.BigEndian.Uint16(data[1:3]))
+		data = data[3:]
+
+		if len(data) < l {
+			return fmt.Errorf("extension %d is truncated", t)
+		} else if _, ok := (*ext)[t]; ok {
+			return fmt.Errorf("extension %d is duplicated", t)
+		}
+
+		(*ext)[t] = append([]byte{}, data[:l]...)
+		data = data[l:]
+	}
 
 	return
 }
 
 // offerMessage is the initial sessOffer message, announcing Alice's public
 // Ed25519 Identity Key (32 byte), her X25519 signed prekey (32 byte), and the
-// signature (64 bytes).
+// signature (64 bytes). Those might be followed by optional extensions.
 type offerMessage struct {
 	idKey []byte
 	spKey []byte
 	spSig []byte
+	ext   extensions
 }
 
 func (msg offerMessage) MarshalBinary() (data []byte, err error) {
-	data = make([]byte, 32+32+64)
+	extData, err := msg.ext.MarshalBinary()
+	if err != nil {
+		return
+	}
+
+	data = make([]byte, 32+32+64+len(extData))
 
 	copy(data[:32], msg.idKey)
 	copy(data[32:64], msg.spKey)
-	copy(data[64:], msg.spSig)
+	copy(data[64:128], msg.spSig)
+	copy(data[128:], extData)
 
 	return
 }
 
 func (msg *offerMessage) UnmarshalBinary(data []byte) (err error) {
-	if len(data) != 32+32+64 {
-		return fmt.Errorf("sessOffer payload MUST be of 128 byte")
+	if len(data) < 32+32+64 {
+		return fmt.Errorf("sessOffer payload MUST be >= 128 byte")
 	}
 
 	msg.idKey = make([]byte, 32)
@@ -129,7 +506,11 @@ func (msg *offerMessage) UnmarshalBinary(data []byte) (err error) {
 
 	copy(msg.idKey, data[:32])
 	copy(msg.spKey, data[32:64])
-	copy(msg.spSig, data[64:])
+	copy(msg.spSig, data[64:128])
+
+	if len(data) > 128 {
+		err = msg.ext.UnmarshalBinary(data[128:])
+	}
 
 	return
 }
@@ -170,6 +551,253 @@ func (msg *ackMessage) UnmarshalBinary(data []byte) (err error) {
 	return
 }
 
+// ackExtMessage is the sessAckExt message, an ackMessage with extensions. The
+// extensions are placed between the ephemeral key and the ciphertext, prefixed
+// by their total length (2 bytes, big endian).
+type ackExtMessage struct {
+	ackMessage
+	ext extensions
+}
+
+func (msg ackExtMessage) MarshalBinary() (data []byte, err error) {
+	extData, err := msg.ext.MarshalBinary()
+	if err != nil {
+		return
+	} else if len(extData) >= 1<<16 {
+		return nil, fmt.Errorf("sessAckExt extensions exceed maximum length")
+	}
+
+	data = make([]byte, 32+32+2+len(extData)+len(msg.cipher))
+
+	copy(data[:32], msg.idKey)
+	copy(data[32:64], msg.eKey)
+	binary.BigEndian.PutUint16(data[64:66], uint16(len(extData)))
+	copy(data[66:66+len(extData)], extData)
+	copy(data[66+len(extData):], msg.cipher)
+
+	return
+}
+
+func (msg *ackExtMessage) UnmarshalBinary(data []byte) (err error) {
+	if len(data) < 32+32+2 {
+		return fmt.Errorf("sessAckExt payload MUST be >= 66 byte")
+	}
+
+	extLen := int(binary.BigEndian.Uint16(data[64:66]))
+	if len(data) <= 66+extLen {
+		return fmt.Errorf("sessAckExt payload misses its ciphertext")
+	}
+
+	if err = msg.ext.UnmarshalBinary(data[66 : 66+extLen]); err != nil {
+		return
+	}
+
+	msg.idKey = make([]byte, 32)
+	msg.eKey = make([]byte, 32)
+	msg.cipher = make([]byte, len(data)-66-extLen)
+
+	copy(msg.idKey, data[:32])
+	copy(msg.eKey, data[32:64])
+	copy(msg.cipher, data[66+extLen:])
+
+	return
+}
+
+// pakeOfferMessage is Alice's sessPakeOffer message. It consists of her
+// Ed25519 identity key (32 byte), her X25519 key for the Double Ratchet (32
+// byte), her SPAKE2 share (32 byte), and a signature over those by her identity
+// key (64 byte).
+type pakeOfferMessage struct {
+	idKey []byte
+	dhKey []byte
+	share []byte
+	sig   []byte
+}
+
+func (msg pakeOfferMessage) MarshalBinary() (data []byte, err error) {
+	data = make([]byte, 32+32+32+64)
+
+	copy(data[:32], msg.idKey)
+	copy(data[32:64], msg.dhKey)
+	copy(data[64:96], msg.share)
+	copy(data[96:], msg.sig)
+
+	return
+}
+
+func (msg *pakeOfferMessage) UnmarshalBinary(data []byte) (err error) {
+	if len(data) != 32+32+32+64 {
+		return fmt.Errorf("sessPakeOffer payload MUST be 160 byte")
+	}
+
+	msg.idKey = make([]byte, 32)
+	msg.dhKey = make([]byte, 32)
+	msg.share = make([]byte, 32)
+	msg.sig = make([]byte, 64)
+
+	copy(msg.idKey, data[:32])
+	copy(msg.dhKey, data[32:64])
+	copy(msg.share, data[64:96])
+	copy(msg.sig, data[96:])
+
+	return
+}
+
+// pakeAckMessage is Bob's sessPakeAck message. It consists of his Ed25519
+// identity key (32 byte), his SPAKE2 share (32 byte), his key confirmation
+// (32 byte), a signature by his identity key (64 byte), and a nonsense initial
+// ciphertext.
+type pakeAckMessage struct {
+	idKey  []byte
+	share  []byte
+	mac    []byte
+	sig    []byte
+	cipher []byte
+}
+
+func (msg pakeAckMessage) MarshalBinary() (data []byte, err error) {
+	data = make([]byte, 32+32+32+64+len(msg.cipher))
+
+	copy(data[:32], msg.idKey)
+	copy(data[32:64], msg.share)
+	copy(data[64:96], msg.mac)
+	copy(data[96:160], msg.sig)
+	copy(data[160:], msg.cipher)
+
+	return
+}
+
+func (msg *pakeAckMessage) UnmarshalBinary(data []byte) (err error) {
+	if len(data) <= 32+32+32+64 {
+		return fmt.Errorf("sessPakeAck payload MUST be > 160 byte")
+	}
+
+	msg.idKey = make([]byte, 32)
+	msg.share = make([]byte, 32)
+	msg.mac = make([]byte, 32)
+	msg.sig = make([]byte, 64)
+	msg.cipher = make([]byte, len(data)-160)
+
+	copy(msg.idKey, data[:32])
+	copy(msg.share, data[32:64])
+	copy(msg.mac, data[64:96])
+	copy(msg.sig, data[96:160])
+	copy(msg.cipher, data[160:])
+
+	return
+}
+
+// noiseOfferMessage is Alice's sessNoiseOffer message. It consists of the
+// Noise pattern (1 byte) and the first handshake message.
+type noiseOfferMessage struct {
+	pattern   byte
+	handshake []byte
+}
+
+func (msg noiseOfferMessage) MarshalBinary() (data []byte, err error) {
+	data = make([]byte, 1+len(msg.handshake))
+
+	data[0] = msg.pattern
+	copy(data[1:], msg.handshake)
+
+	return
+}
+
+func (msg *noiseOfferMessage) UnmarshalBinary(data []byte) (err error) {
+	if len(data) <= 1 {
+		return fmt.Errorf("sessNoiseOffer payload MUST be > 1 byte")
+	}
+
+	msg.pattern = data[0]
+	msg.handshake = make([]byte, len(data)-1)
+	copy(msg.handshake, data[1:])
+
+	return
+}
+
+// noiseMessage is both the sessNoiseAck and the sessNoiseFinish message. It
+// consists of the handshake message, prefixed by its length (2 bytes, big
+// endian), and an optional Double Ratchet ciphertext.
+type noiseMessage struct {
+	handshake []byte
+	cipher    []byte
+}
+
+func (msg noiseMessage) MarshalBinary() (data []byte, err error) {
+	if len(msg.handshake) >= 1<<16 {
+		return nil, fmt.Errorf("Noise handshake message exceeds maximum length")
+	}
+
+	data = make([]byte, 2+len(msg.handshake)+len(msg.cipher))
+
+	binary.BigEndian.PutUint16(data[:2], uint16(len(msg.handshake)))
+	copy(data[2:2+len(msg.handshake)], msg.handshake)
+	copy(data[2+len(msg.handshake):], msg.cipher)
+
+	return
+}
+
+func (msg *noiseMessage) UnmarshalBinary(data []byte) (err error) {
+	if len(data) < 2 {
+		return fmt.Errorf("Noise message payload MUST be >= 2 byte")
+	}
+
+	l := int(binary.BigEndian.Uint16(data[:2]))
+	if l == 0 || len(data) < 2+l {
+		return fmt.Errorf("Noise message has an invalid handshake length")
+	}
+
+	msg.handshake = make([]byte, l)
+	copy(msg.handshake, data[2:2+l])
+
+	if len(data) > 2+l {
+		msg.cipher = make([]byte, len(data)-2-l)
+		copy(msg.cipher, data[2+l:])
+	}
+
+	return
+}
+
+// groupMessage is the sessGroup message. It consists of the group's identifier,
+// prefixed by its length (2 bytes, big endian), and a Sender Key message.
+type groupMessage struct {
+	groupID []byte
+	data    []byte
+}
+
+func (msg groupMessage) MarshalBinary() (data []byte, err error) {
+	if len(msg.groupID) >= 1<<16 {
+		return nil, fmt.Errorf("group identifier exceeds maximum length")
+	}
+
+	data = make([]byte, 2+len(msg.groupID)+len(msg.data))
+
+	binary.BigEndian.PutUint16(data[:2], uint16(len(msg.groupID)))
+	copy(data[2:2+len(msg.groupID)], msg.groupID)
+	copy(data[2+len(msg.groupID):], msg.data)
+
+	return
+}
+
+func (msg *groupMessage) UnmarshalBinary(data []byte) (err error) {
+	if len(data) < 2 {
+		return fmt.Errorf("sessGroup payload MUST be >= 2 byte")
+	}
+
+	l := int(binary.BigEndian.Uint16(data[:2]))
+	if len(data) <= 2+l {
+		return fmt.Errorf("sessGroup message has an invalid group identifier length")
+	}
+
+	msg.groupID = make([]byte, l)
+	copy(msg.groupID, data[2:2+l])
+
+	msg.data = make([]byte, len(data)-2-l)
+	copy(msg.data, data[2+l:])
+
+	return
+}
+
 // dataMessage is the sessData message for the bidirectional exchange of
 // encrypted ciphertext. Thus, its length is dynamic.
 type dataMessage []byte
@@ -183,15 +811,90 @@ func (msg *dataMessage) UnmarshalBinary(data []byte) (err error) {
 	return
 }
 
-// closeMessage is the bidirectional sessClose message. Its payload ix 0xff.
+// streamMessage is the sessStream message, announcing an encrypted stream. Its
+// payload is a Double Ratchet ciphertext of the stream's key.
+type streamMessage []byte
+
+func (msg streamMessage) MarshalBinary() (data []byte, err error) {
+	return msg, nil
+}
+
+func (msg *streamMessage) UnmarshalBinary(data []byte) (err error) {
+	if len(data) == 0 {
+		return fmt.Errorf("sessStream payload MUST NOT be empty")
+	}
+
+	*msg = data
+	return
+}
+
+// confirmMessage is the sessConfirm message for Alice's key confirmation. It
+// consists of an HMAC over the handshake's transcript (32 byte), her revealed
+// nonce (32 byte) if committed within the offer, and an optional ciphertext of
+// her first message.
+//
+// As the nonce's presence depends on the offer, UnmarshalBinary leaves it
+// within cipher; splitNonce.
+type confirmMessage struct {
+	mac    []byte
+	nonce  []byte
+	cipher []byte
+}
+
+func (msg confirmMessage) MarshalBinary() (data []byte, err error) {
+	data = make([]byte, 32+len(msg.nonce)+len(msg.cipher))
+
+	copy(data[:32], msg.mac)
+	copy(data[32:], msg.nonce)
+	copy(data[32+len(msg.nonce):], msg.cipher)
+
+	return
+}
+
+// splitNonce moves the leading nonce from cipher to nonce.
+func (msg *confirmMessage) splitNonce() (err error) {
+	if len(msg.cipher) < sasNonceSize {
+		return fmt.Errorf("sessConfirm misses its nonce")
+	}
+
+	msg.nonce, msg.cipher = msg.cipher[:sasNonceSize], msg.cipher[sasNonceSize:]
+	if len(msg.cipher) == 0 {
+		msg.cipher = nil
+	}
+	return
+}
+
+func (msg *confirmMessage) UnmarshalBinary(data []byte) (err error) {
+	if len(data) < 32 {
+		return fmt.Errorf("sessConfirm payload MUST be >= 32 byte")
+	}
+
+	msg.mac = make([]byte, 32)
+	copy(msg.mac, data[:32])
+
+	if len(data) > 32 {
+		msg.cipher = make([]byte, len(data)-32)
+		copy(msg.cipher, data[32:])
+	}
+
+	return
+}
+
+// closeMessage is the bidirectional sessClose message. Its payload is either
+// 0xff for an unauthenticated close or a Double Ratchet ciphertext.
 type closeMessage []byte
 
+// isAuthenticated reports whether this closeMessage contains a ciphertext.
+func (msg closeMessage) isAuthenticated() bool {
+	return len(msg) > 1
+}
+
 func (msg closeMessage) MarshalBinary() (data []byte, err error) {
 	return msg, nil
 }
 
 func (msg *closeMessage) UnmarshalBinary(data []byte) (err error) {
-	if subtle.ConstantTimeCompare(data, []byte{0xff}) != 1 {
+	if len(data) == 0 || (len(data) == 1 && subtle.ConstantTimeCompare(data, []byte{0xff}) != 1) {
 		err = fmt.Errorf("sessClose has an inavlid payload")
 	} else {
 		*msg = data
@@ -199,3 +902,50 @@ func (msg *closeMessage) UnmarshalBinary(data []byte) (err error) {
 
 	return
 }
+
+// fragmentMessage is the sessFragment message, holding a part of another
+// encoded message. It starts with a header, followed by this part's data:
+//
+//	message identifier (8 byte) | index (2 byte) | count (2 byte) | data
+//
+// All fragments of the same message share the identifier and the count. Both
+// integers are encoded in network byte order.
+type fragmentMessage struct {
+	id    uint64
+	index uint16
+	count uint16
+	data  []byte
+}
+
+// fragmentHeaderSize is the fragmentMessage's header length.
+const fragmentHeaderSize = 12
+
+func (msg fragmentMessage) MarshalBinary() (data []byte, err error) {
+	data = make([]byte, fragmentHeaderSize+len(msg.data))
+
+	binary.BigEndian.PutUint64(data[:8], msg.id)
+	binary.BigEndian.PutUint16(data[8:10], msg.index)
+	binary.BigEndian.PutUint16(data[10:12], msg.count)
+	copy(data[fragmentHeaderSize:], msg.data)
+
+	return
+}
+
+func (msg *fragmentMessage) UnmarshalBinary(data []byte) (err error) {
+	if len(data) <= fragmentHeaderSize {
+		return fmt.Errorf("sessFragment payload MUST be > %d byte", fragmentHeaderSize)
+	}
+
+	msg.id = binary.BigEndian.Uint64(data[:8])
+	msg.index = binary.BigEndian.Uint16(data[8:10])
+	msg.count = binary.BigEndian.Uint16(data[10:12])
+
+	if msg.index >= msg.count {
+		return fmt.Errorf("sessFragment index %d exceeds count %d", msg.index, msg.count)
+	}
+
+	msg.data = make([]byte, len(data)-fragmentHeaderSize)
+	copy(msg.data, data[fragmentHeaderSize:])
+
+	return
+}
@@ -31,6 +31,39 @@ func TestMessageMarshall(t *testing.T) {
 				cipher: []byte{1, 2, 3, 4, 5, 6, 7},
 			},
 		},
+		{
+			t: sessOffer,
+			m: &offerMessage{
+				idKey: []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 1, 2},
+				spKey: []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 1, 2},
+				spSig: []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 1, 2, 3, 4},
+				ext:   extensions{extKemPub: []byte{1, 2, 3}, extKemSig: []byte{}, 0xff: []byte{4, 5}},
+			},
+		},
+		{
+			t: sessAckExt,
+			m: &ackExtMessage{
+				ackMessage: ackMessage{
+					idKey:  []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 1, 2},
+					eKey:   []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 1, 2},
+					cipher: []byte{1, 2, 3, 4, 5, 6, 7},
+				},
+				ext: extensions{extKemCipher: []byte{1, 2, 3}},
+			},
+		},
+		{
+			t: sessConfirm,
+			m: &confirmMessage{
+				mac: []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 1, 2},
+			},
+		},
+		{
+			t: sessConfirm,
+			m: &confirmMessage{
+				mac:    []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 1, 2},
+				cipher: []byte{1, 2, 3, 4, 5, 6, 7},
+			},
+		},
 		{
 			t: sessData,
 			m: &dataMessage{1, 2, 3, 4, 5, 6, 7},
@@ -39,23 +72,68 @@ func TestMessageMarshall(t *testing.T) {
 			t: sessClose,
 			m: &closeMessage{0xff},
 		},
+		{
+			t: sessClose,
+			m: &closeMessage{1, 2, 3, 4, 5, 6, 7},
+		},
+		{
+			t: sessStream,
+			m: &streamMessage{1, 2, 3, 4, 5, 6, 7},
+		},
+		{
+			t: sessFragment,
+			m: &fragmentMessage{id: 0x2342, index: 1, count: 3, data: []byte{1, 2, 3}},
+		},
 	}
 
-	for _, testcase := range testcases {
-		txt, err := marshalMessage(testcase.t, testcase.m)
-		if err != nil {
-			t.Fatal(err)
+	for v := ProtocolLegacy; v <= protocolLatest; v++ {
+		for _, testcase := range testcases {
+			txt, err := marshalVersionedMessage(v, testcase.t, testcase.m)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ver, ty, m, err := unmarshalVersionedMessage(txt)
+			if err != nil {
+				t.Fatal(err)
+			} else if ver != v {
+				t.Errorf("unexpected version, %d %d", ver, v)
+			} else if ty != testcase.t {
+				t.Errorf("unexpected type, %d %d", ty, testcase.t)
+			} else if !reflect.DeepEqual(m, testcase.m) {
+				t.Errorf("messages differ, %#v %#v", m, testcase.m)
+			}
 		}
+	}
+}
+
+func TestMessageFraming(t *testing.T) {
+	testcases := []struct {
+		v   ProtocolVersion
+		t   messageType
+		out string
+	}{
+		{ProtocolLegacy, sessData, Prefix + "3AQID" + Suffix},
+		{Protocol1, sessData, Prefix + "v1.3.AQID" + Suffix},
+		{Protocol1, messageType(42), Prefix + "v1.42.AQID" + Suffix},
+	}
 
-		ty, m, err := unmarshalMessage(txt)
+	for _, testcase := range testcases {
+		out, err := marshalVersionedMessage(testcase.v, testcase.t, dataMessage{1, 2, 3})
 		if err != nil {
 			t.Fatal(err)
-		} else if ty != testcase.t {
-			t.Errorf("unexpected type, %d %d", ty, testcase.t)
-		} else if !reflect.DeepEqual(m, testcase.m) {
-			t.Errorf("messages differ, %#v %#v", m, testcase.m)
+		} else if out != testcase.out {
+			t.Errorf("framing differs, %s %s", out, testcase.out)
 		}
 	}
+
+	// Types above nine are not expressible in the legacy format.
+	if _, err := marshalVersionedMessage(ProtocolLegacy, messageType(10), dataMessage{1}); err == nil {
+		t.Error("legacy format with type 10 did not error")
+	}
+	if _, err := marshalVersionedMessage(protocolLatest+1, sessData, dataMessage{1}); err == nil {
+		t.Error("unsupported version did not error")
+	}
 }
 
 func TestMessageUnmarshalInvalid(t *testing.T) {
@@ -69,8 +147,24 @@ func TestMessageUnmarshalInvalid(t *testing.T) {
 		Prefix + "2" + Suffix,
 		Prefix + "4" + Suffix,
 		Prefix + "5" + Suffix,
+		Prefix + "6" + Suffix,
+		Prefix + "7" + Suffix,
+		Prefix + "8" + Suffix,
+		Prefix + "7AAAAAAAAAAAAAAAAAQ==" + Suffix,
 		Prefix + "42" + Suffix,
+		Prefix + "4AA==" + Suffix,
 		Prefix + "3💩💩💩" + Suffix,
+		Prefix + "v" + Suffix,
+		Prefix + "v1" + Suffix,
+		Prefix + "v1.3" + Suffix,
+		Prefix + "v1.3AQID" + Suffix,
+		Prefix + "v0.3.AQID" + Suffix,
+		Prefix + "v2.3.AQID" + Suffix,
+		Prefix + "v256.3.AQID" + Suffix,
+		Prefix + "v-1.3.AQID" + Suffix,
+		Prefix + "v1.x.AQID" + Suffix,
+		Prefix + "v1.42.AQID" + Suffix,
+		Prefix + "v1.3.💩" + Suffix,
 	}
 
 	for _, input := range inputs {
@@ -80,3 +174,44 @@ func TestMessageUnmarshalInvalid(t *testing.T) {
 		}
 	}
 }
+
+func TestExtensionsUnmarshalInvalid(t *testing.T) {
+	inputs := [][]byte{
+		// truncated header
+		{0x01},
+		{0x01, 0x00},
+		// truncated value
+		{0x01, 0x00, 0x02, 0xff},
+		// duplicated extension
+		{0x01, 0x00, 0x01, 0xff, 0x01, 0x00, 0x01, 0xff},
+	}
+
+	for _, input := range inputs {
+		var ext extensions
+		if err := ext.UnmarshalBinary(input); err == nil {
+			t.Errorf("%x did not error", input)
+		}
+	}
+}
+
+func TestAckExtUnmarshalInvalid(t *testing.T) {
+	keys := make([]byte, 64)
+
+	inputs := [][]byte{
+		// too short
+		keys,
+		// extensions' length exceeds payload
+		append(append([]byte{}, keys...), 0x00, 0x04, 0x01, 0x00, 0x00),
+		// no ciphertext
+		append(append([]byte{}, keys...), 0x00, 0x04, 0x01, 0x00, 0x01, 0xff),
+		// invalid extensions
+		append(append([]byte{}, keys...), 0x00, 0x02, 0x01, 0x00, 0xff),
+	}
+
+	for _, input := range inputs {
+		var msg ackExtMessage
+		if err := msg.UnmarshalBinary(input); err == nil {
+			t.Errorf("%x did not error", input)
+		}
+	}
+}
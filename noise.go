@@ -0,0 +1,445 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This file implements the Noise handshakes as an alternative to X3DH.
+//
+// For always-online peers, an interactive Noise handshake might be used
+// instead of X3DH; Session.Handshake. Both parties' Ed25519 identity keys are
+// converted to X25519 static keys. As the conversion is not reversible, each
+// static key is accompanied by its Ed25519 identity key within the handshake
+// payload, being checked against each other.
+//
+// The Noise handshake messages are embedded into the following messages:
+//
+//	PatternXX:                            PatternIK:
+//	  Alice → Bob: sessNoiseOffer  (e)      Alice → Bob: sessNoiseOffer (e, es, s, ss)
+//	  Bob → Alice: sessNoiseAck    (e, …)   Bob → Alice: sessNoiseAck   (e, ee, se)
+//	  Alice → Bob: sessNoiseFinish (s, se)
+//
+// The Double Ratchet's root key is exported from the finished handshake and
+// its associated data is the handshake hash. The party sending the last
+// handshake message becomes the Double Ratchet's active party, using the other
+// party's ephemeral key as the initial ratchet key. Thus, the other party's
+// ephemeral key pair becomes the passive party's initial ratchet key pair.
+
+package xochimilco
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/oxzi/xochimilco/doubleratchet"
+	"github.com/oxzi/xochimilco/noise"
+	"github.com/oxzi/xochimilco/x3dh"
+)
+
+// Handshake selects the key agreement protocol of an Offer.
+type Handshake byte
+
+const (
+	// HandshakeX3dh is the default X3DH based handshake, allowing an offline
+	// passive party by its signed prekey.
+	HandshakeX3dh Handshake = iota
+
+	// HandshakeNoiseXX is Noise's XX handshake, requiring three messages.
+	HandshakeNoiseXX
+
+	// HandshakeNoiseIK is Noise's IK handshake, requiring the other party's
+	// identity key in advance; Session.NoisePeerKey.
+	HandshakeNoiseIK
+)
+
+func (handshake Handshake) String() string {
+	switch handshake {
+	case HandshakeX3dh:
+		return "X3DH"
+	case HandshakeNoiseXX:
+		return "Noise_XX"
+	case HandshakeNoiseIK:
+		return "Noise_IK"
+	default:
+		return fmt.Sprintf("unknown handshake %d", byte(handshake))
+	}
+}
+
+const (
+	// noiseProtocol is the ProtocolVersion of all Noise handshakes, as their
+	// message types cannot be encoded in the legacy format.
+	noiseProtocol = Protocol1
+
+	// noisePrologue is the Noise prologue, binding the handshake to this
+	// protocol.
+	noisePrologue = "Xochimilco Noise"
+
+	// noiseRootKeyLabel is the label to export the Double Ratchet's root key.
+	noiseRootKeyLabel = "Xochimilco Double Ratchet"
+)
+
+// noisePattern maps a Handshake to its Noise Pattern.
+func noisePattern(handshake Handshake) (pattern noise.Pattern, err error) {
+	switch handshake {
+	case HandshakeNoiseXX:
+		pattern = noise.PatternXX
+	case HandshakeNoiseIK:
+		pattern = noise.PatternIK
+	default:
+		err = fmt.Errorf("%v is not a Noise handshake", handshake)
+	}
+	return
+}
+
+// noisePeerIdKey checks the other party's Ed25519 identity key from a
+// handshake payload against its X25519 static key.
+func noisePeerIdKey(hs *noise.HandshakeState, payload []byte) (idKey ed25519.PublicKey, err error) {
+	if len(payload) != ed25519.PublicKeySize {
+		err = fmt.Errorf("Noise payload MUST be an identity key of %d bytes", ed25519.PublicKeySize)
+		return
+	}
+
+	staticKey, err := x3dh.PublicIdentityKeyToX25519(payload)
+	if err != nil {
+		return
+	} else if string(staticKey) != string(hs.PeerStaticKey()) {
+		err = fmt.Errorf("identity key does not match the Noise static key")
+		return
+	}
+
+	idKey = append(ed25519.PublicKey{}, payload...)
+	return
+}
+
+// noiseRatchet creates the Double Ratchet from a finished Noise handshake. The
+// active party has sent the last handshake message.
+func (sess *Session) noiseRatchet(hs *noise.HandshakeState, active bool) (err error) {
+	sessKey, err := hs.ExportKey(noiseRootKeyLabel)
+	if err != nil {
+		return
+	}
+	associatedData := hs.HandshakeHash()
+
+	if active {
+		sess.doubleRatchet, err = doubleratchet.CreateActive(sessKey, associatedData, hs.PeerEphemeralKey())
+	} else {
+		dhPub, dhPriv := hs.EphemeralKey()
+		sess.doubleRatchet, err = doubleratchet.CreatePassive(sessKey, associatedData, dhPub, dhPriv)
+	}
+	if err != nil {
+		return
+	}
+
+	// The transcript is only set for a committed PatternXX handshake.
+	sess.protocol = noiseProtocol
+	sess.transcript, sess.sas = nil, nil
+	return
+}
+
+// offerNoise creates the sessNoiseOffer for Offer.
+func (sess *Session) offerNoise() (offerMsg string, err error) {
+	pattern, err := noisePattern(sess.Handshake)
+	if err != nil {
+		return
+	}
+
+	config := noise.Config{
+		Pattern:   pattern,
+		Initiator: true,
+		Prologue:  []byte(noisePrologue),
+		StaticKey: x3dh.IdentityKeyToX25519(sess.IdentityKey),
+	}
+
+	// For IK, Alice's static key is already part of her first message. For
+	// XX, she commits to her nonce for the ShortAuthString, being revealed
+	// within her final message.
+	var payload, sasNonce []byte
+	if pattern == noise.PatternIK {
+		if config.PeerStaticKey, err = x3dh.PublicIdentityKeyToX25519(sess.NoisePeerKey); err != nil {
+			err = fmt.Errorf("invalid NoisePeerKey: %v", err)
+			return
+		}
+		payload = sess.IdentityKey.Public().(ed25519.PublicKey)
+	} else {
+		if sasNonce, err = newSasNonce(); err != nil {
+			return
+		}
+		payload = sasCommitment(sasNonce)
+	}
+
+	hs, err := noise.NewHandshakeState(config)
+	if err != nil {
+		return
+	}
+
+	handshakeMsg, err := hs.WriteMessage(payload)
+	if err != nil {
+		return
+	}
+
+	sess.spkPub, sess.spkPriv = nil, nil
+	sess.kemPriv = nil
+	sess.pake = nil
+	sess.offerData, sess.earlyData = nil, false
+	sess.sasNonce, sess.sasCommit = sasNonce, nil
+	sess.noiseHs, sess.noiseFinish = hs, nil
+	sess.protocol = noiseProtocol
+
+	offer := noiseOfferMessage{pattern: byte(pattern), handshake: handshakeMsg}
+	offerMsg, err = marshalEncodedMessage(sess.Encoding, noiseProtocol, sessNoiseOffer, offer)
+	return
+}
+
+// acknowledgeNoise answers a sessNoiseOffer for AcknowledgeContext.
+func (sess *Session) acknowledgeNoise(
+	ctx context.Context, offer *noiseOfferMessage, version ProtocolVersion, payload []byte,
+) (ackMsg string, err error) {
+	if version != noiseProtocol {
+		err = fmt.Errorf("received protocol version %d instead of %d", version, noiseProtocol)
+		return
+	} else if payload != nil {
+		err = fmt.Errorf("early data is not supported by Noise handshakes")
+		return
+	}
+
+	hs, err := noise.NewHandshakeState(noise.Config{
+		Pattern:   noise.Pattern(offer.pattern),
+		Initiator: false,
+		Prologue:  []byte(noisePrologue),
+		StaticKey: x3dh.IdentityKeyToX25519(sess.IdentityKey),
+	})
+	if err != nil {
+		return
+	}
+
+	offerPayload, err := hs.ReadMessage(offer.handshake)
+	if err != nil {
+		return
+	}
+
+	var ack noiseMessage
+	sess.sasNonce, sess.sasCommit = nil, nil
+	if hs.Pattern() == noise.PatternIK {
+		var peerIdKey ed25519.PublicKey
+		if peerIdKey, err = noisePeerIdKey(hs, offerPayload); err != nil {
+			return
+		}
+		if err = sess.verifyPeer(ctx, StepOffer, peerIdKey); err != nil {
+			return
+		}
+
+		if ack.handshake, err = hs.WriteMessage(nil); err != nil {
+			return
+		}
+		if err = sess.noiseRatchet(hs, true); err != nil {
+			return
+		}
+
+		// As for X3DH, a nonsense ciphertext allows Alice to start sending.
+		initialPayload := make([]byte, 23)
+		if _, err = rand.Read(initialPayload); err != nil {
+			return
+		}
+		if ack.cipher, err = sess.doubleRatchet.Encrypt(initialPayload); err != nil {
+			return
+		}
+
+		// The offer might be replayed, until Alice sends her first message.
+		sess.noiseHs = nil
+		sess.peerConfirmed = false
+
+		if err = sess.establishedPeer(ctx, StepOffer); err != nil {
+			return
+		}
+	} else {
+		// An offer without a commitment has no ShortAuthString.
+		switch len(offerPayload) {
+		case 0:
+		case sha256.Size:
+			sess.sasCommit = offerPayload
+		default:
+			err = fmt.Errorf("Noise offer has an invalid nonce commitment")
+			return
+		}
+
+		if ack.handshake, err = hs.WriteMessage(sess.IdentityKey.Public().(ed25519.PublicKey)); err != nil {
+			return
+		}
+
+		// The Session is established by Alice's sessNoiseFinish.
+		sess.doubleRatchet = nil
+		sess.noiseHs = hs
+		sess.protocol = noiseProtocol
+	}
+
+	sess.confirmMacRecv = nil
+	ackMsg, err = marshalEncodedMessage(sess.Encoding, noiseProtocol, sessNoiseAck, ack)
+	return
+}
+
+// receiveNoiseAck deals with incoming sessNoiseAck messages.
+//
+// The active / opening party receives the other party's answer to its Noise
+// offer. For PatternXX, the final handshake message is sent with Alice's next
+// message; Confirm. The pending handshake is consumed, even on errors.
+func (sess *Session) receiveNoiseAck(
+	ctx context.Context, ack *noiseMessage, version ProtocolVersion,
+) (isEstablished bool, err error) {
+	if sess.doubleRatchet != nil {
+		err = fmt.Errorf("received sessNoiseAck while being in an active session")
+		return
+	} else if sess.noiseHs == nil || !sess.noiseHs.Initiator() {
+		err = fmt.Errorf("received sessNoiseAck without a pending Noise offer")
+		return
+	} else if version != noiseProtocol {
+		err = fmt.Errorf("received protocol version %d instead of %d", version, noiseProtocol)
+		return
+	}
+
+	hs := sess.noiseHs
+	sess.noiseHs = nil
+
+	ackPayload, err := hs.ReadMessage(ack.handshake)
+	if err != nil {
+		return
+	}
+
+	peerIdKey := sess.NoisePeerKey
+	if hs.Pattern() == noise.PatternXX {
+		if peerIdKey, err = noisePeerIdKey(hs, ackPayload); err != nil {
+			return
+		}
+	}
+	if err = sess.verifyPeer(ctx, StepAck, peerIdKey); err != nil {
+		return
+	}
+
+	if hs.Pattern() == noise.PatternIK {
+		if len(ack.cipher) == 0 {
+			err = fmt.Errorf("sessNoiseAck misses its ciphertext")
+			return
+		}
+		if err = sess.noiseRatchet(hs, false); err != nil {
+			return
+		}
+		if _, err = sess.doubleRatchet.Decrypt(ack.cipher); err != nil {
+			return
+		}
+	} else {
+		// The final message reveals the nonce, completing the transcript.
+		finishPayload := append(ed25519.PublicKey{}, sess.IdentityKey.Public().(ed25519.PublicKey)...)
+		finishPayload = append(finishPayload, sess.sasNonce...)
+
+		var finishMsg []byte
+		if finishMsg, err = hs.WriteMessage(finishPayload); err != nil {
+			return
+		}
+		if err = sess.noiseRatchet(hs, true); err != nil {
+			return
+		}
+		sess.noiseFinish = finishMsg
+
+		if sess.sasNonce != nil {
+			sess.transcript = append(hs.HandshakeHash(), sess.sasNonce...)
+		}
+	}
+	sess.sasNonce = nil
+
+	if err = sess.establishedPeer(ctx, StepAck); err != nil {
+		return
+	}
+
+	sess.peerConfirmed = true
+	isEstablished = true
+	return
+}
+
+// receiveNoiseFinish deals with incoming sessNoiseFinish messages.
+//
+// The passive party receives the final message of a PatternXX handshake and
+// establishes this Session. The included message's plaintext is returned.
+func (sess *Session) receiveNoiseFinish(
+	ctx context.Context, finish *noiseMessage, version ProtocolVersion,
+) (isEstablished bool, plaintext []byte, err error) {
+	if sess.doubleRatchet != nil {
+		err = fmt.Errorf("received sessNoiseFinish while being in an active session")
+		return
+	} else if sess.noiseHs == nil || sess.noiseHs.Initiator() {
+		err = fmt.Errorf("received sessNoiseFinish without a pending Noise handshake")
+		return
+	} else if version != noiseProtocol {
+		err = fmt.Errorf("received protocol version %d instead of %d", version, noiseProtocol)
+		return
+	} else if len(finish.cipher) == 0 {
+		err = fmt.Errorf("sessNoiseFinish misses its ciphertext")
+		return
+	}
+
+	hs := sess.noiseHs
+	sess.noiseHs = nil
+
+	finishPayload, err := hs.ReadMessage(finish.handshake)
+	if err != nil {
+		return
+	}
+
+	// A committed nonce follows the identity key.
+	var sasNonce []byte
+	if sess.sasCommit != nil {
+		if len(finishPayload) != ed25519.PublicKeySize+sasNonceSize {
+			err = fmt.Errorf("sessNoiseFinish misses its nonce")
+			return
+		}
+		finishPayload, sasNonce = finishPayload[:ed25519.PublicKeySize], finishPayload[ed25519.PublicKeySize:]
+	}
+
+	peerIdKey, err := noisePeerIdKey(hs, finishPayload)
+	if err != nil {
+		return
+	}
+	if err = sess.verifyPeer(ctx, StepOffer, peerIdKey); err != nil {
+		return
+	}
+
+	if err = sess.noiseRatchet(hs, false); err != nil {
+		return
+	}
+	if plaintext, err = sess.doubleRatchet.Decrypt(finish.cipher); err != nil {
+		return
+	}
+
+	if sasNonce != nil {
+		sess.transcript = hs.HandshakeHash()
+		if err = sess.revealSasNonce(sasNonce); err != nil {
+			plaintext = nil
+			return
+		}
+	}
+
+	if err = sess.establishedPeer(ctx, StepOffer); err != nil {
+		plaintext = nil
+		return
+	}
+
+	sess.peerConfirmed = true
+	isEstablished = true
+	return
+}
+
+// finishNoise creates the pending sessNoiseFinish, including a plaintext.
+func (sess *Session) finishNoise(plaintext []byte) (finishMsg string, err error) {
+	ciphertext, err := sess.doubleRatchet.Encrypt(plaintext)
+	if err != nil {
+		return
+	}
+
+	finish := noiseMessage{handshake: sess.noiseFinish, cipher: ciphertext}
+	finishMsg, err = marshalEncodedMessage(sess.Encoding, sess.protocol, sessNoiseFinish, finish)
+	if err != nil {
+		return
+	}
+
+	sess.noiseFinish = nil
+	return
+}
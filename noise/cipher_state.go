@@ -0,0 +1,85 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package noise
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// CipherState encrypts and decrypts messages by a key and a nonce counter.
+//
+// During the handshake, it is part of the HandshakeState. Afterwards, Split
+// returns one CipherState for each direction of the transport messages.
+type CipherState struct {
+	k      []byte
+	n      uint64
+	hasKey bool
+}
+
+// initializeKey sets a new key and resets the nonce.
+func (cs *CipherState) initializeKey(k []byte) {
+	cs.k = append([]byte{}, k...)
+	cs.n = 0
+	cs.hasKey = true
+}
+
+// nonce encodes the counter as 32 zero bits followed by the little-endian
+// counter, as specified for ChaChaPoly.
+func (cs *CipherState) nonce() []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], cs.n)
+	return nonce
+}
+
+// Encrypt a plaintext with associated data. Without a key, the plaintext is
+// returned unchanged.
+//
+// The Noise specification names this function EncryptWithAd.
+func (cs *CipherState) Encrypt(ad, plaintext []byte) (ciphertext []byte, err error) {
+	if !cs.hasKey {
+		return append([]byte{}, plaintext...), nil
+	} else if cs.n == math.MaxUint64 {
+		return nil, fmt.Errorf("nonce is exhausted")
+	}
+
+	aead, err := chacha20poly1305.New(cs.k)
+	if err != nil {
+		return
+	}
+
+	ciphertext = aead.Seal(nil, cs.nonce(), plaintext, ad)
+	cs.n++
+	return
+}
+
+// Decrypt a ciphertext with associated data. Without a key, the ciphertext is
+// returned unchanged. The nonce is only incremented after a successful
+// decryption.
+//
+// The Noise specification names this function DecryptWithAd.
+func (cs *CipherState) Decrypt(ad, ciphertext []byte) (plaintext []byte, err error) {
+	if !cs.hasKey {
+		return append([]byte{}, ciphertext...), nil
+	} else if cs.n == math.MaxUint64 {
+		return nil, fmt.Errorf("nonce is exhausted")
+	}
+
+	aead, err := chacha20poly1305.New(cs.k)
+	if err != nil {
+		return
+	}
+
+	plaintext, err = aead.Open(nil, cs.nonce(), ciphertext, ad)
+	if err != nil {
+		return nil, fmt.Errorf("decryption failed: %v", err)
+	}
+
+	cs.n++
+	return
+}
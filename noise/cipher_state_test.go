@@ -0,0 +1,55 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package noise
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestCipherState(t *testing.T) {
+	var sender, receiver CipherState
+
+	// Without a key, data is passed through.
+	if out, err := sender.Encrypt(nil, []byte("foo")); err != nil || string(out) != "foo" {
+		t.Fatalf("unexpected output, %q %v", out, err)
+	}
+
+	key := bytes.Repeat([]byte{0x23}, 32)
+	sender.initializeKey(key)
+	receiver.initializeKey(key)
+
+	ciphertexts := make([][]byte, 3)
+	for i := range ciphertexts {
+		var err error
+		if ciphertexts[i], err = sender.Encrypt([]byte("ad"), []byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bytes.Equal(ciphertexts[0], ciphertexts[1]) {
+		t.Fatal("nonce was not incremented")
+	}
+
+	// Out of order or with other associated data, decryption fails.
+	if _, err := receiver.Decrypt([]byte("ad"), ciphertexts[1]); err == nil {
+		t.Fatal("out of order message was decrypted")
+	} else if _, err := receiver.Decrypt([]byte("xx"), ciphertexts[0]); err == nil {
+		t.Fatal("message with other associated data was decrypted")
+	}
+
+	for i := range ciphertexts {
+		if plaintext, err := receiver.Decrypt([]byte("ad"), ciphertexts[i]); err != nil {
+			t.Fatal(err)
+		} else if string(plaintext) != "foo" {
+			t.Fatalf("plaintext differs, %q", plaintext)
+		}
+	}
+
+	sender.n = math.MaxUint64
+	if _, err := sender.Encrypt(nil, nil); err == nil {
+		t.Fatal("exhausted nonce did not error")
+	}
+}
@@ -0,0 +1,302 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package noise
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Config of a HandshakeState.
+type Config struct {
+	// Pattern of the handshake, either PatternXX or PatternIK.
+	Pattern Pattern
+
+	// Initiator is set for the party sending the first handshake message.
+	Initiator bool
+
+	// Prologue is arbitrary data, which both parties MUST agree on.
+	Prologue []byte
+
+	// StaticKey is this party's private X25519 static key.
+	StaticKey []byte
+
+	// PeerStaticKey is the responder's public X25519 static key, required by
+	// the initiator of PatternIK.
+	PeerStaticKey []byte
+
+	// Random is the source for the ephemeral key, crypto/rand if unset.
+	Random io.Reader
+}
+
+// HandshakeState performs a Noise handshake.
+//
+// Both parties alternately call WriteMessage and ReadMessage, starting with
+// the initiator's WriteMessage, until Finished reports true.
+type HandshakeState struct {
+	ss symmetricState
+
+	s, sPub   []byte
+	e, ePub   []byte
+	rs, re    []byte
+	pattern   Pattern
+	initiator bool
+	random    io.Reader
+
+	messages [][]token
+	index    int
+}
+
+// NewHandshakeState initializes a HandshakeState for a Config.
+func NewHandshakeState(c Config) (hs *HandshakeState, err error) {
+	spec, err := c.Pattern.spec()
+	if err != nil {
+		return
+	}
+
+	if len(c.StaticKey) != DHLen {
+		err = fmt.Errorf("static key MUST be of %d bytes", DHLen)
+		return
+	}
+
+	hs = &HandshakeState{
+		s:         append([]byte{}, c.StaticKey...),
+		pattern:   c.Pattern,
+		initiator: c.Initiator,
+		random:    c.Random,
+		messages:  spec.messages,
+	}
+
+	hs.sPub, err = curve25519.X25519(hs.s, curve25519.Basepoint)
+	if err != nil {
+		return
+	}
+
+	hs.ss.initializeSymmetric(c.Pattern.protocolName())
+	hs.ss.mixHash(c.Prologue)
+
+	if spec.responderPreMessage {
+		if c.Initiator {
+			if len(c.PeerStaticKey) != DHLen {
+				err = fmt.Errorf("pattern %v requires the peer's static key", c.Pattern)
+				return
+			}
+			hs.rs = append([]byte{}, c.PeerStaticKey...)
+			hs.ss.mixHash(hs.rs)
+		} else {
+			hs.ss.mixHash(hs.sPub)
+		}
+	}
+
+	return
+}
+
+// isOurTurn reports whether the next handshake message is to be written.
+func (hs *HandshakeState) isOurTurn() bool {
+	return (hs.index%2 == 0) == hs.initiator
+}
+
+// dhToken calculates the DH output for one of the tokens ee, es, se, or ss.
+func (hs *HandshakeState) dhToken(t token) (sharedSec []byte, err error) {
+	// The first letter is the initiator's key, the second the responder's.
+	var local, remote []byte
+	switch {
+	case t == tokenEE:
+		local, remote = hs.e, hs.re
+	case t == tokenSS:
+		local, remote = hs.s, hs.rs
+	case (t == tokenES) == hs.initiator:
+		local, remote = hs.e, hs.rs
+	default:
+		local, remote = hs.s, hs.re
+	}
+
+	if local == nil || remote == nil {
+		err = fmt.Errorf("key for a DH token is missing")
+		return
+	}
+	return dh(local, remote)
+}
+
+// WriteMessage creates the next handshake message, including a payload.
+func (hs *HandshakeState) WriteMessage(payload []byte) (msg []byte, err error) {
+	if hs.Finished() {
+		err = fmt.Errorf("handshake is already finished")
+		return
+	} else if !hs.isOurTurn() {
+		err = fmt.Errorf("handshake awaits a message")
+		return
+	}
+
+	for _, t := range hs.messages[hs.index] {
+		switch t {
+		case tokenE:
+			hs.ePub, hs.e, err = GenerateKeypair(hs.random)
+			if err != nil {
+				return
+			}
+			msg = append(msg, hs.ePub...)
+			hs.ss.mixHash(hs.ePub)
+
+		case tokenS:
+			var ciphertext []byte
+			if ciphertext, err = hs.ss.encryptAndHash(hs.sPub); err != nil {
+				return
+			}
+			msg = append(msg, ciphertext...)
+
+		default:
+			var sharedSec []byte
+			if sharedSec, err = hs.dhToken(t); err != nil {
+				return
+			}
+			if err = hs.ss.mixKey(sharedSec); err != nil {
+				return
+			}
+		}
+	}
+
+	ciphertext, err := hs.ss.encryptAndHash(payload)
+	if err != nil {
+		return
+	}
+	msg = append(msg, ciphertext...)
+
+	hs.index++
+	return
+}
+
+// ReadMessage processes the other party's next handshake message, returning
+// its payload.
+func (hs *HandshakeState) ReadMessage(msg []byte) (payload []byte, err error) {
+	if hs.Finished() {
+		err = fmt.Errorf("handshake is already finished")
+		return
+	} else if hs.isOurTurn() {
+		err = fmt.Errorf("handshake awaits writing a message")
+		return
+	}
+
+	for _, t := range hs.messages[hs.index] {
+		switch t {
+		case tokenE:
+			if len(msg) < DHLen {
+				err = fmt.Errorf("handshake message is truncated")
+				return
+			}
+			hs.re = append([]byte{}, msg[:DHLen]...)
+			msg = msg[DHLen:]
+			hs.ss.mixHash(hs.re)
+
+		case tokenS:
+			l := DHLen
+			if hs.ss.cs.hasKey {
+				l += tagLen
+			}
+			if len(msg) < l {
+				err = fmt.Errorf("handshake message is truncated")
+				return
+			}
+			if hs.rs, err = hs.ss.decryptAndHash(msg[:l]); err != nil {
+				return
+			}
+			msg = msg[l:]
+
+		default:
+			var sharedSec []byte
+			if sharedSec, err = hs.dhToken(t); err != nil {
+				return
+			}
+			if err = hs.ss.mixKey(sharedSec); err != nil {
+				return
+			}
+		}
+	}
+
+	if payload, err = hs.ss.decryptAndHash(msg); err != nil {
+		return
+	}
+
+	hs.index++
+	return
+}
+
+// Pattern of this handshake.
+func (hs *HandshakeState) Pattern() Pattern {
+	return hs.pattern
+}
+
+// Initiator reports whether this party has sent the first handshake message.
+func (hs *HandshakeState) Initiator() bool {
+	return hs.initiator
+}
+
+// Finished reports whether all handshake messages were processed.
+func (hs *HandshakeState) Finished() bool {
+	return hs.index >= len(hs.messages)
+}
+
+// PeerStaticKey returns the other party's public static key, if known yet.
+func (hs *HandshakeState) PeerStaticKey() []byte {
+	return hs.rs
+}
+
+// EphemeralKey returns this party's ephemeral key pair, if created yet.
+func (hs *HandshakeState) EphemeralKey() (pub, priv []byte) {
+	return hs.ePub, hs.e
+}
+
+// PeerEphemeralKey returns the other party's public ephemeral key, if known
+// yet.
+func (hs *HandshakeState) PeerEphemeralKey() []byte {
+	return hs.re
+}
+
+// HandshakeHash returns the handshake hash, which uniquely identifies a
+// finished handshake, e.g., as a channel binding.
+func (hs *HandshakeState) HandshakeHash() []byte {
+	return append([]byte{}, hs.ss.h...)
+}
+
+// Split a finished handshake into two CipherStates for the transport
+// messages, the first one for sending and the second one for receiving.
+func (hs *HandshakeState) Split() (send, recv *CipherState, err error) {
+	if !hs.Finished() {
+		err = fmt.Errorf("handshake is not finished")
+		return
+	}
+
+	c1, c2, err := hs.ss.split()
+	if err != nil {
+		return
+	}
+
+	if hs.initiator {
+		send, recv = c1, c2
+	} else {
+		send, recv = c2, c1
+	}
+	return
+}
+
+// ExportKey derives a 32 byte key from a finished handshake for another
+// protocol, e.g., the root key of a Double Ratchet.
+//
+// The key is derived from the final chaining key by a SHA-256 HKDF with the
+// label as its info. Thus, it is independent from Split's keys.
+func (hs *HandshakeState) ExportKey(label string) (key []byte, err error) {
+	if !hs.Finished() {
+		err = fmt.Errorf("handshake is not finished")
+		return
+	}
+
+	key = make([]byte, 32)
+	_, err = io.ReadFull(hkdf.New(sha256.New, hs.ss.ck, hs.ss.h, []byte(label)), key)
+	return
+}
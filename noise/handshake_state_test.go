@@ -0,0 +1,311 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package noise
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// testVector is a Noise test vector in the format of the Cacophony project.
+// Handshake messages alternate between initiator and responder. Afterwards,
+// transport messages alternate again, starting with the initiator.
+type testVector struct {
+	pattern         Pattern
+	initStatic      string
+	respStatic      string
+	initEphemeral   string
+	respEphemeral   string
+	prologue        string
+	msgPayloads     []string
+	msgCiphertextes []string
+}
+
+// testVectors are taken from the vectors.txt of github.com/flynn/noise.
+var testVectors = []testVector{
+	{
+		pattern:       PatternXX,
+		initStatic:    "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+		respStatic:    "0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20",
+		initEphemeral: "202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f",
+		respEphemeral: "4142434445464748494a4b4c4d4e4f505152535455565758595a5b5c5d5e5f60",
+		msgPayloads:   []string{"", "", "", "79656c6c6f777375626d6172696e65", "7375626d6172696e6579656c6c6f77"},
+		msgCiphertextes: []string{
+			"358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd166254",
+			"64b101b1d0be5a8704bd078f9895001fc03e8e9f9522f188dd128d9846d484663414af878d3e46a2f58911a816d6e8346d4ea17a6f2a0bb4ef4ed56c133cff4560a34e36ea82109f26cf2e5a5caf992b608d55c747f615e5a3425a7a19eefb8f",
+			"87f864c11ba449f46a0a4f4e2eacbb7b0457784f4fca1937f572c93603e9c4d97e5ea11b16f3968710b23a3be3202dc1b5e1ce3c963347491e74f5c0768a9b42",
+			"a52ef02ba60e12696d1d6b9ef4245c88fca757b6134ad6e76b56e310a6adf6",
+			"2445aa438ebd649281c636cc7269ca82f1d9023d72520943aeabf909cdf521",
+		},
+	},
+	{
+		pattern:       PatternXX,
+		initStatic:    "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+		respStatic:    "0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20",
+		initEphemeral: "202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f",
+		respEphemeral: "4142434445464748494a4b4c4d4e4f505152535455565758595a5b5c5d5e5f60",
+		prologue:      "6e6f74736563726574",
+		msgPayloads: []string{
+			"746573745f6d73675f30", "746573745f6d73675f31", "746573745f6d73675f32",
+			"79656c6c6f777375626d6172696e65", "7375626d6172696e6579656c6c6f77",
+		},
+		msgCiphertextes: []string{
+			"358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd166254746573745f6d73675f30",
+			"64b101b1d0be5a8704bd078f9895001fc03e8e9f9522f188dd128d9846d484663414af878d3e46a2f58911a816d6e8346d4ea17a6f2a0bb4ef4ed56c133cff4545958c588d17d6373e0c1dcfa3755d37f50cbca216483ac56bcc98f5095870aa814ba40c08079c11f087",
+			"87f864c11ba449f46a0a4f4e2eacbb7b0457784f4fca1937f572c93603e9c4d9c1e9a1a313d02b78871cfd178a521a4c7c7377a2f4f9144b2f0ccedc84d379151b466741e4b266db6023",
+			"a52ef02ba60e12696d1d6b9ef4245c88fca757b6134ad6e76b56e310a6adf6",
+			"2445aa438ebd649281c636cc7269ca82f1d9023d72520943aeabf909cdf521",
+		},
+	},
+	{
+		pattern:       PatternIK,
+		initStatic:    "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+		respStatic:    "0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20",
+		initEphemeral: "202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f",
+		respEphemeral: "4142434445464748494a4b4c4d4e4f505152535455565758595a5b5c5d5e5f60",
+		msgPayloads:   []string{"", "", "79656c6c6f777375626d6172696e65", "7375626d6172696e6579656c6c6f77"},
+		msgCiphertextes: []string{
+			"358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd1662544f8445e5dc2467b1e32653192d05dee85c4781bf0dd8d33ceebb5905a7a069f09e0d3f2cad1c842930a762eb75e52827f01d2c85189d527644b3221b4c3fc5cc",
+			"64b101b1d0be5a8704bd078f9895001fc03e8e9f9522f188dd128d9846d48466aabfe2e5b1650bbaa88e33679893fc77",
+			"226ca869f2777611f37350a7ab446f650c0cfe2855b7f020ce658bcf100f2d",
+			"90d84d69cd44829283b05d684879b53b8d714e51619b601438a1ae67caacd9",
+		},
+	},
+	{
+		pattern:       PatternIK,
+		initStatic:    "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+		respStatic:    "0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20",
+		initEphemeral: "202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f",
+		respEphemeral: "4142434445464748494a4b4c4d4e4f505152535455565758595a5b5c5d5e5f60",
+		prologue:      "6e6f74736563726574",
+		msgPayloads: []string{
+			"746573745f6d73675f30", "746573745f6d73675f31",
+			"79656c6c6f777375626d6172696e65", "7375626d6172696e6579656c6c6f77",
+		},
+		msgCiphertextes: []string{
+			"358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd1662544f8445e5dc2467b1e32653192d05dee85c4781bf0dd8d33ceebb5905a7a069f0d6bc97dbce6f8f0ee33d49311a72d0f80337527f958f92050deee33c19777fa17306346367055751bb3f",
+			"64b101b1d0be5a8704bd078f9895001fc03e8e9f9522f188dd128d9846d48466cb4a35db52355821787bb67f33957e7809370c44d33538ad5a42",
+			"226ca869f2777611f37350a7ab446f650c0cfe2855b7f020ce658bcf100f2d",
+			"90d84d69cd44829283b05d684879b53b8d714e51619b601438a1ae67caacd9",
+		},
+	},
+}
+
+func TestHandshakeStateVectors(t *testing.T) {
+	for i, vector := range testVectors {
+		respStatic := mustHex(t, vector.respStatic)
+		respStaticPub, _, err := GenerateKeypair(bytes.NewReader(respStatic))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		initiator, err := NewHandshakeState(Config{
+			Pattern:       vector.pattern,
+			Initiator:     true,
+			Prologue:      mustHex(t, vector.prologue),
+			StaticKey:     mustHex(t, vector.initStatic),
+			PeerStaticKey: respStaticPub,
+			Random:        bytes.NewReader(mustHex(t, vector.initEphemeral)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		responder, err := NewHandshakeState(Config{
+			Pattern:   vector.pattern,
+			Initiator: false,
+			Prologue:  mustHex(t, vector.prologue),
+			StaticKey: respStatic,
+			Random:    bytes.NewReader(mustHex(t, vector.respEphemeral)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var initSend, initRecv, respSend, respRecv *CipherState
+		var transportOffset int
+		for j := range vector.msgPayloads {
+			payload, ciphertext := mustHex(t, vector.msgPayloads[j]), mustHex(t, vector.msgCiphertextes[j])
+
+			var msg, plaintext []byte
+			switch {
+			case !initiator.Finished() && j%2 == 0:
+				msg, err = initiator.WriteMessage(payload)
+				if err == nil {
+					plaintext, err = responder.ReadMessage(msg)
+				}
+			case !initiator.Finished():
+				msg, err = responder.WriteMessage(payload)
+				if err == nil {
+					plaintext, err = initiator.ReadMessage(msg)
+				}
+			case (j-transportOffset)%2 == 0:
+				msg, err = initSend.Encrypt(nil, payload)
+				if err == nil {
+					plaintext, err = respRecv.Decrypt(nil, msg)
+				}
+			default:
+				msg, err = respSend.Encrypt(nil, payload)
+				if err == nil {
+					plaintext, err = initRecv.Decrypt(nil, msg)
+				}
+			}
+			if err != nil {
+				t.Fatalf("vector %d, message %d: %v", i, j, err)
+			}
+
+			if !bytes.Equal(msg, ciphertext) {
+				t.Fatalf("vector %d, message %d: ciphertext differs\n%x\n%x", i, j, msg, ciphertext)
+			} else if !bytes.Equal(plaintext, payload) {
+				t.Fatalf("vector %d, message %d: payload differs", i, j)
+			}
+
+			if initiator.Finished() && initSend == nil {
+				transportOffset = j + 1
+
+				if !responder.Finished() {
+					t.Fatalf("vector %d: responder has not finished", i)
+				}
+				if initSend, initRecv, err = initiator.Split(); err != nil {
+					t.Fatal(err)
+				}
+				if respSend, respRecv, err = responder.Split(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		if !bytes.Equal(initiator.HandshakeHash(), responder.HandshakeHash()) {
+			t.Fatalf("vector %d: handshake hashes differ", i)
+		}
+	}
+}
+
+// testHandshake performs a handshake with random keys.
+func testHandshake(t *testing.T, pattern Pattern) (initiator, responder *HandshakeState) {
+	_, initStatic, err := GenerateKeypair(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	respStaticPub, respStatic, err := GenerateKeypair(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	initiator, err = NewHandshakeState(Config{Pattern: pattern, Initiator: true, StaticKey: initStatic, PeerStaticKey: respStaticPub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder, err = NewHandshakeState(Config{Pattern: pattern, StaticKey: respStatic})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer, reader := initiator, responder
+	for !initiator.Finished() {
+		msg, err := writer.WriteMessage([]byte("payload"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if payload, err := reader.ReadMessage(msg); err != nil {
+			t.Fatal(err)
+		} else if string(payload) != "payload" {
+			t.Fatalf("payload differs, %q", payload)
+		}
+
+		writer, reader = reader, writer
+	}
+	return
+}
+
+func TestHandshakeStateExportKey(t *testing.T) {
+	for _, pattern := range []Pattern{PatternXX, PatternIK} {
+		initiator, responder := testHandshake(t, pattern)
+
+		if !responder.Finished() {
+			t.Fatalf("%v: responder has not finished", pattern)
+		} else if !bytes.Equal(initiator.PeerEphemeralKey(), func() []byte { pub, _ := responder.EphemeralKey(); return pub }()) {
+			t.Fatalf("%v: ephemeral keys differ", pattern)
+		}
+
+		initKey, err := initiator.ExportKey("foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		respKey, err := responder.ExportKey("foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		otherKey, err := initiator.ExportKey("bar")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(initKey, respKey) {
+			t.Fatalf("%v: exported keys differ", pattern)
+		} else if bytes.Equal(initKey, otherKey) {
+			t.Fatalf("%v: exported keys are equal for different labels", pattern)
+		}
+	}
+}
+
+func TestHandshakeStateInvalid(t *testing.T) {
+	_, static, err := GenerateKeypair(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewHandshakeState(Config{Pattern: Pattern(23), StaticKey: static}); err == nil {
+		t.Fatal("unknown pattern did not error")
+	} else if _, err := NewHandshakeState(Config{Pattern: PatternIK, Initiator: true, StaticKey: static}); err == nil {
+		t.Fatal("IK without the peer's static key did not error")
+	}
+
+	// A modified message fails to authenticate.
+	initiator, err := NewHandshakeState(Config{Pattern: PatternXX, Initiator: true, StaticKey: static})
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder, err := NewHandshakeState(Config{Pattern: PatternXX, StaticKey: static})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := responder.WriteMessage(nil); err == nil {
+		t.Fatal("responder wrote the first message")
+	}
+
+	msg, err := initiator.WriteMessage(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := responder.ReadMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err = responder.WriteMessage(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg[len(msg)-1] ^= 0xff
+	if _, err := initiator.ReadMessage(msg); err == nil {
+		t.Fatal("modified message did not error")
+	}
+
+	if _, _, err := initiator.Split(); err == nil {
+		t.Fatal("unfinished handshake was split")
+	} else if _, err := initiator.ExportKey("foo"); err == nil {
+		t.Fatal("unfinished handshake exported a key")
+	}
+}
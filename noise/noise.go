@@ -0,0 +1,156 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Package noise implements the interactive handshakes XX and IK of the Noise
+// Protocol Framework.
+//
+// The Noise Protocol Framework by Perrin[0] describes handshakes by patterns
+// of tokens. This implementation is limited to the cipher suite
+// 25519_ChaChaPoly_SHA256, i.e., X25519 as the DH function, ChaCha20-Poly1305
+// as the AEAD cipher, and SHA-256 as the hash function. Only the following two
+// patterns are supported:
+//
+//	XX:                      IK:
+//	  -> e                     <- s
+//	  <- e, ee, s, es          ...
+//	  -> s, se                 -> e, es, s, ss
+//	                           <- e, ee, se
+//
+// For XX, neither party knows the other one's static key in advance. For IK,
+// the initiator already knows the responder's static key, saving one message.
+//
+// After a finished handshake, a HandshakeState might either be split into two
+// CipherStates for the transport messages, as specified, or export a key for
+// another protocol, e.g., for the Double Ratchet; ExportKey.
+//
+//	[0] https://noiseprotocol.org/noise.html
+package noise
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	// DHLen is the length of both public and private X25519 keys.
+	DHLen = 32
+
+	// HashLen is the length of a SHA-256 hash.
+	HashLen = 32
+
+	// tagLen is the length of a ChaCha20-Poly1305 authentication tag.
+	tagLen = 16
+
+	// suiteName is the cipher suite's part of the protocol name.
+	suiteName = "25519_ChaChaPoly_SHA256"
+)
+
+// Pattern of a Noise handshake.
+type Pattern byte
+
+const (
+	_ Pattern = iota
+
+	// PatternXX transmits both static keys within the handshake.
+	PatternXX
+
+	// PatternIK requires the initiator to know the responder's static key.
+	PatternIK
+)
+
+func (p Pattern) String() string {
+	switch p {
+	case PatternXX:
+		return "XX"
+	case PatternIK:
+		return "IK"
+	default:
+		return fmt.Sprintf("unknown pattern %d", byte(p))
+	}
+}
+
+// token of a message pattern.
+type token byte
+
+const (
+	tokenE token = iota
+	tokenS
+	tokenEE
+	tokenES
+	tokenSE
+	tokenSS
+)
+
+// patternSpec is a handshake pattern's definition.
+type patternSpec struct {
+	// responderPreMessage is set if the responder's static key is known to the
+	// initiator in advance.
+	responderPreMessage bool
+
+	// messages are the tokens of each handshake message, alternating between
+	// initiator and responder, starting with the initiator.
+	messages [][]token
+}
+
+// spec returns the Pattern's definition.
+func (p Pattern) spec() (spec patternSpec, err error) {
+	switch p {
+	case PatternXX:
+		spec = patternSpec{
+			messages: [][]token{
+				{tokenE},
+				{tokenE, tokenEE, tokenS, tokenES},
+				{tokenS, tokenSE},
+			},
+		}
+	case PatternIK:
+		spec = patternSpec{
+			responderPreMessage: true,
+			messages: [][]token{
+				{tokenE, tokenES, tokenS, tokenSS},
+				{tokenE, tokenEE, tokenSE},
+			},
+		}
+	default:
+		err = fmt.Errorf("unsupported pattern %v", p)
+	}
+	return
+}
+
+// protocolName of this Pattern, e.g., "Noise_XX_25519_ChaChaPoly_SHA256".
+func (p Pattern) protocolName() string {
+	return "Noise_" + p.String() + "_" + suiteName
+}
+
+// GenerateKeypair creates a new X25519 key pair from a random source. If rnd
+// is nil, crypto/rand is used.
+//
+// The Noise specification names this function GENERATE_KEYPAIR.
+func GenerateKeypair(rnd io.Reader) (pub, priv []byte, err error) {
+	if rnd == nil {
+		rnd = rand.Reader
+	}
+
+	priv = make([]byte, DHLen)
+	if _, err = io.ReadFull(rnd, priv); err != nil {
+		return
+	}
+
+	pub, err = curve25519.X25519(priv, curve25519.Basepoint)
+	return
+}
+
+// dh calculates an X25519 shared secret. An all-zero shared secret, caused by
+// a low order point, results in an error.
+//
+// The Noise specification names this function DH.
+func dh(priv, pub []byte) (sharedSec []byte, err error) {
+	if len(pub) != DHLen {
+		return nil, fmt.Errorf("public key MUST be of %d bytes", DHLen)
+	}
+	return curve25519.X25519(priv, pub)
+}
@@ -0,0 +1,107 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package noise
+
+import (
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// symmetricState holds the chaining key and the handshake hash next to the
+// handshake's CipherState.
+type symmetricState struct {
+	cs CipherState
+	ck []byte
+	h  []byte
+}
+
+// initializeSymmetric sets the handshake hash to the protocol name, either
+// padded or hashed to HashLen bytes.
+func (ss *symmetricState) initializeSymmetric(protocolName string) {
+	if len(protocolName) <= HashLen {
+		ss.h = make([]byte, HashLen)
+		copy(ss.h, protocolName)
+	} else {
+		h := sha256.Sum256([]byte(protocolName))
+		ss.h = h[:]
+	}
+
+	ss.ck = append([]byte{}, ss.h...)
+	ss.cs = CipherState{}
+}
+
+// hkdf2 derives two outputs from the chaining key and the input key material.
+//
+// The specification's HKDF equals RFC 5869's HKDF with the chaining key as the
+// salt and an empty info.
+func hkdf2(ck, ikm []byte) (out1, out2 []byte, err error) {
+	out := make([]byte, 2*HashLen)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, ikm, ck, nil), out); err != nil {
+		return
+	}
+
+	out1, out2 = out[:HashLen], out[HashLen:]
+	return
+}
+
+// mixKey updates the chaining key and the cipher key by a DH output.
+func (ss *symmetricState) mixKey(ikm []byte) (err error) {
+	ck, tempK, err := hkdf2(ss.ck, ikm)
+	if err != nil {
+		return
+	}
+
+	ss.ck = ck
+	ss.cs.initializeKey(tempK)
+	return
+}
+
+// mixHash appends data to the handshake hash.
+func (ss *symmetricState) mixHash(data []byte) {
+	h := sha256.New()
+	_, _ = h.Write(ss.h)
+	_, _ = h.Write(data)
+	ss.h = h.Sum(nil)
+}
+
+// encryptAndHash encrypts a plaintext with the handshake hash as associated
+// data and mixes the ciphertext into the hash.
+func (ss *symmetricState) encryptAndHash(plaintext []byte) (ciphertext []byte, err error) {
+	ciphertext, err = ss.cs.Encrypt(ss.h, plaintext)
+	if err != nil {
+		return
+	}
+
+	ss.mixHash(ciphertext)
+	return
+}
+
+// decryptAndHash decrypts a ciphertext with the handshake hash as associated
+// data and mixes the ciphertext into the hash.
+func (ss *symmetricState) decryptAndHash(ciphertext []byte) (plaintext []byte, err error) {
+	plaintext, err = ss.cs.Decrypt(ss.h, ciphertext)
+	if err != nil {
+		return
+	}
+
+	ss.mixHash(ciphertext)
+	return
+}
+
+// split derives the two CipherStates for the transport messages, the first one
+// for the initiator's and the second one for the responder's messages.
+func (ss *symmetricState) split() (c1, c2 *CipherState, err error) {
+	tempK1, tempK2, err := hkdf2(ss.ck, nil)
+	if err != nil {
+		return
+	}
+
+	c1, c2 = new(CipherState), new(CipherState)
+	c1.initializeKey(tempK1)
+	c2.initializeKey(tempK2)
+	return
+}
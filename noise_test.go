@@ -0,0 +1,161 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package xochimilco
+
+import (
+	"crypto/ed25519"
+	"testing"
+)
+
+// testNoisePair creates two Sessions for Alice and Bob using a Noise handshake.
+func testNoisePair(t *testing.T, handshake Handshake) (alice, bob *Session) {
+	alice, bob = testSessionPair(t)
+	alice.Handshake = handshake
+	alice.NoisePeerKey = bob.IdentityKey.Public().(ed25519.PublicKey)
+	return
+}
+
+func TestSessionNoise(t *testing.T) {
+	for _, handshake := range []Handshake{HandshakeNoiseXX, HandshakeNoiseIK} {
+		alice, bob := testNoisePair(t, handshake)
+		testSessionEstablish(t, alice, bob)
+
+		// For XX, Bob needs Alice's final message, included in her first one.
+		if handshake == HandshakeNoiseXX {
+			if _, err := bob.Send([]byte("hej alice")); err == nil {
+				t.Fatalf("%v: Bob sent before the handshake was finished", handshake)
+			}
+
+			dataMsg, err := alice.Send([]byte("hello bob"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if isEstablished, _, plaintext, err := bob.Receive(dataMsg); err != nil {
+				t.Fatal(err)
+			} else if !isEstablished || string(plaintext) != "hello bob" {
+				t.Fatalf("%v: unexpected finish, %t %q", handshake, isEstablished, plaintext)
+			}
+		} else {
+			testSessionExchange(t, alice, bob, "hello bob")
+		}
+
+		testSessionExchange(t, bob, alice, "hej alice")
+		testSessionExchange(t, bob, alice, "how are you?")
+		testSessionExchange(t, alice, bob, "fine")
+
+		if !alice.PeerIdentityKey().Equal(bob.IdentityKey.Public()) {
+			t.Fatalf("%v: Alice has not Bob's identity key", handshake)
+		} else if !bob.PeerIdentityKey().Equal(alice.IdentityKey.Public()) {
+			t.Fatalf("%v: Bob has not Alice's identity key", handshake)
+		} else if !alice.PeerConfirmed() || !bob.PeerConfirmed() {
+			t.Fatalf("%v: peers are not confirmed", handshake)
+		}
+
+		// Only XX allows Alice to commit to her nonce for the SAS.
+		aliceSas, aliceErr := alice.ShortAuthString()
+		bobSas, bobErr := bob.ShortAuthString()
+		if handshake == HandshakeNoiseIK {
+			if aliceErr == nil || bobErr == nil {
+				t.Fatalf("%v: short authentication string without a commitment", handshake)
+			}
+		} else if aliceErr != nil || bobErr != nil {
+			t.Fatalf("%v: %v %v", handshake, aliceErr, bobErr)
+		} else if aliceSas != bobSas {
+			t.Fatalf("%v: short authentication strings differ", handshake)
+		}
+	}
+}
+
+func TestSessionNoiseConfirm(t *testing.T) {
+	alice, bob := testNoisePair(t, HandshakeNoiseXX)
+	testSessionEstablish(t, alice, bob)
+
+	finishMsg, err := alice.Confirm()
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := alice.Confirm(); err == nil {
+		t.Fatal("second Confirm did not error")
+	}
+
+	if isEstablished, _, plaintext, err := bob.Receive(finishMsg); err != nil {
+		t.Fatal(err)
+	} else if !isEstablished || len(plaintext) > 0 {
+		t.Fatalf("unexpected finish, %t %q", isEstablished, plaintext)
+	}
+
+	testSessionExchange(t, bob, alice, "hej alice")
+	testSessionExchange(t, alice, bob, "hello bob")
+}
+
+func TestSessionNoiseClose(t *testing.T) {
+	alice, bob := testNoisePair(t, HandshakeNoiseXX)
+	testSessionEstablish(t, alice, bob)
+
+	// Without Alice's final message, Bob cannot decrypt an authenticated close.
+	closeMsg, err := alice.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, isClosed, _, err := bob.Receive(closeMsg); err != nil {
+		t.Fatal(err)
+	} else if !isClosed {
+		t.Fatal("Bob's Session was not closed")
+	}
+}
+
+func TestSessionNoiseInvalid(t *testing.T) {
+	// Alice expects another identity key for Bob.
+	alice, bob := testNoisePair(t, HandshakeNoiseIK)
+	mallory, _ := testSessionPair(t)
+	alice.NoisePeerKey = mallory.IdentityKey.Public().(ed25519.PublicKey)
+
+	offerMsg, err := alice.Offer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.Acknowledge(offerMsg); err == nil {
+		t.Fatal("IK offer for another key was acknowledged")
+	}
+
+	// Without the other party's identity key, IK cannot be offered.
+	alice.NoisePeerKey = nil
+	if _, err := alice.Offer(); err == nil {
+		t.Fatal("IK offer without NoisePeerKey did not error")
+	}
+
+	// Bob rejects Alice's identity key at the end of XX.
+	alice, bob = testNoisePair(t, HandshakeNoiseXX)
+	bob.VerifyPeer = func(_ ed25519.PublicKey) bool { return false }
+	testSessionEstablish(t, alice, bob)
+
+	dataMsg, err := alice.Send([]byte("hello bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := bob.Receive(dataMsg); err == nil {
+		t.Fatal("rejected identity key did not error")
+	}
+
+	// Early data is not supported.
+	alice, bob = testNoisePair(t, HandshakeNoiseXX)
+	if offerMsg, err = alice.Offer(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.AcknowledgeWithPayload(offerMsg, []byte("hej alice")); err == nil {
+		t.Fatal("early data did not error")
+	}
+
+	// Each acknowledgement is only accepted once.
+	ackMsg, err := bob.Acknowledge(offerMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := alice.Receive(ackMsg); err != nil {
+		t.Fatal(err)
+	} else if _, _, _, err := alice.Receive(ackMsg); err == nil {
+		t.Fatal("replayed acknowledgement did not error")
+	}
+}
@@ -0,0 +1,390 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This file implements a password-authenticated handshake as an alternative to
+// the X3DH based Offer and Acknowledge.
+//
+// Both parties share a short code, e.g., spoken over the phone, and run SPAKE2
+// as specified in RFC 9382 over edwards25519 with SHA-256, HKDF, and HMAC:
+//
+//	Alice → Bob: sessPakeOffer(IK_A, DH_A, pA = x·G + w·M, Sig_A)
+//	Bob → Alice: sessPakeAck(IK_B, pB = y·G + w·N, cB, Sig_B, ciphertext)
+//	Alice → Bob: sessConfirm(cA, [ciphertext])
+//
+// The password scalar w is derived from the code. Both identity keys are part
+// of SPAKE2's transcript and each party signs its share by its identity key.
+// Thus, only a party knowing the code and owning the identity key is able to
+// finish the handshake, and no VerifyPeer decision is needed.
+//
+// The SPAKE2 key Ke seeds the Double Ratchet; Bob is its active party, as for
+// X3DH, using Alice's DH_A. The confirmation cB is verified by Alice, while
+// Bob awaits cA as a key confirmation; Confirm. An attacker might test one
+// guessed code per handshake. Thus, applications SHOULD limit the attempts.
+
+package xochimilco
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"filippo.io/edwards25519"
+	"github.com/oxzi/xochimilco/doubleratchet"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// pakeProtocol is the ProtocolVersion of all PAKE handshakes, as their
+	// message types cannot be encoded in the legacy format.
+	pakeProtocol = Protocol1
+
+	// pakeCodeInfo is the hash prefix to derive the password scalar.
+	pakeCodeInfo = "Xochimilco PAKE code"
+
+	// pakeSessKeyInfo is the HKDF info to derive the session key from Ke.
+	pakeSessKeyInfo = "Xochimilco PAKE session key"
+
+	// pakeConfirmInfo is the HKDF info to derive the confirmation keys from
+	// Ka, RFC 9382's "ConfirmationKeys" followed by this protocol's AAD.
+	pakeConfirmInfo = "ConfirmationKeys" + "Xochimilco PAKE"
+
+	// pakeOfferSigInfo / pakeAckSigInfo prefixes the signed data of the offer
+	// resp. the acknowledgement.
+	pakeOfferSigInfo = "Xochimilco PAKE offer"
+	pakeAckSigInfo   = "Xochimilco PAKE ack"
+)
+
+// pakeM and pakeN are RFC 9382's fixed points M and N for edwards25519.
+var pakeM, pakeN = pakeMustPoint("d048032c6ea0b6d697ddc2e86bda85a33adac920f1bf18e1b0c6d166a5cecdaf"),
+	pakeMustPoint("d3bfb518f44f3430f29d0c92af503865a1ed3281dc69b35dd868ba85f886c4ab")
+
+// pakeMustPoint decodes a hex encoded point or panics.
+func pakeMustPoint(s string) *edwards25519.Point {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+
+	p, err := new(edwards25519.Point).SetBytes(data)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// pakeState is Alice's pending PAKE handshake between PakeOffer and the
+// reception of Bob's acknowledgement.
+type pakeState struct {
+	w, x          *edwards25519.Scalar
+	share         []byte
+	dhPub, dhPriv []byte
+}
+
+// pakePassword derives the password scalar w from a code.
+//
+// RFC 9382 recommends a memory-hard function. However, as the code is neither
+// stored nor used twice, a hash is sufficient here.
+func pakePassword(code string) (w *edwards25519.Scalar, err error) {
+	if code == "" {
+		err = fmt.Errorf("PAKE code MUST NOT be empty")
+		return
+	}
+
+	h := sha512.Sum512([]byte(pakeCodeInfo + code))
+	return new(edwards25519.Scalar).SetUniformBytes(h[:])
+}
+
+// pakeRandomScalar creates a random scalar.
+func pakeRandomScalar() (s *edwards25519.Scalar, err error) {
+	buff := make([]byte, 64)
+	if _, err = rand.Read(buff); err != nil {
+		return
+	}
+
+	return new(edwards25519.Scalar).SetUniformBytes(buff)
+}
+
+// pakeShare calculates the share x·G + w·P for the random scalar x, the
+// password scalar w, and P being either M or N.
+func pakeShare(x, w *edwards25519.Scalar, p *edwards25519.Point) []byte {
+	share := new(edwards25519.Point).ScalarBaseMult(x)
+	share.Add(share, new(edwards25519.Point).ScalarMult(w, p))
+	return share.Bytes()
+}
+
+// pakeSharedPoint calculates K = h·x·(peerShare - w·P) for our random scalar x,
+// the password scalar w, and P being the other party's M or N.
+func pakeSharedPoint(x, w *edwards25519.Scalar, p *edwards25519.Point, peerShare []byte) (k []byte, err error) {
+	peer, err := new(edwards25519.Point).SetBytes(peerShare)
+	if err != nil {
+		err = fmt.Errorf("invalid PAKE share: %v", err)
+		return
+	}
+
+	point := new(edwards25519.Point).Subtract(peer, new(edwards25519.Point).ScalarMult(w, p))
+	point.ScalarMult(x, point)
+	point.MultByCofactor(point)
+
+	if point.Equal(edwards25519.NewIdentityPoint()) == 1 {
+		err = fmt.Errorf("PAKE resulted in the identity point")
+		return
+	}
+
+	k = point.Bytes()
+	return
+}
+
+// pakeKeys derives the session key and both confirmation MACs from RFC 9382's
+// transcript TT, consisting of both identities, both shares, K, and w.
+func pakeKeys(idKeyA, idKeyB, shareA, shareB, k []byte, w *edwards25519.Scalar) (sessKey, macA, macB []byte, err error) {
+	var tt []byte
+	for _, part := range [][]byte{idKeyA, idKeyB, shareA, shareB, k, w.Bytes()} {
+		tt = binary.LittleEndian.AppendUint64(tt, uint64(len(part)))
+		tt = append(tt, part...)
+	}
+
+	h := sha256.Sum256(tt)
+	ke, ka := h[:sha256.Size/2], h[sha256.Size/2:]
+
+	sessKey = make([]byte, 32)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, ke, nil, []byte(pakeSessKeyInfo)), sessKey); err != nil {
+		return
+	}
+
+	confirmKeys := make([]byte, 2*sha256.Size)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, ka, nil, []byte(pakeConfirmInfo)), confirmKeys); err != nil {
+		return
+	}
+
+	for i, mac := range []*[]byte{&macA, &macB} {
+		m := hmac.New(sha256.New, confirmKeys[i*sha256.Size:(i+1)*sha256.Size])
+		_, _ = m.Write(tt)
+		*mac = m.Sum(nil)
+	}
+	return
+}
+
+// pakeSigData concatenates a signature's info with the signed fields.
+func pakeSigData(info string, fields ...[]byte) (data []byte) {
+	data = []byte(info)
+	for _, field := range fields {
+		data = append(data, field...)
+	}
+	return
+}
+
+// PakeOffer to establish an encrypted Session, authenticated by a code shared
+// with the other party, e.g., spoken over the phone.
+//
+// This is an alternative to Offer, called by the active party (Alice). The
+// other party needs to pass this message and the same code to PakeAcknowledge.
+// After Receive has established this Session, Alice MUST send her key
+// confirmation; Confirm.
+//
+// A PAKE handshake always uses Protocol1. Neither VerifyPeer nor the Verifier
+// is called, as the identity keys are authenticated by the code.
+func (sess *Session) PakeOffer(code string) (offerMsg string, err error) {
+	w, err := pakePassword(code)
+	if err != nil {
+		return
+	}
+
+	x, err := pakeRandomScalar()
+	if err != nil {
+		return
+	}
+
+	dhPriv := make([]byte, curve25519.ScalarSize)
+	if _, err = rand.Read(dhPriv); err != nil {
+		return
+	}
+	dhPub, err := curve25519.X25519(dhPriv, curve25519.Basepoint)
+	if err != nil {
+		return
+	}
+
+	idKey := sess.IdentityKey.Public().(ed25519.PublicKey)
+	share := pakeShare(x, w, pakeM)
+
+	offer := pakeOfferMessage{
+		idKey: idKey,
+		dhKey: dhPub,
+		share: share,
+		sig:   ed25519.Sign(sess.IdentityKey, pakeSigData(pakeOfferSigInfo, idKey, dhPub, share)),
+	}
+
+	sess.spkPub, sess.spkPriv = nil, nil
+	sess.kemPriv = nil
+	sess.offerData, sess.earlyData = nil, false
+	sess.sasNonce, sess.sasCommit = nil, nil
+	sess.noiseHs, sess.noiseFinish = nil, nil
+	sess.protocol = pakeProtocol
+	sess.pake = &pakeState{
+		w:      w,
+		x:      x,
+		share:  share,
+		dhPub:  dhPub,
+		dhPriv: dhPriv,
+	}
+
+	offerMsg, err = marshalEncodedMessage(sess.Encoding, pakeProtocol, sessPakeOffer, offer)
+	return
+}
+
+// PakeAcknowledge to establish an encrypted Session, authenticated by a code
+// shared with the other party.
+//
+// This is an alternative to Acknowledge, called by the passive party (Bob) with
+// the active party's (Alice's) PakeOffer message and the same code. The created
+// acknowledge message MUST be send back. A wrong code is only detected by Alice.
+//
+// At this point, this passive party is able to send messages. However,
+// incoming messages are rejected until Alice's key confirmation arrives,
+// proving her knowledge of the code.
+func (sess *Session) PakeAcknowledge(offerMsg string, code string) (ackMsg string, err error) {
+	version, msgType, offerIf, err := unmarshalVersionedMessage(offerMsg)
+	if err != nil {
+		return
+	} else if msgType != sessPakeOffer {
+		err = fmt.Errorf("unexpected message type %d", msgType)
+		return
+	} else if version != pakeProtocol {
+		err = fmt.Errorf("received protocol version %d instead of %d", version, pakeProtocol)
+		return
+	}
+	offer := offerIf.(*pakeOfferMessage)
+
+	if !ed25519.Verify(offer.idKey, pakeSigData(pakeOfferSigInfo, offer.idKey, offer.dhKey, offer.share), offer.sig) {
+		err = fmt.Errorf("sessPakeOffer has an invalid signature")
+		return
+	}
+
+	w, err := pakePassword(code)
+	if err != nil {
+		return
+	}
+
+	y, err := pakeRandomScalar()
+	if err != nil {
+		return
+	}
+
+	idKey := sess.IdentityKey.Public().(ed25519.PublicKey)
+	share := pakeShare(y, w, pakeN)
+
+	k, err := pakeSharedPoint(y, w, pakeM, offer.share)
+	if err != nil {
+		return
+	}
+
+	sessKey, macA, macB, err := pakeKeys(offer.idKey, idKey, offer.share, share, k, w)
+	if err != nil {
+		return
+	}
+
+	associatedData := append(append([]byte{}, offer.idKey...), idKey...)
+	sess.doubleRatchet, err = doubleratchet.CreateActive(sessKey, associatedData, offer.dhKey)
+	if err != nil {
+		return
+	}
+
+	initialPayload := make([]byte, 23)
+	if _, err = rand.Read(initialPayload); err != nil {
+		return
+	}
+	initialCiphertext, err := sess.doubleRatchet.Encrypt(initialPayload)
+	if err != nil {
+		return
+	}
+
+	ack := pakeAckMessage{
+		idKey:  idKey,
+		share:  share,
+		mac:    macB,
+		sig:    ed25519.Sign(sess.IdentityKey, pakeSigData(pakeAckSigInfo, offer.share, idKey, share)),
+		cipher: initialCiphertext,
+	}
+
+	sess.protocol = pakeProtocol
+	sess.confirmMacRecv = macA
+	sess.peerConfirmed = false
+	sess.peerIdKey = append(ed25519.PublicKey{}, offer.idKey...)
+	sess.peerUnverified = false
+	sess.transcript = sasTranscript(offer.idKey, idKey, offer.share, share, nil)
+	sess.sas = nil
+	sess.sasNonce, sess.sasCommit = nil, nil
+
+	ackMsg, err = marshalEncodedMessage(sess.Encoding, pakeProtocol, sessPakeAck, ack)
+	return
+}
+
+// receivePakeAck deals with incoming sessPakeAck messages.
+//
+// The active / opening party receives the other party's acknowledgement to its
+// PakeOffer. The pending handshake is consumed, even on errors. Thus, each
+// offer only allows testing one code.
+func (sess *Session) receivePakeAck(ack *pakeAckMessage, version ProtocolVersion) (isEstablished bool, err error) {
+	if sess.doubleRatchet != nil {
+		err = fmt.Errorf("received sessPakeAck while being in an active session")
+		return
+	} else if sess.pake == nil {
+		err = fmt.Errorf("received sessPakeAck without a pending PakeOffer")
+		return
+	} else if version != pakeProtocol {
+		err = fmt.Errorf("received protocol version %d instead of %d", version, pakeProtocol)
+		return
+	}
+
+	pake := sess.pake
+	sess.pake = nil
+
+	if !ed25519.Verify(ack.idKey, pakeSigData(pakeAckSigInfo, pake.share, ack.idKey, ack.share), ack.sig) {
+		err = fmt.Errorf("sessPakeAck has an invalid signature")
+		return
+	}
+
+	k, err := pakeSharedPoint(pake.x, pake.w, pakeN, ack.share)
+	if err != nil {
+		return
+	}
+
+	idKey := sess.IdentityKey.Public().(ed25519.PublicKey)
+	sessKey, macA, macB, err := pakeKeys(idKey, ack.idKey, pake.share, ack.share, k, pake.w)
+	if err != nil {
+		return
+	}
+
+	if !hmac.Equal(ack.mac, macB) {
+		err = fmt.Errorf("PAKE confirmation differs, the code might be wrong")
+		return
+	}
+
+	associatedData := append(append([]byte{}, idKey...), ack.idKey...)
+	sess.doubleRatchet, err = doubleratchet.CreatePassive(sessKey, associatedData, pake.dhPub, pake.dhPriv)
+	if err != nil {
+		return
+	}
+
+	if _, err = sess.doubleRatchet.Decrypt(ack.cipher); err != nil {
+		return
+	}
+
+	sess.protocol = pakeProtocol
+	sess.confirmMacSend = macA
+	sess.peerConfirmed = true
+	sess.peerIdKey = append(ed25519.PublicKey{}, ack.idKey...)
+	sess.peerUnverified = false
+	sess.transcript = sasTranscript(idKey, ack.idKey, pake.share, ack.share, nil)
+	sess.sas = nil
+
+	isEstablished = true
+	return
+}
@@ -0,0 +1,172 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package xochimilco
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding"
+	"reflect"
+	"testing"
+)
+
+func TestPakeMessageMarshall(t *testing.T) {
+	key := bytes.Repeat([]byte{0x23}, 32)
+	sig := bytes.Repeat([]byte{0x42}, 64)
+
+	testcases := []struct {
+		t messageType
+		m encoding.BinaryMarshaler
+	}{
+		{sessPakeOffer, &pakeOfferMessage{idKey: key, dhKey: key, share: key, sig: sig}},
+		{sessPakeAck, &pakeAckMessage{idKey: key, share: key, mac: key, sig: sig, cipher: []byte{1, 2, 3}}},
+	}
+
+	for _, testcase := range testcases {
+		txt, err := marshalVersionedMessage(pakeProtocol, testcase.t, testcase.m)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ty, m, err := unmarshalMessage(txt)
+		if err != nil {
+			t.Fatal(err)
+		} else if ty != testcase.t {
+			t.Errorf("unexpected type, %d %d", ty, testcase.t)
+		} else if !reflect.DeepEqual(m, testcase.m) {
+			t.Errorf("messages differ, %#v %#v", m, testcase.m)
+		}
+	}
+
+	if _, _, err := unmarshalMessage(Prefix + "v1.10.AQID" + Suffix); err == nil {
+		t.Fatal("truncated sessPakeAck did not error")
+	}
+}
+
+// testPakeEstablish performs a PAKE handshake between Alice and Bob.
+func testPakeEstablish(t *testing.T, alice, bob *Session, aliceCode, bobCode string) (err error) {
+	offerMsg, err := alice.PakeOffer(aliceCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ackMsg, err := bob.PakeAcknowledge(offerMsg, bobCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	isEstablished, _, _, err := alice.Receive(ackMsg)
+	if err == nil && !isEstablished {
+		t.Fatal("Session was not established")
+	}
+	return
+}
+
+func TestSessionPake(t *testing.T) {
+	alice, bob := testSessionPair(t)
+
+	// No VerifyPeer decision is needed.
+	alice.VerifyPeer, bob.VerifyPeer = nil, nil
+
+	if err := testPakeEstablish(t, alice, bob, "2342", "2342"); err != nil {
+		t.Fatal(err)
+	}
+
+	if !alice.PeerIdentityKey().Equal(bob.IdentityKey.Public()) || !alice.PeerVerified() {
+		t.Fatal("Alice has not verified Bob's identity key")
+	} else if !bob.PeerIdentityKey().Equal(alice.IdentityKey.Public()) || !bob.PeerVerified() {
+		t.Fatal("Bob has not verified Alice's identity key")
+	}
+
+	// Bob awaits Alice's key confirmation, included in her first message.
+	if bob.PeerConfirmed() {
+		t.Fatal("Bob has confirmed Alice")
+	}
+	testSessionExchange(t, alice, bob, "hello bob")
+	if !bob.PeerConfirmed() {
+		t.Fatal("Bob has not confirmed Alice")
+	}
+
+	testSessionExchange(t, bob, alice, "hej alice")
+	testSessionExchange(t, bob, alice, "how are you?")
+	testSessionExchange(t, alice, bob, "fine")
+}
+
+func TestSessionPakeWrongCode(t *testing.T) {
+	alice, bob := testSessionPair(t)
+
+	offerMsg, err := alice.PakeOffer("2342")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ackMsg, err := bob.PakeAcknowledge(offerMsg, "4223")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, err := alice.Receive(ackMsg); err == nil {
+		t.Fatal("wrong code did not error")
+	}
+
+	// The offer was consumed by the failed attempt.
+	correctBob := &Session{IdentityKey: bob.IdentityKey}
+	if ackMsg, err = correctBob.PakeAcknowledge(offerMsg, "2342"); err != nil {
+		t.Fatal(err)
+	} else if _, _, _, err := alice.Receive(ackMsg); err == nil {
+		t.Fatal("consumed offer did not error")
+	}
+
+	if _, err := alice.Send([]byte("hello bob")); err == nil {
+		t.Fatal("Alice has established a Session")
+	}
+}
+
+func TestSessionPakeInvalid(t *testing.T) {
+	alice, bob := testSessionPair(t)
+	mallory, _ := testSessionPair(t)
+
+	if _, err := alice.PakeOffer(""); err == nil {
+		t.Fatal("empty code did not error")
+	}
+
+	offerMsg, err := alice.PakeOffer("2342")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Mallory replaces Alice's identity key, invalidating the signature.
+	_, offerIf, _ := unmarshalMessage(offerMsg)
+	offer := offerIf.(*pakeOfferMessage)
+	offer.idKey = mallory.IdentityKey.Public().(ed25519.PublicKey)
+	forgedMsg, err := marshalVersionedMessage(pakeProtocol, sessPakeOffer, offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.PakeAcknowledge(forgedMsg, "2342"); err == nil {
+		t.Fatal("forged offer did not error")
+	}
+
+	// A regular offer is not a PAKE offer and vice versa.
+	x3dhOfferMsg, err := alice.Offer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.PakeAcknowledge(x3dhOfferMsg, "2342"); err == nil {
+		t.Fatal("X3DH offer was accepted")
+	}
+	if _, err := bob.Acknowledge(offerMsg); err == nil {
+		t.Fatal("PAKE offer was accepted")
+	}
+
+	// The X3DH offer replaced the pending PAKE offer.
+	ackMsg, err := bob.PakeAcknowledge(offerMsg, "2342")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := alice.Receive(ackMsg); err == nil {
+		t.Fatal("replaced PAKE offer did not error")
+	}
+}
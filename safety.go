@@ -0,0 +1,156 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This file implements safety numbers to verify identity keys out of band.
+//
+// The design follows Signal's safety numbers. Each party's fingerprint is
+// derived from its Ed25519 identity key by iterated SHA-512 hashing. Both
+// fingerprints are combined in a sorted order. Thus, both parties see the same
+// safety number and might compare it, e.g., by reading it aloud. Furthermore,
+// a compact payload, e.g., for a QR code, allows scanning the other party's
+// safety number.
+
+package xochimilco
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const (
+	// SafetyNumberVersion is the version of the safety number's derivation,
+	// being part of both the hashed data and the scannable payload.
+	SafetyNumberVersion = 1
+
+	// safetyIterations is the amount of SHA-512 iterations per fingerprint.
+	safetyIterations = 5200
+
+	// safetyFingerprintSize is the length of a fingerprint within the
+	// scannable payload.
+	safetyFingerprintSize = 32
+
+	// safetyDisplaySize is the length of a fingerprint's part being displayed.
+	// Each five bytes result in five digits.
+	safetyDisplaySize = 30
+)
+
+// SafetyNumber of a local and a remote identity key.
+type SafetyNumber struct {
+	local, remote []byte
+}
+
+// safetyFingerprint derives the fingerprint of an identity key.
+func safetyFingerprint(key ed25519.PublicKey) []byte {
+	var version [2]byte
+	binary.BigEndian.PutUint16(version[:], SafetyNumberVersion)
+
+	h := sha512.New()
+	_, _ = h.Write(version[:])
+	_, _ = h.Write(key)
+	hash := h.Sum(nil)
+
+	for i := 0; i < safetyIterations; i++ {
+		h.Reset()
+		_, _ = h.Write(hash)
+		_, _ = h.Write(key)
+		hash = h.Sum(hash[:0])
+	}
+
+	return hash[:safetyFingerprintSize]
+}
+
+// NewSafetyNumber derives the SafetyNumber of the local and the remote party's
+// public identity key.
+func NewSafetyNumber(localKey, remoteKey ed25519.PublicKey) (sn *SafetyNumber, err error) {
+	if len(localKey) != ed25519.PublicKeySize || len(remoteKey) != ed25519.PublicKeySize {
+		err = fmt.Errorf("identity keys MUST be %d bytes", ed25519.PublicKeySize)
+		return
+	}
+
+	sn = &SafetyNumber{
+		local:  safetyFingerprint(localKey),
+		remote: safetyFingerprint(remoteKey),
+	}
+	return
+}
+
+// sorted returns both displayed fingerprints' parts in a stable order.
+func (sn *SafetyNumber) sorted() (first, second []byte) {
+	first, second = sn.local[:safetyDisplaySize], sn.remote[:safetyDisplaySize]
+	if bytes.Compare(first, second) > 0 {
+		first, second = second, first
+	}
+	return
+}
+
+// Digits returns the safety number as 60 digits, in twelve groups of five
+// digits. Both parties get the same digits.
+func (sn *SafetyNumber) Digits() []string {
+	first, second := sn.sorted()
+
+	groups := make([]string, 0, 2*safetyDisplaySize/5)
+	for _, fingerprint := range [][]byte{first, second} {
+		for i := 0; i < len(fingerprint); i += 5 {
+			var chunk uint64
+			for _, b := range fingerprint[i : i+5] {
+				chunk = chunk<<8 | uint64(b)
+			}
+			groups = append(groups, fmt.Sprintf("%05d", chunk%100000))
+		}
+	}
+	return groups
+}
+
+// String returns the safety number's Digits, separated by spaces.
+func (sn *SafetyNumber) String() string {
+	return strings.Join(sn.Digits(), " ")
+}
+
+// Hex returns the safety number as a hexadecimal string. Both parties get the
+// same string.
+func (sn *SafetyNumber) Hex() string {
+	first, second := sn.sorted()
+	return hex.EncodeToString(first) + hex.EncodeToString(second)
+}
+
+// ScannablePayload returns a compact payload for out-of-band comparison, e.g.,
+// encoded as a QR code. It consists of the version, followed by the local and
+// the remote fingerprint:
+//
+//	version (1 byte) | local fingerprint (32 byte) | remote fingerprint (32 byte)
+//
+// The other party passes this payload to its CompareScanned.
+func (sn *SafetyNumber) ScannablePayload() []byte {
+	payload := make([]byte, 0, 1+2*safetyFingerprintSize)
+	payload = append(payload, SafetyNumberVersion)
+	payload = append(payload, sn.local...)
+	payload = append(payload, sn.remote...)
+	return payload
+}
+
+// CompareScanned compares the other party's ScannablePayload with this
+// SafetyNumber. Its local fingerprint must be our remote one and vice versa.
+//
+// An error is returned for an invalid payload, e.g., of another version.
+func (sn *SafetyNumber) CompareScanned(payload []byte) (equal bool, err error) {
+	if len(payload) != 1+2*safetyFingerprintSize {
+		err = fmt.Errorf("scanned payload has an invalid length of %d", len(payload))
+		return
+	} else if payload[0] != SafetyNumberVersion {
+		err = fmt.Errorf("scanned payload has version %d instead of %d", payload[0], SafetyNumberVersion)
+		return
+	}
+
+	peerLocal := payload[1 : 1+safetyFingerprintSize]
+	peerRemote := payload[1+safetyFingerprintSize:]
+
+	equal = subtle.ConstantTimeCompare(peerLocal, sn.remote)&subtle.ConstantTimeCompare(peerRemote, sn.local) == 1
+	return
+}
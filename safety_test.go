@@ -0,0 +1,99 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package xochimilco
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+)
+
+func testSafetyKey(seed byte) ed25519.PublicKey {
+	return ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed}, ed25519.SeedSize)).Public().(ed25519.PublicKey)
+}
+
+func TestSafetyNumber(t *testing.T) {
+	alice, bob := testSafetyKey(0x01), testSafetyKey(0x02)
+
+	snAlice, err := NewSafetyNumber(alice, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snBob, err := NewSafetyNumber(bob, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Known answer to detect accidental changes of the derivation.
+	const (
+		expectedDigits = "48198 06589 64884 22705 23742 49183 31464 11227 87732 08313 95360 84106"
+		expectedHex    = "2df04f29c6b3acf6e0fdf42e4db574ca18d9d4916aa3f5badede1445a89f" +
+			"a00f0f592813e4e6d33b3a09184174fd11f22739996fb2f4e0171c75198a"
+	)
+
+	for _, sn := range []*SafetyNumber{snAlice, snBob} {
+		if s := sn.String(); s != expectedDigits {
+			t.Fatalf("digits differ, %s", s)
+		} else if h := sn.Hex(); h != expectedHex {
+			t.Fatalf("hex differs, %s", h)
+		} else if l := len(sn.Digits()); l != 12 {
+			t.Fatalf("%d instead of 12 groups", l)
+		}
+	}
+
+	snCarol, err := NewSafetyNumber(alice, testSafetyKey(0x03))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snCarol.String() == snAlice.String() || snCarol.Hex() == snAlice.Hex() {
+		t.Fatal("safety numbers of different keys are equal")
+	}
+}
+
+func TestSafetyNumberScannable(t *testing.T) {
+	alice, bob, carol := testSafetyKey(0x01), testSafetyKey(0x02), testSafetyKey(0x03)
+
+	snAlice, _ := NewSafetyNumber(alice, bob)
+	snBob, _ := NewSafetyNumber(bob, alice)
+	snMallory, _ := NewSafetyNumber(carol, alice)
+	snSelf, _ := NewSafetyNumber(alice, bob)
+
+	if equal, err := snBob.CompareScanned(snAlice.ScannablePayload()); err != nil {
+		t.Fatal(err)
+	} else if !equal {
+		t.Fatal("Bob does not match Alice")
+	}
+
+	if equal, err := snAlice.CompareScanned(snBob.ScannablePayload()); err != nil {
+		t.Fatal(err)
+	} else if !equal {
+		t.Fatal("Alice does not match Bob")
+	}
+
+	// Neither another key nor a reflected payload matches.
+	for _, payload := range [][]byte{snMallory.ScannablePayload(), snSelf.ScannablePayload()} {
+		if equal, err := snAlice.CompareScanned(payload); err != nil {
+			t.Fatal(err)
+		} else if equal {
+			t.Fatal("invalid payload matches")
+		}
+	}
+
+	payload := snBob.ScannablePayload()
+	invalids := [][]byte{
+		nil,
+		payload[:len(payload)-1],
+		append([]byte{SafetyNumberVersion + 1}, payload[1:]...),
+	}
+	for _, invalid := range invalids {
+		if _, err := snAlice.CompareScanned(invalid); err == nil {
+			t.Errorf("%x did not error", invalid)
+		}
+	}
+
+	if _, err := NewSafetyNumber(alice, bob[:16]); err == nil {
+		t.Fatal("invalid key did not error")
+	}
+}
@@ -0,0 +1,140 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This file implements a short authentication string (SAS) for a Session.
+//
+// In contrast to the SafetyNumber, the SAS is short enough to be read aloud,
+// e.g., at the beginning of a call. It is derived from the handshake's
+// transcript. Thus, a MITM results in different strings for both parties.
+//
+// As the SAS is short, a MITM might try to generate ephemeral keys until both
+// strings collide. Thus, like ZRTP, a commit-then-reveal step is used: Alice
+// commits to a random nonce within her first message and reveals it only after
+// Bob's answer; the nonce is part of the transcript. A MITM has to choose its
+// keys before knowing the honest party's last contribution, either Alice's
+// nonce or Bob's ephemeral key, leaving a single guess per handshake.
+//
+// For X3DH, the commitment requires KeyConfirmation, as the nonce is revealed
+// within the key confirmation. For Noise, only PatternXX allows a reveal within
+// its third message. A PAKE handshake has no commitment, but a MITM without the
+// password cannot take part in the first place.
+//
+// Furthermore, the SAS is derived by the memory-hard Argon2id function.
+
+package xochimilco
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	// sasDigits is the number of decimal digits of a ShortAuthString.
+	sasDigits = 6
+
+	// sasNonceSize is the length of Alice's committed nonce.
+	sasNonceSize = 32
+
+	// sasSalt is the Argon2id salt, identifying this derivation.
+	sasSalt = "xochimilco SAS v1"
+
+	// sasTime, sasMemory, and sasThreads are the Argon2id parameters, as
+	// recommended by RFC 9106 for memory-constrained environments.
+	sasTime    = 3
+	sasMemory  = 64 * 1024
+	sasThreads = 4
+)
+
+// ShortAuthString is a Session's short authentication string, to be compared
+// by both parties out of band.
+type ShortAuthString uint32
+
+// newShortAuthString derives a ShortAuthString from the X3DH transcript.
+func newShortAuthString(transcript []byte) ShortAuthString {
+	hash := argon2.IDKey(transcript, []byte(sasSalt), sasTime, sasMemory, sasThreads, 8)
+
+	// The modulo bias of a 64-bit value is negligible.
+	mod := uint64(1)
+	for i := 0; i < sasDigits; i++ {
+		mod *= 10
+	}
+	return ShortAuthString(binary.BigEndian.Uint64(hash) % mod)
+}
+
+// Digits of this ShortAuthString, e.g., "042 917".
+func (sas ShortAuthString) Digits() string {
+	digits := fmt.Sprintf("%0*d", sasDigits, uint32(sas))
+	return digits[:sasDigits/2] + " " + digits[sasDigits/2:]
+}
+
+func (sas ShortAuthString) String() string {
+	return sas.Digits()
+}
+
+// sasTranscript concatenates the X3DH transcript in the order of the
+// handshake, independent of our own Role: the initiator's identity key, the
+// responder's identity key, the initiator's signed prekey, the responder's
+// ephemeral key, and the initiator's revealed nonce, if any.
+func sasTranscript(initiatorIdKey, responderIdKey, spKey, eKey, nonce []byte) (transcript []byte) {
+	for _, part := range [][]byte{initiatorIdKey, responderIdKey, spKey, eKey, nonce} {
+		transcript = append(transcript, part...)
+	}
+	return
+}
+
+// newSasNonce creates Alice's random nonce for the commit-then-reveal step.
+func newSasNonce() (nonce []byte, err error) {
+	nonce = make([]byte, sasNonceSize)
+	_, err = rand.Read(nonce)
+	return
+}
+
+// sasCommitment is Alice's commitment to her nonce, a SHA-256 hash.
+func sasCommitment(nonce []byte) []byte {
+	commitment := sha256.Sum256(nonce)
+	return commitment[:]
+}
+
+// revealSasNonce checks Alice's revealed nonce against her commitment, pending
+// in sasCommit, and completes the transcript.
+func (sess *Session) revealSasNonce(nonce []byte) error {
+	if len(nonce) != sasNonceSize || !hmac.Equal(sasCommitment(nonce), sess.sasCommit) {
+		return fmt.Errorf("revealed nonce does not match its commitment")
+	}
+
+	sess.transcript = append(sess.transcript, nonce...)
+	sess.sasCommit = nil
+	return nil
+}
+
+// ShortAuthString returns this Session's short authentication string.
+//
+// Both parties of an established Session have the same string, unless there
+// is a MITM. This requires a committed nonce within the handshake, i.e., an
+// X3DH handshake with KeyConfirmation, a HandshakeNoiseXX, or a PAKE. Bob's
+// string is available after Alice's reveal, her key confirmation resp. her
+// final Noise message.
+//
+// Please note that this derivation is expensive on purpose, taking some time
+// and memory on its first call. The result is cached afterwards.
+func (sess *Session) ShortAuthString() (sas ShortAuthString, err error) {
+	if sess.doubleRatchet == nil || sess.transcript == nil {
+		err = fmt.Errorf("cannot derive a short authentication string without an active session with a committed handshake")
+		return
+	} else if sess.sasCommit != nil {
+		err = fmt.Errorf("cannot derive a short authentication string before the peer's reveal")
+		return
+	}
+
+	if sess.sas == nil {
+		sas = newShortAuthString(sess.transcript)
+		sess.sas = &sas
+	}
+	return *sess.sas, nil
+}
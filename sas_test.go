@@ -0,0 +1,138 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package xochimilco
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestShortAuthStringKat(t *testing.T) {
+	transcript := sasTranscript(
+		bytes.Repeat([]byte{0x01}, 32), bytes.Repeat([]byte{0x02}, 32),
+		bytes.Repeat([]byte{0x03}, 32), bytes.Repeat([]byte{0x04}, 32), nil)
+
+	if sas := newShortAuthString(transcript); sas.Digits() != "983 393" {
+		t.Fatalf("unexpected short authentication string, %v", sas)
+	}
+
+	if sas := ShortAuthString(42); sas.String() != "000 042" {
+		t.Fatalf("digits are not padded, %v", sas)
+	}
+}
+
+// testSasPair creates two Sessions with a committed X3DH handshake.
+func testSasPair(t *testing.T) (alice, bob *Session) {
+	alice, bob = testSessionPair(t)
+	alice.KeyConfirmation = true
+	return
+}
+
+// testSasEstablish establishes a Session including Alice's reveal.
+func testSasEstablish(t *testing.T, alice, bob *Session) {
+	testSessionEstablish(t, alice, bob)
+
+	if _, err := bob.ShortAuthString(); err == nil {
+		t.Fatal("short authentication string was returned before the reveal")
+	}
+
+	confirmMsg, err := alice.Confirm()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := bob.Receive(confirmMsg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionShortAuthString(t *testing.T) {
+	alice, bob := testSasPair(t)
+
+	if _, err := alice.ShortAuthString(); err == nil {
+		t.Fatal("inactive Session returned a short authentication string")
+	}
+
+	testSasEstablish(t, alice, bob)
+
+	aliceSas, err := alice.ShortAuthString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobSas, err := bob.ShortAuthString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aliceSas != bobSas {
+		t.Fatalf("short authentication strings differ, %v %v", aliceSas, bobSas)
+	}
+
+	// Mallory sits between Alice and Bob, resulting in two handshakes.
+	alice, malloryBob := testSasPair(t)
+	malloryAlice, bob := testSasPair(t)
+	testSasEstablish(t, alice, malloryBob)
+	testSasEstablish(t, malloryAlice, bob)
+
+	aliceSas, _ = alice.ShortAuthString()
+	bobSas, _ = bob.ShortAuthString()
+	if aliceSas == bobSas {
+		t.Fatalf("short authentication strings are equal with a MITM, %v", aliceSas)
+	}
+
+	if _, err := bob.Close(); err != nil {
+		t.Fatal(err)
+	} else if _, err := bob.ShortAuthString(); err == nil {
+		t.Fatal("closed Session returned a short authentication string")
+	}
+}
+
+func TestSessionShortAuthStringUncommitted(t *testing.T) {
+	alice, bob := testSessionPair(t)
+	testSessionEstablish(t, alice, bob)
+	testSessionExchange(t, alice, bob, "hello bob")
+
+	for _, sess := range []*Session{alice, bob} {
+		if _, err := sess.ShortAuthString(); err == nil {
+			t.Fatal("uncommitted handshake returned a short authentication string")
+		}
+	}
+}
+
+func TestSessionShortAuthStringReveal(t *testing.T) {
+	alice, bob := testSasPair(t)
+	testSessionEstablish(t, alice, bob)
+
+	confirmMsg, err := alice.Confirm()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, _, confirmIf, err := unmarshalVersionedMessage(confirmMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	confirm := confirmIf.(*confirmMessage)
+
+	// Neither another nonce nor a missing one is accepted.
+	for _, forged := range []confirmMessage{
+		{mac: confirm.mac, nonce: bytes.Repeat([]byte{0x23}, sasNonceSize)},
+		{mac: confirm.mac},
+	} {
+		forgedMsg, err := marshalVersionedMessage(version, sessConfirm, forged)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err := bob.Receive(forgedMsg); err == nil {
+			t.Fatal("forged reveal was accepted")
+		} else if _, err := bob.ShortAuthString(); err == nil {
+			t.Fatal("short authentication string was returned after a forged reveal")
+		}
+	}
+
+	if _, _, _, err := bob.Receive(confirmMsg); err != nil {
+		t.Fatal(err)
+	} else if _, err := bob.ShortAuthString(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,144 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This file implements locating encoded messages within arbitrary text.
+//
+// Chat clients might embed an encoded message within other text, e.g., a
+// signature, or might wrap long lines. Thus, messages are searched by their
+// Prefix and Suffix, ignoring all whitespace in between.
+
+package xochimilco
+
+import (
+	"bufio"
+	"strings"
+	"unicode"
+)
+
+// Span of an encoded message found within a text.
+type Span struct {
+	// Start and End are the byte offsets of this span within the text,
+	// including the Prefix and Suffix. Thus, text[Start:End] might be replaced,
+	// e.g., by the decrypted plaintext.
+	Start, End int
+
+	// Message is the encoded message without any whitespace. It might be
+	// passed to, e.g., Receive.
+	Message string
+}
+
+// stripSpace removes all whitespace from a string.
+func stripSpace(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// nextMessage searches the first valid encoded message within a text.
+func nextMessage(text string) (span Span, ok bool) {
+	for offset := 0; offset < len(text); {
+		start := strings.Index(text[offset:], Prefix)
+		if start < 0 {
+			return
+		}
+		start += offset
+
+		end := strings.Index(text[start+len(Prefix):], Suffix)
+		if end < 0 {
+			return
+		}
+		end += start + len(Prefix) + len(Suffix)
+
+		// Another Prefix before the Suffix starts the actual message.
+		start += strings.LastIndex(text[start:end-len(Suffix)], Prefix)
+
+		msg := stripSpace(text[start:end])
+		if _, _, _, err := unmarshalVersionedMessage(msg); err == nil {
+			span, ok = Span{Start: start, End: end, Message: msg}, true
+			return
+		}
+
+		offset = end
+	}
+
+	return
+}
+
+// FindMessages locates all valid encoded messages within a text.
+//
+// Whitespace within a message, e.g., from line wrapping, is ignored. Text
+// between the Prefix and the Suffix not forming a valid message is skipped.
+func FindMessages(text string) (spans []Span) {
+	for offset := 0; offset < len(text); {
+		span, ok := nextMessage(text[offset:])
+		if !ok {
+			break
+		}
+
+		span.Start += offset
+		span.End += offset
+		spans = append(spans, span)
+
+		offset = span.End
+	}
+
+	return
+}
+
+// scanMaxMessage is ScanMessages' default limit of a message's length. It is
+// below bufio.MaxScanTokenSize, so that a default bufio.Scanner's buffer is
+// not exceeded by a stray Prefix.
+const scanMaxMessage = bufio.MaxScanTokenSize / 2
+
+// ScanMessages is a bufio.SplitFunc, returning each valid encoded message
+// within the input without any whitespace; FindMessages. All other input is
+// discarded.
+//
+// A Prefix without a Suffix within 32 KiB is skipped. For longer messages, use
+// ScanMessagesLimit and enlarge the bufio.Scanner's buffer by its Buffer
+// method accordingly.
+func ScanMessages(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	return scanMessages(data, atEOF, scanMaxMessage)
+}
+
+// ScanMessagesLimit creates a bufio.SplitFunc like ScanMessages, skipping a
+// Prefix without a Suffix within limit bytes. The limit must be below the
+// bufio.Scanner's maximum buffer size.
+func ScanMessagesLimit(limit int) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		return scanMessages(data, atEOF, limit)
+	}
+}
+
+// scanMessages implements ScanMessages with a variable limit.
+func scanMessages(data []byte, atEOF bool, limit int) (advance int, token []byte, err error) {
+	text := string(data)
+
+	if span, ok := nextMessage(text); ok {
+		advance, token = span.End, []byte(span.Message)
+		return
+	}
+
+	if atEOF {
+		advance = len(data)
+		return
+	}
+
+	// Keep a started message resp. a potentially partial Prefix at the end.
+	// A stray Prefix without a Suffix within the limit is skipped. Otherwise,
+	// the bufio.Scanner would request more data until its buffer is exceeded.
+	if pending := strings.LastIndex(text, Prefix); pending >= 0 && !strings.Contains(text[pending:], Suffix) {
+		if len(text)-pending > limit {
+			advance = pending + len(Prefix)
+		} else {
+			advance = pending
+		}
+	} else if len(text) >= len(Prefix) {
+		advance = len(text) - len(Prefix) + 1
+	}
+	return
+}
@@ -0,0 +1,135 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package xochimilco
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFindMessages(t *testing.T) {
+	msg1, err := marshalMessage(sessData, dataMessage{1, 2, 3, 4, 5, 6, 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg2, err := marshalVersionedMessage(Protocol1, sessData, dataMessage{8, 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// msg1 wrapped after its type.
+	msg1Wrapped := msg1[:5] + "\n  " + msg1[5:]
+
+	testcases := []struct {
+		text  string
+		spans []Span
+	}{
+		{"", nil},
+		{"hello world", nil},
+		{msg1, []Span{{0, len(msg1), msg1}}},
+		{"hey " + msg1 + " sent from my phone", []Span{{4, 4 + len(msg1), msg1}}},
+		{msg1 + msg2, []Span{{0, len(msg1), msg1}, {len(msg1), len(msg1) + len(msg2), msg2}}},
+		{msg1Wrapped + " " + msg2, []Span{
+			{0, len(msg1Wrapped), msg1},
+			{len(msg1Wrapped) + 1, len(msg1Wrapped) + 1 + len(msg2), msg2},
+		}},
+		{"!XO! oops " + msg1, []Span{{10, 10 + len(msg1), msg1}}},
+		{Prefix + "invalid" + Suffix + msg2, []Span{{15, 15 + len(msg2), msg2}}},
+		{msg1[:len(msg1)-1], nil},
+	}
+
+	for _, testcase := range testcases {
+		spans := FindMessages(testcase.text)
+		if !reflect.DeepEqual(spans, testcase.spans) {
+			t.Errorf("%q: spans differ, %v %v", testcase.text, spans, testcase.spans)
+		}
+
+		for _, span := range spans {
+			if _, _, _, err := unmarshalVersionedMessage(span.Message); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+}
+
+func TestScanMessages(t *testing.T) {
+	var msgs []string
+	for i := 0; i < 64; i++ {
+		msg, err := marshalMessage(sessData, dataMessage(strings.Repeat("x", i+1)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+
+	var input strings.Builder
+	for i, msg := range msgs {
+		input.WriteString("<alice> ")
+		if i%2 == 0 {
+			input.WriteString(msg[:len(msg)/2] + "\n" + msg[len(msg)/2:])
+		} else {
+			input.WriteString(msg)
+		}
+		input.WriteString(" !XO! no message here\n")
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(input.String()))
+	scanner.Buffer(make([]byte, 64), 4096)
+	scanner.Split(ScanMessages)
+
+	var found []string
+	for scanner.Scan() {
+		found = append(found, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(found, msgs) {
+		t.Fatalf("found messages differ, %d %d", len(found), len(msgs))
+	}
+}
+
+func TestScanMessagesStrayPrefix(t *testing.T) {
+	msg, err := marshalMessage(sessData, dataMessage{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var input strings.Builder
+	input.WriteString("<mallory> " + Prefix + "\n")
+	for i := 0; i < 1000; i++ {
+		input.WriteString("<mallory> " + strings.Repeat("lorem ipsum ", 6) + "\n")
+	}
+	input.WriteString("<alice> " + msg + "\n")
+
+	splits := []struct {
+		split  bufio.SplitFunc
+		buffer int
+	}{
+		{ScanMessages, bufio.MaxScanTokenSize},
+		{ScanMessagesLimit(1024), 4096},
+	}
+
+	for _, s := range splits {
+		scanner := bufio.NewScanner(strings.NewReader(input.String()))
+		scanner.Buffer(make([]byte, 64), s.buffer)
+		scanner.Split(s.split)
+
+		var found []string
+		for scanner.Scan() {
+			found = append(found, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(found, []string{msg}) {
+			t.Fatalf("found messages differ, %v", found)
+		}
+	}
+}
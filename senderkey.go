@@ -0,0 +1,253 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This file implements group messages based on Sender Keys.
+//
+// Each group member creates a SenderKey for the group and sends its
+// SenderKeyDistribution to each other member through their pairwise Session,
+// e.g., by SendSenderKey. The other members create a PeerSenderKey from it.
+// Afterwards, a group message is encrypted once by the SenderKey and might be
+// decrypted by each member's PeerSenderKey. For details on the cryptography,
+// please refer to the senderkey package.
+
+package xochimilco
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/oxzi/xochimilco/senderkey"
+)
+
+// senderKeyMagic starts each marshalled SenderKeyDistribution.
+const senderKeyMagic = "\x00XOK"
+
+// groupProtocol is the ProtocolVersion of group messages.
+const groupProtocol = Protocol1
+
+// SenderKey is this party's state to encrypt messages for one group.
+//
+// A SenderKey should be replaced by a new one if a member leaves the group.
+// Otherwise, the former member is able to decrypt all future messages.
+type SenderKey struct {
+	groupID []byte
+	sender  *senderkey.Sender
+}
+
+// NewSenderKey creates a new SenderKey for a group, identified by an arbitrary
+// non-empty group ID.
+func NewSenderKey(groupID []byte) (sk *SenderKey, err error) {
+	if len(groupID) == 0 || len(groupID) >= 1<<16 {
+		err = fmt.Errorf("group ID MUST be between 1 and %d bytes", 1<<16-1)
+		return
+	}
+
+	sender, err := senderkey.NewSender()
+	if err != nil {
+		return
+	}
+
+	sk = &SenderKey{
+		groupID: append([]byte{}, groupID...),
+		sender:  sender,
+	}
+	return
+}
+
+// GroupID of this SenderKey's group.
+func (sk *SenderKey) GroupID() []byte {
+	return sk.groupID
+}
+
+// Distribution of this SenderKey, to be sent to each other member through a
+// Session; SendSenderKey.
+func (sk *SenderKey) Distribution() *SenderKeyDistribution {
+	return &SenderKeyDistribution{
+		GroupID: sk.groupID,
+		Key:     sk.sender.Distribution(),
+	}
+}
+
+// Encrypt a plaintext as a group message, to be sent to all members.
+func (sk *SenderKey) Encrypt(plaintext []byte) (groupMsg string, err error) {
+	data, err := sk.sender.Encrypt(plaintext, sk.groupID)
+	if err != nil {
+		return
+	}
+
+	return marshalVersionedMessage(groupProtocol, sessGroup, groupMessage{
+		groupID: sk.groupID,
+		data:    data,
+	})
+}
+
+// SenderKeyDistribution is the public part of a member's SenderKey.
+//
+// It MUST only be sent through a Session, e.g., by SendSenderKey, as it holds
+// the chain key to decrypt group messages.
+type SenderKeyDistribution struct {
+	// GroupID identifies the group.
+	GroupID []byte
+
+	// Key is the Sender Key's state.
+	Key senderkey.Distribution
+}
+
+// MarshalBinary encodes a SenderKeyDistribution:
+//
+//	magic "\x00XOK" (4 byte) | group ID length (2 byte) | group ID | key (72 byte)
+//
+// All integers are encoded in network byte order.
+func (dist SenderKeyDistribution) MarshalBinary() (data []byte, err error) {
+	if len(dist.GroupID) == 0 || len(dist.GroupID) >= 1<<16 {
+		err = fmt.Errorf("group ID MUST be between 1 and %d bytes", 1<<16-1)
+		return
+	}
+
+	keyData, err := dist.Key.MarshalBinary()
+	if err != nil {
+		return
+	}
+
+	b := new(bytes.Buffer)
+	_, _ = b.WriteString(senderKeyMagic)
+	_ = binary.Write(b, binary.BigEndian, uint16(len(dist.GroupID)))
+	_, _ = b.Write(dist.GroupID)
+	_, _ = b.Write(keyData)
+
+	data = b.Bytes()
+	return
+}
+
+// UnmarshalBinary decodes a SenderKeyDistribution, e.g., a plaintext from
+// Receive. An error is returned for any other data.
+func (dist *SenderKeyDistribution) UnmarshalBinary(data []byte) (err error) {
+	if len(data) < len(senderKeyMagic)+2 || !bytes.HasPrefix(data, []byte(senderKeyMagic)) {
+		return fmt.Errorf("data is not a sender key distribution")
+	}
+	data = data[len(senderKeyMagic):]
+
+	l := int(binary.BigEndian.Uint16(data[:2]))
+	data = data[2:]
+	if l == 0 || len(data) < l {
+		return fmt.Errorf("sender key distribution has an invalid group ID length")
+	}
+
+	dist.GroupID = append([]byte{}, data[:l]...)
+	return dist.Key.UnmarshalBinary(data[l:])
+}
+
+// SendSenderKey sends a SenderKeyDistribution to the other party.
+//
+// This is a shortcut for Send with the marshalled SenderKeyDistribution. The
+// other party might detect it by unmarshalling Receive's plaintext and create
+// a PeerSenderKey.
+func (sess *Session) SendSenderKey(dist *SenderKeyDistribution) (dataMsg string, err error) {
+	data, err := dist.MarshalBinary()
+	if err != nil {
+		return
+	}
+
+	return sess.Send(data)
+}
+
+// PeerSenderKey is another member's Sender Key to decrypt their group messages.
+type PeerSenderKey struct {
+	groupID  []byte
+	member   ed25519.PublicKey
+	receiver *senderkey.Receiver
+}
+
+// NewPeerSenderKey creates a PeerSenderKey for a member's distribution.
+//
+// The member's identity key MUST be the one of the Session the distribution
+// was received through; Session.PeerIdentityKey.
+func NewPeerSenderKey(member ed25519.PublicKey, dist *SenderKeyDistribution) (psk *PeerSenderKey, err error) {
+	if len(member) != ed25519.PublicKeySize {
+		err = fmt.Errorf("member's identity key MUST be of %d bytes", ed25519.PublicKeySize)
+		return
+	} else if len(dist.GroupID) == 0 {
+		err = fmt.Errorf("group ID MUST NOT be empty")
+		return
+	}
+
+	receiver, err := senderkey.NewReceiver(dist.Key)
+	if err != nil {
+		return
+	}
+
+	psk = &PeerSenderKey{
+		groupID:  append([]byte{}, dist.GroupID...),
+		member:   append(ed25519.PublicKey{}, member...),
+		receiver: receiver,
+	}
+	return
+}
+
+// GroupID of this PeerSenderKey's group.
+func (psk *PeerSenderKey) GroupID() []byte {
+	return psk.groupID
+}
+
+// Member is the identity key of this PeerSenderKey's member.
+func (psk *PeerSenderKey) Member() ed25519.PublicKey {
+	return psk.member
+}
+
+// KeyID identifies the member's SenderKey; GroupMessageInfo.
+func (psk *PeerSenderKey) KeyID() uint32 {
+	return psk.receiver.KeyID()
+}
+
+// Decrypt a group message from this member.
+//
+// Lost or out-of-order messages are supported within a limited window. Each
+// message can only be decrypted once.
+func (psk *PeerSenderKey) Decrypt(groupMsg string) (plaintext []byte, err error) {
+	msg, err := unmarshalGroupMessage(groupMsg)
+	if err != nil {
+		return
+	}
+
+	if !bytes.Equal(msg.groupID, psk.groupID) {
+		err = fmt.Errorf("group message belongs to another group")
+		return
+	}
+
+	return psk.receiver.Decrypt(msg.data, psk.groupID)
+}
+
+// GroupMessageInfo returns a group message's group ID and the key ID of its
+// sender's SenderKey, e.g., to select the matching PeerSenderKey.
+func GroupMessageInfo(groupMsg string) (groupID []byte, keyID uint32, err error) {
+	msg, err := unmarshalGroupMessage(groupMsg)
+	if err != nil {
+		return
+	}
+
+	groupID = msg.groupID
+	keyID, err = senderkey.MessageKeyID(msg.data)
+	return
+}
+
+// unmarshalGroupMessage parses an encoded sessGroup message.
+func unmarshalGroupMessage(groupMsg string) (msg *groupMessage, err error) {
+	version, msgType, msgIf, err := unmarshalVersionedMessage(groupMsg)
+	if err != nil {
+		return
+	}
+
+	if msgType != sessGroup {
+		err = fmt.Errorf("received message type %d instead of a group message", msgType)
+		return
+	} else if version != groupProtocol {
+		err = fmt.Errorf("received protocol version %d instead of %d", version, groupProtocol)
+		return
+	}
+
+	msg = msgIf.(*groupMessage)
+	return
+}
@@ -0,0 +1,94 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This file implements the KDF and AEAD functions of the sender chain.
+
+package senderkey
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// msgKeyInfo is the HKDF's info to expand a message key.
+const msgKeyInfo = "Xochimilco Sender Key"
+
+// chainKdf returns a pair (32-byte chain key, 32-byte message key) from the
+// previous chain key.
+//
+// Internally an HMAC with SHA-256 is used, with 0x01 as the message key's and
+// 0x02 as the chain key's constant.
+func chainKdf(ckIn []byte) (ckOut, msgKey []byte, err error) {
+	if len(ckIn) != 32 {
+		return nil, nil, fmt.Errorf("input chain key MUST be of 32 bytes")
+	}
+
+	for i, k := range []*[]byte{&msgKey, &ckOut} {
+		mac := hmac.New(sha256.New, ckIn)
+		if _, err = mac.Write([]byte{byte(i + 1)}); err != nil {
+			return
+		}
+		*k = mac.Sum(nil)
+	}
+
+	return
+}
+
+// encryptParams derives the ChaCha20-Poly1305 key and nonce from a message key
+// by an HKDF with SHA-256.
+func encryptParams(msgKey []byte) (key, nonce []byte, err error) {
+	if len(msgKey) != 32 {
+		err = fmt.Errorf("message key MUST be of 32 bytes")
+		return
+	}
+
+	key = make([]byte, chacha20poly1305.KeySize)
+	nonce = make([]byte, chacha20poly1305.NonceSize)
+
+	kdf := hkdf.New(sha256.New, msgKey, nil, []byte(msgKeyInfo))
+	for _, k := range []*[]byte{&key, &nonce} {
+		if _, err = io.ReadFull(kdf, *k); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// encrypt returns the AEAD encryption of plaintext with a message key. The
+// associated data is authenticated but is not included in the ciphertext.
+func encrypt(msgKey, plaintext, associatedData []byte) (ciphertext []byte, err error) {
+	key, nonce, err := encryptParams(msgKey)
+	if err != nil {
+		return
+	}
+
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return
+	}
+
+	ciphertext = aead.Seal(nil, nonce, plaintext, associatedData)
+	return
+}
+
+// decrypt returns the AEAD decryption of ciphertext with a message key.
+func decrypt(msgKey, ciphertext, associatedData []byte) (plaintext []byte, err error) {
+	key, nonce, err := encryptParams(msgKey)
+	if err != nil {
+		return
+	}
+
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return
+	}
+
+	return aead.Open(nil, nonce, ciphertext, associatedData)
+}
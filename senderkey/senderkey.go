@@ -0,0 +1,302 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Package senderkey implements Sender Keys for encrypted group messages.
+//
+// Instead of encrypting a group message for each member over pairwise
+// sessions, each member creates a Sender for each group, consisting of a
+// symmetric chain key and an Ed25519 signing key. Its public part, the
+// Distribution, is sent once to each other member over a pairwise session,
+// e.g., a Double Ratchet. Afterwards, each group message is encrypted once and
+// might be decrypted by all members holding a Receiver for this Distribution.
+//
+// The chain key is ratcheted forward for each message, like a symmetric chain
+// of the Double Ratchet. Thus, a compromised state does not reveal previous
+// messages. However, there is no DH ratchet, i.e., a compromised chain key
+// reveals all future messages until a new Sender is distributed.
+//
+// As all members know the chain key, each message is signed by the Sender's
+// signing key. Otherwise, each member might forge messages in another one's
+// name. The signature is verified before decryption.
+//
+// The chain's KDF is an HMAC with SHA-256, using the constants 0x01 for the
+// message key and 0x02 for the next chain key. The message key is expanded by
+// an HKDF into a key and a nonce for ChaCha20-Poly1305.
+//
+// A window allows receiving lost or out-of-order messages. Up to 256 message
+// keys might be skipped and are cached until the window has moved on.
+package senderkey
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// maxSkip is the size of the window of skipped message keys. A message might
+// be at most maxSkip iterations ahead and a skipped message key is cached for
+// maxSkip iterations.
+const maxSkip = 256
+
+// headerLen is the length of a message's header, a key ID and an iteration,
+// both as uint32.
+const headerLen = 4 + 4
+
+// Sender is a group member's own state to encrypt group messages.
+type Sender struct {
+	keyID     uint32
+	iteration uint32
+	chainKey  []byte
+	sigPriv   ed25519.PrivateKey
+}
+
+// NewSender creates a new Sender with a random key ID, chain key, and signing
+// key.
+func NewSender() (s *Sender, err error) {
+	s = &Sender{chainKey: make([]byte, 32)}
+
+	var keyID [4]byte
+	if _, err = rand.Read(keyID[:]); err != nil {
+		return
+	}
+	s.keyID = binary.BigEndian.Uint32(keyID[:])
+
+	if _, err = rand.Read(s.chainKey); err != nil {
+		return
+	}
+
+	_, s.sigPriv, err = ed25519.GenerateKey(nil)
+	return
+}
+
+// KeyID is this Sender's random identifier, part of each message.
+func (s *Sender) KeyID() uint32 {
+	return s.keyID
+}
+
+// Distribution of this Sender's current state to another group member.
+//
+// A Receiver created from this Distribution is able to decrypt all following
+// messages, but no previous ones.
+func (s *Sender) Distribution() Distribution {
+	return Distribution{
+		KeyID:      s.keyID,
+		Iteration:  s.iteration,
+		ChainKey:   append([]byte{}, s.chainKey...),
+		SigningKey: s.sigPriv.Public().(ed25519.PublicKey),
+	}
+}
+
+// Encrypt a plaintext for the group. The associated data, e.g., a group
+// identifier, is authenticated but not included in the message.
+//
+// The message consists of the header, the ciphertext, and the signature:
+//
+//	key ID (4 byte) | iteration (4 byte) | ciphertext | signature (64 byte)
+func (s *Sender) Encrypt(plaintext, associatedData []byte) (msg []byte, err error) {
+	if s.iteration == math.MaxUint32 {
+		err = fmt.Errorf("sender chain is exhausted")
+		return
+	}
+
+	chainKey, msgKey, err := chainKdf(s.chainKey)
+	if err != nil {
+		return
+	}
+
+	msg = make([]byte, headerLen)
+	binary.BigEndian.PutUint32(msg[:4], s.keyID)
+	binary.BigEndian.PutUint32(msg[4:], s.iteration)
+
+	ciphertext, err := encrypt(msgKey, plaintext, append(append([]byte{}, msg...), associatedData...))
+	if err != nil {
+		return
+	}
+	msg = append(msg, ciphertext...)
+	msg = append(msg, ed25519.Sign(s.sigPriv, msg)...)
+
+	s.chainKey, s.iteration = chainKey, s.iteration+1
+	return
+}
+
+// Receiver is the state to decrypt another group member's messages.
+type Receiver struct {
+	keyID      uint32
+	iteration  uint32
+	chainKey   []byte
+	signingKey ed25519.PublicKey
+
+	skipped map[uint32][]byte
+}
+
+// NewReceiver creates a Receiver for another member's Distribution.
+func NewReceiver(dist Distribution) (r *Receiver, err error) {
+	if len(dist.ChainKey) != 32 {
+		err = fmt.Errorf("chain key MUST be of 32 bytes")
+		return
+	} else if len(dist.SigningKey) != ed25519.PublicKeySize {
+		err = fmt.Errorf("signing key MUST be of %d bytes", ed25519.PublicKeySize)
+		return
+	}
+
+	r = &Receiver{
+		keyID:      dist.KeyID,
+		iteration:  dist.Iteration,
+		chainKey:   append([]byte{}, dist.ChainKey...),
+		signingKey: append(ed25519.PublicKey{}, dist.SigningKey...),
+		skipped:    make(map[uint32][]byte),
+	}
+	return
+}
+
+// KeyID is the identifier of the Sender, this Receiver belongs to.
+func (r *Receiver) KeyID() uint32 {
+	return r.keyID
+}
+
+// MessageKeyID returns the key ID of a message, identifying its Sender.
+func MessageKeyID(msg []byte) (keyID uint32, err error) {
+	if len(msg) < headerLen {
+		err = fmt.Errorf("message is too short")
+		return
+	}
+
+	keyID = binary.BigEndian.Uint32(msg[:4])
+	return
+}
+
+// Decrypt a message from the Sender. The associated data MUST be the same as
+// passed to Encrypt.
+//
+// The signature is verified before the state is altered. Each message can only
+// be decrypted once.
+func (r *Receiver) Decrypt(msg, associatedData []byte) (plaintext []byte, err error) {
+	if len(msg) <= headerLen+ed25519.SignatureSize {
+		err = fmt.Errorf("message is too short")
+		return
+	}
+
+	signed, sig := msg[:len(msg)-ed25519.SignatureSize], msg[len(msg)-ed25519.SignatureSize:]
+	if !ed25519.Verify(r.signingKey, signed, sig) {
+		err = fmt.Errorf("message signature is invalid")
+		return
+	}
+
+	header, ciphertext := signed[:headerLen], signed[headerLen:]
+	if keyID := binary.BigEndian.Uint32(header[:4]); keyID != r.keyID {
+		err = fmt.Errorf("message has key ID %d instead of %d", keyID, r.keyID)
+		return
+	}
+	iteration := binary.BigEndian.Uint32(header[4:])
+
+	ad := append(append([]byte{}, header...), associatedData...)
+
+	// A skipped message within the window.
+	if iteration < r.iteration {
+		msgKey, ok := r.skipped[iteration]
+		if !ok {
+			err = fmt.Errorf("message key for iteration %d is not available", iteration)
+			return
+		}
+
+		if plaintext, err = decrypt(msgKey, ciphertext, ad); err != nil {
+			return
+		}
+		delete(r.skipped, iteration)
+		return
+	}
+
+	if iteration-r.iteration > maxSkip {
+		err = fmt.Errorf("cannot skip until %d, maximum is %d", iteration, r.iteration+maxSkip)
+		return
+	}
+
+	// Derive the next keys without altering the state until the decryption
+	// has succeeded.
+	chainKey, skipped := r.chainKey, make(map[uint32][]byte)
+	var msgKey []byte
+	for i := r.iteration; ; i++ {
+		if chainKey, msgKey, err = chainKdf(chainKey); err != nil {
+			return
+		}
+		if i == iteration {
+			break
+		}
+		skipped[i] = msgKey
+	}
+
+	if plaintext, err = decrypt(msgKey, ciphertext, ad); err != nil {
+		return
+	}
+
+	r.chainKey, r.iteration = chainKey, iteration+1
+	for i, k := range skipped {
+		r.skipped[i] = k
+	}
+	for i := range r.skipped {
+		if r.iteration-i > maxSkip {
+			delete(r.skipped, i)
+		}
+	}
+	return
+}
+
+// Distribution is the public part of a Sender, to be sent to each other group
+// member over a pairwise secure channel.
+type Distribution struct {
+	// KeyID identifies the Sender.
+	KeyID uint32
+
+	// Iteration is the chain's position of the next message.
+	Iteration uint32
+
+	// ChainKey is the 32 byte chain key at Iteration.
+	ChainKey []byte
+
+	// SigningKey is the Sender's public Ed25519 signing key.
+	SigningKey ed25519.PublicKey
+}
+
+// distributionLen is the length of a marshalled Distribution.
+const distributionLen = 4 + 4 + 32 + ed25519.PublicKeySize
+
+// MarshalBinary encodes a Distribution:
+//
+//	key ID (4 byte) | iteration (4 byte) | chain key (32 byte) | signing key (32 byte)
+//
+// All integers are encoded in network byte order.
+func (dist Distribution) MarshalBinary() (data []byte, err error) {
+	if len(dist.ChainKey) != 32 {
+		err = fmt.Errorf("chain key MUST be of 32 bytes")
+		return
+	} else if len(dist.SigningKey) != ed25519.PublicKeySize {
+		err = fmt.Errorf("signing key MUST be of %d bytes", ed25519.PublicKeySize)
+		return
+	}
+
+	b := new(bytes.Buffer)
+	_ = binary.Write(b, binary.BigEndian, dist.KeyID)
+	_ = binary.Write(b, binary.BigEndian, dist.Iteration)
+	_, _ = b.Write(dist.ChainKey)
+	_, _ = b.Write(dist.SigningKey)
+
+	data = b.Bytes()
+	return
+}
+
+// UnmarshalBinary decodes a Distribution.
+func (dist *Distribution) UnmarshalBinary(data []byte) (err error) {
+	if len(data) != distributionLen {
+		return fmt.Errorf("distribution MUST be of %d bytes", distributionLen)
+	}
+
+	dist.KeyID = binary.BigEndian.Uint32(data[:4])
+	dist.Iteration = binary.BigEndian.Uint32(data[4:8])
+	dist.ChainKey = append([]byte{}, data[8:40]...)
+	dist.SigningKey = append(ed25519.PublicKey{}, data[40:]...)
+	return
+}
@@ -0,0 +1,194 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package senderkey
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// testSetup creates a Sender and a Receiver for its Distribution.
+func testSetup(t *testing.T) (s *Sender, r *Receiver) {
+	s, err := NewSender()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err = NewReceiver(s.Distribution())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestSenderKeyRoundTrip(t *testing.T) {
+	s, r := testSetup(t)
+	ad := []byte("group")
+
+	for i := 0; i < 16; i++ {
+		plaintext := []byte(fmt.Sprintf("message %d", i))
+
+		msg, err := s.Encrypt(plaintext, ad)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if keyID, err := MessageKeyID(msg); err != nil {
+			t.Fatal(err)
+		} else if keyID != s.KeyID() || keyID != r.KeyID() {
+			t.Fatalf("message has key ID %d instead of %d", keyID, s.KeyID())
+		}
+
+		if out, err := r.Decrypt(msg, ad); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(plaintext, out) {
+			t.Fatalf("plaintext differs: %q != %q", plaintext, out)
+		}
+
+		if _, err := r.Decrypt(msg, ad); err == nil {
+			t.Fatal("replayed message was decrypted")
+		}
+	}
+}
+
+func TestSenderKeyOutOfOrder(t *testing.T) {
+	s, r := testSetup(t)
+
+	msgs := make([][]byte, 8)
+	for i := range msgs {
+		var err error
+		if msgs[i], err = s.Encrypt([]byte{byte(i)}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, i := range []int{3, 0, 7, 1, 2, 6, 4, 5} {
+		if out, err := r.Decrypt(msgs[i], nil); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(out, []byte{byte(i)}) {
+			t.Fatalf("message %d decrypted to %x", i, out)
+		}
+	}
+}
+
+func TestSenderKeyWindow(t *testing.T) {
+	s, r := testSetup(t)
+
+	msgs := make([][]byte, maxSkip+2)
+	for i := range msgs {
+		var err error
+		if msgs[i], err = s.Encrypt([]byte{0x23}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The last message is one iteration too far ahead.
+	if _, err := r.Decrypt(msgs[maxSkip+1], nil); err == nil {
+		t.Fatal("message outside the window was decrypted")
+	}
+
+	// Receiving the second last message moves the window past the first one.
+	if _, err := r.Decrypt(msgs[maxSkip], nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Decrypt(msgs[0], nil); err == nil {
+		t.Fatal("message key outside the window was still cached")
+	}
+	for _, i := range []int{1, maxSkip - 1, maxSkip + 1} {
+		if _, err := r.Decrypt(msgs[i], nil); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+
+	// A Receiver cannot decrypt messages before its Distribution.
+	r2, err := NewReceiver(s.Distribution())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r2.Decrypt(msgs[maxSkip+1], nil); err == nil {
+		t.Fatal("message before the distribution was decrypted")
+	}
+}
+
+func TestSenderKeyInvalid(t *testing.T) {
+	s, r := testSetup(t)
+
+	msg, err := s.Encrypt([]byte("hello"), []byte("group"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.Decrypt(msg, []byte("other group")); err == nil {
+		t.Fatal("message with other associated data was decrypted")
+	}
+
+	for i := range msg {
+		forged := append([]byte{}, msg...)
+		forged[i] ^= 0x01
+		if _, err := r.Decrypt(forged, []byte("group")); err == nil {
+			t.Fatalf("message with a flipped bit at %d was decrypted", i)
+		}
+	}
+
+	// Another member knowing the chain key cannot forge a message.
+	mallory, err := NewSender()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mallory.keyID, mallory.chainKey = s.keyID, r.chainKey
+	forged, err := mallory.Encrypt([]byte("hello"), []byte("group"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Decrypt(forged, []byte("group")); err == nil {
+		t.Fatal("message with a forged signature was decrypted")
+	}
+
+	if out, err := r.Decrypt(msg, []byte("group")); err != nil {
+		t.Fatal(err)
+	} else if string(out) != "hello" {
+		t.Fatalf("plaintext differs: %q", out)
+	}
+
+	if _, err := r.Decrypt(msg[:headerLen], nil); err == nil {
+		t.Fatal("truncated message was decrypted")
+	}
+}
+
+func TestDistributionMarshal(t *testing.T) {
+	s, err := NewSender()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Encrypt(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	dist := s.Distribution()
+	data, err := dist.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(data) != distributionLen {
+		t.Fatalf("marshalled distribution has %d bytes", len(data))
+	}
+
+	var dist2 Distribution
+	if err := dist2.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if dist.KeyID != dist2.KeyID || dist2.Iteration != 1 ||
+		!bytes.Equal(dist.ChainKey, dist2.ChainKey) || !dist.SigningKey.Equal(dist2.SigningKey) {
+		t.Fatalf("distribution differs: %v != %v", dist, dist2)
+	}
+
+	if err := dist2.UnmarshalBinary(data[1:]); err == nil {
+		t.Fatal("truncated distribution was unmarshalled")
+	}
+	if _, err := NewReceiver(Distribution{ChainKey: dist.ChainKey}); err == nil {
+		t.Fatal("distribution without signing key was accepted")
+	}
+}
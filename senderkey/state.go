@@ -0,0 +1,108 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This file implements the serialization of Senders and Receivers, e.g., to
+// persist a group's state. The serialized state contains secret keys and MUST
+// be stored securely.
+
+package senderkey
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+)
+
+// senderLen is the length of a marshalled Sender.
+const senderLen = 4 + 4 + 32 + ed25519.SeedSize
+
+// MarshalBinary encodes a Sender's state:
+//
+//	key ID (4 byte) | iteration (4 byte) | chain key (32 byte) | signing key seed (32 byte)
+//
+// All integers are encoded in network byte order.
+func (s *Sender) MarshalBinary() (data []byte, err error) {
+	b := new(bytes.Buffer)
+	_ = binary.Write(b, binary.BigEndian, s.keyID)
+	_ = binary.Write(b, binary.BigEndian, s.iteration)
+	_, _ = b.Write(s.chainKey)
+	_, _ = b.Write(s.sigPriv.Seed())
+
+	data = b.Bytes()
+	return
+}
+
+// UnmarshalBinary decodes a Sender's state.
+func (s *Sender) UnmarshalBinary(data []byte) (err error) {
+	if len(data) != senderLen {
+		return fmt.Errorf("sender MUST be of %d bytes", senderLen)
+	}
+
+	s.keyID = binary.BigEndian.Uint32(data[:4])
+	s.iteration = binary.BigEndian.Uint32(data[4:8])
+	s.chainKey = append([]byte{}, data[8:40]...)
+	s.sigPriv = ed25519.NewKeyFromSeed(data[40:])
+	return
+}
+
+// MarshalBinary encodes a Receiver's state, followed by its skipped message
+// keys:
+//
+//	key ID (4 byte) | iteration (4 byte) | chain key (32 byte) | signing key (32 byte) |
+//	skipped count (2 byte) | { iteration (4 byte) | message key (32 byte) }
+//
+// All integers are encoded in network byte order.
+func (r *Receiver) MarshalBinary() (data []byte, err error) {
+	dist := Distribution{
+		KeyID:      r.keyID,
+		Iteration:  r.iteration,
+		ChainKey:   r.chainKey,
+		SigningKey: r.signingKey,
+	}
+	if data, err = dist.MarshalBinary(); err != nil {
+		return
+	}
+
+	b := bytes.NewBuffer(data)
+	_ = binary.Write(b, binary.BigEndian, uint16(len(r.skipped)))
+	for i, msgKey := range r.skipped {
+		_ = binary.Write(b, binary.BigEndian, i)
+		_, _ = b.Write(msgKey)
+	}
+
+	data = b.Bytes()
+	return
+}
+
+// UnmarshalBinary decodes a Receiver's state.
+func (r *Receiver) UnmarshalBinary(data []byte) (err error) {
+	if len(data) < distributionLen+2 {
+		return fmt.Errorf("receiver is truncated")
+	}
+
+	var dist Distribution
+	if err = dist.UnmarshalBinary(data[:distributionLen]); err != nil {
+		return
+	}
+	data = data[distributionLen:]
+
+	count := int(binary.BigEndian.Uint16(data[:2]))
+	data = data[2:]
+	if count > maxSkip {
+		return fmt.Errorf("receiver has %d skipped message keys, maximum is %d", count, maxSkip)
+	} else if len(data) != count*(4+32) {
+		return fmt.Errorf("receiver's skipped message keys have an invalid length")
+	}
+
+	skipped := make(map[uint32][]byte, count)
+	for ; len(data) > 0; data = data[4+32:] {
+		skipped[binary.BigEndian.Uint32(data[:4])] = append([]byte{}, data[4:4+32]...)
+	}
+
+	r.keyID, r.iteration = dist.KeyID, dist.Iteration
+	r.chainKey, r.signingKey = dist.ChainKey, dist.SigningKey
+	r.skipped = skipped
+	return
+}
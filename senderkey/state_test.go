@@ -0,0 +1,72 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package senderkey
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestStateMarshal(t *testing.T) {
+	s, r := testSetup(t)
+
+	msgs := make([][]byte, 4)
+	for i := range msgs {
+		var err error
+		if msgs[i], err = s.Encrypt([]byte{byte(i)}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := r.Decrypt(msgs[2], nil); err != nil {
+		t.Fatal(err)
+	}
+
+	sData, err := s.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rData, err := r.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var s2 Sender
+	if err := s2.UnmarshalBinary(sData); err != nil {
+		t.Fatal(err)
+	}
+	var r2 Receiver
+	if err := r2.UnmarshalBinary(rData); err != nil {
+		t.Fatal(err)
+	}
+
+	// The restored Receiver still knows the skipped message keys.
+	for _, i := range []int{0, 1, 3} {
+		if out, err := r2.Decrypt(msgs[i], nil); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(out, []byte{byte(i)}) {
+			t.Fatalf("message %d decrypted to %x", i, out)
+		}
+	}
+
+	// The restored Sender continues its chain.
+	msg, err := s2.Encrypt([]byte("hello"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := r2.Decrypt(msg, nil); err != nil {
+		t.Fatal(err)
+	} else if string(out) != "hello" {
+		t.Fatalf("plaintext differs: %q", out)
+	}
+
+	for _, invalid := range [][]byte{nil, rData[:len(rData)-1], append(rData, 0x00)} {
+		if err := r2.UnmarshalBinary(invalid); err == nil {
+			t.Fatalf("invalid receiver %x was unmarshalled", invalid)
+		}
+	}
+	if err := s2.UnmarshalBinary(sData[1:]); err == nil {
+		t.Fatal("truncated sender was unmarshalled")
+	}
+}
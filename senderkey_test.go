@@ -0,0 +1,197 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package xochimilco
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"reflect"
+	"testing"
+)
+
+// testSenderKeyDistribute sends a SenderKey's distribution from Alice to Bob
+// and returns Bob's PeerSenderKey.
+func testSenderKeyDistribute(t *testing.T, sk *SenderKey, alice, bob *Session) (psk *PeerSenderKey) {
+	dataMsg, err := alice.SendSenderKey(sk.Distribution())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, plaintext, err := bob.Receive(dataMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dist SenderKeyDistribution
+	if err := dist.UnmarshalBinary(plaintext); err != nil {
+		t.Fatal(err)
+	}
+
+	psk, err = NewPeerSenderKey(bob.PeerIdentityKey(), &dist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestSenderKey(t *testing.T) {
+	groupID := []byte("xochimilco group")
+
+	alice, bob := testSessionPair(t)
+	testSessionEstablish(t, alice, bob)
+	alice2, carol := testSessionPair(t)
+	alice2.IdentityKey = alice.IdentityKey
+	carol.VerifyPeer = func(peer ed25519.PublicKey) bool {
+		return peer.Equal(alice.IdentityKey.Public())
+	}
+	testSessionEstablish(t, alice2, carol)
+
+	sk, err := NewSenderKey(groupID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bobPsk := testSenderKeyDistribute(t, sk, alice, bob)
+	carolPsk := testSenderKeyDistribute(t, sk, alice2, carol)
+
+	for _, psk := range []*PeerSenderKey{bobPsk, carolPsk} {
+		if !psk.Member().Equal(alice.IdentityKey.Public()) {
+			t.Fatal("member is not Alice")
+		} else if !bytes.Equal(psk.GroupID(), groupID) {
+			t.Fatalf("group ID differs, %q", psk.GroupID())
+		}
+	}
+
+	for _, plaintext := range []string{"hello group", "", "how are you?"} {
+		groupMsg, err := sk.Encrypt([]byte(plaintext))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if msgGroupID, keyID, err := GroupMessageInfo(groupMsg); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(msgGroupID, groupID) || keyID != bobPsk.KeyID() {
+			t.Fatalf("unexpected group message info, %q %d", msgGroupID, keyID)
+		}
+
+		for _, psk := range []*PeerSenderKey{bobPsk, carolPsk} {
+			if out, err := psk.Decrypt(groupMsg); err != nil {
+				t.Fatal(err)
+			} else if string(out) != plaintext {
+				t.Fatalf("plaintext differs, %q %q", out, plaintext)
+			}
+		}
+	}
+
+	// Group messages are not part of a Session.
+	groupMsg, err := sk.Encrypt([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := bob.Receive(groupMsg); err == nil {
+		t.Fatal("Session accepted a group message")
+	}
+}
+
+func TestSenderKeyInvalid(t *testing.T) {
+	if _, err := NewSenderKey(nil); err == nil {
+		t.Fatal("SenderKey without group ID was created")
+	}
+
+	alice, bob := testSessionPair(t)
+	testSessionEstablish(t, alice, bob)
+
+	sk, err := NewSenderKey([]byte("group"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	psk := testSenderKeyDistribute(t, sk, alice, bob)
+
+	// Another group's message, sharing the same key.
+	other := &SenderKey{groupID: []byte("other"), sender: sk.sender}
+	otherMsg, err := other.Encrypt([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := psk.Decrypt(otherMsg); err == nil {
+		t.Fatal("other group's message was decrypted")
+	}
+
+	// Another member's message, claiming the same group.
+	sk2, err := NewSenderKey([]byte("group"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherMsg, err = sk2.Encrypt([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := psk.Decrypt(otherMsg); err == nil {
+		t.Fatal("other member's message was decrypted")
+	}
+
+	// A regular Session message.
+	dataMsg, err := alice.Send([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := psk.Decrypt(dataMsg); err == nil {
+		t.Fatal("Session message was decrypted")
+	}
+	if _, _, err := GroupMessageInfo(dataMsg); err == nil {
+		t.Fatal("Session message has group message info")
+	}
+
+	if _, err := NewPeerSenderKey(nil, sk.Distribution()); err == nil {
+		t.Fatal("PeerSenderKey without member was created")
+	}
+}
+
+func TestSenderKeyDistributionMarshal(t *testing.T) {
+	sk, err := NewSenderKey([]byte("group"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dist := sk.Distribution()
+	data, err := dist.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dist2 SenderKeyDistribution
+	if err := dist2.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(dist, &dist2) {
+		t.Fatalf("distributions differ, %v %v", dist, dist2)
+	}
+
+	for _, invalid := range [][]byte{
+		nil,
+		[]byte("hello world"),
+		data[:len(data)-1],
+		append(append([]byte{}, data...), 0x00),
+		append([]byte(senderKeyMagic), 0x00, 0x00),
+	} {
+		if err := dist2.UnmarshalBinary(invalid); err == nil {
+			t.Fatalf("invalid distribution %x was unmarshalled", invalid)
+		}
+	}
+
+	var att Attachment
+	if err := att.UnmarshalBinary(data); err == nil {
+		t.Fatal("distribution was unmarshalled as an attachment")
+	}
+
+	groupMsg, err := marshalVersionedMessage(groupProtocol, sessGroup, groupMessage{groupID: []byte("group"), data: []byte{1, 2, 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := unmarshalGroupMessage(groupMsg); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(msg, &groupMessage{groupID: []byte("group"), data: []byte{1, 2, 3}}) {
+		t.Fatalf("group message differs, %v", msg)
+	}
+}
@@ -5,11 +5,15 @@
 package xochimilco
 
 import (
+	"context"
 	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding"
 	"fmt"
 
 	"github.com/oxzi/xochimilco/doubleratchet"
+	"github.com/oxzi/xochimilco/noise"
 	"github.com/oxzi/xochimilco/x3dh"
 )
 
@@ -39,14 +43,167 @@ type Session struct {
 	//
 	// To determine when a key is correct is out of Xochimilco's scope. The key
 	// might be either exchanged over another secure channel or a trust on first
-	// use (TOFU) principle might be used.
+	// use (TOFU) principle might be used. For the latter, a TrustStore provides
+	// a ready-made callback; TrustStore.VerifyPeer.
 	VerifyPeer func(peer ed25519.PublicKey) (valid bool)
 
+	// PeerEstablished is an optional callback, called with the other party's
+	// public key verified by VerifyPeer once the handshake has been completed,
+	// e.g., to pin a new key only afterwards; TrustStore.Pin. An error aborts
+	// the handshake.
+	PeerEstablished func(peer ed25519.PublicKey) error
+
+	// Verifier is a context-aware alternative to VerifyPeer, receiving more
+	// information about the handshake. If set, neither VerifyPeer nor
+	// PeerEstablished is used. An EstablishedVerifier is also informed about
+	// the completed handshake.
+	Verifier Verifier
+
+	// Contact is the other party's claimed contact on the transport, e.g., a
+	// nickname or an address. It is passed to the Verifier within PeerInfo.
+	Contact string
+
+	// UnverifiedPolicy restricts this Session while the Verifier's decision
+	// is deferred; DecisionDefer. By default, sending is blocked.
+	UnverifiedPolicy UnverifiedPolicy
+
+	// X3dhConfig configures the X3DH key agreement, e.g., its KDF version.
+	//
+	// With x3dh.Version1, an application specific Info label and optional
+	// ChannelBinding bytes, e.g., a chat room's identifier, might be set. Both
+	// are mixed into the session key and the Double Ratchet's associated data.
+	// Thus, a Session cannot be confused with another application's or
+	// another chat room's Session.
+	//
+	// Both parties MUST use the same configuration. The zero value keeps the
+	// legacy KDF for compatibility with existing deployments.
+	X3dhConfig x3dh.Config
+
+	// PostQuantum enforces the post-quantum hybrid PQXDH key agreement.
+	//
+	// The active party offers an additional signed ML-KEM-768 key and only
+	// accepts an acknowledgement based on it. The passive party rejects offers
+	// without such a key. Independent of this setting, the passive party always
+	// answers a PQXDH offer accordingly and falls back to the classical X3DH
+	// otherwise.
+	//
+	// PQXDH requires x3dh.Version1 or later within X3dhConfig.
+	PostQuantum bool
+
+	// KeyConfirmation requests resp. requires an explicit key confirmation.
+	//
+	// The active party requests it within the offer and MUST afterwards send
+	// a confirmation, either by Confirm or included in the next Send. The
+	// passive party rejects offers without this request. Independent of this
+	// setting, the passive party honors such a request and rejects messages
+	// before a valid confirmation. The state is reported by PeerConfirmed.
+	//
+	// Furthermore, the key confirmation is required for a ShortAuthString.
+	KeyConfirmation bool
+
+	// EarlyData allows the passive party to include application data within
+	// its acknowledgement; AcknowledgeWithPayload.
+	//
+	// The active party announces this within its offer. The plaintext will be
+	// returned by Receive, together with the established Session. Peers not
+	// supporting extensions reject such an offer.
+	EarlyData bool
+
+	// Protocol is the latest ProtocolVersion this party supports.
+	//
+	// The active party announces all versions up to this one within its offer,
+	// which is still encoded in the legacy format. The passive party chooses
+	// the latest common version and encodes its acknowledgement and all later
+	// messages accordingly. A peer not announcing any version is answered by
+	// ProtocolLegacy, the zero value.
+	//
+	// Both the announced and the chosen version are bound into the Double
+	// Ratchet's associated data. Thus, a downgrade by stripping the
+	// announcement from the offer will be detected.
+	Protocol ProtocolVersion
+
+	// MaxFragmentSize limits the length of each fragment created by Fragment
+	// resp. SendFragments. If unset, messages are not fragmented.
+	MaxFragmentSize int
+
+	// Reassembler collects incoming fragments within Receive. Its limits might
+	// be configured; the zero value uses the defaults.
+	Reassembler Reassembler
+
+	// Encoding of all created messages. Incoming messages' encoding is
+	// detected automatically. The zero value is the default Base64 text.
+	//
+	// Please note that peers not supporting alternative encodings only
+	// understand the default encoding.
+	Encoding Encoding
+
+	// Handshake selects the key agreement protocol of Offer. The zero value is
+	// X3DH. The passive party accepts each supported handshake.
+	//
+	// Please note that the Noise handshakes are interactive and cannot be
+	// used with an offline party.
+	Handshake Handshake
+
+	// NoisePeerKey is the other party's public identity key, required in
+	// advance for HandshakeNoiseIK.
+	NoisePeerKey ed25519.PublicKey
+
 	// private fields //
 
 	// spkPub / spkPriv is the X3DH signed prekey for our opening party.
 	spkPub, spkPriv []byte
 
+	// kemPriv is the ML-KEM-768 private key for our opening party's PQXDH offer.
+	kemPriv []byte
+
+	// pake is our opening party's pending PAKE handshake; PakeOffer.
+	pake *pakeState
+
+	// noiseHs is a pending Noise handshake, either our opening party's offer
+	// or our passive party's PatternXX acknowledgement.
+	noiseHs *noise.HandshakeState
+
+	// noiseFinish is the opening party's final PatternXX handshake message,
+	// to be sent with the next message.
+	noiseFinish []byte
+
+	// earlyData is set if the opening party's offer supports early data.
+	earlyData bool
+
+	// offerData is the opening party's binary offer for the key confirmation.
+	offerData []byte
+
+	// confirmMacSend / confirmMacRecv is the pending key confirmation HMAC to
+	// be sent by the opening resp. received by the passive party.
+	confirmMacSend, confirmMacRecv []byte
+
+	// protocol is the negotiated ProtocolVersion. For the opening party, this
+	// is the latest offered version until the acknowledgement arrives.
+	protocol ProtocolVersion
+
+	// peerIdKey is the other party's identity key, passed to the verification.
+	peerIdKey ed25519.PublicKey
+
+	// peerUnverified is set while the verification's decision is deferred.
+	peerUnverified bool
+
+	// transcript is the X3DH transcript for the ShortAuthString, cached in sas
+	// after its first derivation.
+	transcript []byte
+	sas        *ShortAuthString
+
+	// sasNonce is the opening party's nonce, committed within the offer and to
+	// be revealed. sasCommit is the passive party's received commitment,
+	// pending its reveal.
+	sasNonce, sasCommit []byte
+
+	// peerConfirmed is set if the other party has proven its session key.
+	peerConfirmed bool
+
+	// peerCloseReason / peerCloseText is the other party's last close reason.
+	peerCloseReason CloseReason
+	peerCloseText   string
+
 	// doubleRatchet is the internal Double Ratchet.
 	doubleRatchet *doubleratchet.DoubleRatchet
 }
@@ -55,7 +212,13 @@ type Session struct {
 //
 // This method MUST be called initially by the active resp. opening party
 // (Alice) once. The other party will hopefully Acknowledge this message.
+//
+// The key agreement protocol is selected by Handshake.
 func (sess *Session) Offer() (offerMsg string, err error) {
+	if sess.Handshake != HandshakeX3dh {
+		return sess.offerNoise()
+	}
+
 	spkPub, spkPriv, spkSig, err := x3dh.CreateNewSpk(sess.IdentityKey)
 	if err != nil {
 		return
@@ -63,13 +226,65 @@ func (sess *Session) Offer() (offerMsg string, err error) {
 
 	sess.spkPub = spkPub
 	sess.spkPriv = spkPriv
+	sess.kemPriv = nil
+	sess.pake = nil
+	sess.noiseHs, sess.noiseFinish = nil, nil
 
 	offer := offerMessage{
 		idKey: sess.IdentityKey.Public().(ed25519.PublicKey),
 		spKey: spkPub,
 		spSig: spkSig,
+		ext:   make(extensions),
+	}
+
+	if sess.PostQuantum {
+		if sess.X3dhConfig.Version == x3dh.VersionLegacy {
+			err = fmt.Errorf("PQXDH is not supported by the legacy X3DH version")
+			return
+		}
+
+		var kemPub, kemSig []byte
+		kemPub, sess.kemPriv, kemSig, err = x3dh.CreateNewKemKey(sess.IdentityKey)
+		if err != nil {
+			return
+		}
+
+		offer.ext[extKemPub] = kemPub
+		offer.ext[extKemSig] = kemSig
+	}
+
+	sess.earlyData = sess.EarlyData
+	if sess.EarlyData {
+		offer.ext[extEarlyData] = []byte{}
 	}
-	offerMsg, err = marshalMessage(sessOffer, offer)
+
+	if sess.Protocol > protocolLatest {
+		err = fmt.Errorf("unsupported protocol version %d", sess.Protocol)
+		return
+	} else if sess.Protocol > ProtocolLegacy {
+		offer.ext[extProtocols] = offeredProtocols(sess.Protocol)
+	}
+	sess.protocol = sess.Protocol
+
+	sess.offerData = nil
+	sess.sasNonce, sess.sasCommit = nil, nil
+	if sess.KeyConfirmation {
+		offer.ext[extKeyConfirm] = []byte{}
+
+		// The nonce for the ShortAuthString is revealed with the key
+		// confirmation.
+		if sess.sasNonce, err = newSasNonce(); err != nil {
+			return
+		}
+		offer.ext[extSasCommit] = sasCommitment(sess.sasNonce)
+
+		sess.offerData, err = offer.MarshalBinary()
+		if err != nil {
+			return
+		}
+	}
+
+	offerMsg, err = marshalEncodedMessage(sess.Encoding, ProtocolLegacy, sessOffer, offer)
 	return
 }
 
@@ -80,35 +295,128 @@ func (sess *Session) Offer() (offerMsg string, err error) {
 //
 // At this point, this passive part is able to send and receive messages.
 func (sess *Session) Acknowledge(offerMsg string) (ackMsg string, err error) {
-	msgType, offerIf, err := unmarshalMessage(offerMsg)
+	return sess.AcknowledgeContext(context.Background(), offerMsg, nil)
+}
+
+// AcknowledgeWithPayload works like Acknowledge, but additionally includes an
+// application plaintext within the acknowledgement.
+//
+// This saves a round-trip for protocols where Bob wants to answer immediately.
+// However, this requires Alice to announce her support by EarlyData. Otherwise
+// an error is returned for a non-nil payload.
+//
+// Please note that the payload is sent before Bob has received any proof of
+// Alice's presence, as the offer itself might be replayed. It is still only
+// readable for the owner of the offer's identity key.
+func (sess *Session) AcknowledgeWithPayload(offerMsg string, payload []byte) (ackMsg string, err error) {
+	return sess.AcknowledgeContext(context.Background(), offerMsg, payload)
+}
+
+// AcknowledgeContext works like AcknowledgeWithPayload, passing the context to
+// the Verifier. A nil payload does not include any application data.
+func (sess *Session) AcknowledgeContext(ctx context.Context, offerMsg string, payload []byte) (ackMsg string, err error) {
+	version, msgType, offerIf, err := unmarshalVersionedMessage(offerMsg)
 	if err != nil {
 		return
+	} else if msgType == sessNoiseOffer {
+		return sess.acknowledgeNoise(ctx, offerIf.(*noiseOfferMessage), version, payload)
 	} else if msgType != sessOffer {
 		err = fmt.Errorf("unexpected message type %d", msgType)
 		return
 	}
 	offer := offerIf.(*offerMessage)
 
-	if !sess.VerifyPeer(offer.idKey) {
-		err = fmt.Errorf("verification function refuses public key")
+	if err = sess.verifyPeer(ctx, StepOffer, offer.idKey); err != nil {
+		return
+	}
+
+	if payload != nil {
+		if err = sess.checkSendPolicy(); err != nil {
+			return
+		}
+	}
+
+	_, isEarlyData := offer.ext[extEarlyData]
+	if !isEarlyData && payload != nil {
+		err = fmt.Errorf("offer does not support early data")
 		return
 	}
 
-	sessKey, associatedData, ekPub, err := x3dh.CreateInitialMessage(
-		sess.IdentityKey, offer.idKey, offer.spKey, offer.spSig)
+	_, isConfirm := offer.ext[extKeyConfirm]
+	if !isConfirm && sess.KeyConfirmation {
+		err = fmt.Errorf("offer does not support the required key confirmation")
+		return
+	}
+
+	sasCommit, isSasCommit := offer.ext[extSasCommit]
+	if isSasCommit && (!isConfirm || len(sasCommit) != sha256.Size) {
+		err = fmt.Errorf("offer has an invalid nonce commitment")
+		return
+	}
+
+	if sess.Protocol > protocolLatest {
+		err = fmt.Errorf("unsupported protocol version %d", sess.Protocol)
+		return
+	}
+	protocol := ProtocolLegacy
+	for _, v := range offer.ext[extProtocols] {
+		if v := ProtocolVersion(v); v > protocol && v <= sess.Protocol {
+			protocol = v
+		}
+	}
+
+	kemPub, kemSig := offer.ext[extKemPub], offer.ext[extKemSig]
+	isPq := kemPub != nil || kemSig != nil
+	if !isPq && sess.PostQuantum {
+		err = fmt.Errorf("offer does not support the required PQXDH")
+		return
+	}
+
+	var sessKey, associatedData, ekPub, kemCipher []byte
+	if isPq {
+		sessKey, associatedData, ekPub, kemCipher, err = sess.X3dhConfig.CreatePqInitialMessage(
+			sess.IdentityKey, offer.idKey, offer.spKey, offer.spSig, kemPub, kemSig)
+	} else {
+		sessKey, associatedData, ekPub, err = sess.X3dhConfig.CreateInitialMessage(
+			sess.IdentityKey, offer.idKey, offer.spKey, offer.spSig)
+	}
 	if err != nil {
 		return
 	}
 
+	associatedData = protocolAssociatedData(associatedData, offer.ext[extProtocols], protocol)
+	associatedData = earlyDataAssociatedData(associatedData, isEarlyData)
 	sess.doubleRatchet, err = doubleratchet.CreateActive(sessKey, associatedData, offer.spKey)
 	if err != nil {
 		return
 	}
 
-	// This will be padded up to 32 bytes for AES-256.
-	initialPayload := make([]byte, 23)
-	if _, err = rand.Read(initialPayload); err != nil {
-		return
+	// Without a commitment, there is no ShortAuthString. Otherwise, Alice's
+	// nonce completes the transcript when being revealed.
+	sess.transcript, sess.sas = nil, nil
+	sess.sasNonce, sess.sasCommit = nil, nil
+	if isSasCommit {
+		sess.transcript = sasTranscript(offer.idKey, sess.IdentityKey.Public().(ed25519.PublicKey), offer.spKey, ekPub, nil)
+		sess.sasCommit = append([]byte{}, sasCommit...)
+	}
+
+	// Without early data, this will be padded up to 32 bytes for AES-256. If
+	// early data is supported, a leading byte indicates its presence. As it is
+	// encrypted and the support is bound into the associated data, a MITM can
+	// neither strip nor inject early data.
+	initialPayload := payload
+	if payload == nil {
+		initialPayload = make([]byte, 23)
+		if _, err = rand.Read(initialPayload); err != nil {
+			return
+		}
+	}
+	if isEarlyData {
+		flag := earlyDataAbsent
+		if payload != nil {
+			flag = earlyDataPresent
+		}
+		initialPayload = append([]byte{flag}, initialPayload...)
 	}
 	initialCiphertext, err := sess.doubleRatchet.Encrypt(initialPayload)
 	if err != nil {
@@ -120,44 +428,151 @@ func (sess *Session) Acknowledge(offerMsg string) (ackMsg string, err error) {
 		eKey:   ekPub,
 		cipher: initialCiphertext,
 	}
-	ackMsg, err = marshalMessage(sessAck, ack)
+
+	ackExt := make(extensions)
+	if isPq {
+		ackExt[extKemCipher] = kemCipher
+	}
+
+	var ackType messageType = sessAck
+	var ackBody encoding.BinaryMarshaler = ack
+	if len(ackExt) > 0 {
+		ackType = sessAckExt
+		ackBody = ackExtMessage{ackMessage: ack, ext: ackExt}
+	}
+
+	sess.protocol = protocol
+	sess.confirmMacRecv = nil
+	sess.peerConfirmed = false
+	if isConfirm {
+		var offerData, ackData []byte
+		if offerData, err = offer.MarshalBinary(); err != nil {
+			return
+		}
+		if ackData, err = ackBody.MarshalBinary(); err != nil {
+			return
+		}
+
+		sess.confirmMacRecv, err = confirmMac(sessKey, offerData, ackType, ackData)
+		if err != nil {
+			return
+		}
+	}
+
+	if err = sess.establishedPeer(ctx, StepOffer); err != nil {
+		return
+	}
+
+	ackMsg, err = marshalEncodedMessage(sess.Encoding, sess.protocol, ackType, ackBody)
 	return
 }
 
-// receiveAck deals with incoming sessAck messages.
+// receiveAck deals with incoming sessAck and sessAckExt messages.
 //
 // The active / opening party receives the other party's acknowledgement and
-// tries to establish a Session.
-func (sess *Session) receiveAck(ack *ackMessage) (isEstablished bool, err error) {
+// tries to establish a Session. The extensions of a sessAckExt are passed as
+// ext, being nil for a sessAck. The ackType and ackBody are the received
+// message's type and payload, required for the key confirmation. The version
+// is the ProtocolVersion of the acknowledgement's encoding.
+func (sess *Session) receiveAck(
+	ctx context.Context, ack *ackMessage, ext extensions, ackType messageType, ackBody encoding.BinaryMarshaler, version ProtocolVersion,
+) (isEstablished bool, plaintext []byte, err error) {
 	if sess.doubleRatchet != nil {
 		err = fmt.Errorf("received sessAck while being in an active session")
 		return
 	}
 
-	if !sess.VerifyPeer(ack.idKey) {
-		err = fmt.Errorf("verification function refuses public key")
+	if version > sess.protocol {
+		err = fmt.Errorf("acknowledgement uses the unoffered protocol version %d", version)
+		return
+	}
+
+	if err = sess.verifyPeer(ctx, StepAck, ack.idKey); err != nil {
 		return
 	}
 
-	sessKey, associatedData, err := x3dh.ReceiveInitialMessage(
-		sess.IdentityKey, ack.idKey, sess.spkPriv, ack.eKey)
+	// Early data is indicated within the encrypted initial payload. The
+	// unauthenticated extension is not used anymore.
+	if _, ok := ext[extEarlyData]; ok {
+		err = fmt.Errorf("acknowledgement contains an unexpected early data extension")
+		return
+	}
+
+	// A PQXDH offer MUST be answered as such. Otherwise, a MITM might strip
+	// the ML-KEM-768 key from the offer.
+	var sessKey, associatedData []byte
+	kemCipher := ext[extKemCipher]
+	switch {
+	case sess.kemPriv != nil && kemCipher == nil:
+		err = fmt.Errorf("acknowledgement misses the offered PQXDH")
+	case sess.kemPriv == nil && kemCipher != nil:
+		err = fmt.Errorf("acknowledgement contains an unexpected PQXDH answer")
+	case kemCipher != nil:
+		sessKey, associatedData, err = sess.X3dhConfig.ReceivePqInitialMessage(
+			sess.IdentityKey, ack.idKey, sess.spkPriv, sess.kemPriv, ack.eKey, kemCipher)
+	default:
+		sessKey, associatedData, err = sess.X3dhConfig.ReceiveInitialMessage(
+			sess.IdentityKey, ack.idKey, sess.spkPriv, ack.eKey)
+	}
 	if err != nil {
 		return
 	}
 
+	associatedData = protocolAssociatedData(associatedData, offeredProtocols(sess.protocol), version)
+	associatedData = earlyDataAssociatedData(associatedData, sess.earlyData)
 	sess.doubleRatchet, err = doubleratchet.CreatePassive(
 		sessKey, associatedData, sess.spkPub, sess.spkPriv)
 	if err != nil {
 		return
 	}
 
+	sess.transcript, sess.sas = nil, nil
+	if sess.sasNonce != nil {
+		sess.transcript = sasTranscript(sess.IdentityKey.Public().(ed25519.PublicKey), ack.idKey, sess.spkPub, ack.eKey, sess.sasNonce)
+	}
+
 	sess.spkPub, sess.spkPriv = nil, nil
+	sess.kemPriv = nil
 
-	_, err = sess.doubleRatchet.Decrypt(ack.cipher)
+	initialPayload, err := sess.doubleRatchet.Decrypt(ack.cipher)
 	if err != nil {
 		return
 	}
 
+	if sess.offerData != nil {
+		var ackData []byte
+		if ackData, err = ackBody.MarshalBinary(); err != nil {
+			return
+		}
+
+		sess.confirmMacSend, err = confirmMac(sessKey, sess.offerData, ackType, ackData)
+		if err != nil {
+			return
+		}
+		sess.offerData = nil
+	}
+
+	// Without early data, the initial payload is just random. Otherwise, its
+	// first byte indicates the presence of early data.
+	if sess.earlyData {
+		switch {
+		case len(initialPayload) > 0 && initialPayload[0] == earlyDataPresent:
+			plaintext = initialPayload[1:]
+		case len(initialPayload) > 0 && initialPayload[0] == earlyDataAbsent:
+		default:
+			err = fmt.Errorf("initial payload has an invalid early data indication")
+			return
+		}
+		sess.earlyData = false
+	}
+
+	if err = sess.establishedPeer(ctx, StepAck); err != nil {
+		plaintext = nil
+		return
+	}
+
+	sess.protocol = version
+	sess.peerConfirmed = true
 	isEstablished = true
 	return
 }
@@ -169,8 +584,18 @@ func (sess *Session) receiveData(data *dataMessage) (plaintext []byte, err error
 		return
 	}
 
+	if sess.confirmMacRecv != nil {
+		err = fmt.Errorf("received sessData before the key confirmation")
+		return
+	}
+
 	ciphertext := []byte(*data)
 	plaintext, err = sess.doubleRatchet.Decrypt(ciphertext)
+	if err != nil {
+		return
+	}
+
+	sess.peerConfirmed = true
 	return
 }
 
@@ -180,25 +605,77 @@ func (sess *Session) receiveData(data *dataMessage) (plaintext []byte, err error
 // to this method. The multiple return fields indicate this message's kind.
 //
 // If the active party receives its first (acknowledge) message, this Session
-// will be established; isEstablished. If the other party has signaled to close
-// the Session, isClosed is set. This Session MUST then also be closed down. In
+// will be established; isEstablished. If the other party has included early
+// data, its plaintext is also returned. If the other party has signaled to close
+// the Session, isClosed is set. This Session is then reset, as by Close, and the
+// other party's reason is available by PeerCloseReason. In
 // case of an incoming encrypted message, the plaintext field holds its
 // decrypted plaintext value. Of course, there might also be an error.
+//
+// Fragments are collected until the original message is complete, which is
+// then handled as described. Until then, all return fields are empty.
 func (sess *Session) Receive(msg string) (isEstablished, isClosed bool, plaintext []byte, err error) {
-	msgType, msgIf, err := unmarshalMessage(msg)
+	return sess.ReceiveContext(context.Background(), msg)
+}
+
+// ReceiveContext works like Receive, passing the context to the Verifier.
+func (sess *Session) ReceiveContext(ctx context.Context, msg string) (isEstablished, isClosed bool, plaintext []byte, err error) {
+	version, msgType, msgIf, err := unmarshalVersionedMessage(msg)
 	if err != nil {
 		return
 	}
 
+	// Within an active Session, all messages MUST use the negotiated version.
+	// Unauthenticated close messages are always encoded in the legacy format,
+	// as the other party might not know the negotiated version yet.
+	isUnauthClose := msgType == sessClose && !msgIf.(*closeMessage).isAuthenticated()
+	if sess.doubleRatchet != nil && version != sess.protocol && !(isUnauthClose && version == ProtocolLegacy) {
+		err = fmt.Errorf("received protocol version %d instead of %d", version, sess.protocol)
+		return
+	}
+
 	switch msgType {
 	case sessAck:
-		isEstablished, err = sess.receiveAck(msgIf.(*ackMessage))
+		ack := msgIf.(*ackMessage)
+		isEstablished, plaintext, err = sess.receiveAck(ctx, ack, nil, msgType, ack, version)
+
+	case sessAckExt:
+		ackExt := msgIf.(*ackExtMessage)
+		isEstablished, plaintext, err = sess.receiveAck(ctx, &ackExt.ackMessage, ackExt.ext, msgType, ackExt, version)
+
+	case sessNoiseAck:
+		isEstablished, err = sess.receiveNoiseAck(ctx, msgIf.(*noiseMessage), version)
+
+	case sessNoiseFinish:
+		isEstablished, plaintext, err = sess.receiveNoiseFinish(ctx, msgIf.(*noiseMessage), version)
+
+	case sessPakeAck:
+		isEstablished, err = sess.receivePakeAck(msgIf.(*pakeAckMessage), version)
+
+	case sessConfirm:
+		plaintext, err = sess.receiveConfirm(msgIf.(*confirmMessage))
 
 	case sessData:
 		plaintext, err = sess.receiveData(msgIf.(*dataMessage))
 
 	case sessClose:
-		isClosed = true
+		isClosed, err = sess.receiveClose(*msgIf.(*closeMessage))
+
+	case sessStream:
+		err = fmt.Errorf("received sessStream, which must be passed to ReceiveStream")
+
+	case sessGroup:
+		err = fmt.Errorf("received sessGroup, which must be passed to a PeerSenderKey")
+
+	case sessFragment:
+		var assembledMsg string
+		var isComplete bool
+		assembledMsg, isComplete, err = sess.Reassembler.add(msgIf.(*fragmentMessage))
+		if err != nil || !isComplete {
+			return
+		}
+
+		return sess.ReceiveContext(ctx, assembledMsg)
 
 	default:
 		err = fmt.Errorf("received an unexpected message type %d", msgType)
@@ -218,22 +695,26 @@ func (sess *Session) Send(plaintext []byte) (dataMsg string, err error) {
 		return
 	}
 
+	if err = sess.checkSendPolicy(); err != nil {
+		return
+	}
+
+	if sess.noiseFinish != nil {
+		return sess.finishNoise(plaintext)
+	}
+
 	ciphertext, err := sess.doubleRatchet.Encrypt(plaintext)
 	if err != nil {
 		return
 	}
 
-	dataMsg, err = marshalMessage(sessData, dataMessage(ciphertext))
-	return
-}
-
-// Close this Session and tell the other party to do the same.
-//
-// This resets the internal state. Thus, the same Session might be reused.
-func (sess *Session) Close() (closeMsg string, err error) {
-	sess.spkPub, sess.spkPriv = nil, nil
-	sess.doubleRatchet = nil
+	if sess.confirmMacSend != nil {
+		confirm := confirmMessage{mac: sess.confirmMacSend, nonce: sess.sasNonce, cipher: ciphertext}
+		dataMsg, err = marshalEncodedMessage(sess.Encoding, sess.protocol, sessConfirm, confirm)
+		sess.confirmMacSend, sess.sasNonce = nil, nil
+		return
+	}
 
-	closeMsg, err = marshalMessage(sessClose, closeMessage{0xff})
+	dataMsg, err = marshalEncodedMessage(sess.Encoding, sess.protocol, sessData, dataMessage(ciphertext))
 	return
 }
@@ -5,8 +5,11 @@
 package xochimilco
 
 import (
+	"bytes"
 	"crypto/ed25519"
 	"testing"
+
+	"github.com/oxzi/xochimilco/x3dh"
 )
 
 func TestSessionPingPong(t *testing.T) {
@@ -194,3 +197,529 @@ func TestSessionInvalidVerifyAlice(t *testing.T) {
 		t.Fatal("should fail")
 	}
 }
+
+// testSessionPair creates two Sessions for Alice and Bob, already knowing the
+// other party's public key.
+func testSessionPair(t *testing.T) (alice, bob *Session) {
+	alicePub, alicePriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bobPub, bobPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice = &Session{
+		IdentityKey: alicePriv,
+		VerifyPeer: func(peer ed25519.PublicKey) (valid bool) {
+			return peer.Equal(bobPub)
+		},
+	}
+
+	bob = &Session{
+		IdentityKey: bobPriv,
+		VerifyPeer: func(peer ed25519.PublicKey) (valid bool) {
+			return peer.Equal(alicePub)
+		},
+	}
+
+	return
+}
+
+// testSessionEstablish performs the handshake between Alice and Bob.
+func testSessionEstablish(t *testing.T, alice, bob *Session) {
+	offerMsg, err := alice.Offer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ackMsg, err := bob.Acknowledge(offerMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	isEstablished, isClosed, plaintext, err := alice.Receive(ackMsg)
+	if err != nil {
+		t.Fatal(err)
+	} else if !isEstablished || isClosed || len(plaintext) > 0 {
+		t.Fatal("invalid message")
+	}
+}
+
+// testSessionExchange sends a message from the sender to the receiver and
+// checks its plaintext.
+func testSessionExchange(t *testing.T, sender, receiver *Session, plaintext string) {
+	dataMsg, err := sender.Send([]byte(plaintext))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	isEstablished, isClosed, plaintextRecv, err := receiver.Receive(dataMsg)
+	if err != nil {
+		t.Fatal(err)
+	} else if isEstablished || isClosed {
+		t.Fatal("invalid message")
+	} else if string(plaintextRecv) != plaintext {
+		t.Fatalf("plaintext differs, %s %s", plaintextRecv, plaintext)
+	}
+}
+
+func TestSessionX3dhVersion1(t *testing.T) {
+	alice, bob := testSessionPair(t)
+	alice.X3dhConfig = x3dh.Config{Version: x3dh.Version1}
+	bob.X3dhConfig = x3dh.Config{Version: x3dh.Version1}
+
+	testSessionEstablish(t, alice, bob)
+	testSessionExchange(t, alice, bob, "hello bob")
+	testSessionExchange(t, bob, alice, "hej alice")
+}
+
+func TestSessionX3dhVersionMismatch(t *testing.T) {
+	alice, bob := testSessionPair(t)
+	bob.X3dhConfig = x3dh.Config{Version: x3dh.Version1}
+
+	offerMsg, err := alice.Offer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ackMsg, err := bob.Acknowledge(offerMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Alice derives another session key and cannot decrypt Bob's ciphertext.
+	_, _, _, err = alice.Receive(ackMsg)
+	if err == nil {
+		t.Fatal("should fail")
+	}
+}
+
+func TestSessionChannelBinding(t *testing.T) {
+	alice, bob := testSessionPair(t)
+	alice.X3dhConfig = x3dh.Config{Version: x3dh.Version1, Info: "ExampleChat", ChannelBinding: []byte("#room")}
+	bob.X3dhConfig = x3dh.Config{Version: x3dh.Version1, Info: "ExampleChat", ChannelBinding: []byte("#room")}
+
+	testSessionEstablish(t, alice, bob)
+	testSessionExchange(t, alice, bob, "hello bob")
+	testSessionExchange(t, bob, alice, "hej alice")
+}
+
+func TestSessionChannelBindingMismatch(t *testing.T) {
+	alice, bob := testSessionPair(t)
+	alice.X3dhConfig = x3dh.Config{Version: x3dh.Version1, Info: "ExampleChat", ChannelBinding: []byte("#room-a")}
+	bob.X3dhConfig = x3dh.Config{Version: x3dh.Version1, Info: "ExampleChat", ChannelBinding: []byte("#room-b")}
+
+	offerMsg, err := alice.Offer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ackMsg, err := bob.Acknowledge(offerMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The offer was relayed into another chat room. Alice MUST reject it.
+	_, _, _, err = alice.Receive(ackMsg)
+	if err == nil {
+		t.Fatal("should fail")
+	}
+}
+
+func TestSessionPostQuantum(t *testing.T) {
+	testcases := []struct {
+		alicePq bool
+		bobPq   bool
+	}{
+		{true, true},
+		{true, false},
+		{false, false},
+	}
+
+	for _, testcase := range testcases {
+		alice, bob := testSessionPair(t)
+		alice.X3dhConfig = x3dh.Config{Version: x3dh.Version1}
+		bob.X3dhConfig = x3dh.Config{Version: x3dh.Version1}
+		alice.PostQuantum = testcase.alicePq
+		bob.PostQuantum = testcase.bobPq
+
+		testSessionEstablish(t, alice, bob)
+		testSessionExchange(t, alice, bob, "hello bob")
+		testSessionExchange(t, bob, alice, "hej alice")
+	}
+}
+
+func TestSessionPostQuantumRequired(t *testing.T) {
+	alice, bob := testSessionPair(t)
+	alice.X3dhConfig = x3dh.Config{Version: x3dh.Version1}
+	bob.X3dhConfig = x3dh.Config{Version: x3dh.Version1}
+	bob.PostQuantum = true
+
+	offerMsg, err := alice.Offer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Bob requires PQXDH, which Alice does not offer.
+	_, err = bob.Acknowledge(offerMsg)
+	if err == nil {
+		t.Fatal("should fail")
+	}
+}
+
+func TestSessionPostQuantumLegacy(t *testing.T) {
+	alice, _ := testSessionPair(t)
+	alice.PostQuantum = true
+
+	_, err := alice.Offer()
+	if err == nil {
+		t.Fatal("should fail")
+	}
+}
+
+func TestSessionPostQuantumDowngrade(t *testing.T) {
+	alice, bob := testSessionPair(t)
+	alice.X3dhConfig = x3dh.Config{Version: x3dh.Version1}
+	bob.X3dhConfig = x3dh.Config{Version: x3dh.Version1}
+	alice.PostQuantum = true
+
+	offerMsg, err := alice.Offer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A MITM strips the PQXDH extensions from Alice's offer.
+	_, offerIf, err := unmarshalMessage(offerMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer := offerIf.(*offerMessage)
+	offer.ext = nil
+
+	offerMsg, err = marshalMessage(sessOffer, offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ackMsg, err := bob.Acknowledge(offerMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Alice MUST detect this downgrade.
+	_, _, _, err = alice.Receive(ackMsg)
+	if err == nil {
+		t.Fatal("should fail")
+	}
+}
+
+func TestSessionEarlyData(t *testing.T) {
+	testcases := []struct {
+		payload     []byte
+		postQuantum bool
+	}{
+		{[]byte("hej alice, nice to meet you"), false},
+		{[]byte("hej alice, nice to meet you"), true},
+		{[]byte{}, false},
+		{nil, false},
+	}
+
+	for _, testcase := range testcases {
+		alice, bob := testSessionPair(t)
+		alice.EarlyData = true
+		if testcase.postQuantum {
+			alice.X3dhConfig = x3dh.Config{Version: x3dh.Version1}
+			bob.X3dhConfig = x3dh.Config{Version: x3dh.Version1}
+			alice.PostQuantum = true
+		}
+
+		offerMsg, err := alice.Offer()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ackMsg, err := bob.AcknowledgeWithPayload(offerMsg, testcase.payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		isEstablished, isClosed, plaintext, err := alice.Receive(ackMsg)
+		if err != nil {
+			t.Fatal(err)
+		} else if !isEstablished || isClosed {
+			t.Fatal("invalid message")
+		} else if !bytes.Equal(plaintext, testcase.payload) {
+			t.Fatalf("plaintext differs, %x %x", plaintext, testcase.payload)
+		}
+
+		testSessionExchange(t, alice, bob, "hello bob")
+		testSessionExchange(t, bob, alice, "hej alice")
+	}
+}
+
+func TestSessionEarlyDataUnsupported(t *testing.T) {
+	alice, bob := testSessionPair(t)
+
+	offerMsg, err := alice.Offer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Alice has not announced early data support.
+	_, err = bob.AcknowledgeWithPayload(offerMsg, []byte("hej alice"))
+	if err == nil {
+		t.Fatal("should fail")
+	}
+}
+
+func TestSessionEarlyDataInjected(t *testing.T) {
+	for _, earlyData := range []bool{false, true} {
+		alice, bob := testSessionPair(t)
+		alice.EarlyData = earlyData
+
+		offerMsg, err := alice.Offer()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ackMsg, err := bob.Acknowledge(offerMsg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// A MITM adds the unauthenticated early data extension, trying to pass
+		// Bob's random initial payload as application data.
+		_, ackIf, err := unmarshalMessage(ackMsg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ackMsg, err = marshalMessage(sessAckExt, ackExtMessage{
+			ackMessage: *ackIf.(*ackMessage),
+			ext:        extensions{extEarlyData: []byte{}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, plaintext, err := alice.Receive(ackMsg); err == nil {
+			t.Fatalf("injected early data was accepted, %x", plaintext)
+		}
+	}
+}
+
+func TestSessionEarlyDataStripped(t *testing.T) {
+	for _, earlyData := range []bool{false, true} {
+		alice, bob := testSessionPair(t)
+		alice.EarlyData = earlyData
+
+		offerMsg, err := alice.Offer()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// A MITM strips resp. adds the early data extension within the offer.
+		_, offerIf, err := unmarshalMessage(offerMsg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offer := offerIf.(*offerMessage)
+		if earlyData {
+			delete(offer.ext, extEarlyData)
+		} else {
+			offer.ext = extensions{extEarlyData: []byte{}}
+		}
+		offerMsg, err = marshalMessage(sessOffer, offer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var payload []byte
+		if !earlyData {
+			payload = []byte("injected")
+		}
+		ackMsg, err := bob.AcknowledgeWithPayload(offerMsg, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, plaintext, err := alice.Receive(ackMsg); err == nil {
+			t.Fatalf("acknowledgement of an altered offer was accepted, %x", plaintext)
+		}
+	}
+}
+
+func TestSessionProtocolNegotiation(t *testing.T) {
+	testcases := []struct {
+		alice, bob ProtocolVersion
+		expected   ProtocolVersion
+	}{
+		{ProtocolLegacy, ProtocolLegacy, ProtocolLegacy},
+		{ProtocolLegacy, Protocol1, ProtocolLegacy},
+		{Protocol1, ProtocolLegacy, ProtocolLegacy},
+		{Protocol1, Protocol1, Protocol1},
+	}
+
+	for _, testcase := range testcases {
+		alice, bob := testSessionPair(t)
+		alice.Protocol = testcase.alice
+		bob.Protocol = testcase.bob
+
+		offerMsg, err := alice.Offer()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The offer is always encoded in the legacy format.
+		if v, _, _, err := unmarshalVersionedMessage(offerMsg); err != nil {
+			t.Fatal(err)
+		} else if v != ProtocolLegacy {
+			t.Fatalf("offer uses version %d", v)
+		}
+
+		ackMsg, err := bob.Acknowledge(offerMsg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, _, err := alice.Receive(ackMsg); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, sess := range []*Session{alice, bob} {
+			if sess.protocol != testcase.expected {
+				t.Fatalf("negotiated version %d instead of %d", sess.protocol, testcase.expected)
+			}
+		}
+
+		for _, msg := range []string{"hello bob", "hej alice"} {
+			dataMsg, err := alice.Send([]byte(msg))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if v, _, _, err := unmarshalVersionedMessage(dataMsg); err != nil {
+				t.Fatal(err)
+			} else if v != testcase.expected {
+				t.Fatalf("message uses version %d instead of %d", v, testcase.expected)
+			}
+
+			if _, _, plaintext, err := bob.Receive(dataMsg); err != nil {
+				t.Fatal(err)
+			} else if string(plaintext) != msg {
+				t.Fatalf("plaintext differs, %q %q", plaintext, msg)
+			}
+
+			alice, bob = bob, alice
+		}
+	}
+}
+
+func TestSessionProtocolUnoffered(t *testing.T) {
+	alice, bob := testSessionPair(t)
+	bob.Protocol = Protocol1
+
+	offerMsg, err := alice.Offer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ackMsg, err := bob.Acknowledge(offerMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A MITM re-encodes Bob's acknowledgement in a version Alice never offered.
+	_, ackIf, err := unmarshalMessage(ackMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ackMsg, err = marshalVersionedMessage(Protocol1, sessAck, ackIf.(*ackMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, err := alice.Receive(ackMsg); err == nil {
+		t.Fatal("should fail")
+	}
+}
+
+func TestSessionProtocolMismatch(t *testing.T) {
+	alice, bob := testSessionPair(t)
+	alice.Protocol = Protocol1
+	bob.Protocol = Protocol1
+
+	testSessionEstablish(t, alice, bob)
+
+	dataMsg, err := alice.Send([]byte("hello bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Once negotiated, another version MUST NOT be accepted.
+	_, dataIf, err := unmarshalMessage(dataMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataMsg, err = marshalMessage(sessData, dataIf.(*dataMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, err := bob.Receive(dataMsg); err == nil {
+		t.Fatal("should fail")
+	}
+}
+
+func TestSessionProtocolDowngrade(t *testing.T) {
+	for _, keyConfirmation := range []bool{false, true} {
+		testSessionProtocolDowngrade(t, keyConfirmation)
+	}
+}
+
+func testSessionProtocolDowngrade(t *testing.T, keyConfirmation bool) {
+	alice, bob := testSessionPair(t)
+	alice.Protocol = Protocol1
+	alice.KeyConfirmation = keyConfirmation
+	bob.Protocol = Protocol1
+
+	offerMsg, err := alice.Offer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A MITM strips the supported versions from Alice's offer.
+	_, offerIf, err := unmarshalMessage(offerMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer := offerIf.(*offerMessage)
+	delete(offer.ext, extProtocols)
+
+	offerMsg, err = marshalMessage(sessOffer, offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ackMsg, err := bob.Acknowledge(offerMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Alice detects the downgrade by the differing associated data.
+	if _, _, _, err := alice.Receive(ackMsg); err == nil {
+		t.Fatal("downgraded acknowledgement was accepted")
+	}
+}
+
+func TestParseFramingInvalidLegacyType(t *testing.T) {
+	for _, in := range []string{"AAQID", "/AQID", ":AQID"} {
+		if _, _, _, err := parseFraming(in); err == nil {
+			t.Fatalf("invalid legacy type %q was parsed", in)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This file implements the streaming encryption of large payloads.
+//
+// Instead of encrypting a whole payload as one Double Ratchet message, a fresh
+// random stream key is sent through the Double Ratchet within a sessStream
+// message. The payload itself is transferred next to the Session, split into
+// chunks of at most StreamChunkSize bytes. Each chunk is encrypted by
+// AES-256-GCM, consisting of a header and the ciphertext:
+//
+//	flags (1 byte) | ciphertext length (4 byte) | ciphertext
+//
+// The nonce is the chunk's counter, followed by the flags. Thus, reordered or
+// removed chunks fail to authenticate. The last chunk is flagged as such to
+// detect a truncated stream.
+
+package xochimilco
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	// StreamChunkSize is the maximum plaintext length of a stream's chunk.
+	StreamChunkSize = 64 * 1024
+
+	// streamKeySize is the length of a stream's AES-256 key.
+	streamKeySize = 32
+
+	// streamHeaderSize is the length of a stream's chunk header.
+	streamHeaderSize = 1 + 4
+
+	// streamFlagLast flags the stream's last chunk.
+	streamFlagLast byte = 0x01
+)
+
+// streamNonce creates the nonce for the counter's chunk and its flags.
+func streamNonce(counter uint64, flags byte) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	nonce[11] = flags
+	return nonce
+}
+
+// newStreamAead creates the AES-256-GCM AEAD for a stream's key.
+func newStreamAead(key []byte) (aead cipher.AEAD, err error) {
+	if len(key) != streamKeySize {
+		err = fmt.Errorf("stream key MUST be %d bytes", streamKeySize)
+		return
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// StreamWriter encrypts a stream into chunks; SendStream.
+//
+// Written data is buffered up to StreamChunkSize bytes. The stream MUST be
+// finished by Close, writing the last chunk.
+type StreamWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	counter uint64
+	buff    []byte
+	closed  bool
+	err     error
+}
+
+// newStreamWriter creates a StreamWriter for a stream key.
+func newStreamWriter(w io.Writer, key []byte) (sw *StreamWriter, err error) {
+	aead, err := newStreamAead(key)
+	if err != nil {
+		return
+	}
+
+	sw = &StreamWriter{
+		w:    w,
+		aead: aead,
+		buff: make([]byte, 0, StreamChunkSize),
+	}
+	return
+}
+
+// writeChunk encrypts and writes the buffer as the next chunk.
+func (sw *StreamWriter) writeChunk(flags byte) (err error) {
+	chunk := make([]byte, streamHeaderSize, streamHeaderSize+len(sw.buff)+sw.aead.Overhead())
+	chunk[0] = flags
+	binary.BigEndian.PutUint32(chunk[1:streamHeaderSize], uint32(len(sw.buff)+sw.aead.Overhead()))
+	chunk = sw.aead.Seal(chunk, streamNonce(sw.counter, flags), sw.buff, nil)
+
+	if _, err = sw.w.Write(chunk); err != nil {
+		return
+	}
+
+	sw.counter++
+	sw.buff = sw.buff[:0]
+	return
+}
+
+// Write plaintext data to the stream.
+func (sw *StreamWriter) Write(p []byte) (n int, err error) {
+	if sw.err != nil {
+		return 0, sw.err
+	} else if sw.closed {
+		return 0, fmt.Errorf("stream is already closed")
+	}
+
+	for len(p) > 0 {
+		// A full chunk is only written if more data follows. Otherwise, it
+		// might be the last chunk.
+		if len(sw.buff) == StreamChunkSize {
+			if sw.err = sw.writeChunk(0); sw.err != nil {
+				return n, sw.err
+			}
+		}
+
+		l := copy(sw.buff[len(sw.buff):StreamChunkSize], p)
+		sw.buff = sw.buff[:len(sw.buff)+l]
+		p = p[l:]
+		n += l
+	}
+
+	return
+}
+
+// Close the stream by writing the last chunk. The underlying io.Writer will
+// not be closed.
+func (sw *StreamWriter) Close() (err error) {
+	if sw.err != nil {
+		return sw.err
+	} else if sw.closed {
+		return nil
+	}
+
+	sw.closed = true
+	sw.err = sw.writeChunk(streamFlagLast)
+	return sw.err
+}
+
+// StreamReader decrypts a stream's chunks; ReceiveStream.
+//
+// Read returns an error for an altered, reordered, or truncated stream. Please
+// note that data already returned by previous Read calls has been
+// authenticated, but the stream might still turn out to be truncated. Thus,
+// the whole stream's integrity is only ensured once io.EOF is returned.
+type StreamReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	counter uint64
+	buff    []byte
+	last    bool
+	err     error
+}
+
+// newStreamReader creates a StreamReader for a stream key.
+func newStreamReader(r io.Reader, key []byte) (sr *StreamReader, err error) {
+	aead, err := newStreamAead(key)
+	if err != nil {
+		return
+	}
+
+	sr = &StreamReader{
+		r:    r,
+		aead: aead,
+	}
+	return
+}
+
+// readChunk reads and decrypts the next chunk into the buffer.
+func (sr *StreamReader) readChunk() (err error) {
+	header := make([]byte, streamHeaderSize)
+	if _, err = io.ReadFull(sr.r, header); err == io.EOF {
+		return io.ErrUnexpectedEOF
+	} else if err != nil {
+		return
+	}
+
+	flags, length := header[0], binary.BigEndian.Uint32(header[1:])
+	if flags&^streamFlagLast != 0 {
+		return fmt.Errorf("stream chunk has unknown flags %x", flags)
+	} else if length < uint32(sr.aead.Overhead()) || length > uint32(StreamChunkSize+sr.aead.Overhead()) {
+		return fmt.Errorf("stream chunk has an invalid length of %d", length)
+	}
+
+	ciphertext := make([]byte, length)
+	if _, err = io.ReadFull(sr.r, ciphertext); err == io.EOF {
+		return io.ErrUnexpectedEOF
+	} else if err != nil {
+		return
+	}
+
+	sr.buff, err = sr.aead.Open(ciphertext[:0], streamNonce(sr.counter, flags), ciphertext, nil)
+	if err != nil {
+		return fmt.Errorf("stream chunk %d failed to authenticate", sr.counter)
+	}
+
+	sr.counter++
+	sr.last = flags&streamFlagLast != 0
+	return
+}
+
+// Read decrypted plaintext data from the stream.
+func (sr *StreamReader) Read(p []byte) (n int, err error) {
+	for len(sr.buff) == 0 {
+		if sr.err != nil {
+			return 0, sr.err
+		} else if sr.last {
+			return 0, io.EOF
+		}
+
+		sr.err = sr.readChunk()
+	}
+
+	n = copy(p, sr.buff)
+	sr.buff = sr.buff[n:]
+	return
+}
+
+// SendStream announces an encrypted stream to the other party.
+//
+// The returned streamMsg MUST be sent to the other party, who passes it to
+// ReceiveStream. All data written to the StreamWriter will be encrypted and
+// written to w, which might be, e.g., a file transfer next to the Session. The
+// StreamWriter MUST be closed afterwards.
+//
+// This method is allowed to be called after the initial handshake, like Send.
+// However, a pending key confirmation MUST be sent first, by Confirm.
+func (sess *Session) SendStream(w io.Writer) (streamMsg string, sw *StreamWriter, err error) {
+	if sess.doubleRatchet == nil {
+		err = fmt.Errorf("cannot encrypt a stream without being in an active session")
+		return
+	} else if sess.confirmMacSend != nil || sess.noiseFinish != nil {
+		err = fmt.Errorf("cannot encrypt a stream before the key confirmation")
+		return
+	} else if err = sess.checkSendPolicy(); err != nil {
+		return
+	}
+
+	key := make([]byte, streamKeySize)
+	if _, err = rand.Read(key); err != nil {
+		return
+	}
+
+	sw, err = newStreamWriter(w, key)
+	if err != nil {
+		return
+	}
+
+	ciphertext, err := sess.doubleRatchet.EncryptWithAssociatedData(key, typeAssociatedData(sessStream))
+	if err != nil {
+		return
+	}
+
+	streamMsg, err = marshalEncodedMessage(sess.Encoding, sess.protocol, sessStream, streamMessage(ciphertext))
+	return
+}
+
+// ReceiveStream decrypts a stream, announced by the other party's SendStream.
+//
+// The streamMsg is the other party's announcement. The encrypted stream will
+// be read from r. In contrast, Receive rejects such an announcement.
+func (sess *Session) ReceiveStream(streamMsg string, r io.Reader) (sr *StreamReader, err error) {
+	if sess.doubleRatchet == nil {
+		err = fmt.Errorf("received sessStream while not being in an active session")
+		return
+	} else if sess.confirmMacRecv != nil {
+		err = fmt.Errorf("received sessStream before the key confirmation")
+		return
+	}
+
+	version, msgType, msgIf, err := unmarshalVersionedMessage(streamMsg)
+	if err != nil {
+		return
+	} else if msgType != sessStream {
+		err = fmt.Errorf("unexpected message type %d", msgType)
+		return
+	} else if version != sess.protocol {
+		err = fmt.Errorf("received protocol version %d instead of %d", version, sess.protocol)
+		return
+	}
+
+	key, err := sess.doubleRatchet.DecryptWithAssociatedData(
+		*msgIf.(*streamMessage), typeAssociatedData(sessStream))
+	if err != nil {
+		return
+	}
+
+	sr, err = newStreamReader(r, key)
+	if err != nil {
+		return
+	}
+
+	sess.peerConfirmed = true
+	return
+}
@@ -0,0 +1,225 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package xochimilco
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// testStream sends a payload from Alice to Bob and returns the encrypted
+// stream together with Bob's announcement.
+func testStream(t *testing.T, alice *Session, payload []byte, writeSize int) (streamMsg string, stream []byte) {
+	var buff bytes.Buffer
+	streamMsg, sw, err := alice.SendStream(&buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for p := payload; len(p) > 0; {
+		l := writeSize
+		if l > len(p) {
+			l = len(p)
+		}
+
+		if n, err := sw.Write(p[:l]); err != nil {
+			t.Fatal(err)
+		} else if n != l {
+			t.Fatalf("wrote %d instead of %d bytes", n, l)
+		}
+		p = p[l:]
+	}
+
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	stream = buff.Bytes()
+	return
+}
+
+// testStreamChunks splits an encrypted stream into its chunks.
+func testStreamChunks(stream []byte) (chunks [][]byte) {
+	for len(stream) > 0 {
+		l := streamHeaderSize + int(binary.BigEndian.Uint32(stream[1:streamHeaderSize]))
+		chunks = append(chunks, stream[:l])
+		stream = stream[l:]
+	}
+	return
+}
+
+func TestSessionStream(t *testing.T) {
+	sizes := []int{0, 1, 1337, StreamChunkSize - 1, StreamChunkSize, StreamChunkSize + 1, 3*StreamChunkSize + 23}
+
+	for _, size := range sizes {
+		for _, writeSize := range []int{1000, StreamChunkSize, 4 * StreamChunkSize} {
+			alice, bob := testSessionPair(t)
+			testSessionEstablish(t, alice, bob)
+
+			payload := make([]byte, size)
+			if _, err := rand.Read(payload); err != nil {
+				t.Fatal(err)
+			}
+
+			streamMsg, stream := testStream(t, alice, payload, writeSize)
+
+			if chunks := testStreamChunks(stream); len(chunks) != size/StreamChunkSize+1 &&
+				!(size > 0 && size%StreamChunkSize == 0 && len(chunks) == size/StreamChunkSize) {
+				t.Fatalf("%d: unexpected amount of chunks, %d", size, len(chunks))
+			}
+
+			sr, err := bob.ReceiveStream(streamMsg, bytes.NewReader(stream))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			plaintext, err := io.ReadAll(sr)
+			if err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(plaintext, payload) {
+				t.Fatalf("%d: payload differs", size)
+			}
+
+			testSessionExchange(t, bob, alice, "got it")
+		}
+	}
+}
+
+func TestSessionStreamInvalid(t *testing.T) {
+	payload := bytes.Repeat([]byte{0x23}, 3*StreamChunkSize+42)
+
+	testcases := []struct {
+		name   string
+		modify func(chunks [][]byte) [][]byte
+	}{
+		{"truncated", func(chunks [][]byte) [][]byte {
+			return chunks[:len(chunks)-1]
+		}},
+		{"reordered", func(chunks [][]byte) [][]byte {
+			chunks[0], chunks[1] = chunks[1], chunks[0]
+			return chunks
+		}},
+		{"removed", func(chunks [][]byte) [][]byte {
+			return append(chunks[:1], chunks[2:]...)
+		}},
+		{"flagged", func(chunks [][]byte) [][]byte {
+			chunks[0][0] = streamFlagLast
+			return chunks
+		}},
+		{"altered", func(chunks [][]byte) [][]byte {
+			chunks[1][streamHeaderSize] ^= 0xff
+			return chunks
+		}},
+		{"cut", func(chunks [][]byte) [][]byte {
+			last := chunks[len(chunks)-1]
+			chunks[len(chunks)-1] = last[:len(last)-1]
+			return chunks
+		}},
+	}
+
+	for _, testcase := range testcases {
+		alice, bob := testSessionPair(t)
+		testSessionEstablish(t, alice, bob)
+
+		streamMsg, stream := testStream(t, alice, payload, StreamChunkSize)
+		chunks := testcase.modify(testStreamChunks(stream))
+
+		sr, err := bob.ReceiveStream(streamMsg, bytes.NewReader(bytes.Join(chunks, nil)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := io.ReadAll(sr); err == nil {
+			t.Fatalf("%s stream did not error", testcase.name)
+		}
+	}
+}
+
+func TestSessionStreamRelabelled(t *testing.T) {
+	alice, bob := testSessionPair(t)
+	testSessionEstablish(t, alice, bob)
+	testSessionExchange(t, alice, bob, "hello bob")
+
+	// A MITM relabels a data message of a key's size as a stream.
+	dataMsg, err := alice.Send(bytes.Repeat([]byte{0x23}, streamKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, _, dataIf, err := unmarshalVersionedMessage(dataMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forgedMsg, err := marshalVersionedMessage(version, sessStream, streamMessage(*dataIf.(*dataMessage)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := bob.ReceiveStream(forgedMsg, bytes.NewReader(nil)); err == nil {
+		t.Fatal("relabelled data message was accepted as a stream")
+	}
+
+	// The other way round, a stream's announcement cannot be relabelled as data.
+	streamMsg, _ := testStream(t, bob, []byte("hello alice"), StreamChunkSize)
+
+	version, _, streamIf, err := unmarshalVersionedMessage(streamMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forgedMsg, err = marshalVersionedMessage(version, sessData, dataMessage(*streamIf.(*streamMessage)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, err := alice.Receive(forgedMsg); err == nil {
+		t.Fatal("relabelled stream was accepted as a data message")
+	}
+}
+
+func TestSessionStreamState(t *testing.T) {
+	alice, bob := testSessionPair(t)
+
+	if _, _, err := alice.SendStream(io.Discard); err == nil {
+		t.Fatal("stream without a Session did not error")
+	}
+
+	testSessionEstablish(t, alice, bob)
+
+	streamMsg, _, err := alice.SendStream(io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The announcement is not accepted by Receive.
+	if _, _, _, err := bob.Receive(streamMsg); err == nil {
+		t.Fatal("Receive accepted a sessStream")
+	}
+
+	// Other messages are not accepted by ReceiveStream.
+	dataMsg, err := alice.Send([]byte("hello bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.ReceiveStream(dataMsg, bytes.NewReader(nil)); err == nil {
+		t.Fatal("ReceiveStream accepted a sessData")
+	}
+
+	// A closed StreamWriter cannot be written to.
+	_, sw, err := alice.SendStream(io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sw.Write([]byte("foo")); err == nil {
+		t.Fatal("writing to a closed stream did not error")
+	}
+}
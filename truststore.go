@@ -0,0 +1,317 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This file implements a trust on first use (TOFU) store for identity keys.
+//
+// The first identity key seen for a peer's name is pinned; by the Verifier
+// only after the handshake has been completed. Later, another key for the
+// same name is rejected and reported as a key change until the user accepts
+// it. Furthermore, a key might be marked as verified, e.g., after comparing
+// the SafetyNumber, or as blocked.
+
+package xochimilco
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrKeyChanged is returned if a peer presents another identity key than the
+// pinned one.
+var ErrKeyChanged = errors.New("identity key has changed")
+
+// TrustStatus of a pinned identity key.
+type TrustStatus int
+
+const (
+	// TrustUnverified is a key pinned on its first use.
+	TrustUnverified TrustStatus = iota
+
+	// TrustVerified is a key verified by the user, e.g., by a SafetyNumber.
+	TrustVerified
+
+	// TrustBlocked is a key being rejected.
+	TrustBlocked
+)
+
+func (status TrustStatus) String() string {
+	switch status {
+	case TrustUnverified:
+		return "unverified"
+	case TrustVerified:
+		return "verified"
+	case TrustBlocked:
+		return "blocked"
+	default:
+		return fmt.Sprintf("unknown status %d", int(status))
+	}
+}
+
+// MarshalText encodes the TrustStatus as its String.
+func (status TrustStatus) MarshalText() ([]byte, error) {
+	switch status {
+	case TrustUnverified, TrustVerified, TrustBlocked:
+		return []byte(status.String()), nil
+	default:
+		return nil, fmt.Errorf("cannot marshal %v", status)
+	}
+}
+
+// UnmarshalText decodes a TrustStatus from its String.
+func (status *TrustStatus) UnmarshalText(text []byte) error {
+	for _, s := range []TrustStatus{TrustUnverified, TrustVerified, TrustBlocked} {
+		if string(text) == s.String() {
+			*status = s
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown trust status %q", text)
+}
+
+// TrustEntry is a peer's pinned identity key within a TrustStore.
+type TrustEntry struct {
+	// Key is the pinned identity key.
+	Key ed25519.PublicKey `json:"key"`
+
+	// Status of the pinned Key.
+	Status TrustStatus `json:"status"`
+
+	// FirstSeen is the time when Key was pinned.
+	FirstSeen time.Time `json:"first_seen"`
+
+	// ChangedKey is another identity key presented for this peer, if any. It
+	// might be accepted by AcceptKeyChange.
+	ChangedKey ed25519.PublicKey `json:"changed_key,omitempty"`
+}
+
+// TrustStore pins identity keys by the peer's name, e.g., a nickname or a
+// phone number. It is safe for concurrent use.
+//
+// If created by OpenTrustStore, all changes are persisted to a JSON file.
+type TrustStore struct {
+	// OnKeyChange is an optional callback, called if a peer presents another
+	// identity key than the pinned one.
+	OnKeyChange func(name string, pinnedKey, changedKey ed25519.PublicKey)
+
+	// OnError is an optional callback, called with each error of a VerifyPeer
+	// callback, as the latter only reports a rejection.
+	OnError func(name string, err error)
+
+	path    string
+	mutex   sync.Mutex
+	entries map[string]*TrustEntry
+}
+
+// NewTrustStore creates an in-memory TrustStore without persistence.
+func NewTrustStore() *TrustStore {
+	return &TrustStore{entries: make(map[string]*TrustEntry)}
+}
+
+// OpenTrustStore loads a TrustStore from a JSON file, persisting all changes.
+// A missing file will be created on the first change.
+func OpenTrustStore(path string) (ts *TrustStore, err error) {
+	ts = NewTrustStore()
+	ts.path = path
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+
+	if err = json.Unmarshal(data, &ts.entries); err != nil {
+		err = fmt.Errorf("cannot parse trust store %s: %v", path, err)
+		return
+	}
+	// A JSON null results in a nil map.
+	if ts.entries == nil {
+		ts.entries = make(map[string]*TrustEntry)
+	}
+
+	for name, entry := range ts.entries {
+		if entry == nil || len(entry.Key) != ed25519.PublicKeySize {
+			err = fmt.Errorf("trust store %s has an invalid key for %q", path, name)
+			return
+		}
+	}
+	return
+}
+
+// save persists the TrustStore, if it has a file. The caller MUST hold the
+// mutex.
+func (ts *TrustStore) save() (err error) {
+	if ts.path == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(ts.entries, "", "  ")
+	if err != nil {
+		return
+	}
+
+	// Write to a temporary file first, not to corrupt the store on errors.
+	f, err := os.CreateTemp(filepath.Dir(ts.path), filepath.Base(ts.path)+".*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(f.Name())
+
+	if _, err = f.Write(data); err != nil {
+		_ = f.Close()
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+
+	return os.Rename(f.Name(), ts.path)
+}
+
+// Lookup a peer's TrustEntry.
+func (ts *TrustStore) Lookup(name string) (entry TrustEntry, ok bool) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	if e, exists := ts.entries[name]; exists {
+		entry, ok = *e, true
+	}
+	return
+}
+
+// Verify a peer's identity key.
+//
+// An unknown peer's key is accepted, but not pinned yet; Pin. A pinned key is
+// accepted unless it is TrustBlocked. Another key than the pinned one is
+// rejected with ErrKeyChanged and stored as the entry's ChangedKey.
+func (ts *TrustStore) Verify(name string, key ed25519.PublicKey) (valid bool, err error) {
+	return ts.check(name, key, false)
+}
+
+// Pin an unknown peer's identity key as TrustUnverified, e.g., after a
+// Session has been established with a key accepted by Verify. Otherwise, the
+// key is checked as by Verify.
+func (ts *TrustStore) Pin(name string, key ed25519.PublicKey) error {
+	valid, err := ts.check(name, key, true)
+	if err == nil && !valid {
+		err = fmt.Errorf("identity key for %q is blocked", name)
+	}
+	return err
+}
+
+// check implements both Verify and Pin.
+func (ts *TrustStore) check(name string, key ed25519.PublicKey, pin bool) (valid bool, err error) {
+	if len(key) != ed25519.PublicKeySize {
+		err = fmt.Errorf("identity key MUST be %d bytes", ed25519.PublicKeySize)
+		return
+	}
+
+	var pinnedKey, changedKey ed25519.PublicKey
+
+	ts.mutex.Lock()
+	entry, ok := ts.entries[name]
+	switch {
+	case !ok && !pin:
+		valid = true
+
+	case !ok:
+		ts.entries[name] = &TrustEntry{
+			Key:       append(ed25519.PublicKey{}, key...),
+			Status:    TrustUnverified,
+			FirstSeen: time.Now().UTC(),
+		}
+		err = ts.save()
+		valid = err == nil
+
+	case entry.Key.Equal(key):
+		valid = entry.Status != TrustBlocked
+
+	default:
+		if !entry.ChangedKey.Equal(key) {
+			entry.ChangedKey = append(ed25519.PublicKey{}, key...)
+			err = ts.save()
+			pinnedKey, changedKey = entry.Key, entry.ChangedKey
+		}
+		if err == nil {
+			err = ErrKeyChanged
+		}
+	}
+	ts.mutex.Unlock()
+
+	// The callback is called without holding the mutex, allowing it to use
+	// this TrustStore, e.g., by AcceptKeyChange.
+	if err == ErrKeyChanged && changedKey != nil && ts.OnKeyChange != nil {
+		ts.OnKeyChange(name, pinnedKey, changedKey)
+	}
+	return
+}
+
+// SetStatus of a peer's pinned identity key.
+func (ts *TrustStore) SetStatus(name string, status TrustStatus) error {
+	if _, err := status.MarshalText(); err != nil {
+		return err
+	}
+
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	entry, ok := ts.entries[name]
+	if !ok {
+		return fmt.Errorf("no pinned key for %q", name)
+	}
+
+	entry.Status = status
+	return ts.save()
+}
+
+// AcceptKeyChange pins a peer's ChangedKey, replacing the former key. As the
+// new key has not been verified yet, it is TrustUnverified.
+func (ts *TrustStore) AcceptKeyChange(name string) error {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	entry, ok := ts.entries[name]
+	if !ok || entry.ChangedKey == nil {
+		return fmt.Errorf("no changed key for %q", name)
+	}
+
+	ts.entries[name] = &TrustEntry{
+		Key:       entry.ChangedKey,
+		Status:    TrustUnverified,
+		FirstSeen: time.Now().UTC(),
+	}
+	return ts.save()
+}
+
+// Remove a peer's TrustEntry. Its next key will be pinned again.
+func (ts *TrustStore) Remove(name string) error {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	delete(ts.entries, name)
+	return ts.save()
+}
+
+// VerifyPeer returns a callback for Session.VerifyPeer, verifying the identity
+// key of the named peer and pinning an unknown key on its first use; Pin.
+// Errors result in a rejection and are passed to OnError.
+//
+// In contrast to Verifier, the key is already pinned during the handshake,
+// as the callback does not learn about its completion.
+func (ts *TrustStore) VerifyPeer(name string) func(peer ed25519.PublicKey) (valid bool) {
+	return func(peer ed25519.PublicKey) (valid bool) {
+		err := ts.Pin(name, peer)
+		if err != nil && ts.OnError != nil {
+			ts.OnError(name, err)
+		}
+		return err == nil
+	}
+}
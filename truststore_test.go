@@ -0,0 +1,206 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package xochimilco
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTrustStoreTofu(t *testing.T) {
+	bob, mallory := testSafetyKey(0x02), testSafetyKey(0x03)
+
+	var changes int
+	ts := NewTrustStore()
+	ts.OnKeyChange = func(name string, pinnedKey, changedKey ed25519.PublicKey) {
+		if name != "bob" || !pinnedKey.Equal(bob) || !changedKey.Equal(mallory) {
+			t.Fatalf("unexpected key change for %q", name)
+		}
+		// The callback might use the TrustStore.
+		if entry, ok := ts.Lookup(name); !ok || !entry.ChangedKey.Equal(changedKey) {
+			t.Fatalf("unexpected entry, %v", entry)
+		}
+		changes++
+	}
+
+	// An unknown key is accepted, but only pinned explicitly.
+	if valid, err := ts.Verify("bob", bob); err != nil {
+		t.Fatal(err)
+	} else if !valid {
+		t.Fatal("unknown key was rejected")
+	}
+	if _, ok := ts.Lookup("bob"); ok {
+		t.Fatal("verified key was pinned")
+	}
+
+	// The first key is pinned.
+	for i := 0; i < 2; i++ {
+		if err := ts.Pin("bob", bob); err != nil {
+			t.Fatal(err)
+		}
+		if valid, err := ts.Verify("bob", bob); err != nil {
+			t.Fatal(err)
+		} else if !valid {
+			t.Fatal("pinned key was rejected")
+		}
+	}
+
+	if entry, ok := ts.Lookup("bob"); !ok {
+		t.Fatal("no entry for bob")
+	} else if !entry.Key.Equal(bob) || entry.Status != TrustUnverified || entry.FirstSeen.IsZero() {
+		t.Fatalf("unexpected entry, %v", entry)
+	}
+
+	// Another key is rejected and reported once.
+	for i := 0; i < 2; i++ {
+		if valid, err := ts.Verify("bob", mallory); !errors.Is(err, ErrKeyChanged) || valid {
+			t.Fatalf("changed key was not rejected, %t %v", valid, err)
+		}
+	}
+	if changes != 1 {
+		t.Fatalf("%d instead of one key change", changes)
+	}
+
+	// The pinned key is still valid, while the changed key might be accepted.
+	if valid, err := ts.Verify("bob", bob); err != nil || !valid {
+		t.Fatal("pinned key was rejected")
+	}
+
+	if err := ts.AcceptKeyChange("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if valid, err := ts.Verify("bob", mallory); err != nil || !valid {
+		t.Fatal("accepted key was rejected")
+	}
+	if err := ts.AcceptKeyChange("bob"); err == nil {
+		t.Fatal("accepting without a changed key did not error")
+	}
+}
+
+func TestTrustStoreStatus(t *testing.T) {
+	bob := testSafetyKey(0x02)
+
+	ts := NewTrustStore()
+	if err := ts.SetStatus("bob", TrustVerified); err == nil {
+		t.Fatal("setting the status of an unknown peer did not error")
+	}
+
+	if err := ts.Pin("bob", bob); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, status := range []TrustStatus{TrustVerified, TrustBlocked, TrustUnverified} {
+		if err := ts.SetStatus("bob", status); err != nil {
+			t.Fatal(err)
+		}
+
+		if entry, _ := ts.Lookup("bob"); entry.Status != status {
+			t.Fatalf("status differs, %v %v", entry.Status, status)
+		}
+
+		if valid, err := ts.Verify("bob", bob); err != nil {
+			t.Fatal(err)
+		} else if valid == (status == TrustBlocked) {
+			t.Fatalf("%v key was accepted: %t", status, valid)
+		}
+	}
+
+	if err := ts.SetStatus("bob", TrustStatus(23)); err == nil {
+		t.Fatal("invalid status did not error")
+	}
+
+	if err := ts.Remove("bob"); err != nil {
+		t.Fatal(err)
+	} else if _, ok := ts.Lookup("bob"); ok {
+		t.Fatal("removed entry still exists")
+	}
+}
+
+func TestTrustStorePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trust.json")
+	alice, bob, carol := testSafetyKey(0x01), testSafetyKey(0x02), testSafetyKey(0x03)
+
+	ts, err := OpenTrustStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, key := range map[string]ed25519.PublicKey{"alice": alice, "bob": bob} {
+		if err := ts.Pin(name, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ts.SetStatus("alice", TrustVerified); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.Verify("bob", carol); !errors.Is(err, ErrKeyChanged) {
+		t.Fatal(err)
+	}
+
+	ts, err = OpenTrustStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if entry, ok := ts.Lookup("alice"); !ok || !entry.Key.Equal(alice) || entry.Status != TrustVerified {
+		t.Fatalf("alice's entry differs, %v", entry)
+	}
+	if entry, ok := ts.Lookup("bob"); !ok || !entry.Key.Equal(bob) || !entry.ChangedKey.Equal(carol) {
+		t.Fatalf("bob's entry differs, %v", entry)
+	}
+
+	// A JSON null is an empty TrustStore.
+	if err := os.WriteFile(path, []byte("null"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if ts, err = OpenTrustStore(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.Pin("carol", carol); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTrustStoreSession(t *testing.T) {
+	alice, bob := testSessionPair(t)
+	alicePub := alice.IdentityKey.Public().(ed25519.PublicKey)
+
+	// Only the VerifyPeer callback is used, pinning on the first use.
+	var errs []error
+	ts := NewTrustStore()
+	ts.OnError = func(name string, err error) {
+		if name != "alice" {
+			t.Fatalf("unexpected error for %q", name)
+		}
+		errs = append(errs, err)
+	}
+	bob.VerifyPeer = ts.VerifyPeer("alice")
+
+	testSessionEstablish(t, alice, bob)
+	if entry, ok := ts.Lookup("alice"); !ok || !entry.Key.Equal(alicePub) {
+		t.Fatal("alice's key was not pinned")
+	} else if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	// Another key claiming to be Alice is rejected.
+	mallory, _ := testSessionPair(t)
+	mallory.VerifyPeer = func(_ ed25519.PublicKey) bool { return true }
+
+	offerMsg, err := mallory.Offer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bob.VerifyPeer = ts.VerifyPeer("alice")
+	if _, err := bob.Acknowledge(offerMsg); err == nil {
+		t.Fatal("changed key was accepted")
+	} else if len(errs) != 1 || !errors.Is(errs[0], ErrKeyChanged) {
+		t.Fatalf("unexpected errors, %v", errs)
+	}
+}
@@ -0,0 +1,299 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This file implements the context-aware verification of the other party.
+//
+// Next to the simple VerifyPeer callback, a Session might use a Verifier. It
+// receives a context.Context and information about the handshake and returns
+// a Decision or an error. Thus, verification might, e.g., query a database.
+//
+// Furthermore, a Verifier might defer its decision, e.g., to ask the user. The
+// Session is established in an unverified state, restricted by the
+// UnverifiedPolicy, until it is either marked as verified or rejected.
+
+package xochimilco
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+)
+
+// Role of a party within the handshake.
+type Role int
+
+const (
+	// RoleInitiator is the active party (Alice), sending the offer.
+	RoleInitiator Role = iota
+
+	// RoleResponder is the passive party (Bob), acknowledging the offer.
+	RoleResponder
+)
+
+func (role Role) String() string {
+	switch role {
+	case RoleInitiator:
+		return "initiator"
+	case RoleResponder:
+		return "responder"
+	default:
+		return fmt.Sprintf("unknown role %d", int(role))
+	}
+}
+
+// HandshakeStep identifies the handshake message containing the identity key
+// to be verified.
+type HandshakeStep int
+
+const (
+	// StepOffer is the initiator's offer, verified by the responder.
+	StepOffer HandshakeStep = iota
+
+	// StepAck is the responder's acknowledgement, verified by the initiator.
+	StepAck
+)
+
+func (step HandshakeStep) String() string {
+	switch step {
+	case StepOffer:
+		return "offer"
+	case StepAck:
+		return "acknowledgement"
+	default:
+		return fmt.Sprintf("unknown step %d", int(step))
+	}
+}
+
+// PeerInfo describes the other party to be verified.
+type PeerInfo struct {
+	// IdentityKey is the other party's public identity key.
+	IdentityKey ed25519.PublicKey
+
+	// Role is our own Role within the handshake.
+	Role Role
+
+	// Step is the handshake message containing the IdentityKey.
+	Step HandshakeStep
+
+	// Contact is the other party's claimed contact on the transport, as set
+	// in the Session's Contact field, e.g., a nickname or an address.
+	Contact string
+}
+
+// Decision of a Verifier.
+type Decision int
+
+const (
+	// DecisionReject aborts the handshake.
+	DecisionReject Decision = iota
+
+	// DecisionAccept continues the handshake.
+	DecisionAccept
+
+	// DecisionDefer continues the handshake, but establishes the Session in an
+	// unverified state. The decision might be made later by MarkVerified or
+	// RejectPeer. Until then, the UnverifiedPolicy applies.
+	DecisionDefer
+)
+
+func (decision Decision) String() string {
+	switch decision {
+	case DecisionReject:
+		return "reject"
+	case DecisionAccept:
+		return "accept"
+	case DecisionDefer:
+		return "defer"
+	default:
+		return fmt.Sprintf("unknown decision %d", int(decision))
+	}
+}
+
+// UnverifiedPolicy restricts an unverified Session; DecisionDefer.
+type UnverifiedPolicy int
+
+const (
+	// UnverifiedBlockSend rejects sending application data. Incoming messages
+	// are still decrypted. This is the default.
+	UnverifiedBlockSend UnverifiedPolicy = iota
+
+	// UnverifiedAllowSend allows sending application data.
+	UnverifiedAllowSend
+)
+
+// Verifier decides whether to trust the other party's identity key.
+//
+// The context is passed from, e.g., AcknowledgeContext or ReceiveContext. An
+// error aborts the handshake, as does DecisionReject.
+type Verifier interface {
+	Verify(ctx context.Context, info PeerInfo) (Decision, error)
+}
+
+// EstablishedVerifier is a Verifier being informed once the handshake with an
+// accepted resp. deferred peer has been completed, e.g., to pin its identity
+// key only afterwards. An error aborts the handshake.
+type EstablishedVerifier interface {
+	Verifier
+	Established(ctx context.Context, info PeerInfo) error
+}
+
+// VerifierFunc is a function implementing the Verifier interface.
+type VerifierFunc func(ctx context.Context, info PeerInfo) (Decision, error)
+
+// Verify calls the function itself.
+func (f VerifierFunc) Verify(ctx context.Context, info PeerInfo) (Decision, error) {
+	return f(ctx, info)
+}
+
+// trustStoreVerifier is the EstablishedVerifier of a TrustStore.
+type trustStoreVerifier struct {
+	ts *TrustStore
+}
+
+// Verify the peer's identity key by the TrustStore.
+func (v trustStoreVerifier) Verify(ctx context.Context, info PeerInfo) (decision Decision, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	} else if info.Contact == "" {
+		// Otherwise, all peers would share the same entry.
+		err = errors.New("TrustStore requires the Session's Contact")
+		return
+	}
+
+	valid, err := v.ts.Verify(info.Contact, info.IdentityKey)
+	if valid {
+		decision = DecisionAccept
+	}
+	return
+}
+
+// Established pins the peer's identity key within the TrustStore.
+func (v trustStoreVerifier) Established(_ context.Context, info PeerInfo) error {
+	return v.ts.Pin(info.Contact, info.IdentityKey)
+}
+
+// Verifier returns an EstablishedVerifier based on this TrustStore, using the
+// PeerInfo's Contact as the peer's name; Verify. Thus, an empty Contact is
+// rejected. A new key is pinned after the handshake; Pin. A key change
+// results in an error wrapping ErrKeyChanged.
+func (ts *TrustStore) Verifier() Verifier {
+	return trustStoreVerifier{ts}
+}
+
+// peerInfo describes the other party for the verification.
+func (sess *Session) peerInfo(step HandshakeStep, key ed25519.PublicKey) (info PeerInfo) {
+	info = PeerInfo{
+		IdentityKey: key,
+		Role:        RoleInitiator,
+		Step:        step,
+		Contact:     sess.Contact,
+	}
+	if step == StepOffer {
+		info.Role = RoleResponder
+	}
+	return
+}
+
+// verifyPeer checks the other party's identity key by either the Verifier or
+// the VerifyPeer callback.
+func (sess *Session) verifyPeer(ctx context.Context, step HandshakeStep, key ed25519.PublicKey) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	var decision Decision
+	switch {
+	case sess.Verifier != nil:
+		decision, err = sess.Verifier.Verify(ctx, sess.peerInfo(step, key))
+		if err != nil {
+			return fmt.Errorf("verifier failed: %w", err)
+		}
+
+	case sess.VerifyPeer != nil:
+		if sess.VerifyPeer(key) {
+			decision = DecisionAccept
+		}
+
+	default:
+		return errors.New("neither Verifier nor VerifyPeer is set")
+	}
+
+	if decision != DecisionAccept && decision != DecisionDefer {
+		return fmt.Errorf("verification refuses public key, %v", decision)
+	}
+
+	sess.peerIdKey = append(ed25519.PublicKey{}, key...)
+	sess.peerUnverified = decision == DecisionDefer
+	return
+}
+
+// establishedPeer informs either the EstablishedVerifier or the PeerEstablished
+// callback about the completed handshake with the verified peer. On errors,
+// the Session is reset.
+func (sess *Session) establishedPeer(ctx context.Context, step HandshakeStep) (err error) {
+	switch {
+	case sess.Verifier != nil:
+		if v, ok := sess.Verifier.(EstablishedVerifier); ok {
+			if err = v.Established(ctx, sess.peerInfo(step, sess.peerIdKey)); err != nil {
+				err = fmt.Errorf("verifier failed: %w", err)
+			}
+		}
+
+	case sess.PeerEstablished != nil:
+		err = sess.PeerEstablished(sess.peerIdKey)
+	}
+
+	if err != nil {
+		sess.reset()
+	}
+	return
+}
+
+// checkSendPolicy returns an error if the UnverifiedPolicy forbids sending.
+func (sess *Session) checkSendPolicy() error {
+	if sess.peerUnverified && sess.UnverifiedPolicy == UnverifiedBlockSend {
+		return fmt.Errorf("cannot send to an unverified peer")
+	}
+	return nil
+}
+
+// PeerIdentityKey returns the other party's public identity key within an
+// active Session, or nil.
+func (sess *Session) PeerIdentityKey() ed25519.PublicKey {
+	if sess.doubleRatchet == nil {
+		return nil
+	}
+	return sess.peerIdKey
+}
+
+// PeerVerified reports whether the other party's identity key was accepted
+// within an active Session, either during the handshake or later by
+// MarkVerified.
+func (sess *Session) PeerVerified() bool {
+	return sess.PeerIdentityKey() != nil && !sess.peerUnverified
+}
+
+// MarkVerified accepts the other party's identity key after a deferred
+// decision; DecisionDefer. Afterwards, the UnverifiedPolicy does not apply.
+func (sess *Session) MarkVerified() error {
+	if !sess.peerUnverified {
+		return fmt.Errorf("there is no deferred verification")
+	}
+
+	sess.peerUnverified = false
+	return nil
+}
+
+// RejectPeer rejects the other party's identity key after a deferred decision;
+// DecisionDefer. The Session is closed with CloseKeyRejected and the returned
+// close message SHOULD be sent to the other party.
+func (sess *Session) RejectPeer() (closeMsg string, err error) {
+	if !sess.peerUnverified {
+		err = fmt.Errorf("there is no deferred verification")
+		return
+	}
+
+	return sess.CloseWithReason(CloseKeyRejected, "")
+}
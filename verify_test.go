@@ -0,0 +1,283 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package xochimilco
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"testing"
+)
+
+func TestSessionVerifier(t *testing.T) {
+	alice, bob := testSessionPair(t)
+	alicePub := alice.IdentityKey.Public().(ed25519.PublicKey)
+	bobPub := bob.IdentityKey.Public().(ed25519.PublicKey)
+
+	type ctxKey struct{}
+	ctx := context.WithValue(context.Background(), ctxKey{}, "foo")
+
+	var infos []PeerInfo
+	verifier := VerifierFunc(func(ctx context.Context, info PeerInfo) (Decision, error) {
+		if ctx.Value(ctxKey{}) != "foo" {
+			t.Fatal("context was not passed")
+		}
+		infos = append(infos, info)
+		return DecisionAccept, nil
+	})
+
+	alice.Verifier, alice.Contact = verifier, "bob@example.org"
+	bob.Verifier, bob.Contact = verifier, "alice@example.org"
+
+	// The Verifier takes precedence.
+	alice.VerifyPeer = func(_ ed25519.PublicKey) bool { return false }
+	bob.VerifyPeer = nil
+
+	offerMsg, err := alice.Offer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ackMsg, err := bob.AcknowledgeContext(ctx, offerMsg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if isEstablished, _, _, err := alice.ReceiveContext(ctx, ackMsg); err != nil {
+		t.Fatal(err)
+	} else if !isEstablished {
+		t.Fatal("Session was not established")
+	}
+
+	expected := []PeerInfo{
+		{IdentityKey: alicePub, Role: RoleResponder, Step: StepOffer, Contact: "alice@example.org"},
+		{IdentityKey: bobPub, Role: RoleInitiator, Step: StepAck, Contact: "bob@example.org"},
+	}
+	if len(infos) != len(expected) {
+		t.Fatalf("%d instead of %d verifications", len(infos), len(expected))
+	}
+	for i := range expected {
+		if !infos[i].IdentityKey.Equal(expected[i].IdentityKey) || infos[i].Role != expected[i].Role ||
+			infos[i].Step != expected[i].Step || infos[i].Contact != expected[i].Contact {
+			t.Fatalf("info %d differs, %v %v", i, infos[i], expected[i])
+		}
+	}
+
+	testSessionExchange(t, alice, bob, "hello bob")
+}
+
+func TestSessionVerifierFailure(t *testing.T) {
+	errDatabase := errors.New("database is down")
+
+	cancelledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	testcases := []struct {
+		name     string
+		ctx      context.Context
+		verifier Verifier
+		isErr    error
+	}{
+		{"reject", context.Background(), VerifierFunc(func(_ context.Context, _ PeerInfo) (Decision, error) {
+			return DecisionReject, nil
+		}), nil},
+		{"error", context.Background(), VerifierFunc(func(_ context.Context, _ PeerInfo) (Decision, error) {
+			return DecisionAccept, errDatabase
+		}), errDatabase},
+		{"cancelled", cancelledCtx, VerifierFunc(func(_ context.Context, _ PeerInfo) (Decision, error) {
+			return DecisionAccept, nil
+		}), context.Canceled},
+		{"unset", context.Background(), nil, nil},
+	}
+
+	for _, testcase := range testcases {
+		alice, bob := testSessionPair(t)
+		bob.Verifier = testcase.verifier
+		if testcase.verifier == nil {
+			bob.VerifyPeer = nil
+		}
+
+		offerMsg, err := alice.Offer()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = bob.AcknowledgeContext(testcase.ctx, offerMsg, nil)
+		if err == nil {
+			t.Fatalf("%s did not error", testcase.name)
+		} else if testcase.isErr != nil && !errors.Is(err, testcase.isErr) {
+			t.Fatalf("%s: unexpected error, %v", testcase.name, err)
+		}
+	}
+}
+
+func TestTrustStoreVerifier(t *testing.T) {
+	ts := NewTrustStore()
+
+	for _, name := range []string{"alice", "mallory"} {
+		alice, bob := testSessionPair(t)
+		bob.Verifier, bob.Contact = ts.Verifier(), "alice"
+
+		offerMsg, err := alice.Offer()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Mallory claims to be Alice, but has another key.
+		_, err = bob.AcknowledgeContext(context.Background(), offerMsg, nil)
+		if name == "alice" && err != nil {
+			t.Fatal(err)
+		} else if name == "mallory" && !errors.Is(err, ErrKeyChanged) {
+			t.Fatalf("unexpected error, %v", err)
+		}
+	}
+}
+
+func TestTrustStoreVerifierFailedHandshake(t *testing.T) {
+	ts := NewTrustStore()
+
+	alice, bob := testSessionPair(t)
+	bob.Verifier, bob.Contact = ts.Verifier(), "alice"
+
+	offerMsg, err := alice.Offer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The signed prekey's signature is only checked after the verification.
+	_, offerIf, err := unmarshalMessage(offerMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer := offerIf.(*offerMessage)
+	offer.spSig = append([]byte{}, offer.spSig...)
+	offer.spSig[0] ^= 0x01
+	forgedMsg, err := marshalMessage(sessOffer, offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := bob.Acknowledge(forgedMsg); err == nil {
+		t.Fatal("forged offer was accepted")
+	} else if _, ok := ts.Lookup("alice"); ok {
+		t.Fatal("key of a failed handshake was pinned")
+	}
+
+	if _, err := bob.Acknowledge(offerMsg); err != nil {
+		t.Fatal(err)
+	} else if entry, ok := ts.Lookup("alice"); !ok || !entry.Key.Equal(alice.IdentityKey.Public()) {
+		t.Fatal("key of an established Session was not pinned")
+	}
+}
+
+func TestTrustStoreVerifierContact(t *testing.T) {
+	ts := NewTrustStore()
+
+	alice, bob := testSessionPair(t)
+	bob.Verifier = ts.Verifier()
+
+	offerMsg, err := alice.Offer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := bob.AcknowledgeContext(context.Background(), offerMsg, nil); err == nil {
+		t.Fatal("offer without a Contact was accepted")
+	} else if _, ok := ts.Lookup(""); ok {
+		t.Fatal("key was pinned without a Contact")
+	}
+}
+
+// testDeferredSessions establishes a Session, where Bob defers his decision.
+func testDeferredSessions(t *testing.T, policy UnverifiedPolicy) (alice, bob *Session) {
+	alice, bob = testSessionPair(t)
+	bob.Verifier = VerifierFunc(func(_ context.Context, _ PeerInfo) (Decision, error) {
+		return DecisionDefer, nil
+	})
+	bob.UnverifiedPolicy = policy
+
+	testSessionEstablish(t, alice, bob)
+
+	if !alice.PeerVerified() {
+		t.Fatal("Alice has not verified Bob")
+	} else if bob.PeerVerified() {
+		t.Fatal("Bob has verified Alice")
+	} else if !bob.PeerIdentityKey().Equal(alice.IdentityKey.Public()) {
+		t.Fatal("Bob has not Alice's identity key")
+	}
+	return
+}
+
+func TestSessionDeferredVerify(t *testing.T) {
+	alice, bob := testDeferredSessions(t, UnverifiedBlockSend)
+
+	// Bob receives, but cannot send messages.
+	testSessionExchange(t, alice, bob, "hello bob")
+	if _, err := bob.Send([]byte("hej alice")); err == nil {
+		t.Fatal("unverified Send did not error")
+	}
+
+	if err := bob.MarkVerified(); err != nil {
+		t.Fatal(err)
+	} else if !bob.PeerVerified() {
+		t.Fatal("Bob has not verified Alice")
+	} else if err := bob.MarkVerified(); err == nil {
+		t.Fatal("second MarkVerified did not error")
+	}
+
+	testSessionExchange(t, bob, alice, "hej alice")
+}
+
+func TestSessionDeferredAllow(t *testing.T) {
+	alice, bob := testDeferredSessions(t, UnverifiedAllowSend)
+
+	testSessionExchange(t, bob, alice, "hej alice")
+	testSessionExchange(t, alice, bob, "hello bob")
+
+	if bob.PeerVerified() {
+		t.Fatal("Bob has verified Alice")
+	}
+}
+
+func TestSessionDeferredReject(t *testing.T) {
+	alice, bob := testDeferredSessions(t, UnverifiedBlockSend)
+
+	closeMsg, err := bob.RejectPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, isClosed, _, err := alice.Receive(closeMsg); err != nil {
+		t.Fatal(err)
+	} else if !isClosed {
+		t.Fatal("Alice's Session was not closed")
+	} else if reason, _ := alice.PeerCloseReason(); reason != CloseKeyRejected {
+		t.Fatalf("unexpected close reason, %v", reason)
+	}
+
+	if bob.PeerIdentityKey() != nil {
+		t.Fatal("Bob's Session was not reset")
+	} else if _, err := bob.RejectPeer(); err == nil {
+		t.Fatal("second RejectPeer did not error")
+	}
+}
+
+func TestSessionDeferredEarlyData(t *testing.T) {
+	alice, bob := testSessionPair(t)
+	alice.EarlyData = true
+	bob.Verifier = VerifierFunc(func(_ context.Context, _ PeerInfo) (Decision, error) {
+		return DecisionDefer, nil
+	})
+
+	offerMsg, err := alice.Offer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Early data is also blocked by the UnverifiedPolicy.
+	if _, err := bob.AcknowledgeWithPayload(offerMsg, []byte("hej alice")); err == nil {
+		t.Fatal("unverified early data did not error")
+	}
+}
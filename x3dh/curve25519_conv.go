@@ -4,20 +4,27 @@
 // SPDX-License-Identifier: BSD-3-Clause
 
 // This file contains two functions to convert Ed25519 public and private keys
-// to their X25519 pedant. Those functions were extracted from Filippo
+// to their X25519 pedant. Those functions were initially extracted from Filippo
 // Valsorda's age tool[0]. A more general explanation is available as a blog
 // post[1]. Thanks a lot!
 //
+// The public key conversion was later replaced by a constant-time field
+// arithmetic implementation based on the edwards25519 package[2], which also
+// allows validating the input point.
+//
 // [0] https://github.com/FiloSottile/age/blob/v1.0.0-beta5/agessh/agessh.go
 // [1] https://blog.filippo.io/using-ed25519-keys-for-encryption/
+// [2] https://pkg.go.dev/filippo.io/edwards25519
 
 package x3dh
 
 import (
 	"crypto/ed25519"
 	"crypto/sha512"
-	"math/big"
+	"crypto/subtle"
+	"fmt"
 
+	"filippo.io/edwards25519"
 	"golang.org/x/crypto/curve25519"
 )
 
@@ -28,33 +35,37 @@ func ed25519PrivateKeyToCurve25519(pk ed25519.PrivateKey) []byte {
 	return out[:curve25519.ScalarSize]
 }
 
-var curve25519P, _ = new(big.Int).SetString("57896044618658097711785492504343953926634992332820282019728792003956564819949", 10)
+// ed25519PublicKeyToCurve25519 converts an Ed25519 public key to its X25519
+// Montgomery u-coordinate.
+//
+// The Montgomery u-coordinate is derived through the birational map
+//
+//	u = (1 + y) / (1 - y)
+//
+// which is implemented by the edwards25519 package in constant time.
+//
+// Only canonical encodings of points on the curve are accepted. Furthermore,
+// points of a small order are rejected, as they would result in a predictable
+// ECDH output.
+func ed25519PublicKeyToCurve25519(pk ed25519.PublicKey) ([]byte, error) {
+	if len(pk) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Ed25519 public key MUST be of %d bytes", ed25519.PublicKeySize)
+	}
+
+	p, err := new(edwards25519.Point).SetBytes(pk)
+	if err != nil {
+		return nil, fmt.Errorf("Ed25519 public key is not a valid point: %v", err)
+	}
 
-func ed25519PublicKeyToCurve25519(pk ed25519.PublicKey) []byte {
-	// ed25519.PublicKey is a little endian representation of the y-coordinate,
-	// with the most significant bit set based on the sign of the x-coordinate.
-	bigEndianY := make([]byte, ed25519.PublicKeySize)
-	for i, b := range pk {
-		bigEndianY[ed25519.PublicKeySize-i-1] = b
+	// SetBytes also accepts non-canonical encodings, e.g., a y-coordinate >= p.
+	// Re-encoding the point reveals those.
+	if subtle.ConstantTimeCompare(p.Bytes(), pk) != 1 {
+		return nil, fmt.Errorf("Ed25519 public key is not canonically encoded")
 	}
-	bigEndianY[0] &= 0b0111_1111
-
-	// The Montgomery u-coordinate is derived through the bilinear map
-	//
-	//     u = (1 + y) / (1 - y)
-	//
-	// See https://blog.filippo.io/using-ed25519-keys-for-encryption.
-	y := new(big.Int).SetBytes(bigEndianY)
-	denom := big.NewInt(1)
-	denom.ModInverse(denom.Sub(denom, y), curve25519P) // 1 / (1 - y)
-	u := y.Mul(y.Add(y, big.NewInt(1)), denom)
-	u.Mod(u, curve25519P)
-
-	out := make([]byte, curve25519.PointSize)
-	uBytes := u.Bytes()
-	for i, b := range uBytes {
-		out[len(uBytes)-i-1] = b
+
+	if new(edwards25519.Point).MultByCofactor(p).Equal(edwards25519.NewIdentityPoint()) == 1 {
+		return nil, fmt.Errorf("Ed25519 public key is of a small order")
 	}
 
-	return out
+	return p.BytesMontgomery(), nil
 }
@@ -11,6 +11,7 @@ package x3dh
 import (
 	"bytes"
 	"crypto/ed25519"
+	"encoding/hex"
 	"testing"
 
 	"golang.org/x/crypto/curve25519"
@@ -22,7 +23,10 @@ func TestCurve25519Duality(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	xPub := ed25519PublicKeyToCurve25519(edPub)
+	xPub, err := ed25519PublicKeyToCurve25519(edPub)
+	if err != nil {
+		t.Fatal(err)
+	}
 	xPriv := ed25519PrivateKeyToCurve25519(edPriv)
 
 	xPubDeriv, err := curve25519.X25519(xPriv, curve25519.Basepoint)
@@ -50,7 +54,10 @@ func TestEd25519Ecdh(t *testing.T) {
 
 	// Alice's calculation
 	aliceXPriv := ed25519PrivateKeyToCurve25519(aliceEdPriv)
-	bobXPub := ed25519PublicKeyToCurve25519(bobEdPub)
+	bobXPub, err := ed25519PublicKeyToCurve25519(bobEdPub)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	aliceSk, err := curve25519.X25519(aliceXPriv, bobXPub)
 	if err != nil {
@@ -59,7 +66,10 @@ func TestEd25519Ecdh(t *testing.T) {
 
 	// Bob's calculation
 	bobXPriv := ed25519PrivateKeyToCurve25519(bobEdPriv)
-	aliceXPub := ed25519PublicKeyToCurve25519(aliceEdPub)
+	aliceXPub, err := ed25519PublicKeyToCurve25519(aliceEdPub)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	bobSk, err := curve25519.X25519(bobXPriv, aliceXPub)
 	if err != nil {
@@ -71,3 +81,80 @@ func TestEd25519Ecdh(t *testing.T) {
 		t.Fatalf("secret keys differ, %x %x", aliceSk, bobSk)
 	}
 }
+
+func TestEd25519PublicKeyToCurve25519KnownAnswers(t *testing.T) {
+	// Those test vectors were generated by the previous math/big based
+	// implementation for the SHA-256 hashed seeds "alice", "bob", "carol", and
+	// "dave".
+	testcases := []struct {
+		edPub string
+		xPub  string
+	}{
+		{
+			"d5bf4a3fcce717b0388bcc2749ebc148ad9969b23f45ee1b605fd58778576ac4",
+			"2548088eecdb81d5b6aa0ca83eb6b3b1929367086ed75666a19d2cee2641770e",
+		},
+		{
+			"ecc1b58727f3f12b3194881a9ecb9de0b28ce7b207230d8e930fe1bce75e256c",
+			"01185533c4590981bdaf2d33b09d1ea895bda8c18772479b52a3064b8b9f3411",
+		},
+		{
+			"26b1c72849b93ca53664ca8240643c514c471ca0a4a424e24cf2ccc80a39933e",
+			"56a980431152efc4dfec9f45b57a6fb99286800fb37e729eb817c17a04881410",
+		},
+		{
+			"8d9293c327662be3c0faeb579b2aedd3b2cec33d74dadedceea76b7a94dc90c0",
+			"6a8ed5bec4a8d1d0e65a000d469b8d9031255a5a6bd270f574c582c830be4b51",
+		},
+	}
+
+	for _, testcase := range testcases {
+		edPub, _ := hex.DecodeString(testcase.edPub)
+		xPubExpect, _ := hex.DecodeString(testcase.xPub)
+
+		xPub, err := ed25519PublicKeyToCurve25519(edPub)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(xPub, xPubExpect) {
+			t.Errorf("public keys differ, %x %x", xPub, xPubExpect)
+		}
+	}
+}
+
+func TestEd25519PublicKeyToCurve25519Invalid(t *testing.T) {
+	inputs := []string{
+		// invalid lengths
+		"",
+		"d5bf4a3fcce717b0388bcc2749ebc148ad9969b23f45ee1b605fd58778576a",
+		"d5bf4a3fcce717b0388bcc2749ebc148ad9969b23f45ee1b605fd58778576ac400",
+
+		// not on the curve, y = 2
+		"0200000000000000000000000000000000000000000000000000000000000000",
+
+		// non-canonical encodings, y = p + 3 and y = p + 18
+		"f0ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff7f",
+		"ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff",
+
+		// non-canonical encoding of the identity, x = -0
+		"0100000000000000000000000000000000000000000000000000000000000080",
+
+		// small order points: identity, order 2, and order 4
+		"0100000000000000000000000000000000000000000000000000000000000000",
+		"ecffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff7f",
+		"0000000000000000000000000000000000000000000000000000000000000000",
+		"0000000000000000000000000000000000000000000000000000000000000080",
+
+		// small order points of order 8
+		"26e8958fc2b227b045c3f489f2ef98f0d5dfac05d3c63339b13802886d53fc05",
+		"c7176a703d4dd84fba3c0b760d10670f2a2053fa2c39ccc64ec7fd7792ac037a",
+	}
+
+	for _, input := range inputs {
+		pk, _ := hex.DecodeString(input)
+		if _, err := ed25519PublicKeyToCurve25519(pk); err == nil {
+			t.Errorf("%s did not error", input)
+		}
+	}
+}
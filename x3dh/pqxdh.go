@@ -0,0 +1,114 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// This file implements a post-quantum hybrid variant of X3DH, following the
+// ideas of Signal's PQXDH[0].
+//
+// Next to the signed prekey (SPK), the responder publishes a signed ML-KEM-768
+// encapsulation key (PQSPK). The initiator encapsulates a shared secret to this
+// key and sends the ciphertext together with the ephemeral key. Finally, the
+// KEM shared secret is appended to the KDF's input:
+//
+//	KDF(F || DH1 || DH2 || DH3 || SS)
+//
+// Thus, the session key remains confidential as long as either the elliptic
+// curve or the KEM part is secure. This protects against an adversary storing
+// today's handshakes to decrypt them later with a quantum computer.
+//
+//	[0] https://signal.org/docs/specifications/pqxdh/
+
+package x3dh
+
+import (
+	"crypto/ed25519"
+	"crypto/mlkem"
+	"fmt"
+)
+
+const (
+	// KemPublicKeySize is the size of an ML-KEM-768 encapsulation key.
+	KemPublicKeySize = mlkem.EncapsulationKeySize768
+
+	// KemCiphertextSize is the size of an ML-KEM-768 ciphertext.
+	KemCiphertextSize = mlkem.CiphertextSize768
+)
+
+// CreateNewKemKey creates a new ML-KEM-768 key pair to be used as a post-quantum
+// signed prekey (PQSPK) next to an SPK. The public encapsulation key is signed
+// by the identity key.
+//
+// The private decapsulation key is returned in its 64 byte seed form.
+func CreateNewKemKey(idKey ed25519.PrivateKey) (kemPub, kemPriv, kemSig []byte, err error) {
+	dk, err := mlkem.GenerateKey768()
+	if err != nil {
+		return
+	}
+
+	kemPub = dk.EncapsulationKey().Bytes()
+	kemPriv = dk.Bytes()
+	kemSig = ed25519.Sign(idKey, kemPub)
+	return
+}
+
+// CreatePqInitialMessage based on the peer's published SPK and PQSPK.
+//
+// This function works like CreateInitialMessage. Additionally, a shared secret
+// is encapsulated to the peer's ML-KEM-768 key and mixed into the session key.
+// The resulting KEM ciphertext must be sent to the peer next to the ephemeral
+// key. PQXDH requires Version1.
+func (c Config) CreatePqInitialMessage(
+	idKey ed25519.PrivateKey, peerIdKey ed25519.PublicKey, spkPub, spkSig, kemPub, kemSig []byte,
+) (sessKey, associatedData, ekPub, kemCipher []byte, err error) {
+	if c.Version == VersionLegacy {
+		err = fmt.Errorf("PQXDH is not supported by VersionLegacy")
+		return
+	}
+
+	if len(peerIdKey) != ed25519.PublicKeySize {
+		err = fmt.Errorf("invalid peer public key size")
+		return
+	}
+
+	if !ed25519.Verify(peerIdKey, kemPub, kemSig) {
+		err = fmt.Errorf("invalid PQSPK signature")
+		return
+	}
+
+	ek, err := mlkem.NewEncapsulationKey768(kemPub)
+	if err != nil {
+		return
+	}
+	kemSec, kemCipher := ek.Encapsulate()
+
+	sessKey, associatedData, ekPub, err = c.createInitialMessage(idKey, peerIdKey, spkPub, spkSig, kemSec)
+	return
+}
+
+// ReceivePqInitialMessage handles the initial PQXDH message from the passive
+// party.
+//
+// This function works like ReceiveInitialMessage. Additionally, the KEM
+// ciphertext is decapsulated with the PQSPK's private part and the shared
+// secret is mixed into the session key. PQXDH requires Version1.
+func (c Config) ReceivePqInitialMessage(
+	idKey ed25519.PrivateKey, peerIdKey ed25519.PublicKey, spkPriv, kemPriv, ekPub, kemCipher []byte,
+) (sessKey, associatedData []byte, err error) {
+	if c.Version == VersionLegacy {
+		err = fmt.Errorf("PQXDH is not supported by VersionLegacy")
+		return
+	}
+
+	dk, err := mlkem.NewDecapsulationKey768(kemPriv)
+	if err != nil {
+		return
+	}
+
+	kemSec, err := dk.Decapsulate(kemCipher)
+	if err != nil {
+		return
+	}
+
+	sessKey, associatedData, err = c.receiveInitialMessage(idKey, peerIdKey, spkPriv, ekPub, kemSec)
+	return
+}
@@ -0,0 +1,127 @@
+// SPDX-FileCopyrightText: 2026 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package x3dh
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+)
+
+// testPqxdhSetup creates Alice's and Bob's identity keys as well as Bob's SPK
+// and PQSPK.
+func testPqxdhSetup(t *testing.T) (aliceIdPriv, bobIdPriv ed25519.PrivateKey, spkPub, spkPriv, spkSig, kemPub, kemPriv, kemSig []byte) {
+	_, aliceIdPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, bobIdPriv, err = ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spkPub, spkPriv, spkSig, err = CreateNewSpk(bobIdPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kemPub, kemPriv, kemSig, err = CreateNewKemKey(bobIdPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return
+}
+
+func TestPqxdh(t *testing.T) {
+	aliceIdPriv, bobIdPriv, spkPub, spkPriv, spkSig, kemPub, kemPriv, kemSig := testPqxdhSetup(t)
+	aliceIdPub := aliceIdPriv.Public().(ed25519.PublicKey)
+	bobIdPub := bobIdPriv.Public().(ed25519.PublicKey)
+
+	config := Config{Version: Version1}
+
+	aliceSk, aliceAd, ekPub, kemCipher, err := config.CreatePqInitialMessage(
+		aliceIdPriv, bobIdPub, spkPub, spkSig, kemPub, kemSig)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(kemCipher) != KemCiphertextSize {
+		t.Fatalf("invalid KEM ciphertext length %d", len(kemCipher))
+	}
+
+	bobSk, bobAd, err := config.ReceivePqInitialMessage(
+		bobIdPriv, aliceIdPub, spkPriv, kemPriv, ekPub, kemCipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(aliceSk, bobSk) {
+		t.Errorf("secret keys differ, %x %x", aliceSk, bobSk)
+	}
+	if !bytes.Equal(aliceAd, bobAd) {
+		t.Errorf("associated data differ, %x %x", aliceAd, bobAd)
+	}
+
+	// The KEM shared secret MUST be part of the session key. Thus, the
+	// classical X3DH results in another session key.
+	classicSk, _, err := config.ReceiveInitialMessage(bobIdPriv, aliceIdPub, spkPriv, ekPub)
+	if err != nil {
+		t.Fatal(err)
+	} else if bytes.Equal(classicSk, bobSk) {
+		t.Error("PQXDH and X3DH session keys are equal")
+	}
+}
+
+func TestPqxdhInvalid(t *testing.T) {
+	aliceIdPriv, bobIdPriv, spkPub, spkPriv, spkSig, kemPub, kemPriv, kemSig := testPqxdhSetup(t)
+	aliceIdPub := aliceIdPriv.Public().(ed25519.PublicKey)
+	bobIdPub := bobIdPriv.Public().(ed25519.PublicKey)
+
+	config := Config{Version: Version1}
+
+	// PQXDH is not available for the legacy KDF.
+	_, _, _, _, err := Config{}.CreatePqInitialMessage(aliceIdPriv, bobIdPub, spkPub, spkSig, kemPub, kemSig)
+	if err == nil {
+		t.Error("legacy version did not error")
+	}
+
+	// The PQSPK's signature MUST be valid.
+	_, _, _, _, err = config.CreatePqInitialMessage(aliceIdPriv, bobIdPub, spkPub, spkSig, kemPub, spkSig)
+	if err == nil {
+		t.Error("invalid PQSPK signature did not error")
+	}
+
+	// An invalid encapsulation key MUST be rejected.
+	_, _, _, _, err = config.CreatePqInitialMessage(aliceIdPriv, bobIdPub, spkPub, spkSig, kemPub[1:], ed25519.Sign(bobIdPriv, kemPub[1:]))
+	if err == nil {
+		t.Error("invalid PQSPK did not error")
+	}
+
+	_, _, ekPub, kemCipher, err := config.CreatePqInitialMessage(aliceIdPriv, bobIdPub, spkPub, spkSig, kemPub, kemSig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A truncated KEM ciphertext MUST be rejected.
+	_, _, err = config.ReceivePqInitialMessage(bobIdPriv, aliceIdPub, spkPriv, kemPriv, ekPub, kemCipher[1:])
+	if err == nil {
+		t.Error("truncated KEM ciphertext did not error")
+	}
+
+	// A modified KEM ciphertext results in another session key, due to ML-KEM's
+	// implicit rejection.
+	aliceSk, _, ekPub, kemCipher, err := config.CreatePqInitialMessage(aliceIdPriv, bobIdPub, spkPub, spkSig, kemPub, kemSig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kemCipher[0] ^= 0xff
+
+	bobSk, _, err := config.ReceivePqInitialMessage(bobIdPriv, aliceIdPub, spkPriv, kemPriv, ekPub, kemCipher)
+	if err != nil {
+		t.Fatal(err)
+	} else if bytes.Equal(aliceSk, bobSk) {
+		t.Error("modified KEM ciphertext resulted in the same session key")
+	}
+}
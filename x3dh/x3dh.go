@@ -13,6 +13,14 @@
 // This implementation does not contain support for one-time prekeys. Thus, the
 // published signed prekey (SPK) needs to be rotated.
 //
+// The key derivation function is versioned. The specification conformant
+// Version1 should be used by new deployments, while VersionLegacy remains the
+// default for compatibility reasons. The version is selected by a Config.
+//
+// Optionally, a post-quantum hybrid handshake following Signal's PQXDH can be
+// performed. There, an ML-KEM-768 shared secret is mixed into the session key;
+// CreateNewKemKey, CreatePqInitialMessage, and ReceivePqInitialMessage.
+//
 // However, a serious difference from the standard is the choice of Ed25519 for
 // the identity keys (IK). Originally, X25519 is used for all keys. As a
 // drawback, Signal requires its XEdDSA[1] specification to allow signatures
@@ -39,13 +47,61 @@ import (
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"io"
+	"strings"
 
 	"golang.org/x/crypto/curve25519"
 	"golang.org/x/crypto/hkdf"
 )
 
+// ErrLowOrderPoint is returned if one of the peer's X25519 public keys, e.g.,
+// the SPK or the ephemeral key, is a point of a low order. Such a key results
+// in an all-zero shared secret without any contribution from our private key.
+var ErrLowOrderPoint = errors.New("X25519 public key is a low order point")
+
+// dh calculates an X25519 shared secret between a private key and another
+// peer's public key.
+//
+// In contrast to curve25519.X25519, an all-zero shared secret results in an
+// ErrLowOrderPoint. This enforces the contributory behaviour of both keys, as
+// recommended in RFC 7748, section 6.1.
+func dh(privKey, pubKey []byte) (sharedSec []byte, err error) {
+	if len(privKey) != curve25519.ScalarSize {
+		return nil, fmt.Errorf("private key MUST be of %d bytes", curve25519.ScalarSize)
+	} else if len(pubKey) != curve25519.PointSize {
+		return nil, fmt.Errorf("public key MUST be of %d bytes", curve25519.PointSize)
+	}
+
+	var dst, scalar, point [32]byte
+	copy(scalar[:], privKey)
+	copy(point[:], pubKey)
+	curve25519.ScalarMult(&dst, &scalar, &point)
+
+	if subtle.ConstantTimeCompare(dst[:], make([]byte, len(dst))) == 1 {
+		return nil, ErrLowOrderPoint
+	}
+
+	sharedSec = dst[:]
+	return
+}
+
+// IdentityKeyToX25519 converts an Ed25519 private identity key to its X25519
+// equivalent, as used within the key agreement. This allows using the same
+// identity key for other X25519 based protocols, e.g., a Noise handshake.
+func IdentityKeyToX25519(idKey ed25519.PrivateKey) []byte {
+	return ed25519PrivateKeyToCurve25519(idKey)
+}
+
+// PublicIdentityKeyToX25519 converts an Ed25519 public identity key to its
+// X25519 equivalent; IdentityKeyToX25519. Invalid keys and keys of a small
+// order result in an error.
+func PublicIdentityKeyToX25519(idKey ed25519.PublicKey) ([]byte, error) {
+	return ed25519PublicKeyToCurve25519(idKey)
+}
+
 // CreateNewSpk creates a new X25519 signed prekey (SPK), both the public and
 // private part. The public part is signed by the identity key.
 //
@@ -67,14 +123,129 @@ func CreateNewSpk(idKey ed25519.PrivateKey) (spkPub, spkPriv, spkSig []byte, err
 	return
 }
 
-// kdf derives a session key based on a SHA-256 HKDF from the DH parameters.
+// Version of the X3DH key derivation function (KDF).
+//
+// Both parties MUST use the same Version. Otherwise, they will end up with
+// different session keys.
+type Version byte
+
+const (
+	// VersionLegacy is the initial KDF of this implementation.
+	//
+	// Its input key material are the DH outputs, prefixed by 128 zero bytes
+	// instead of F. Furthermore, the HKDF's info is just 0xff. This version
+	// only remains for compatibility with existing deployments.
+	VersionLegacy Version = iota
+
+	// Version1 follows the X3DH specification's KDF.
+	//
+	// The input key material is F || DH1 || DH2 || DH3, with F being 32 0xff
+	// bytes. The HKDF's salt are 32 zero bytes and its info is based on the
+	// Config's Info and ChannelBinding.
+	Version1
+)
+
+// DefaultInfo is the HKDF info used by Version1 if no other Info is configured.
+const DefaultInfo = "Xochimilco X3DH v1"
+
+// Config of the X3DH key agreement.
+//
+// Both parties MUST use the same Config. The zero value uses VersionLegacy for
+// compatibility with existing deployments. New deployments SHOULD use Version1.
+type Config struct {
+	// Version of the KDF.
+	Version Version
+
+	// Info is an application specific label, e.g., "ExampleChat", to separate
+	// the keys of different applications. It MUST NOT contain a zero byte. If
+	// empty, DefaultInfo is used. This requires Version1.
+	Info string
+
+	// ChannelBinding are optional bytes to bind a session to its context, e.g.,
+	// a chat room's identifier or the transport's identity. This requires
+	// Version1.
+	ChannelBinding []byte
+}
+
+// info returns the HKDF info for Version1, also being appended to the
+// associated data.
+//
+// The info is the Info string. If ChannelBinding is set, it is appended after
+// a zero byte separator.
+func (c Config) info() (info []byte, err error) {
+	if c.Version == VersionLegacy {
+		if c.Info != "" || len(c.ChannelBinding) > 0 {
+			err = fmt.Errorf("Info and ChannelBinding are not supported by VersionLegacy")
+		}
+		return
+	}
+
+	if strings.IndexByte(c.Info, 0x00) >= 0 {
+		err = fmt.Errorf("Info MUST NOT contain a zero byte")
+		return
+	}
+
+	info = []byte(c.Info)
+	if len(info) == 0 {
+		info = []byte(DefaultInfo)
+	}
+
+	if len(c.ChannelBinding) > 0 {
+		info = append(info, 0x00)
+		info = append(info, c.ChannelBinding...)
+	}
+
+	return
+}
+
+// associatedData returns the associated data for the initiator's and the
+// responder's public identity key.
+//
+// The associated data are the concatenation of both public keys. For Version1,
+// the HKDF info is appended; resulting in IK_A || IK_B || info.
+func (c Config) associatedData(initiatorIdKey, responderIdKey ed25519.PublicKey) (ad []byte, err error) {
+	info, err := c.info()
+	if err != nil {
+		return
+	}
+
+	ad = make([]byte, 0, 2*ed25519.PublicKeySize+len(info))
+	ad = append(ad, initiatorIdKey...)
+	ad = append(ad, responderIdKey...)
+	ad = append(ad, info...)
+	return
+}
+
+// kdf derives a session key based on a SHA-256 HKDF from the DH outputs.
 //
-// Internally the input key material (concatenated DH values) are appended to 32
-// zero bytes, as the X3DH specification demands. For the HKDF, 0xff is used as
-// the info.
-func kdf(km []byte) (out []byte, err error) {
-	in := append(bytes.Repeat([]byte{0x00}, 32), km...)
-	kdf := hkdf.New(sha256.New, in, bytes.Repeat([]byte{0x00}, sha256.Size), []byte{0xff})
+// The input key material's layout and the HKDF's info depend on the configured
+// Version, as documented there. For PQXDH, the KEM shared secret is passed as
+// the last DH output.
+func (c Config) kdf(dhOuts [][]byte) (out []byte, err error) {
+	var in, info []byte
+
+	switch c.Version {
+	case VersionLegacy:
+		in = bytes.Repeat([]byte{0x00}, 32+3*curve25519.ScalarSize)
+		info = []byte{0xff}
+
+	case Version1:
+		in = bytes.Repeat([]byte{0xff}, 32)
+		info, err = c.info()
+		if err != nil {
+			return
+		}
+
+	default:
+		err = fmt.Errorf("unsupported X3DH version %d", c.Version)
+		return
+	}
+
+	for _, dhOut := range dhOuts {
+		in = append(in, dhOut...)
+	}
+
+	kdf := hkdf.New(sha256.New, in, bytes.Repeat([]byte{0x00}, sha256.Size), info)
 
 	out = make([]byte, 32)
 	if _, err = io.ReadFull(kdf, out); err != nil {
@@ -89,9 +260,20 @@ func kdf(km []byte) (out []byte, err error) {
 // This function must be called by the active opening party. Internally an
 // ephemeral key (X25519) will be generated and used with the X25519 equivalent
 // of the two identity keys to establish an ECDH secret. The associated data are
-// the concatenation of the two public keys.
-func CreateInitialMessage(
+// the concatenation of the two public keys, extended by the Config's info for
+// Version1.
+//
+// A SPK of a low order is rejected with an ErrLowOrderPoint.
+func (c Config) CreateInitialMessage(
 	idKey ed25519.PrivateKey, peerIdKey ed25519.PublicKey, spkPub, spkSig []byte,
+) (sessKey, associatedData, ekPub []byte, err error) {
+	return c.createInitialMessage(idKey, peerIdKey, spkPub, spkSig, nil)
+}
+
+// createInitialMessage implements CreateInitialMessage. An optional KEM shared
+// secret, as used by PQXDH, is appended to the KDF's input.
+func (c Config) createInitialMessage(
+	idKey ed25519.PrivateKey, peerIdKey ed25519.PublicKey, spkPub, spkSig, kemSec []byte,
 ) (sessKey, associatedData, ekPub []byte, err error) {
 	if len(peerIdKey) != ed25519.PublicKeySize {
 		err = fmt.Errorf("invalid peer public key size")
@@ -113,36 +295,60 @@ func CreateInitialMessage(
 	}
 
 	idXKey := ed25519PrivateKeyToCurve25519(idKey)
-	peerIdXKey := ed25519PublicKeyToCurve25519(peerIdKey)
+	peerIdXKey, err := ed25519PublicKeyToCurve25519(peerIdKey)
+	if err != nil {
+		return
+	}
 
-	dhOut := make([]byte, 3*curve25519.ScalarSize)
+	dhOuts := make([][]byte, 0, 3)
 	dhSteps := [][][]byte{{idXKey, spkPub}, {ekPriv, peerIdXKey}, {ekPriv, spkPub}}
 
 	for _, dhStep := range dhSteps {
 		var dhTmp []byte
-		dhTmp, err = curve25519.X25519(dhStep[0], dhStep[1])
+		dhTmp, err = dh(dhStep[0], dhStep[1])
 		if err != nil {
 			return
 		}
 
-		dhOut = append(dhOut, dhTmp...)
+		dhOuts = append(dhOuts, dhTmp)
+	}
+
+	if kemSec != nil {
+		dhOuts = append(dhOuts, kemSec)
 	}
 
-	sessKey, err = kdf(dhOut)
+	sessKey, err = c.kdf(dhOuts)
 	if err != nil {
 		return
 	}
 
-	associatedData = append(idKey.Public().(ed25519.PublicKey), []byte(peerIdKey)...)
+	associatedData, err = c.associatedData(idKey.Public().(ed25519.PublicKey), peerIdKey)
 	return
 }
 
+// CreateInitialMessage based on the peer's published signed prekey with the
+// default Config, using VersionLegacy.
+func CreateInitialMessage(
+	idKey ed25519.PrivateKey, peerIdKey ed25519.PublicKey, spkPub, spkSig []byte,
+) (sessKey, associatedData, ekPub []byte, err error) {
+	return Config{}.CreateInitialMessage(idKey, peerIdKey, spkPub, spkSig)
+}
+
 // ReceiveInitialMessage handles the initial message from the passive party.
 //
 // Therefore the same calculation is performed as for CreateInitialMessage,
-// just in reverse.
-func ReceiveInitialMessage(
+// just in reverse. An ephemeral key of a low order is rejected with an
+// ErrLowOrderPoint.
+func (c Config) ReceiveInitialMessage(
 	idKey ed25519.PrivateKey, peerIdKey ed25519.PublicKey, spkPriv, ekPub []byte,
+) (sessKey, associatedData []byte, err error) {
+	return c.receiveInitialMessage(idKey, peerIdKey, spkPriv, ekPub, nil)
+}
+
+// receiveInitialMessage implements ReceiveInitialMessage. An optional KEM
+// shared secret, as used by PQXDH, is appended to the KDF's input.
+func (c Config) receiveInitialMessage(
+	idKey ed25519.PrivateKey, peerIdKey ed25519.PublicKey, spkPriv, ekPub, kemSec []byte,
 ) (sessKey, associatedData []byte, err error) {
 	if len(peerIdKey) != ed25519.PublicKeySize {
 		err = fmt.Errorf("invalid peer public key size")
@@ -150,26 +356,41 @@ func ReceiveInitialMessage(
 	}
 
 	idXKey := ed25519PrivateKeyToCurve25519(idKey)
-	peerIdXKey := ed25519PublicKeyToCurve25519(peerIdKey)
+	peerIdXKey, err := ed25519PublicKeyToCurve25519(peerIdKey)
+	if err != nil {
+		return
+	}
 
-	dhOut := make([]byte, 3*curve25519.ScalarSize)
+	dhOuts := make([][]byte, 0, 3)
 	dhSteps := [][][]byte{{spkPriv, peerIdXKey}, {idXKey, ekPub}, {spkPriv, ekPub}}
 
 	for _, dhStep := range dhSteps {
 		var dhTmp []byte
-		dhTmp, err = curve25519.X25519(dhStep[0], dhStep[1])
+		dhTmp, err = dh(dhStep[0], dhStep[1])
 		if err != nil {
 			return
 		}
 
-		dhOut = append(dhOut, dhTmp...)
+		dhOuts = append(dhOuts, dhTmp)
+	}
+
+	if kemSec != nil {
+		dhOuts = append(dhOuts, kemSec)
 	}
 
-	sessKey, err = kdf(dhOut)
+	sessKey, err = c.kdf(dhOuts)
 	if err != nil {
 		return
 	}
 
-	associatedData = append([]byte(peerIdKey), idKey.Public().(ed25519.PublicKey)...)
+	associatedData, err = c.associatedData(peerIdKey, idKey.Public().(ed25519.PublicKey))
 	return
 }
+
+// ReceiveInitialMessage handles the initial message from the passive party with
+// the default Config, using VersionLegacy.
+func ReceiveInitialMessage(
+	idKey ed25519.PrivateKey, peerIdKey ed25519.PublicKey, spkPriv, ekPub []byte,
+) (sessKey, associatedData []byte, err error) {
+	return Config{}.ReceiveInitialMessage(idKey, peerIdKey, spkPriv, ekPub)
+}
@@ -7,10 +7,23 @@ package x3dh
 import (
 	"bytes"
 	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
 	"testing"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
 )
 
 func TestX3dh(t *testing.T) {
+	for _, version := range []Version{VersionLegacy, Version1} {
+		testX3dh(t, Config{Version: version})
+	}
+}
+
+func testX3dh(t *testing.T, config Config) {
 	aliceIdPub, aliceIdPriv, err := ed25519.GenerateKey(nil)
 	if err != nil {
 		t.Fatal(err)
@@ -28,13 +41,13 @@ func TestX3dh(t *testing.T) {
 	}
 
 	// Alice fetches (bobIdPub, spkPub, spkSig) from Bob / a key server.
-	aliceSk, aliceAd, ekPub, err := CreateInitialMessage(aliceIdPriv, bobIdPub, spkPub, spkSig)
+	aliceSk, aliceAd, ekPub, err := config.CreateInitialMessage(aliceIdPriv, bobIdPub, spkPub, spkSig)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	// Alice contacts Bob with (aliceIdPub, ekPub) and some AEAD ciphertext.
-	bobSk, bobAd, err := ReceiveInitialMessage(bobIdPriv, aliceIdPub, spkPriv, ekPub)
+	bobSk, bobAd, err := config.ReceiveInitialMessage(bobIdPriv, aliceIdPub, spkPriv, ekPub)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -46,3 +59,243 @@ func TestX3dh(t *testing.T) {
 		t.Errorf("associated data differ, %x %x", aliceAd, bobAd)
 	}
 }
+
+// testKeys returns deterministic key material for known answer tests.
+func testKeys() (aliceIdPriv, bobIdPriv ed25519.PrivateKey, spkPriv, ekPriv []byte) {
+	seed := func(s string) []byte {
+		h := sha256.Sum256([]byte(s))
+		return h[:]
+	}
+
+	aliceIdPriv = ed25519.NewKeyFromSeed(seed("alice"))
+	bobIdPriv = ed25519.NewKeyFromSeed(seed("bob"))
+	spkPriv = seed("spk")
+	ekPriv = seed("ek")
+	return
+}
+
+func TestX3dhLegacyKnownAnswer(t *testing.T) {
+	aliceIdPriv, bobIdPriv, spkPriv, ekPriv := testKeys()
+	ekPub, _ := curve25519.X25519(ekPriv, curve25519.Basepoint)
+
+	// This session key was calculated by the initial implementation.
+	skExpect, _ := hex.DecodeString("a0de0c2867fae07041b592fe70372f810cc746a3b7476fc45de1da2777a11b27")
+
+	for _, sk := range [][]byte{
+		testReceive(t, Config{}, bobIdPriv, aliceIdPriv, spkPriv, ekPub),
+		testReceive(t, Config{Version: VersionLegacy}, bobIdPriv, aliceIdPriv, spkPriv, ekPub),
+	} {
+		if !bytes.Equal(sk, skExpect) {
+			t.Errorf("session key differs, %x %x", sk, skExpect)
+		}
+	}
+}
+
+func TestX3dhVersion1Layout(t *testing.T) {
+	aliceIdPriv, bobIdPriv, spkPriv, ekPriv := testKeys()
+	ekPub, _ := curve25519.X25519(ekPriv, curve25519.Basepoint)
+
+	// Recalculate the three DH outputs from Alice's perspective.
+	spkPub, _ := curve25519.X25519(spkPriv, curve25519.Basepoint)
+	aliceIdXPriv := ed25519PrivateKeyToCurve25519(aliceIdPriv)
+	bobIdXPub, err := ed25519PublicKeyToCurve25519(bobIdPriv.Public().(ed25519.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dh1, _ := curve25519.X25519(aliceIdXPriv, spkPub)
+	dh2, _ := curve25519.X25519(ekPriv, bobIdXPub)
+	dh3, _ := curve25519.X25519(ekPriv, spkPub)
+
+	// KDF(F || DH1 || DH2 || DH3) as in the X3DH specification, section 2.2.
+	km := bytes.Repeat([]byte{0xff}, 32)
+	km = append(km, dh1...)
+	km = append(km, dh2...)
+	km = append(km, dh3...)
+
+	skExpect := make([]byte, 32)
+	kdf := hkdf.New(sha256.New, km, make([]byte, sha256.Size), []byte(DefaultInfo))
+	if _, err := io.ReadFull(kdf, skExpect); err != nil {
+		t.Fatal(err)
+	}
+
+	sk := testReceive(t, Config{Version: Version1}, bobIdPriv, aliceIdPriv, spkPriv, ekPub)
+	if !bytes.Equal(sk, skExpect) {
+		t.Errorf("session key differs, %x %x", sk, skExpect)
+	}
+}
+
+func TestX3dhVersionUnsupported(t *testing.T) {
+	aliceIdPriv, bobIdPriv, spkPriv, ekPriv := testKeys()
+	ekPub, _ := curve25519.X25519(ekPriv, curve25519.Basepoint)
+
+	_, _, err := Config{Version: 0xff}.ReceiveInitialMessage(
+		bobIdPriv, aliceIdPriv.Public().(ed25519.PublicKey), spkPriv, ekPub)
+	if err == nil {
+		t.Fatal("should fail")
+	}
+}
+
+// testReceive is a helper to call ReceiveInitialMessage for Bob.
+func testReceive(
+	t *testing.T, config Config, bobIdPriv, aliceIdPriv ed25519.PrivateKey, spkPriv, ekPub []byte,
+) (sk []byte) {
+	sk, _, err := config.ReceiveInitialMessage(
+		bobIdPriv, aliceIdPriv.Public().(ed25519.PublicKey), spkPriv, ekPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return
+}
+
+// testLowOrderPoints are some X25519 public keys of a low order.
+var testLowOrderPoints = []string{
+	"0000000000000000000000000000000000000000000000000000000000000000",
+	"0100000000000000000000000000000000000000000000000000000000000000",
+	"e0eb7a7c3b41b8ae1656e3faf19fc46ada098deb9c32b1fd866205165f49b800",
+	"5f9c95bca3508c24b1d0b1559c83ef5b04445cc4581c8e86d8224eddd09f1157",
+	"ecffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff7f",
+	"edffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff7f",
+	"eeffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff7f",
+	"0000000000000000000000000000000000000000000000000000000000000080",
+}
+
+func TestX3dhLowOrderSpk(t *testing.T) {
+	_, aliceIdPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bobIdPub, bobIdPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Bob, or someone in possession of his identity key, signs a weak SPK.
+	for _, point := range testLowOrderPoints {
+		spkPub, _ := hex.DecodeString(point)
+		spkSig := ed25519.Sign(bobIdPriv, spkPub)
+
+		_, _, _, err := CreateInitialMessage(aliceIdPriv, bobIdPub, spkPub, spkSig)
+		if !errors.Is(err, ErrLowOrderPoint) {
+			t.Errorf("%s resulted in err %v", point, err)
+		}
+	}
+}
+
+func TestX3dhLowOrderEk(t *testing.T) {
+	aliceIdPub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, bobIdPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, spkPriv, _, err := CreateNewSpk(bobIdPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, point := range testLowOrderPoints {
+		ekPub, _ := hex.DecodeString(point)
+
+		_, _, err := ReceiveInitialMessage(bobIdPriv, aliceIdPub, spkPriv, ekPub)
+		if !errors.Is(err, ErrLowOrderPoint) {
+			t.Errorf("%s resulted in err %v", point, err)
+		}
+	}
+}
+
+func TestX3dhDomainSeparation(t *testing.T) {
+	aliceIdPriv, bobIdPriv, spkPriv, ekPriv := testKeys()
+	ekPub, _ := curve25519.X25519(ekPriv, curve25519.Basepoint)
+
+	configs := []Config{
+		{Version: Version1},
+		{Version: Version1, Info: DefaultInfo + " "},
+		{Version: Version1, Info: "ExampleChat"},
+		{Version: Version1, Info: "ExampleChat", ChannelBinding: []byte("#room-a")},
+		{Version: Version1, Info: "ExampleChat", ChannelBinding: []byte("#room-b")},
+		{Version: Version1, ChannelBinding: []byte("#room-a")},
+	}
+
+	sessKeys := make(map[string]bool)
+	associatedData := make(map[string]bool)
+
+	for _, config := range configs {
+		sk, ad, err := config.ReceiveInitialMessage(
+			bobIdPriv, aliceIdPriv.Public().(ed25519.PublicKey), spkPriv, ekPub)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if sessKeys[string(sk)] {
+			t.Errorf("%#v resulted in a previous session key", config)
+		}
+		sessKeys[string(sk)] = true
+
+		if associatedData[string(ad)] {
+			t.Errorf("%#v resulted in previous associated data", config)
+		}
+		associatedData[string(ad)] = true
+	}
+
+	// An empty Info is the same as DefaultInfo.
+	skDefault := testReceive(t, Config{Version: Version1}, bobIdPriv, aliceIdPriv, spkPriv, ekPub)
+	skExplicit := testReceive(t, Config{Version: Version1, Info: DefaultInfo}, bobIdPriv, aliceIdPriv, spkPriv, ekPub)
+	if !bytes.Equal(skDefault, skExplicit) {
+		t.Errorf("session keys differ, %x %x", skDefault, skExplicit)
+	}
+}
+
+func TestX3dhAssociatedData(t *testing.T) {
+	aliceIdPriv, bobIdPriv, spkPriv, ekPriv := testKeys()
+	ekPub, _ := curve25519.X25519(ekPriv, curve25519.Basepoint)
+
+	aliceIdPub := aliceIdPriv.Public().(ed25519.PublicKey)
+	bobIdPub := bobIdPriv.Public().(ed25519.PublicKey)
+
+	testcases := []struct {
+		config Config
+		suffix []byte
+	}{
+		{Config{}, nil},
+		{Config{Version: Version1}, []byte(DefaultInfo)},
+		{Config{Version: Version1, Info: "app", ChannelBinding: []byte{0x00, 0x01}}, []byte("app\x00\x00\x01")},
+	}
+
+	for _, testcase := range testcases {
+		_, ad, err := testcase.config.ReceiveInitialMessage(bobIdPriv, aliceIdPub, spkPriv, ekPub)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		adExpect := append(append(append([]byte{}, aliceIdPub...), bobIdPub...), testcase.suffix...)
+		if !bytes.Equal(ad, adExpect) {
+			t.Errorf("associated data differ, %x %x", ad, adExpect)
+		}
+	}
+}
+
+func TestX3dhConfigInvalid(t *testing.T) {
+	aliceIdPriv, bobIdPriv, spkPriv, ekPriv := testKeys()
+	ekPub, _ := curve25519.X25519(ekPriv, curve25519.Basepoint)
+
+	configs := []Config{
+		{Version: VersionLegacy, Info: "ExampleChat"},
+		{Version: VersionLegacy, ChannelBinding: []byte("#room")},
+		{Version: Version1, Info: "Example\x00Chat"},
+	}
+
+	for _, config := range configs {
+		_, _, err := config.ReceiveInitialMessage(
+			bobIdPriv, aliceIdPriv.Public().(ed25519.PublicKey), spkPriv, ekPub)
+		if err == nil {
+			t.Errorf("%#v did not error", config)
+		}
+	}
+}